@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The read-only /v1 API serves the state of the last reconciles, so it
+// can be told why a service is or is not in the LB without debug logs.
+
+// lbConfigView is an LB config as served by the API, including the fields
+// that are not passed on to providers.
+type lbConfigView struct {
+	model.LBConfig
+	Service   string   `json:"Service,omitempty"`
+	Protected bool     `json:"Protected,omitempty"`
+	Providers []string `json:"Providers,omitempty"`
+}
+
+type metadataState struct {
+	Time        time.Time                        `json:"time"`
+	Configs     []lbConfigView                   `json:"configs"`
+	LabelErrors map[string][]metadata.LabelError `json:"label_errors"`
+}
+
+type providerState struct {
+	Provider string         `json:"provider"`
+	Time     time.Time      `json:"time"`
+	Configs  []lbConfigView `json:"configs"`
+	// Foreign are the configs matching our naming but owned by another instance
+	Foreign []lbConfigView `json:"foreign_configs"`
+}
+
+type syncState struct {
+	Provider string    `json:"provider"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	Circuit  string    `json:"circuit_breaker"`
+	Failures int       `json:"consecutive_failures"`
+}
+
+var (
+	apiLock      sync.Mutex
+	lastMetadata = metadataState{Configs: []lbConfigView{}}
+
+	// apiToken protects the mutating endpoints if set
+	apiToken string
+	// syncRequests carries the sync requests to the main loop
+	syncRequests = make(chan struct{}, 1)
+)
+
+// recordMetadataState keeps the LB configs read from metadata for the API.
+func recordMetadataState(configs map[string]model.LBConfig, labelErrors map[string][]metadata.LabelError) {
+	apiLock.Lock()
+	defer apiLock.Unlock()
+	lastMetadata = metadataState{
+		Time:        time.Now(),
+		Configs:     configViews(configs),
+		LabelErrors: labelErrors,
+	}
+}
+
+// recordProviderState keeps the LB configs read from the provider for the API.
+func (c *providerController) recordProviderState(configs map[string]model.LBConfig, foreign map[string]model.LBConfig) {
+	apiLock.Lock()
+	defer apiLock.Unlock()
+	c.lastState = providerState{
+		Provider: c.provider.GetName(),
+		Time:     time.Now(),
+		Configs:  configViews(configs),
+		Foreign:  configViews(foreign),
+	}
+}
+
+// recordSync keeps the outcome of the reconcile started at started for the
+// API and the readiness check.
+func (c *providerController) recordSync(started time.Time, err error) {
+	apiLock.Lock()
+	defer apiLock.Unlock()
+	c.lastSync = syncState{
+		Provider: c.provider.GetName(),
+		Started:  started,
+		Duration: time.Since(started).String(),
+	}
+	if err != nil {
+		c.lastSync.Error = err.Error()
+	} else {
+		c.lastSuccess = started
+	}
+}
+
+func configViews(configs map[string]model.LBConfig) []lbConfigView {
+	var endpoints []string
+	for endpoint := range configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	views := []lbConfigView{}
+	for _, endpoint := range endpoints {
+		config := configs[endpoint]
+		views = append(views, lbConfigView{
+			LBConfig:  config,
+			Service:   config.Service,
+			Protected: config.Protected,
+			Providers: config.Providers,
+		})
+	}
+	return views
+}
+
+func configsHandler(w http.ResponseWriter, req *http.Request) {
+	apiLock.Lock()
+	state := lastMetadata
+	apiLock.Unlock()
+	writeJSON(w, state)
+}
+
+func providerStateHandler(w http.ResponseWriter, req *http.Request) {
+	states := []providerState{}
+	apiLock.Lock()
+	for _, c := range controllers {
+		state := c.lastState
+		state.Provider = c.provider.GetName()
+		states = append(states, state)
+	}
+	apiLock.Unlock()
+	writeJSON(w, states)
+}
+
+func lastSyncHandler(w http.ResponseWriter, req *http.Request) {
+	syncs := []syncState{}
+	for _, c := range controllers {
+		apiLock.Lock()
+		state := c.lastSync
+		apiLock.Unlock()
+		state.Provider = c.provider.GetName()
+		state.Circuit, state.Failures, _ = c.breaker.status()
+		syncs = append(syncs, state)
+	}
+	writeJSON(w, syncs)
+}
+
+// syncHandler makes the main loop reconcile with the current metadata
+// right after its current poll, instead of waiting for a metadata change.
+func syncHandler(w http.ResponseWriter, req *http.Request) {
+	if len(apiToken) != 0 {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !election.isLeader() {
+		http.Error(w, "Not the leader, the leader reconciles", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case syncRequests <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Sync scheduled"))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to render response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord describes a single change sent to a provider.
+type auditRecord struct {
+	Time     time.Time       `json:"time"`
+	Provider string          `json:"provider"`
+	OwnerID  string          `json:"owner_id"`
+	Op       string          `json:"op"`
+	Endpoint string          `json:"endpoint"`
+	Service  string          `json:"service,omitempty"`
+	Desired  *model.LBConfig `json:"desired,omitempty"`
+	Previous *model.LBConfig `json:"previous,omitempty"`
+	Outcome  string          `json:"outcome"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// auditLog appends a JSON record per provider change to a file or stdout,
+// whatever its outcome. A nil *auditLog records nothing.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openAuditLog opens the audit log at path, "-" meaning stdout.
+func openAuditLog(path string) (*auditLog, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	if path == "-" {
+		return &auditLog{out: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{out: file}, nil
+}
+
+// record logs op of the provider, changing previous into desired. Either
+// may be nil for additions and removals.
+func (a *auditLog) record(provider string, op string, desired *model.LBConfig, previous *model.LBConfig, err error) {
+	if a == nil {
+		return
+	}
+	record := auditRecord{
+		Time:     time.Now(),
+		Provider: provider,
+		OwnerID:  ownerID,
+		Op:       op,
+		Desired:  desired,
+		Previous: previous,
+		Outcome:  "success",
+	}
+	for _, config := range []*model.LBConfig{previous, desired} {
+		if config != nil {
+			record.Endpoint = config.LBEndpoint
+			if len(config.Service) != 0 {
+				record.Service = config.Service
+			}
+		}
+	}
+	if err != nil {
+		record.Outcome = "failure"
+		record.Error = err.Error()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logrus.Errorf("Failed to render audit record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("Failed to write audit record: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// backoffBase is the delay after the first failed reconcile, it
+	// doubles with every further failure up to backoffMax
+	backoffBase = time.Second
+
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var (
+	backoffMax              = 5 * time.Minute
+	circuitBreakerThreshold = 3
+)
+
+// breaker backs off the reconciles of a provider that keeps failing, so an
+// API that is down or throttling us is not retried at full speed. After
+// circuitBreakerThreshold consecutive failures the circuit opens, which
+// fails the healthcheck until the back off is over. The next reconcile is
+// then a trial (half-open) that either closes the circuit again or backs
+// off further.
+type breaker struct {
+	mu       sync.Mutex
+	provider string
+	log      *logrus.Entry
+	failures int
+	retryAt  time.Time
+	rand     *rand.Rand
+}
+
+func newBreaker(provider string, log *logrus.Entry) *breaker {
+	return &breaker{
+		provider: provider,
+		log:      log,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// record updates the breaker with the outcome of a reconcile.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failures >= circuitBreakerThreshold {
+			b.log.Info("Provider recovered, closing the circuit breaker")
+		}
+		b.failures = 0
+		b.retryAt = time.Time{}
+		providerCircuitOpen.Set(0, b.provider)
+		return
+	}
+	b.failures++
+	delay := backoffBase
+	for i := 1; i < b.failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	// jitter keeps several instances from retrying in lockstep
+	delay = delay/2 + time.Duration(b.rand.Int63n(int64(delay/2)+1))
+	b.retryAt = time.Now().Add(delay)
+	b.log.Errorf("Error updating provider lb entries, retrying in %v: %v", delay, err)
+	if b.failures == circuitBreakerThreshold {
+		b.log.Warnf("Opening the circuit breaker after %d failed reconciles", b.failures)
+	}
+	if b.failures >= circuitBreakerThreshold {
+		providerCircuitOpen.Set(1, b.provider)
+	}
+}
+
+// wait returns the remaining back off.
+func (b *breaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures == 0 {
+		return 0
+	}
+	if wait := b.retryAt.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// status returns the circuit state, the number of consecutive failed
+// reconciles and the remaining back off.
+func (b *breaker) status() (string, int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < circuitBreakerThreshold {
+		return circuitClosed, b.failures, 0
+	}
+	if wait := b.retryAt.Sub(time.Now()); wait > 0 {
+		return circuitOpen, b.failures, wait
+	}
+	return circuitHalfOpen, b.failures, 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/providers"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// secretSettingHints are substrings of setting names whose values are
+// always redacted, even if a provider forgot to do so itself.
+var secretSettingHints = []string{"PWD", "PASSWORD", "SECRET", "TOKEN", "KEY", "CREDENTIAL"}
+
+// effectiveConfig returns the fully resolved configuration of the service.
+func effectiveConfig() map[string]interface{} {
+	var providerNames []string
+	providerSettings := map[string]map[string]string{}
+	for _, c := range controllers {
+		name := c.provider.GetName()
+		providerNames = append(providerNames, name)
+		settings := map[string]string{}
+		if reporter, ok := c.provider.(providers.ConfigReporter); ok {
+			for key, value := range reporter.GetConfig() {
+				settings[key] = redactSetting(key, value)
+			}
+		}
+		providerSettings[name] = settings
+	}
+
+	return map[string]interface{}{
+		"providers":                 providerNames,
+		"provider_settings":         providerSettings,
+		"config_file":               *configFile,
+		"source":                    *sourceName,
+		"name_template":             *nameTemplate,
+		"metadata_urls":             os.Getenv("LB_METADATA_URLS"),
+		"poll_interval":             pollInterval.String(),
+		"version_wait_timeout":      versionWaitTimeout.String(),
+		"force_update_interval_min": forceUpdateInterval,
+		"log_level":                 logrus.GetLevel().String(),
+		"log_format":                *logFormat,
+		"log_file":                  *logFile,
+		"healthcheck_port":          healthcheckPort,
+		"liveness_timeout":          livenessTimeout.String(),
+		"ready_sync_intervals":      readySyncIntervals,
+		"endpoint_label":            lbEndpointServiceLabel,
+		"target_rancher_suffix":     targetRancherSuffix,
+		"target_ip_source":          m.TargetIPSource,
+		"target_ip_host_label":      m.TargetIPHostLabel,
+		"only_healthy_targets":      m.OnlyHealthyTargets,
+		"managed_services":          managedServiceNames(),
+		"owner_id":                  ownerID,
+		"leader_election":           os.Getenv("LB_LEADER_ELECTION"),
+		"provider_rate_limit":       providerRateLimit,
+		"provider_rate_limit_burst": providerRateBurst,
+		"stabilization_period":      stabilizationPeriod.String(),
+		"backoff_max":               backoffMax.String(),
+		"circuit_breaker_threshold": circuitBreakerThreshold,
+		"disable_removals":          *disableRemovals,
+		"gc_grace_period":           gcGracePeriod.String(),
+		"gc_dry_run":                *gcDryRun,
+		"state_file":                os.Getenv("LB_STATE_FILE"),
+		"shutdown_mode":             shutdownMode,
+		"status_file":               statusFile,
+		"audit_log":                 os.Getenv("LB_AUDIT_LOG"),
+		"webhook_url":               redacted(os.Getenv("LB_WEBHOOK_URL")),
+		"expose_config":             exposeConfig,
+		"api_token":                 redacted(apiToken),
+		"read_concurrency":          readConcurrency,
+		"write_concurrency":         writeConcurrency,
+		"dry_run":                   *dryRun,
+		"dry_run_output":            *dryRunOutput,
+	}
+}
+
+func redactSetting(key string, value string) string {
+	upper := strings.ToUpper(key)
+	for _, hint := range secretSettingHints {
+		if strings.Contains(upper, hint) && len(value) != 0 {
+			return providers.Redacted
+		}
+	}
+	return value
+}
+
+// redacted hides values that carry secrets however they are named, e.g.
+// webhook URLs with embedded tokens.
+func redacted(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	return providers.Redacted
+}
+
+func managedServiceNames() []string {
+	names := []string{}
+	for name := range m.ManagedServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func logEffectiveConfig() {
+	data, err := json.Marshal(effectiveConfig())
+	if err != nil {
+		logrus.Errorf("Failed to render effective configuration: %v", err)
+		return
+	}
+	logrus.Infof("Effective configuration: %s", data)
+}
+
+func configHandler(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(effectiveConfig(), "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to render configuration", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
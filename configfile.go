@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// fileEnv and fileFlags are the settings applied from the config
+	// file, a reload replaces them while the real overrides are kept
+	fileEnv   = map[string]bool{}
+	fileFlags = map[string]bool{}
+)
+
+// loadConfigFile applies the settings of the config file at path. The file
+// is a flat YAML mapping: lower case keys name command line flags, e.g.
+// "provider: f5_BigIP", upper case keys name environment variables, e.g.
+// "F5_BIGIP_HOST: 10.0.0.1", so everything configurable through the
+// environment, provider credentials included, can be kept in the file.
+// Flags given on the command line and variables set in the environment
+// take precedence over the file, so container deployments can override
+// single settings. When the file is loaded again, settings removed from
+// it are reset.
+func loadConfigFile(path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, setting := range settings {
+		if setting.key != strings.ToUpper(setting.key) && flag.Lookup(setting.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", path, setting.line, setting.key)
+		}
+	}
+
+	overriddenFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if !fileFlags[f.Name] {
+			overriddenFlags[f.Name] = true
+		}
+	})
+	env := make(map[string]bool)
+	flags := make(map[string]bool)
+	for _, setting := range settings {
+		if setting.key == strings.ToUpper(setting.key) {
+			if _, ok := os.LookupEnv(setting.key); !ok || fileEnv[setting.key] {
+				os.Setenv(setting.key, setting.value)
+				env[setting.key] = true
+			}
+			continue
+		}
+		if overriddenFlags[setting.key] {
+			continue
+		}
+		if err := flag.Set(setting.key, setting.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q of %s: %v", path, setting.line, setting.value, setting.key, err)
+		}
+		flags[setting.key] = true
+	}
+
+	for key := range fileEnv {
+		if !env[key] {
+			os.Unsetenv(key)
+		}
+	}
+	for name := range fileFlags {
+		if !flags[name] {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}
+	fileEnv = env
+	fileFlags = flags
+	return nil
+}
+
+type configSetting struct {
+	key   string
+	value string
+	line  int
+}
+
+// readConfigFile parses the top level "key: value" pairs of a YAML file.
+// Nested mappings and lists are not supported.
+func readConfigFile(path string) ([]configSetting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings []configSetting
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if text[0] == ' ' || text[0] == '\t' || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("%s:%d: only top level key: value pairs are supported", path, line)
+		}
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, line)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(trimmed[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		settings = append(settings, configSetting{
+			key:   strings.TrimSpace(trimmed[:i]),
+			value: value,
+			line:  line,
+		})
+	}
+	return settings, scanner.Err()
+}
+
+// parseConfigValue unquotes a YAML scalar and strips trailing comments
+// of unquoted ones.
+func parseConfigValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 || !isConfigComment(value[end+1:]) {
+			return "", fmt.Errorf("invalid quoted value %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 || !isConfigComment(value[end+1:]) {
+			return "", fmt.Errorf("invalid quoted value %s", value)
+		}
+		return strings.Replace(value[1:end], "''", "'", -1), nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+func isConfigComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return len(rest) == 0 || strings.HasPrefix(rest, "#")
+}
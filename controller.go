@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"os"
+	"sync"
+	"time"
+)
+
+// providerController reconciles the LB configs of a single provider.
+// Every configured provider gets its own controller running in its own
+// goroutine, so a slow or failing provider does not hold back the others.
+type providerController struct {
+	provider     providers.Provider
+	log          *logrus.Entry
+	limiter      *rateLimiter
+	breaker      *breaker
+	state        *stateStore
+	stabilizer   *stabilizer
+	collector    *collector
+	statusFile   string
+	dryRunOutput string
+
+	// lastState and lastSync are served by the API, guarded by apiLock
+	lastState   providerState
+	lastSync    syncState
+	lastSuccess time.Time
+
+	// lock is held while a reconcile is in flight so shutdown never
+	// interrupts a half-applied change
+	lock    sync.Mutex
+	configs chan map[string]model.LBConfig
+}
+
+// newProviderController sets up a controller for p. With more than one
+// provider configured the state, status and dry-run output files get the
+// provider name appended so that the controllers do not overwrite each
+// other's files.
+func newProviderController(p providers.Provider, multiple bool) *providerController {
+	path := func(path string) string {
+		if len(path) == 0 || path == "-" || !multiple {
+			return path
+		}
+		return path + "." + p.GetName()
+	}
+
+	log := logrus.WithField("provider", p.GetName())
+	return &providerController{
+		provider:     p,
+		log:          log,
+		limiter:      newRateLimiter(p.GetName(), log, providerRateLimit, providerRateBurst),
+		breaker:      newBreaker(p.GetName(), log),
+		state:        loadStateStore(path(os.Getenv("LB_STATE_FILE"))),
+		stabilizer:   newStabilizer(stabilizationPeriod),
+		collector:    newCollector(*gcGracePeriod, *gcDryRun),
+		statusFile:   path(statusFile),
+		dryRunOutput: path(*dryRunOutput),
+		configs:      make(chan map[string]model.LBConfig, 1),
+	}
+}
+
+// sync hands the latest metadata LB configs published through this
+// provider to the controller. Configs the controller has not picked up
+// yet are replaced, so it always works on the most recent state. While
+// the provider rejects the target pool name of a config, the provider is
+// not reconciled at all: leaving the config out would remove its LB.
+func (c *providerController) sync(metadataConfigs map[string]model.LBConfig) {
+	configs := make(map[string]model.LBConfig, len(metadataConfigs))
+	validator, validates := c.provider.(providers.PoolNameValidator)
+	invalid := 0
+	for key, config := range metadataConfigs {
+		if !publishedThrough(config, c.provider.GetName()) {
+			continue
+		}
+		if validates {
+			if err := validator.ValidatePoolName(config.LBTargetPoolName); err != nil {
+				c.log.Errorf("LB endpoint %s has an invalid target pool name %s: %v", key, config.LBTargetPoolName, err)
+				invalid++
+				continue
+			}
+		}
+		configs[key] = config
+	}
+	if invalid != 0 {
+		c.log.Errorf("Not reconciling the provider while %d LB configs have invalid target pool names", invalid)
+		return
+	}
+
+	select {
+	case <-c.configs:
+	default:
+	}
+	c.configs <- configs
+}
+
+func (c *providerController) run() {
+	for configs := range c.configs {
+		if wait := c.breaker.wait(); wait > 0 {
+			time.Sleep(wait)
+			// work on the configs handed over while backing off
+			select {
+			case configs = <-c.configs:
+			default:
+			}
+		}
+
+		c.lock.Lock()
+		started := time.Now()
+		err := c.UpdateProviderLBConfigs(configs)
+		providerUpdateDuration.Observe(time.Since(started).Seconds(), c.provider.GetName())
+		c.recordSync(started, err)
+		c.breaker.record(err)
+		if err := c.state.save(); err != nil {
+			c.log.Errorf("Failed to save reconcile state: %v", err)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// publishedThrough reports whether config is to be published through the
+// provider called name.
+func publishedThrough(config model.LBConfig, name string) bool {
+	if len(config.Providers) == 0 {
+		return true
+	}
+	for _, provider := range config.Providers {
+		if provider == name {
+			return true
+		}
+	}
+	return false
+}
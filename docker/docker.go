@@ -0,0 +1,349 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHost = "unix:///var/run/docker.sock"
+
+	// the labels grouping containers into services, compose labels first,
+	// swarm task containers carry the stack and service labels
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	swarmStackLabel     = "com.docker.stack.namespace"
+	swarmServiceLabel   = "com.docker.swarm.service.name"
+
+	// defaultStack is the stack of containers without a compose or swarm stack
+	defaultStack = "docker"
+)
+
+// Source reads the running containers of a Docker engine through its API
+// and presents them in the shape of Rancher metadata. Containers are
+// grouped into services by their compose project and service labels, or
+// by the stack and service labels of swarm tasks; other containers form a
+// service of their own in the "docker" stack. The external LB labels are
+// the container labels, the engine is the only host.
+type Source struct {
+	client     *http.Client
+	baseURL    string
+	hostIP     string
+	envName    string
+	eventsWait *http.Client
+}
+
+type container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+	Status string            `json:"Status"`
+	// Created orders the containers like the Rancher create index
+	Created int64 `json:"Created"`
+	Ports   []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type info struct {
+	ID     string   `json:"ID"`
+	Name   string   `json:"Name"`
+	Labels []string `json:"Labels"`
+}
+
+// NewSource connects to the engine given by DOCKER_HOST, a unix socket or
+// a tcp address.
+func NewSource() (*Source, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if len(host) == 0 {
+		host = defaultHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DOCKER_HOST value %q: %v", host, err)
+	}
+	s := &Source{
+		hostIP:  os.Getenv("DOCKER_HOST_IP"),
+		envName: os.Getenv("DOCKER_ENVIRONMENT_NAME"),
+	}
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+		s.baseURL = "http://docker"
+	case "tcp", "http":
+		s.baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("Invalid DOCKER_HOST value %q, expected a unix:// or tcp:// address", host)
+	}
+	s.client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	// the events request is held open for the whole wait
+	s.eventsWait = &http.Client{Transport: transport}
+
+	engine, err := s.info()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the engine info: %v", err)
+	}
+	if len(s.envName) == 0 {
+		s.envName = engine.Name
+	}
+	return s, nil
+}
+
+// GetVersion returns a hash of the running containers, their labels and
+// ports.
+func (s *Source) GetVersion() (string, error) {
+	containers, err := s.containers()
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	for _, c := range containers {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// WaitForVersionChange waits for a container event on the events API for
+// at most maxWait, and returns the current version.
+func (s *Source) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	if current, err := s.GetVersion(); err != nil || current != version {
+		return current, err
+	}
+	now := time.Now()
+	query := url.Values{}
+	query.Set("since", strconv.FormatInt(now.Unix(), 10))
+	query.Set("until", strconv.FormatInt(now.Add(maxWait).Unix(), 10))
+	query.Set("filters", `{"type":["container"]}`)
+	resp, err := s.eventsWait.Get(s.baseURL + "/events?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	// the first event is enough, the stream ends at until otherwise
+	bufio.NewReader(resp.Body).ReadLine()
+	resp.Body.Close()
+	return s.GetVersion()
+}
+
+// GetServices groups the running containers into services. The published
+// ports of a container are "<ip>:<public port>:<private port>/<type>",
+// with the IP of ports bound to all addresses replaced by DOCKER_HOST_IP.
+// Ports that are not published are given with the container IP.
+func (s *Source) GetServices() ([]metadata.Service, error) {
+	containers, err := s.containers()
+	if err != nil {
+		return nil, err
+	}
+	engine, err := s.info()
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*metadata.Service)
+	var names []string
+	for _, c := range containers {
+		stack, name := serviceName(c)
+		key := stack + "/" + name
+		service, ok := services[key]
+		if !ok {
+			service = &metadata.Service{Name: name, StackName: stack, Labels: map[string]string{}}
+			services[key] = service
+			names = append(names, key)
+		}
+		// the service carries the labels of its oldest container
+		if len(service.Containers) == 0 || int(c.Created) < service.CreateIndex {
+			service.Labels = c.Labels
+			service.CreateIndex = int(c.Created)
+		}
+		service.Containers = append(service.Containers, s.convert(c, stack, name, engine.ID))
+	}
+	sort.Strings(names)
+	var result []metadata.Service
+	for _, key := range names {
+		result = append(result, *services[key])
+	}
+	return result, nil
+}
+
+func (s *Source) convert(c container, stack string, service string, hostUUID string) metadata.Container {
+	converted := metadata.Container{
+		Name:        containerName(c),
+		UUID:        c.ID,
+		ServiceName: service,
+		StackName:   stack,
+		Labels:      c.Labels,
+		CreateIndex: int(c.Created),
+		HostUUID:    hostUUID,
+	}
+	var networks []string
+	for network := range c.NetworkSettings.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		if ip := c.NetworkSettings.Networks[network].IPAddress; len(ip) != 0 {
+			converted.PrimaryIp = ip
+			break
+		}
+	}
+	switch {
+	case strings.Contains(c.Status, "(healthy)"):
+		converted.HealthState = "healthy"
+	case strings.Contains(c.Status, "(unhealthy)"):
+		converted.HealthState = "unhealthy"
+	case strings.Contains(c.Status, "(health: starting)"):
+		converted.HealthState = "initializing"
+	}
+	for _, port := range c.Ports {
+		ip, public := port.IP, port.PublicPort
+		if public == 0 {
+			ip, public = converted.PrimaryIp, port.PrivatePort
+		} else if len(ip) == 0 || ip == "0.0.0.0" || ip == "::" {
+			ip = s.hostIP
+		}
+		if len(ip) == 0 {
+			continue
+		}
+		converted.Ports = append(converted.Ports, fmt.Sprintf("%s:%d:%d/%s", ip, public, port.PrivatePort, port.Type))
+	}
+	return converted
+}
+
+func serviceName(c container) (string, string) {
+	if service, ok := c.Labels[composeServiceLabel]; ok {
+		return c.Labels[composeProjectLabel], service
+	}
+	if service, ok := c.Labels[swarmServiceLabel]; ok {
+		stack := c.Labels[swarmStackLabel]
+		if len(stack) == 0 {
+			stack = defaultStack
+		} else {
+			service = strings.TrimPrefix(service, stack+"_")
+		}
+		return stack, service
+	}
+	return defaultStack, containerName(c)
+}
+
+func containerName(c container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// GetHosts returns the engine as the only host, with DOCKER_HOST_IP as its
+// agent IP and the engine labels.
+func (s *Source) GetHosts() ([]metadata.Host, error) {
+	engine, err := s.info()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(engine.Labels))
+	for _, label := range engine.Labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return []metadata.Host{{
+		Name:     engine.Name,
+		Hostname: engine.Name,
+		UUID:     engine.ID,
+		AgentIP:  s.hostIP,
+		Labels:   labels,
+	}}, nil
+}
+
+// GetSelfStack describes the engine as the environment. Swarm nodes are
+// environments of their own too, as each only sees its own task containers.
+func (s *Source) GetSelfStack() (metadata.Stack, error) {
+	engine, err := s.info()
+	if err != nil {
+		return metadata.Stack{}, err
+	}
+	return metadata.Stack{
+		EnvironmentUUID: sanitizeID(engine.ID),
+		EnvironmentName: s.envName,
+		Name:            defaultStack,
+	}, nil
+}
+
+func (s *Source) GetSelfContainer() (metadata.Container, error) {
+	return metadata.Container{}, fmt.Errorf("the docker source does not know its own container")
+}
+
+func (s *Source) GetSelfService() (metadata.Service, error) {
+	return metadata.Service{}, fmt.Errorf("the docker source does not know its own service")
+}
+
+// sanitizeID makes an engine ID, e.g. "ABCD:EFGH:...", usable in target
+// pool names.
+func sanitizeID(id string) string {
+	return strings.ToLower(strings.Replace(id, ":", "", -1))
+}
+
+func (s *Source) containers() ([]container, error) {
+	var containers []container
+	if err := s.get("/containers/json", &containers); err != nil {
+		return nil, fmt.Errorf("Error listing containers: %v", err)
+	}
+	sort.Sort(byID(containers))
+	return containers, nil
+}
+
+type byID []container
+
+func (c byID) Len() int           { return len(c) }
+func (c byID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+
+func (s *Source) info() (info, error) {
+	var engine info
+	err := s.get("/info", &engine)
+	return engine, err
+}
+
+func (s *Source) get(path string, out interface{}) error {
+	resp, err := s.client.Get(s.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rancher/external-lb/model"
+	"strings"
+)
+
+// reportDrift logs the provider configs that were changed outside of
+// external-lb since this instance last applied them, e.g. a target
+// removed by hand in the provider UI. The reconcile then restores them
+// like any other difference to metadata, so without this report the
+// manual change would be overwritten silently.
+func (c *providerController) reportDrift(providerConfigs map[string]model.LBConfig, foreignConfigs map[string]model.LBConfig) {
+	for endpoint, applied := range c.state.appliedConfigs() {
+		var drift []string
+		if current, ok := providerConfigs[endpoint]; ok {
+			drift = describeDrift(applied, current)
+		} else if foreign, ok := foreignConfigs[endpoint]; ok {
+			drift = []string{fmt.Sprintf("taken over by owner %s", foreign.OwnerID)}
+		} else {
+			drift = []string{"removed"}
+		}
+		if len(drift) == 0 {
+			continue
+		}
+		c.log.WithFields(lbFields(endpoint, applied.Service, "Drift")).Warnf(
+			"LB endpoint %s was changed outside of external-lb since it was last applied: %s", endpoint, strings.Join(drift, ", "))
+		driftDetected.Inc(c.provider.GetName())
+	}
+}
+
+// describeDrift lists the differences of the current provider config to
+// the applied one.
+func describeDrift(applied model.LBConfig, current model.LBConfig) []string {
+	var drift []string
+	if !strings.EqualFold(applied.LBTargetPoolName, current.LBTargetPoolName) {
+		drift = append(drift, fmt.Sprintf("target pool %s instead of %s", current.LBTargetPoolName, applied.LBTargetPoolName))
+	}
+	if applied.OwnerID != current.OwnerID {
+		drift = append(drift, fmt.Sprintf("owner %q instead of %q", current.OwnerID, applied.OwnerID))
+	}
+	if applied.Protocol != current.Protocol {
+		drift = append(drift, fmt.Sprintf("protocol %q instead of %q", current.Protocol, applied.Protocol))
+	}
+	if applied.MaxConn != current.MaxConn {
+		drift = append(drift, fmt.Sprintf("connection limit %d instead of %d", current.MaxConn, applied.MaxConn))
+	}
+	if applied.DrainTimeout != current.DrainTimeout {
+		drift = append(drift, fmt.Sprintf("drain timeout %ds instead of %ds", current.DrainTimeout, applied.DrainTimeout))
+	}
+	if applied.SlowStart != current.SlowStart {
+		drift = append(drift, fmt.Sprintf("slow start %ds instead of %ds", current.SlowStart, applied.SlowStart))
+	}
+	if applied.ProxyProtocol != current.ProxyProtocol {
+		drift = append(drift, fmt.Sprintf("PROXY protocol %v instead of %v", current.ProxyProtocol, applied.ProxyProtocol))
+	}
+	if !attributesEqual(applied.Attributes, current.Attributes) {
+		drift = append(drift, fmt.Sprintf("attributes %v instead of %v", current.Attributes, applied.Attributes))
+	}
+	if !healthCheckEqual(applied.HealthCheck, current.HealthCheck) {
+		drift = append(drift, fmt.Sprintf("health check %s instead of %s", describeHealthCheck(current.HealthCheck), describeHealthCheck(applied.HealthCheck)))
+	}
+	if !stickinessEqual(applied.Stickiness, current.Stickiness) {
+		drift = append(drift, fmt.Sprintf("stickiness %s instead of %s", describeStickiness(current.Stickiness), describeStickiness(applied.Stickiness)))
+	}
+	if added := targetNames(targetsMissing(current.LBTargets, applied.LBTargets)); len(added) != 0 {
+		drift = append(drift, fmt.Sprintf("targets %v added", added))
+	}
+	if removed := targetNames(targetsMissing(applied.LBTargets, current.LBTargets)); len(removed) != 0 {
+		drift = append(drift, fmt.Sprintf("targets %v removed", removed))
+	}
+	return drift
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"sync"
+)
+
+// leaderElectionMetadata elects the leader among the replicas of the
+// service from Rancher metadata, see MetadataClient.GetLeader.
+const leaderElectionMetadata = "metadata"
+
+// elector keeps track of whether this instance is the leader among the
+// replicas of its service. Only the leader reconciles and cleans up the
+// provider on shutdown, the others stand by to take over when it dies.
+// A nil *elector is always the leader.
+type elector struct {
+	mu     sync.Mutex
+	leader bool
+	name   string
+}
+
+func newElector(mode string) *elector {
+	if mode != leaderElectionMetadata {
+		return nil
+	}
+	return &elector{}
+}
+
+// update reads the current leader from metadata and reports whether this
+// instance just became the leader. Leadership is kept as it is while
+// metadata cannot be read.
+func (e *elector) update() bool {
+	if e == nil {
+		return false
+	}
+	name, leader, err := m.GetLeader()
+	if err != nil {
+		logrus.Errorf("Failed to read the leader from metadata: %v", err)
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	became := leader && !e.leader
+	switch {
+	case became:
+		logrus.Info("Elected as leader, reconciling the providers")
+	case !leader && (e.leader || name != e.name):
+		if len(name) == 0 {
+			logrus.Warn("No healthy replica to elect as leader, standing by")
+		} else {
+			logrus.Infof("Standing by, %s is the leader", name)
+		}
+	}
+	e.leader = leader
+	e.name = name
+	if leader {
+		leaderElected.Set(1)
+	} else {
+		leaderElected.Set(0)
+	}
+	return became
+}
+
+func (e *elector) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
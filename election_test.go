@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/sources"
+	rancher "github.com/rancher/go-rancher-metadata/metadata"
+	"testing"
+	"time"
+)
+
+// replicaSource is the metadata seen by one replica of the external-lb
+// service.
+type replicaSource struct {
+	self    rancher.Container
+	service rancher.Service
+}
+
+func (s *replicaSource) GetVersion() (string, error) { return "1", nil }
+func (s *replicaSource) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	return "1", nil
+}
+func (s *replicaSource) GetServices() ([]rancher.Service, error) { return nil, nil }
+func (s *replicaSource) GetHosts() ([]rancher.Host, error)       { return nil, nil }
+func (s *replicaSource) GetSelfStack() (rancher.Stack, error) {
+	return rancher.Stack{Name: s.service.StackName, EnvironmentUUID: "env1"}, nil
+}
+func (s *replicaSource) GetSelfContainer() (rancher.Container, error) { return s.self, nil }
+func (s *replicaSource) GetSelfService() (rancher.Service, error)     { return s.service, nil }
+
+// startReplica sets up the globals as main does for the replica running
+// in container self, whose hostname is the container name.
+func startReplica(t *testing.T, self rancher.Container, service rancher.Service) *elector {
+	replica := &replicaSource{self: self, service: service}
+	m = &metadata.MetadataClient{MetadataClient: replica, EnvironmentUUID: "env1"}
+	source = sources.NewMetadataSource(m)
+	var err error
+	if ownerID, err = defaultOwnerID(self.Name, replica, source.GetEnvironmentUUID(), true); err != nil {
+		t.Fatalf("%s: no owner ID: %v", self.Name, err)
+	}
+	return newElector(leaderElectionMetadata)
+}
+
+func TestLeaderFailoverTakesOverTheResources(t *testing.T) {
+	defer useTestSource()()
+
+	first := rancher.Container{Name: "lb-external-lb-1", UUID: "c1", CreateIndex: 1}
+	second := rancher.Container{Name: "lb-external-lb-2", UUID: "c2", CreateIndex: 2}
+	service := rancher.Service{Name: "external-lb", StackName: "lb", Containers: []rancher.Container{first, second}}
+	p := newFakeProvider()
+	config := model.LBConfig{
+		LBEndpoint:       "web.example.com",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "80"}},
+	}
+
+	election := startReplica(t, first, service)
+	if !election.update() {
+		t.Fatalf("the oldest replica was not elected")
+	}
+	firstOwner := ownerID
+	c := newTestController(p)
+	if err := c.UpdateProviderLBConfigs(map[string]model.LBConfig{config.LBEndpoint: config}); err != nil {
+		t.Fatalf("the first leader failed to add the config: %v", err)
+	}
+
+	// the first replica is gone, the second one runs on another host
+	service.Containers = []rancher.Container{second}
+	election = startReplica(t, second, service)
+	if ownerID != firstOwner {
+		t.Errorf("the replicas have the owner IDs %s and %s", firstOwner, ownerID)
+	}
+	if !election.update() {
+		t.Fatalf("the remaining replica was not elected")
+	}
+	config.LBTargets = []model.LBTarget{{HostIP: "10.0.0.2", Port: "80"}}
+	c = newTestController(p)
+	if err := c.UpdateProviderLBConfigs(map[string]model.LBConfig{config.LBEndpoint: config}); err != nil {
+		t.Fatalf("the new leader failed to update the config: %v", err)
+	}
+	updated := p.configs[config.LBEndpoint]
+	if len(updated.LBTargets) != 1 || updated.LBTargets[0].HostIP != "10.0.0.2" {
+		t.Errorf("the new leader did not update the config written by the first one: %v", updated)
+	}
+}
+
+func TestDefaultOwnerID(t *testing.T) {
+	replica := &replicaSource{service: rancher.Service{Name: "external-lb", StackName: "lb"}}
+	for _, elected := range []bool{false, true} {
+		if id, err := defaultOwnerID("lb-external-lb-1", replica, "env1", elected); err != nil || id != "external-lb.lb_env1" {
+			t.Errorf("leader election %v: got owner ID %s, %v", elected, id, err)
+		}
+	}
+	// without the own service only a single instance can use the hostname
+	if id, err := defaultOwnerID("lb-external-lb-1", nil, "env1", false); err != nil || id != "lb-external-lb-1_env1" {
+		t.Errorf("got owner ID %s, %v without the own service", id, err)
+	}
+	if _, err := defaultOwnerID("lb-external-lb-1", nil, "env1", true); err == nil {
+		t.Errorf("expected an error with leader election without the own service")
+	}
+}
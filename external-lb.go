@@ -4,39 +4,184 @@ import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"sort"
 	"strings"
+	"sync"
 )
 
-func UpdateProviderLBConfigs(metadataConfigs map[string]model.LBConfig) error {
-	providerConfigs, err := getProviderLBConfigs()
+func (c *providerController) UpdateProviderLBConfigs(metadataConfigs map[string]model.LBConfig) error {
+	providerConfigs, foreignConfigs, err := c.getProviderLBConfigs()
 	if err != nil {
+		providerUpdateErrors.Inc(c.provider.GetName(), "Read")
 		return fmt.Errorf("Provider error reading lb configs: %v", err)
 	}
-	logrus.Debugf("Rancher LB configs from provider: %v", providerConfigs)
+	c.log.Debugf("Rancher LB configs from provider: %v", providerConfigs)
+	c.recordProviderState(providerConfigs, foreignConfigs)
+	c.reportDrift(providerConfigs, foreignConfigs)
 
-	removeExtraConfigs(metadataConfigs, providerConfigs)
+	for key, config := range metadataConfigs {
+		if foreign, ok := foreignConfigs[key]; ok {
+			c.log.Errorf("LB endpoint %s is managed by another external-lb instance with owner ID %s, refusing to touch it", key, foreign.OwnerID)
+			delete(metadataConfigs, key)
+			continue
+		}
+		config.OwnerID = ownerID
+		if !appliesHealthChecks(c.provider) {
+			config.HealthCheck = nil
+		}
+		if !appliesStickiness(c.provider) {
+			config.Stickiness = nil
+		}
+		if !appliesProtocol(c.provider) {
+			config.Protocol = ""
+		}
+		if !appliesDrainTimeout(c.provider) {
+			config.DrainTimeout = 0
+		}
+		if !appliesSlowStart(c.provider) {
+			config.SlowStart = 0
+		}
+		if !appliesProxyProtocol(c.provider) {
+			config.ProxyProtocol = false
+		}
+		if !appliesAttributes(c.provider) {
+			config.Attributes = nil
+		}
+		if !appliesMaxConn(c.provider) {
+			config.MaxConn = 0
+		}
+		metadataConfigs[key] = config
+		c.state.setProtected(key, config.Protected)
+	}
+
+	managedLBConfigs.Set(float64(len(metadataConfigs)), c.provider.GetName())
+
+	plan := c.newReconcilePlan(metadataConfigs, providerConfigs)
+	plan.log(c.log)
+	if *dryRun {
+		c.log.Info("Dry run, no changes are sent to the provider")
+		return plan.write(c.dryRunOutput)
+	}
+
+	errs := changeErrors{}
+	c.updateProvider(plan.toRemove, nil, &Remove, errs)
 
-	addMissingConfigs(metadataConfigs, providerConfigs)
+	c.updateProvider(plan.toAdd, nil, &Add, errs)
 
-	updateExistingConfigs(metadataConfigs, providerConfigs)
+	c.updateProvider(plan.toUpdate, providerConfigs, &Update, errs)
 
+	if len(errs) == 0 {
+		return nil
+	}
+	// single configs may fail for reasons of their own, only a provider
+	// failing all changes counts as a failed reconcile
+	changes := len(plan.toRemove) + len(plan.toAdd) + len(plan.toUpdate)
+	if len(errs) == changes {
+		return fmt.Errorf("Provider failed all %d changes: %v", changes, errs)
+	}
+	c.log.Warnf("%d of %d provider changes failed: %v", len(errs), changes, errs)
 	return nil
 }
 
-func getProviderLBConfigs() (map[string]model.LBConfig, error) {
-	allConfigs, err := provider.GetLBConfigs()
+// changeErrors holds the errors of the failed provider changes of a
+// reconcile by LB endpoint.
+type changeErrors map[string]error
+
+func (e changeErrors) Error() string {
+	var endpoints []string
+	for endpoint := range e {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	var msgs []string
+	for _, endpoint := range endpoints {
+		msgs = append(msgs, endpoint+": "+e[endpoint].Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// withoutProtected drops the configs that must not be removed from
+// toRemove, with a warning for each.
+func (c *providerController) withoutProtected(toRemove []model.LBConfig) []model.LBConfig {
+	var removable []model.LBConfig
+	for _, config := range toRemove {
+		switch {
+		case *disableRemovals:
+			c.log.Warnf("Removals are disabled, keeping LB config of endpoint %s that is no longer in metadata", config.LBEndpoint)
+		case c.state.isProtected(config.LBEndpoint):
+			c.log.Warnf("LB endpoint %s is protected, keeping its LB config that is no longer in metadata", config.LBEndpoint)
+		default:
+			removable = append(removable, config)
+		}
+	}
+	return removable
+}
+
+func appliesHealthChecks(provider providers.Provider) bool {
+	applier, ok := provider.(providers.HealthCheckApplier)
+	return ok && applier.AppliesHealthChecks()
+}
+
+func appliesStickiness(provider providers.Provider) bool {
+	applier, ok := provider.(providers.StickinessApplier)
+	return ok && applier.AppliesStickiness()
+}
+
+func appliesProtocol(provider providers.Provider) bool {
+	applier, ok := provider.(providers.ProtocolApplier)
+	return ok && applier.AppliesProtocol()
+}
+
+func appliesDrainTimeout(provider providers.Provider) bool {
+	applier, ok := provider.(providers.DrainTimeoutApplier)
+	return ok && applier.AppliesDrainTimeout()
+}
+
+func appliesSlowStart(provider providers.Provider) bool {
+	applier, ok := provider.(providers.SlowStartApplier)
+	return ok && applier.AppliesSlowStart()
+}
+
+func appliesProxyProtocol(provider providers.Provider) bool {
+	applier, ok := provider.(providers.ProxyProtocolApplier)
+	return ok && applier.AppliesProxyProtocol()
+}
+
+func appliesAttributes(provider providers.Provider) bool {
+	applier, ok := provider.(providers.AttributesApplier)
+	return ok && applier.AppliesAttributes()
+}
+
+func appliesMaxConn(provider providers.Provider) bool {
+	applier, ok := provider.(providers.MaxConnApplier)
+	return ok && applier.AppliesMaxConn()
+}
+
+// getProviderLBConfigs returns the provider configs matching our naming
+// convention, split into those owned by this instance (or not carrying
+// any owner yet) and those owned by another instance.
+func (c *providerController) getProviderLBConfigs() (map[string]model.LBConfig, map[string]model.LBConfig, error) {
+	allConfigs, err := c.readProviderLBConfigs()
 	if err != nil {
-		logrus.Debugf("Error Getting Rancher LB configs from provider: %v", err)
-		return nil, err
+		c.log.Debugf("Error Getting Rancher LB configs from provider: %v", err)
+		return nil, nil, err
 	}
 	rancherConfigs := make(map[string]model.LBConfig, len(allConfigs))
-	suffix := "_" + m.EnvironmentUUID + "_" + targetRancherSuffix
+	foreignConfigs := make(map[string]model.LBConfig)
+	suffix := "_" + source.GetEnvironmentUUID() + "_" + targetRancherSuffix
 	for _, value := range allConfigs {
-		if strings.HasSuffix(value.LBTargetPoolName, suffix) {
-			rancherConfigs[value.LBEndpoint] = value
+		if !strings.HasSuffix(value.LBTargetPoolName, suffix) {
+			continue
 		}
+		if len(value.OwnerID) != 0 && value.OwnerID != ownerID {
+			c.log.Warnf("LB config for endpoint %s matches our naming but is owned by %s, ignoring it", value.LBEndpoint, value.OwnerID)
+			foreignConfigs[value.LBEndpoint] = value
+			continue
+		}
+		rancherConfigs[value.LBEndpoint] = value
 	}
-	return rancherConfigs, nil
+	return rancherConfigs, foreignConfigs, nil
 }
 
 func removeExtraConfigs(metadataConfigs map[string]model.LBConfig, providerConfigs map[string]model.LBConfig) []model.LBConfig {
@@ -46,13 +191,8 @@ func removeExtraConfigs(metadataConfigs map[string]model.LBConfig, providerConfi
 			toRemove = append(toRemove, providerConfigs[key])
 		}
 	}
-
-	if len(toRemove) == 0 {
-		logrus.Debug("No LB configs to remove")
-	} else {
-		logrus.Infof("LB configs to remove: %v", toRemove)
-	}
-	return updateProvider(toRemove, &Remove)
+	sort.Sort(byEndpoint(toRemove))
+	return toRemove
 }
 
 func addMissingConfigs(metadataConfigs map[string]model.LBConfig, providerConfigs map[string]model.LBConfig) []model.LBConfig {
@@ -62,87 +202,279 @@ func addMissingConfigs(metadataConfigs map[string]model.LBConfig, providerConfig
 			toAdd = append(toAdd, metadataConfigs[key])
 		}
 	}
-	if len(toAdd) == 0 {
-		logrus.Debug("No LB configs to add")
-	} else {
-		logrus.Infof("LB configs to add: %v", toAdd)
-	}
-	return updateProvider(toAdd, &Add)
+	sort.Sort(byEndpoint(toAdd))
+	return toAdd
 }
 
 func updateExistingConfigs(metadataConfigs map[string]model.LBConfig, providerConfigs map[string]model.LBConfig) []model.LBConfig {
 	var toUpdate []model.LBConfig
 	for key := range metadataConfigs {
 		if _, ok := providerConfigs[key]; ok {
-			mLBConfig := metadataConfigs[key]
-			pLBConfig := providerConfigs[key]
-			var update bool
-
-			//check that the targetPoolName and targets match
-			if strings.EqualFold(mLBConfig.LBTargetPoolName, pLBConfig.LBTargetPoolName) {
-				if len(mLBConfig.LBTargets) != len(pLBConfig.LBTargets) {
-					update = true
-				}
-				//check if any target have changed
-				for _, mTarget := range mLBConfig.LBTargets {
-					targetExists := false
-					for _, pTarget := range pLBConfig.LBTargets {
-						if pTarget.HostIP == mTarget.HostIP && pTarget.Port == mTarget.Port {
-							targetExists = true
-							break
-						}
-					}
-					if !targetExists {
-						//lb target changed, update the config on provider
-						update = true
-						break
-					}
-				}
-			} else {
-				//targetPool should be changed
-				logrus.Debugf("The LBEndPoint %s  will be updated to map to a new LBTargetPoolName %s", key, mLBConfig.LBTargetPoolName)
-				update = true
+			if lbConfigChanged(metadataConfigs[key], providerConfigs[key]) {
+				toUpdate = append(toUpdate, metadataConfigs[key])
 			}
+		}
+	}
+	sort.Sort(byEndpoint(toUpdate))
+	return toUpdate
+}
 
-			if update {
-				toUpdate = append(toUpdate, metadataConfigs[key])
+type byEndpoint []model.LBConfig
+
+func (c byEndpoint) Len() int           { return len(c) }
+func (c byEndpoint) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byEndpoint) Less(i, j int) bool { return c[i].LBEndpoint < c[j].LBEndpoint }
+
+// lbConfigChanged reports whether the target pool name, the owner, the
+// protocol, the connection limit, the drain timeout, the slow start, the
+// PROXY protocol, the attributes, the health check, the stickiness or the
+// targets of the two configs differ.
+func lbConfigChanged(mLBConfig model.LBConfig, pLBConfig model.LBConfig) bool {
+	if mLBConfig.OwnerID != pLBConfig.OwnerID {
+		logrus.Debugf("The LBEndPoint %s will be updated to carry owner ID %s", mLBConfig.LBEndpoint, mLBConfig.OwnerID)
+		return true
+	}
+	//check that the targetPoolName and targets match
+	if !strings.EqualFold(mLBConfig.LBTargetPoolName, pLBConfig.LBTargetPoolName) {
+		//targetPool should be changed
+		logrus.Debugf("The LBEndPoint %s  will be updated to map to a new LBTargetPoolName %s", mLBConfig.LBEndpoint, mLBConfig.LBTargetPoolName)
+		return true
+	}
+	if mLBConfig.Protocol != pLBConfig.Protocol {
+		logrus.Debugf("The LBEndPoint %s will be updated to use protocol %q", mLBConfig.LBEndpoint, mLBConfig.Protocol)
+		return true
+	}
+	if mLBConfig.MaxConn != pLBConfig.MaxConn {
+		logrus.Debugf("The LBEndPoint %s will be updated to limit connections per target to %d", mLBConfig.LBEndpoint, mLBConfig.MaxConn)
+		return true
+	}
+	if mLBConfig.DrainTimeout != pLBConfig.DrainTimeout {
+		logrus.Debugf("The LBEndPoint %s will be updated to drain removed targets for %ds", mLBConfig.LBEndpoint, mLBConfig.DrainTimeout)
+		return true
+	}
+	if mLBConfig.SlowStart != pLBConfig.SlowStart {
+		logrus.Debugf("The LBEndPoint %s will be updated to ramp up new targets over %ds", mLBConfig.LBEndpoint, mLBConfig.SlowStart)
+		return true
+	}
+	if mLBConfig.ProxyProtocol != pLBConfig.ProxyProtocol {
+		logrus.Debugf("The LBEndPoint %s will be updated to set the PROXY protocol to %v", mLBConfig.LBEndpoint, mLBConfig.ProxyProtocol)
+		return true
+	}
+	if !attributesEqual(mLBConfig.Attributes, pLBConfig.Attributes) {
+		logrus.Debugf("The LBEndPoint %s will be updated to change its attributes", mLBConfig.LBEndpoint)
+		return true
+	}
+	if !healthCheckEqual(mLBConfig.HealthCheck, pLBConfig.HealthCheck) {
+		logrus.Debugf("The LBEndPoint %s will be updated to change its health check", mLBConfig.LBEndpoint)
+		return true
+	}
+	if !stickinessEqual(mLBConfig.Stickiness, pLBConfig.Stickiness) {
+		logrus.Debugf("The LBEndPoint %s will be updated to change its stickiness", mLBConfig.LBEndpoint)
+		return true
+	}
+	if len(mLBConfig.LBTargets) != len(pLBConfig.LBTargets) {
+		return true
+	}
+	//check if any target have changed
+	for _, mTarget := range mLBConfig.LBTargets {
+		targetExists := false
+		for _, pTarget := range pLBConfig.LBTargets {
+			if pTarget.HostIP == mTarget.HostIP && pTarget.Port == mTarget.Port {
+				targetExists = true
+				break
 			}
 		}
+		if !targetExists {
+			//lb target changed, update the config on provider
+			return true
+		}
+	}
+	return false
+}
+
+// healthCheckEqual compares two health checks, nil being equal to the
+// provider defaults.
+func healthCheckEqual(a *model.HealthCheck, b *model.HealthCheck) bool {
+	var x, y model.HealthCheck
+	if a != nil {
+		x = *a
+	}
+	if b != nil {
+		y = *b
+	}
+	return x == y
+}
+
+// attributesEqual compares two attribute sets, nil being equal to empty.
+func attributesEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
 	}
+	return true
+}
 
-	if len(toUpdate) == 0 {
-		logrus.Debug("No LB configs to update")
-	} else {
-		logrus.Infof("LB configs to update: %v", toUpdate)
+func stickinessEqual(a *model.Stickiness, b *model.Stickiness) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
+	return *a == *b
+}
 
-	return updateProvider(toUpdate, &Update)
+// targetsOnlyChanged reports whether the two configs differ in nothing
+// but their targets.
+func targetsOnlyChanged(mLBConfig model.LBConfig, pLBConfig model.LBConfig) bool {
+	if mLBConfig.LBTargetPoolName != pLBConfig.LBTargetPoolName {
+		return false
+	}
+	pLBConfig.LBTargets = mLBConfig.LBTargets
+	return !lbConfigChanged(mLBConfig, pLBConfig)
 }
 
-func updateProvider(toChange []model.LBConfig, op *Op) []model.LBConfig {
-	var changed []model.LBConfig
-	for _, value := range toChange {
+// targetsMissing returns the targets in a that are not in b.
+func targetsMissing(a []model.LBTarget, b []model.LBTarget) []model.LBTarget {
+	existing := make(map[model.LBTarget]bool, len(b))
+	for _, target := range b {
+		existing[target] = true
+	}
+	var missing []model.LBTarget
+	for _, target := range a {
+		if !existing[target] {
+			missing = append(missing, target)
+		}
+	}
+	return missing
+}
+
+// lbFields are the structured log fields of a change of an LB config.
+func lbFields(endpoint string, service string, action string) logrus.Fields {
+	fields := logrus.Fields{
+		"lb_name": endpoint,
+		"action":  action,
+	}
+	if len(service) != 0 {
+		fields["service"] = service
+	}
+	return fields
+}
+
+// updateProvider sends the changes to the provider, with up to
+// writeConcurrency changes in flight, and adds the errors of the failed
+// ones to errs. For updates current holds the provider configs, updates
+// that only change the targets are sent as target changes to providers
+// implementing TargetUpdater.
+func (c *providerController) updateProvider(toChange []model.LBConfig, current map[string]model.LBConfig, op *Op, errs changeErrors) {
+	updater, canUpdateTargets := c.provider.(providers.TargetUpdater)
+	var mu sync.Mutex
+	forEachParallel(writeConcurrency, len(toChange), func(i int) {
+		value := toChange[i]
+		log := c.log.WithFields(lbFields(value.LBEndpoint, value.Service, op.Name))
+		c.limiter.Wait()
+		var err error
 		switch *op {
 		case Add:
-			logrus.Infof("Adding LB config: %v", value)
-			if err := provider.AddLBConfig(value); err != nil {
-				logrus.Errorf("Failed to add LB config to provider %v: %v", value, err)
+			log.Infof("Adding LB config: %v", value)
+			if err = c.provider.AddLBConfig(value); err != nil {
+				log.Errorf("Failed to add LB config to provider %v: %v", value, err)
 			} else {
-				changed = append(changed, value)
+				c.stabilizer.added(value.LBEndpoint)
 			}
 		case Remove:
-			logrus.Infof("Removing LB config: %v", value)
-			if err := provider.RemoveLBConfig(value); err != nil {
-				logrus.Errorf("Failed to remove LB config from provider %v: %v", value, err)
+			log.Infof("Removing LB config: %v", value)
+			if err = c.provider.RemoveLBConfig(value); err != nil {
+				log.Errorf("Failed to remove LB config from provider %v: %v", value, err)
 			}
 		case Update:
-			logrus.Infof("Updating LB config: %v", value)
-			if err := provider.UpdateLBConfig(value); err != nil {
-				logrus.Errorf("Failed to update LB config to provider %v: %v", value, err)
-			} else {
-				changed = append(changed, value)
+			existing, ok := current[value.LBEndpoint]
+			if canUpdateTargets && ok && targetsOnlyChanged(value, existing) {
+				add := targetsMissing(value.LBTargets, existing.LBTargets)
+				remove := targetsMissing(existing.LBTargets, value.LBTargets)
+				log.Infof("Updating targets of LB config %v: adding %v, removing %v", value, add, remove)
+				if err = updater.UpdateLBTargets(value, add, remove); err != nil {
+					log.Errorf("Failed to update targets of LB config to provider %v: %v", value, err)
+				}
+				break
+			}
+			log.Infof("Updating LB config: %v", value)
+			if err = c.provider.UpdateLBConfig(value); err != nil {
+				log.Errorf("Failed to update LB config to provider %v: %v", value, err)
 			}
 		}
+
+		var desired, previous *model.LBConfig
+		switch *op {
+		case Add:
+			desired = &value
+		case Remove:
+			previous = &value
+		case Update:
+			desired = &value
+			if existing, ok := current[value.LBEndpoint]; ok {
+				previous = &existing
+			}
+		}
+		audit.record(c.provider.GetName(), op.Name, desired, previous, err)
+		event := changeEvent(c.provider.GetName(), op, value, previous)
+
+		switch {
+		case err != nil:
+			event.Failures = c.state.recordFailure(value, err)
+			event.Error = err.Error()
+			notifications.notifyFailure(event)
+			providerUpdateErrors.Inc(c.provider.GetName(), op.Name)
+			mu.Lock()
+			errs[value.LBEndpoint] = err
+			mu.Unlock()
+		case *op == Remove:
+			c.state.forget(value.LBEndpoint)
+			notifications.notify(event)
+		default:
+			c.state.recordSuccess(value)
+			notifications.notify(event)
+		}
+	})
+}
+
+// readProviderLBConfigs reads all LB configs from the provider. Providers
+// that can read single endpoints are read with readConcurrency workers.
+// The read fails if any endpoint cannot be read, as the endpoint would
+// look missing and be added again.
+func (c *providerController) readProviderLBConfigs() ([]model.LBConfig, error) {
+	reader, ok := c.provider.(providers.EndpointReader)
+	if !ok {
+		c.limiter.Wait()
+		return c.provider.GetLBConfigs()
+	}
+
+	c.limiter.Wait()
+	endpoints, err := reader.ListLBEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	var allConfigs []model.LBConfig
+	var failed []string
+	var mu sync.Mutex
+	forEachParallel(readConcurrency, len(endpoints), func(i int) {
+		c.limiter.Wait()
+		config, found, err := reader.GetLBConfig(endpoints[i])
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			c.log.Errorf("Failed to read LB config of endpoint %s from provider: %v", endpoints[i], err)
+			failed = append(failed, endpoints[i])
+			return
+		}
+		if found {
+			allConfigs = append(allConfigs, config)
+		}
+	})
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return nil, fmt.Errorf("Failed to read %d of %d LB endpoints from provider: %s", len(failed), len(endpoints), strings.Join(failed, ", "))
 	}
-	return changed
+	return allConfigs, nil
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/sources"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider keeps its LB configs in memory. It reads single endpoints
+// so that the reads can run concurrently, and records the highest number
+// of reads in flight at once.
+type fakeProvider struct {
+	mu       sync.Mutex
+	configs  map[string]model.LBConfig
+	failRead map[string]bool
+	delay    time.Duration
+	inFlight int
+	maxReads int
+}
+
+func newFakeProvider(configs ...model.LBConfig) *fakeProvider {
+	p := &fakeProvider{configs: map[string]model.LBConfig{}, failRead: map[string]bool{}}
+	for _, config := range configs {
+		p.configs[config.LBEndpoint] = config
+	}
+	return p
+}
+
+func (p *fakeProvider) Init() error     { return nil }
+func (p *fakeProvider) GetName() string { return "fake" }
+
+func (p *fakeProvider) AddLBConfig(config model.LBConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configs[config.LBEndpoint] = config
+	return nil
+}
+
+func (p *fakeProvider) RemoveLBConfig(config model.LBConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.configs, config.LBEndpoint)
+	return nil
+}
+
+func (p *fakeProvider) UpdateLBConfig(config model.LBConfig) error {
+	return p.AddLBConfig(config)
+}
+
+func (p *fakeProvider) GetLBConfigs() ([]model.LBConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var configs []model.LBConfig
+	for _, config := range p.configs {
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (p *fakeProvider) CleanupLBConfigs(configs []model.LBConfig) error { return nil }
+func (p *fakeProvider) TestConnection() error                           { return nil }
+
+func (p *fakeProvider) ListLBEndpoints() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var endpoints []string
+	for endpoint := range p.configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+func (p *fakeProvider) GetLBConfig(endpoint string) (model.LBConfig, bool, error) {
+	p.mu.Lock()
+	p.inFlight++
+	if p.inFlight > p.maxReads {
+		p.maxReads = p.inFlight
+	}
+	p.mu.Unlock()
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	if p.failRead[endpoint] {
+		return model.LBConfig{}, false, fmt.Errorf("read of %s failed", endpoint)
+	}
+	config, ok := p.configs[endpoint]
+	return config, ok, nil
+}
+
+func newTestController(p *fakeProvider) *providerController {
+	return &providerController{provider: p, log: logrus.WithField("provider", p.GetName()), state: loadStateStore("")}
+}
+
+// useTestSource points the globals read by a reconcile at the
+// environment "env" of fakeConfigs, until the returned func restores them.
+func useTestSource() func() {
+	previousM, previousSource, previousOwner, previousSuffix := m, source, ownerID, targetRancherSuffix
+	m = &metadata.MetadataClient{EnvironmentUUID: "env"}
+	source = sources.NewMetadataSource(m)
+	ownerID = "owner1"
+	targetRancherSuffix = "rancher.internal"
+	return func() {
+		m, source, ownerID, targetRancherSuffix = previousM, previousSource, previousOwner, previousSuffix
+	}
+}
+
+func fakeConfigs(count int) []model.LBConfig {
+	var configs []model.LBConfig
+	for i := 0; i < count; i++ {
+		configs = append(configs, model.LBConfig{
+			LBEndpoint:       fmt.Sprintf("ep%d", i),
+			LBTargetPoolName: fmt.Sprintf("pool%d_env_rancher.internal", i),
+		})
+	}
+	return configs
+}
+
+func TestReadProviderLBConfigsConcurrency(t *testing.T) {
+	defer func(previous int) { readConcurrency = previous }(readConcurrency)
+
+	for _, workers := range []int{1, 3, 8} {
+		readConcurrency = workers
+		p := newFakeProvider(fakeConfigs(8)...)
+		p.delay = 20 * time.Millisecond
+
+		configs, err := newTestController(p).readProviderLBConfigs()
+		if err != nil {
+			t.Fatalf("%d workers: unexpected error: %v", workers, err)
+		}
+		if len(configs) != 8 {
+			t.Errorf("%d workers: read %d configs, expected 8", workers, len(configs))
+		}
+		if p.maxReads > workers {
+			t.Errorf("%d workers: %d reads were in flight at once", workers, p.maxReads)
+		}
+		if workers > 1 && p.maxReads < 2 {
+			t.Errorf("%d workers: the reads did not run concurrently", workers)
+		}
+	}
+}
+
+func TestReadProviderLBConfigsFailsOnEndpointError(t *testing.T) {
+	defer func(previous int) { readConcurrency = previous }(readConcurrency)
+	readConcurrency = 4
+
+	p := newFakeProvider(fakeConfigs(6)...)
+	p.failRead["ep2"] = true
+	p.failRead["ep4"] = true
+
+	configs, err := newTestController(p).readProviderLBConfigs()
+	if err == nil {
+		t.Fatalf("expected an error, got %d configs", len(configs))
+	}
+	if !strings.Contains(err.Error(), "2 of 6") || !strings.Contains(err.Error(), "ep2, ep4") {
+		t.Errorf("error does not name the failed endpoints: %v", err)
+	}
+	if configs != nil {
+		t.Errorf("expected no configs with a failed read, got %d", len(configs))
+	}
+}
+
+// maxConnProvider is a fakeProvider applying the connection limit.
+type maxConnProvider struct {
+	*fakeProvider
+}
+
+func (maxConnProvider) AppliesMaxConn() bool { return true }
+
+func TestMaxConnDroppedForProvidersNotApplyingIt(t *testing.T) {
+	defer useTestSource()()
+
+	config := fakeConfigs(1)[0]
+	config.MaxConn = 100
+	metadataConfigs := func() map[string]model.LBConfig {
+		return map[string]model.LBConfig{config.LBEndpoint: config}
+	}
+
+	p := newFakeProvider()
+	if err := newTestController(p).UpdateProviderLBConfigs(metadataConfigs()); err != nil {
+		t.Fatalf("UpdateProviderLBConfigs failed: %v", err)
+	}
+	if got := p.configs[config.LBEndpoint].MaxConn; got != 0 {
+		t.Errorf("a provider not applying the connection limit got %d", got)
+	}
+
+	applier := maxConnProvider{newFakeProvider()}
+	c := &providerController{provider: applier, log: logrus.WithField("provider", applier.GetName()), state: loadStateStore("")}
+	if err := c.UpdateProviderLBConfigs(metadataConfigs()); err != nil {
+		t.Fatalf("UpdateProviderLBConfigs failed: %v", err)
+	}
+	if got := applier.configs[config.LBEndpoint].MaxConn; got != 100 {
+		t.Errorf("a provider applying the connection limit got %d", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"sync"
+	"time"
+)
+
+// collector garbage collects the provider configs that no longer have a
+// service in metadata. Their removal is held back until they have been
+// missing for the grace period, so a short metadata outage or a service
+// being recreated does not tear down the LB. In dry-run mode due removals
+// are only logged.
+// A nil *collector removes every orphaned config immediately.
+type collector struct {
+	mu          sync.Mutex
+	gracePeriod time.Duration
+	dryRun      bool
+	missing     map[string]time.Time
+}
+
+func newCollector(gracePeriod time.Duration, dryRun bool) *collector {
+	if gracePeriod <= 0 && !dryRun {
+		return nil
+	}
+	return &collector{
+		gracePeriod: gracePeriod,
+		dryRun:      dryRun,
+		missing:     make(map[string]time.Time),
+	}
+}
+
+// filter returns the orphaned configs that have been missing from
+// metadata for the full grace period. Configs that are no longer
+// orphaned are dropped from the missing set.
+func (g *collector) filter(toRemove []model.LBConfig) []model.LBConfig {
+	if g == nil {
+		return toRemove
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	orphaned := make(map[string]bool, len(toRemove))
+	for _, config := range toRemove {
+		orphaned[config.LBEndpoint] = true
+	}
+	for endpoint := range g.missing {
+		if !orphaned[endpoint] {
+			logrus.Infof("LB endpoint %s is back in metadata, it will not be removed", endpoint)
+			delete(g.missing, endpoint)
+		}
+	}
+
+	now := time.Now()
+	var due []model.LBConfig
+	for _, config := range toRemove {
+		since, ok := g.missing[config.LBEndpoint]
+		if !ok {
+			since = now
+			g.missing[config.LBEndpoint] = since
+			if g.gracePeriod > 0 {
+				logrus.Infof("LB endpoint %s is no longer in metadata, removing it in %v", config.LBEndpoint, g.gracePeriod)
+			}
+		}
+		if now.Sub(since) < g.gracePeriod {
+			logrus.Debugf("LB endpoint %s is missing from metadata since %v, not removing it yet", config.LBEndpoint, since)
+			continue
+		}
+		if g.dryRun {
+			logrus.Infof("GC dry run, not removing LB endpoint %s missing from metadata since %v", config.LBEndpoint, since)
+			continue
+		}
+		delete(g.missing, config.LBEndpoint)
+		due = append(due, config)
+	}
+	return due
+}
+
+// due reports whether any orphaned config has reached the end of its
+// grace period and should be picked up by a reconcile.
+func (g *collector) due() bool {
+	if g == nil || g.dryRun {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, since := range g.missing {
+		if time.Since(since) >= g.gracePeriod {
+			return true
+		}
+	}
+	return false
+}
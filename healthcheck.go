@@ -1,36 +1,127 @@
 package main
 
 import (
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/rancher/external-lb/metrics"
 	"net/http"
+	"sync"
+	"time"
 )
 
 var (
 	router          = mux.NewRouter()
 	healthcheckPort = ":1000"
+
+	// livenessTimeout is the time the main loop may go without finishing
+	// an iteration before the instance is considered wedged
+	livenessTimeout = 2 * time.Minute
+	// readySyncIntervals is the number of forced update intervals the
+	// last successful reconcile of a provider may be old for readiness
+	readySyncIntervals = 3
+
+	heartbeatLock sync.Mutex
+	lastHeartbeat = time.Now()
 )
 
 func startHealthcheck() {
 	router.HandleFunc("/", healthcheck).Methods("GET", "HEAD").Name("Healthcheck")
+	router.HandleFunc("/live", liveness).Methods("GET", "HEAD").Name("Liveness")
+	router.HandleFunc("/ready", readiness).Methods("GET", "HEAD").Name("Readiness")
+	router.HandleFunc("/metrics", metrics.Handler).Methods("GET").Name("Metrics")
+	router.HandleFunc("/v1/configs", configsHandler).Methods("GET").Name("Configs")
+	router.HandleFunc("/v1/provider/state", providerStateHandler).Methods("GET").Name("ProviderState")
+	router.HandleFunc("/v1/lastsync", lastSyncHandler).Methods("GET").Name("LastSync")
+	router.HandleFunc("/v1/sync", syncHandler).Methods("POST").Name("Sync")
+	if exposeConfig {
+		router.HandleFunc("/config", configHandler).Methods("GET").Name("Config")
+	}
 	logrus.Info("Healthcheck handler is listening on ", healthcheckPort)
 	logrus.Fatal(http.ListenAndServe(healthcheckPort, router))
 }
 
 func healthcheck(w http.ResponseWriter, req *http.Request) {
 	// 1) test metadata server
-	_, err := m.MetadataClient.GetSelfStack()
+	err := source.TestConnection()
 	if err != nil {
 		logrus.Error("Healthcheck failed: unable to reach metadata")
 		http.Error(w, "Failed to reach metadata server", http.StatusInternalServerError)
-	} else {
-		// 2) test provider
-		err := provider.TestConnection()
+		return
+	}
+	// 2) test providers
+	for _, c := range controllers {
+		// do not add to the load of a provider we are backing off from
+		if state, failures, retryIn := c.breaker.status(); state == circuitOpen {
+			c.log.Errorf("Healthcheck failed: circuit breaker is open after %d failed reconciles", failures)
+			http.Error(w, fmt.Sprintf("Circuit breaker open for external provider %s, retrying in %v", c.provider.GetName(), retryIn), http.StatusServiceUnavailable)
+			return
+		}
+		err := c.provider.TestConnection()
 		if err != nil {
-			logrus.Errorf("Healthcheck failed: unable to reach a provider, error:%v", err)
-			http.Error(w, "Failed to reach an external provider ", http.StatusInternalServerError)
-		} else {
-			w.Write([]byte("OK"))
+			c.log.Errorf("Healthcheck failed: unable to reach a provider, error:%v", err)
+			http.Error(w, "Failed to reach an external provider "+c.provider.GetName(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
+
+// heartbeat records that the main loop finished an iteration.
+func heartbeat() {
+	heartbeatLock.Lock()
+	lastHeartbeat = time.Now()
+	heartbeatLock.Unlock()
+}
+
+// liveness fails when the main loop is wedged, so the instance gets
+// restarted. Unreachable dependencies do not fail it, see readiness.
+func liveness(w http.ResponseWriter, req *http.Request) {
+	heartbeatLock.Lock()
+	since := time.Since(lastHeartbeat)
+	heartbeatLock.Unlock()
+	if since > livenessTimeout {
+		logrus.Errorf("Liveness check failed: the main loop did not finish an iteration for %v", since)
+		http.Error(w, fmt.Sprintf("Main loop stuck for %v", since), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// readiness fails while metadata or a provider cannot be reached, or the
+// last successful reconcile of a provider is older than readySyncIntervals
+// forced update intervals. Standby replicas only need metadata.
+func readiness(w http.ResponseWriter, req *http.Request) {
+	if err := source.TestConnection(); err != nil {
+		http.Error(w, "Failed to reach metadata server", http.StatusServiceUnavailable)
+		return
+	}
+	if !election.isLeader() {
+		w.Write([]byte("OK, standing by"))
+		return
+	}
+	maxAge := time.Duration(readySyncIntervals*forceUpdateInterval) * time.Minute
+	for _, c := range controllers {
+		name := c.provider.GetName()
+		if state, _, retryIn := c.breaker.status(); state == circuitOpen {
+			http.Error(w, fmt.Sprintf("Circuit breaker open for external provider %s, retrying in %v", name, retryIn), http.StatusServiceUnavailable)
+			return
+		}
+		if err := c.provider.TestConnection(); err != nil {
+			http.Error(w, "Failed to reach an external provider "+name, http.StatusServiceUnavailable)
+			return
+		}
+		apiLock.Lock()
+		lastSuccess := c.lastSuccess
+		apiLock.Unlock()
+		if lastSuccess.IsZero() {
+			http.Error(w, "No successful reconcile of external provider "+name+" yet", http.StatusServiceUnavailable)
+			return
+		}
+		if age := time.Since(lastSuccess); age > maxAge {
+			http.Error(w, fmt.Sprintf("Last successful reconcile of external provider %s was %v ago", name, age), http.StatusServiceUnavailable)
+			return
 		}
 	}
+	w.Write([]byte("OK"))
 }
@@ -0,0 +1,373 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTokenFile   = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultCAFile      = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultClusterName = "kubernetes"
+
+	// clusterNamespace is the namespace whose UID identifies the cluster,
+	// it exists in every cluster and is never recreated
+	clusterNamespace = "kube-system"
+)
+
+// Source reads the Services, Endpoints and Nodes of a Kubernetes cluster
+// through the API server and presents them in the shape of Rancher
+// metadata. Namespaces take the place of stacks, the ready addresses of a
+// Service's Endpoints that of its containers, and the Nodes that of the
+// hosts. The external LB labels are read from the Service labels and
+// annotations, annotations taking precedence since label values cannot
+// hold every endpoint.
+type Source struct {
+	apiURL      string
+	tokenFile   string
+	namespace   string
+	clusterID   string
+	clusterName string
+	client      *http.Client
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []servicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name string `json:"name"`
+}
+
+type endpoints struct {
+	Metadata objectMeta       `json:"metadata"`
+	Subsets  []endpointSubset `json:"subsets"`
+}
+
+type endpointSubset struct {
+	Addresses []endpointAddress `json:"addresses"`
+	Ports     []endpointPort    `json:"ports"`
+}
+
+type endpointAddress struct {
+	IP        string `json:"ip"`
+	NodeName  string `json:"nodeName"`
+	TargetRef *struct {
+		Name string `json:"name"`
+		UID  string `json:"uid"`
+	} `json:"targetRef"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type node struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+// NewSource configures the API server connection from the in-cluster
+// service account, overridable through the KUBERNETES_* variables.
+func NewSource() (*Source, error) {
+	s := &Source{
+		apiURL:      os.Getenv("KUBERNETES_API_URL"),
+		tokenFile:   os.Getenv("KUBERNETES_TOKEN_FILE"),
+		namespace:   os.Getenv("KUBERNETES_NAMESPACE"),
+		clusterID:   os.Getenv("KUBERNETES_CLUSTER_ID"),
+		clusterName: os.Getenv("KUBERNETES_CLUSTER_NAME"),
+	}
+	if len(s.apiURL) == 0 {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if len(host) == 0 || len(port) == 0 {
+			return nil, fmt.Errorf("KUBERNETES_API_URL is not set and external-lb is not running in a cluster")
+		}
+		s.apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	s.apiURL = strings.TrimRight(s.apiURL, "/")
+	if len(s.tokenFile) == 0 {
+		s.tokenFile = defaultTokenFile
+	}
+	if len(s.clusterName) == 0 {
+		s.clusterName = defaultClusterName
+	}
+
+	caFile := os.Getenv("KUBERNETES_CA_FILE")
+	if len(caFile) == 0 {
+		caFile = defaultCAFile
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if data, err := ioutil.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+
+	if len(s.clusterID) == 0 {
+		var ns struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		if err := s.get("/api/v1/namespaces/"+clusterNamespace, &ns); err != nil {
+			return nil, fmt.Errorf("KUBERNETES_CLUSTER_ID is not set and the %s namespace could not be read: %v", clusterNamespace, err)
+		}
+		s.clusterID = ns.Metadata.UID
+	}
+	return s, nil
+}
+
+// GetVersion returns a hash of the resource versions of all Services and
+// Endpoints, which changes with every change to them.
+func (s *Source) GetVersion() (string, error) {
+	services, endpoints, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	var versions []string
+	for _, svc := range services {
+		versions = append(versions, "service/"+svc.Metadata.Namespace+"/"+svc.Metadata.Name+"@"+svc.Metadata.ResourceVersion)
+	}
+	for _, ep := range endpoints {
+		versions = append(versions, "endpoints/"+ep.Metadata.Namespace+"/"+ep.Metadata.Name+"@"+ep.Metadata.ResourceVersion)
+	}
+	sort.Strings(versions)
+	h := fnv.New64a()
+	for _, version := range versions {
+		h.Write([]byte(version))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// WaitForVersionChange returns the current version at once, the caller
+// polls it every poll interval.
+func (s *Source) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	return s.GetVersion()
+}
+
+// GetServices returns the Services with their ready addresses as
+// containers. Each address publishes the ports of its subset in the order
+// of the Service ports, as "<ip>:<port>:<port>/<protocol>", so the first
+// Service port is the one published without a ports label.
+func (s *Source) GetServices() ([]metadata.Service, error) {
+	services, endpoints, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	subsets := make(map[string][]endpointSubset, len(endpoints))
+	for _, ep := range endpoints {
+		subsets[ep.Metadata.Namespace+"/"+ep.Metadata.Name] = ep.Subsets
+	}
+
+	var result []metadata.Service
+	for _, svc := range services {
+		labels := make(map[string]string, len(svc.Metadata.Labels)+len(svc.Metadata.Annotations))
+		for key, value := range svc.Metadata.Labels {
+			labels[key] = value
+		}
+		for key, value := range svc.Metadata.Annotations {
+			labels[key] = value
+		}
+		converted := metadata.Service{
+			Name:      svc.Metadata.Name,
+			StackName: svc.Metadata.Namespace,
+			Labels:    labels,
+			UUID:      svc.Metadata.UID,
+		}
+		portOrder := make(map[string]int, len(svc.Spec.Ports))
+		for i, port := range svc.Spec.Ports {
+			portOrder[port.Name] = i
+		}
+		for _, subset := range subsets[svc.Metadata.Namespace+"/"+svc.Metadata.Name] {
+			ports := sortedPorts(subset.Ports, portOrder)
+			// not ready addresses are left out like Kubernetes leaves them
+			// out of the Service
+			for _, address := range subset.Addresses {
+				container := metadata.Container{
+					Name:        address.IP,
+					UUID:        address.IP,
+					PrimaryIp:   address.IP,
+					ServiceName: svc.Metadata.Name,
+					StackName:   svc.Metadata.Namespace,
+					HostUUID:    address.NodeName,
+					HealthState: "healthy",
+				}
+				if address.TargetRef != nil {
+					container.Name = address.TargetRef.Name
+					container.UUID = address.TargetRef.UID
+				}
+				for _, port := range ports {
+					protocol := strings.ToLower(port.Protocol)
+					if len(protocol) == 0 {
+						protocol = "tcp"
+					}
+					container.Ports = append(container.Ports, fmt.Sprintf("%s:%d:%d/%s", address.IP, port.Port, port.Port, protocol))
+				}
+				converted.Containers = append(converted.Containers, container)
+			}
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+// sortedPorts orders the ports of a subset like the Service ports they
+// belong to, matched by name.
+func sortedPorts(ports []endpointPort, order map[string]int) []endpointPort {
+	sorted := byServicePort{ports: make([]endpointPort, len(ports)), order: order}
+	copy(sorted.ports, ports)
+	sort.Stable(sorted)
+	return sorted.ports
+}
+
+type byServicePort struct {
+	ports []endpointPort
+	order map[string]int
+}
+
+func (p byServicePort) Len() int      { return len(p.ports) }
+func (p byServicePort) Swap(i, j int) { p.ports[i], p.ports[j] = p.ports[j], p.ports[i] }
+func (p byServicePort) Less(i, j int) bool {
+	return p.index(p.ports[i]) < p.index(p.ports[j])
+}
+
+func (p byServicePort) index(port endpointPort) int {
+	if i, ok := p.order[port.Name]; ok {
+		return i
+	}
+	return len(p.order)
+}
+
+// GetHosts returns the Nodes, their InternalIP serving as agent IP.
+func (s *Source) GetHosts() ([]metadata.Host, error) {
+	var nodes struct {
+		Items []node `json:"items"`
+	}
+	if err := s.get("/api/v1/nodes", &nodes); err != nil {
+		return nil, err
+	}
+	var hosts []metadata.Host
+	for _, n := range nodes.Items {
+		host := metadata.Host{
+			Name:     n.Metadata.Name,
+			Hostname: n.Metadata.Name,
+			UUID:     n.Metadata.Name,
+			Labels:   n.Metadata.Labels,
+		}
+		for _, address := range n.Status.Addresses {
+			if address.Type == "InternalIP" {
+				host.AgentIP = address.Address
+				break
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// GetSelfStack describes the cluster as the environment, reading the
+// cluster namespace to check the API server connection.
+func (s *Source) GetSelfStack() (metadata.Stack, error) {
+	if err := s.get("/api/v1/namespaces/"+clusterNamespace, nil); err != nil {
+		return metadata.Stack{}, err
+	}
+	return metadata.Stack{
+		EnvironmentUUID: s.clusterID,
+		EnvironmentName: s.clusterName,
+		Name:            s.namespace,
+	}, nil
+}
+
+func (s *Source) GetSelfContainer() (metadata.Container, error) {
+	return metadata.Container{}, fmt.Errorf("the kubernetes source does not know its own pod")
+}
+
+func (s *Source) GetSelfService() (metadata.Service, error) {
+	return metadata.Service{}, fmt.Errorf("the kubernetes source does not know its own service")
+}
+
+// list returns the Services and Endpoints of the namespace, or of all
+// namespaces if none is set.
+func (s *Source) list() ([]service, []endpoints, error) {
+	prefix := "/api/v1"
+	if len(s.namespace) != 0 {
+		prefix += "/namespaces/" + s.namespace
+	}
+	var services struct {
+		Items []service `json:"items"`
+	}
+	if err := s.get(prefix+"/services", &services); err != nil {
+		return nil, nil, fmt.Errorf("Error listing services: %v", err)
+	}
+	var eps struct {
+		Items []endpoints `json:"items"`
+	}
+	if err := s.get(prefix+"/endpoints", &eps); err != nil {
+		return nil, nil, fmt.Errorf("Error listing endpoints: %v", err)
+	}
+	return services.Items, eps.Items, nil
+}
+
+func (s *Source) get(path string, out interface{}) error {
+	req, err := http.NewRequest("GET", s.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	// the token is read on every request, service account tokens are rotated
+	if token, err := ioutil.ReadFile(s.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
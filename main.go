@@ -1,19 +1,53 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/docker"
+	"github.com/rancher/external-lb/kubernetes"
 	"github.com/rancher/external-lb/metadata"
 	"github.com/rancher/external-lb/providers"
+	_ "github.com/rancher/external-lb/providers/a10"
+	_ "github.com/rancher/external-lb/providers/avi"
+	_ "github.com/rancher/external-lb/providers/cloudflare"
+	_ "github.com/rancher/external-lb/providers/consul"
+	_ "github.com/rancher/external-lb/providers/digitalocean"
+	_ "github.com/rancher/external-lb/providers/envoy"
 	_ "github.com/rancher/external-lb/providers/f5"
+	_ "github.com/rancher/external-lb/providers/gcp"
+	_ "github.com/rancher/external-lb/providers/haproxy"
+	_ "github.com/rancher/external-lb/providers/hetzner"
+	_ "github.com/rancher/external-lb/providers/keepalived"
+	_ "github.com/rancher/external-lb/providers/kemp"
+	_ "github.com/rancher/external-lb/providers/netscaler"
+	_ "github.com/rancher/external-lb/providers/nginxplus"
+	_ "github.com/rancher/external-lb/providers/octavia"
+	_ "github.com/rancher/external-lb/providers/plugin"
+	_ "github.com/rancher/external-lb/providers/traefik"
+	"github.com/rancher/external-lb/sources"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	poll = 1000
+	// sourceRancher reads the services from Rancher metadata,
+	// sourceKubernetes from the Kubernetes API, sourceDocker from the
+	// containers of a Docker engine, sourceFile reads the LB configs from
+	// a file
+	sourceRancher    = "rancher"
+	sourceKubernetes = "kubernetes"
+	sourceDocker     = "docker"
+	sourceFile       = "file"
+
 	// if metadata wasn't updated in 1 min, force update would be executed
 	forceUpdateInterval = 1
+	// maximum time a metadata version long-poll is held open, this also
+	// bounds how late forced and stabilization updates can run
+	versionWaitTimeout = 5 * time.Second
 )
 
 type Op struct {
@@ -27,19 +61,48 @@ var (
 )
 
 var (
-	providerName = flag.String("provider", "", "External LB  provider name")
-	debug        = flag.Bool("debug", false, "Debug")
-	logFile      = flag.String("log", "", "Log file")
+	configFile      = flag.String("config", "", "Config file with flag and environment variable settings")
+	providerName    = flag.String("provider", "", "External LB provider name, or a comma separated list of provider names")
+	sourceName      = flag.String("source", sourceRancher, "Source of the services, rancher, kubernetes, docker or file")
+	nameTemplate    = flag.String("name-template", "", "Go template of the target pool names, e.g. {{.Service}}-{{.Stack}}-{{.Env}}")
+	debug           = flag.Bool("debug", false, "Debug")
+	logFile         = flag.String("log", "", "Log file")
+	logFormat       = flag.String("log-format", "text", "Log format, text or json")
+	dryRun          = flag.Bool("dry-run", false, "Compute the planned provider changes without applying them")
+	deregister      = flag.Bool("deregister-on-shutdown", false, "Drain and deregister the targets registered by this instance on shutdown")
+	onlyHealthy     = flag.Bool("only-healthy-targets", false, "Only register containers that Rancher reports as healthy")
+	disableRemovals = flag.Bool("disable-removals", false, "Never remove LB configs whose service is gone from metadata, only warn about them")
+	gcGracePeriod   = flag.Duration("gc-grace-period", 0, "Only remove LB configs that have been missing from metadata for this long")
+	gcDryRun        = flag.Bool("gc-dry-run", false, "Log the removal of LB configs missing from metadata instead of removing them")
+	dryRunOutput    = flag.String("dry-run-output", "", "Write the planned changes as JSON to this file ('-' for stdout) in dry-run mode")
 
-	provider               providers.Provider
+	controllers            []*providerController
+	audit                  *auditLog
+	notifications          *notifier
+	election               *elector
+	pollInterval           = time.Second
 	m                      *metadata.MetadataClient
+	source                 sources.Source
 	lbEndpointServiceLabel string
 	targetRancherSuffix    string
+	ownerID                string
+	shutdownMode           string
+	statusFile             string
+	providerRateLimit      float64
+	providerRateBurst      = 1
+	stabilizationPeriod    time.Duration
+	exposeConfig           bool
+	readConcurrency        = 1
+	writeConcurrency       = 1
 )
 
 func setEnv() {
 	flag.Parse()
-	provider = providers.GetProvider(*providerName)
+	if len(*configFile) != 0 {
+		if err := loadConfigFile(*configFile); err != nil {
+			logrus.Fatalf("Failed to load config file: %v", err)
+		}
+	}
 	if *debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
@@ -54,13 +117,158 @@ func setEnv() {
 			logrus.SetFormatter(formatter)
 		}
 	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.Fatalf("Invalid -log-format value %q, expected text or json", *logFormat)
+	}
 
 	// configure metadata client
-	mClient, err := metadata.NewMetadataClient()
-	if err != nil {
-		logrus.Fatalf("Failed to configure rancher-metadata client: %v", err)
+	var metadataSource metadata.Source
+	var err error
+	switch *sourceName {
+	case sourceRancher:
+		urls := []string{metadata.DefaultMetadataURL}
+		if value := os.Getenv("LB_METADATA_URLS"); len(value) != 0 {
+			urls = nil
+			for _, url := range strings.Split(value, ",") {
+				if url = strings.TrimSpace(url); len(url) != 0 {
+					urls = append(urls, url)
+				}
+			}
+		}
+		switch {
+		case len(urls) == 0:
+			logrus.Fatalf("Invalid LB_METADATA_URLS value %q, expected a comma separated list of URLs", os.Getenv("LB_METADATA_URLS"))
+		case len(urls) == 1:
+			if metadataSource, err = metadata.NewRancherSource(urls[0]); err != nil {
+				logrus.Fatalf("Failed to configure rancher-metadata: %v", err)
+			}
+		default:
+			if metadataSource, err = metadata.NewEnvironmentsSource(urls); err != nil {
+				logrus.Fatalf("Failed to configure rancher-metadata: %v", err)
+			}
+			logrus.Infof("Aggregating the services of %d environments", len(urls))
+		}
+	case sourceKubernetes:
+		if metadataSource, err = kubernetes.NewSource(); err != nil {
+			logrus.Fatalf("Failed to configure the Kubernetes API client: %v", err)
+		}
+		logrus.Info("Reading the services from the Kubernetes API")
+	case sourceDocker:
+		if metadataSource, err = docker.NewSource(); err != nil {
+			logrus.Fatalf("Failed to configure the Docker API client: %v", err)
+		}
+		logrus.Info("Reading the services from the Docker API")
+	case sourceFile:
+		path := os.Getenv("FILE_SOURCE_PATH")
+		if len(path) == 0 {
+			logrus.Fatalf("FILE_SOURCE_PATH is required by the %s source", sourceFile)
+		}
+		environmentUUID := os.Getenv("FILE_SOURCE_ENVIRONMENT_UUID")
+		if len(environmentUUID) == 0 {
+			environmentUUID = "static"
+		} else if strings.Contains(environmentUUID, "_") {
+			logrus.Fatalf("Invalid FILE_SOURCE_ENVIRONMENT_UUID value %q, expected no underscores", environmentUUID)
+		}
+		environmentName := os.Getenv("FILE_SOURCE_ENVIRONMENT_NAME")
+		if len(environmentName) == 0 {
+			environmentName = environmentUUID
+		}
+		if source, err = sources.NewFileSource(path, environmentUUID, environmentName); err != nil {
+			logrus.Fatalf("Failed to read the LB configs file: %v", err)
+		}
+		logrus.Infof("Reading the LB configs from %s", path)
+	default:
+		logrus.Fatalf("Invalid -source value %q, expected %s, %s, %s or %s", *sourceName, sourceRancher, sourceKubernetes, sourceDocker, sourceFile)
+	}
+	if source == nil {
+		mClient, err := metadata.NewMetadataClient(metadataSource)
+		if err != nil {
+			logrus.Fatalf("Failed to configure rancher-metadata client: %v", err)
+		}
+		m = mClient
+		source = sources.NewMetadataSource(m)
+	} else {
+		// the service label settings are kept, but there are no services
+		m = &metadata.MetadataClient{}
+	}
+
+	shutdownMode = os.Getenv("LB_SHUTDOWN_MODE")
+	switch {
+	case *deregister:
+		shutdownMode = shutdownDeregister
+	case len(shutdownMode) == 0:
+		shutdownMode = shutdownDrain
+	case shutdownMode != shutdownDrain && shutdownMode != shutdownDeregister && shutdownMode != shutdownCleanup:
+		logrus.Fatalf("Invalid LB_SHUTDOWN_MODE value %q, expected %q, %q or %q", shutdownMode, shutdownDrain, shutdownDeregister, shutdownCleanup)
+	}
+	statusFile = os.Getenv("LB_STATUS_FILE")
+
+	switch mode := os.Getenv("LB_LEADER_ELECTION"); mode {
+	case "":
+	case leaderElectionMetadata:
+		if *sourceName != sourceRancher {
+			logrus.Fatalf("LB_LEADER_ELECTION=%s needs the %s source", mode, sourceRancher)
+		}
+		logrus.Info("Electing the leader among the replicas of the service from metadata")
+		election = newElector(mode)
+	default:
+		logrus.Fatalf("Invalid LB_LEADER_ELECTION value %q, expected %q", mode, leaderElectionMetadata)
+	}
+
+	ownerID = os.Getenv("LB_OWNER_ID")
+	if len(ownerID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logrus.Fatalf("LB_OWNER_ID is not set and the hostname could not be determined: %v", err)
+		}
+		if ownerID, err = defaultOwnerID(hostname, metadataSource, source.GetEnvironmentUUID(), election != nil); err != nil {
+			logrus.Fatalf("LB_OWNER_ID is not set and the own service could not be read: %v", err)
+		}
+	}
+	logrus.Infof("Managing provider resources as owner %s", ownerID)
+	if audit, err = openAuditLog(os.Getenv("LB_AUDIT_LOG")); err != nil {
+		logrus.Fatalf("Failed to open the audit log: %v", err)
+	}
+	failureThreshold := 3
+	if value := os.Getenv("LB_WEBHOOK_FAILURE_THRESHOLD"); len(value) != 0 {
+		if failureThreshold, err = strconv.Atoi(value); err != nil || failureThreshold < 1 {
+			logrus.Fatalf("Invalid LB_WEBHOOK_FAILURE_THRESHOLD value %q, expected a positive number of failures", value)
+		}
+	}
+	if notifications, err = newNotifier(os.Getenv("LB_WEBHOOK_URL"), os.Getenv("LB_WEBHOOK_TEMPLATE"), failureThreshold); err != nil {
+		logrus.Fatalf("Failed to configure the webhook: %v", err)
+	}
+
+	m.TargetIPSource = os.Getenv("LB_TARGET_IP_SOURCE")
+	if len(m.TargetIPSource) == 0 {
+		m.TargetIPSource = metadata.TargetIPSourceHost
+	} else if !metadata.IsValidTargetIPSource(m.TargetIPSource) {
+		logrus.Fatalf("Invalid LB_TARGET_IP_SOURCE value %q, expected %q, %q, %q or %q", m.TargetIPSource,
+			metadata.TargetIPSourceHost, metadata.TargetIPSourceContainer, metadata.TargetIPSourceAgent, metadata.TargetIPSourceHostLabel)
+	}
+	m.TargetIPHostLabel = os.Getenv("LB_TARGET_IP_HOST_LABEL")
+	if len(m.TargetIPHostLabel) == 0 {
+		m.TargetIPHostLabel = metadata.DefaultTargetIPHostLabel
+	}
+	logrus.Infof("Using %s IPs as LB targets", m.TargetIPSource)
+	if len(*nameTemplate) != 0 {
+		if m.PoolNameTemplate, err = metadata.ParsePoolNameTemplate(*nameTemplate); err != nil {
+			logrus.Fatalf("Invalid -name-template value %q: %v", *nameTemplate, err)
+		}
+		logrus.Infof("Naming the target pools %s_%s_<suffix>", *nameTemplate, source.GetEnvironmentUUID())
+	}
+	m.OnlyHealthyTargets = *onlyHealthy
+	if m.OnlyHealthyTargets {
+		logrus.Info("Only registering healthy containers as LB targets")
+	}
+
+	if err := setReloadableEnv(); err != nil {
+		logrus.Fatal(err)
 	}
-	m = mClient
 
 	targetRancherSuffix = os.Getenv("LB_TARGET_RANCHER_SUFFIX")
 	if len(targetRancherSuffix) == 0 {
@@ -69,53 +277,380 @@ func setEnv() {
 	}
 
 	lbEndpointServiceLabel = "io.rancher.service.external_lb_endpoint"
+
+	if rateLimit, env := getenvWithAlias("LB_PROVIDER_RATE_LIMIT", "PROVIDER_RATE_LIMIT_QPS"); len(rateLimit) != 0 {
+		opsPerSecond, err := strconv.ParseFloat(rateLimit, 64)
+		if err != nil || opsPerSecond <= 0 {
+			logrus.Fatalf("Invalid %s value %q, expected a positive number of operations per second", env, rateLimit)
+		}
+		providerRateLimit = opsPerSecond
+	}
+	if burst, env := getenvWithAlias("LB_PROVIDER_RATE_LIMIT_BURST", "PROVIDER_RATE_LIMIT_BURST"); len(burst) != 0 {
+		operations, err := strconv.Atoi(burst)
+		if err != nil || operations < 1 {
+			logrus.Fatalf("Invalid %s value %q, expected a positive number of operations", env, burst)
+		}
+		providerRateBurst = operations
+	}
+	if providerRateLimit > 0 {
+		logrus.Infof("Limiting provider calls to %v operations per second with bursts of %d", providerRateLimit, providerRateBurst)
+	}
+
+	if period := os.Getenv("LB_STABILIZATION_PERIOD"); len(period) != 0 {
+		duration, err := time.ParseDuration(period)
+		if err != nil || duration < 0 {
+			logrus.Fatalf("Invalid LB_STABILIZATION_PERIOD value %q, expected a duration such as 30s", period)
+		}
+		logrus.Infof("New LB configs must be stable for %v before they are added to the provider", duration)
+		stabilizationPeriod = duration
+	}
+
+	exposeConfig = os.Getenv("LB_EXPOSE_CONFIG") == "true"
+	apiToken = os.Getenv("LB_API_TOKEN")
+	if value := os.Getenv("LB_LIVENESS_TIMEOUT"); len(value) != 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= versionWaitTimeout {
+			logrus.Fatalf("Invalid LB_LIVENESS_TIMEOUT value %q, expected a duration longer than %v", value, versionWaitTimeout)
+		}
+		livenessTimeout = timeout
+	}
+	if value := os.Getenv("LB_READY_SYNC_INTERVALS"); len(value) != 0 {
+		intervals, err := strconv.Atoi(value)
+		if err != nil || intervals < 1 {
+			logrus.Fatalf("Invalid LB_READY_SYNC_INTERVALS value %q, expected a positive number of intervals", value)
+		}
+		readySyncIntervals = intervals
+	}
+
+	if value := os.Getenv("LB_BACKOFF_MAX"); len(value) != 0 {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < backoffBase {
+			logrus.Fatalf("Invalid LB_BACKOFF_MAX value %q, expected a duration of at least %v", value, backoffBase)
+		}
+		backoffMax = duration
+	}
+	if value := os.Getenv("LB_CIRCUIT_BREAKER_THRESHOLD"); len(value) != 0 {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 1 {
+			logrus.Fatalf("Invalid LB_CIRCUIT_BREAKER_THRESHOLD value %q, expected a positive number of failed reconciles", value)
+		}
+		circuitBreakerThreshold = threshold
+	}
+
+	readConcurrency = getConcurrency("LB_READ_CONCURRENCY", readConcurrency)
+	writeConcurrency = getConcurrency("LB_WRITE_CONCURRENCY", writeConcurrency)
+
+	names := getProviderNames()
+	if len(names) == 0 {
+		logrus.Fatalf("No provider specified, available providers: %v", providers.ListProviders())
+	}
+	for _, name := range names {
+		provider, err := providers.GetProvider(name)
+		if err != nil {
+			logrus.Fatalf("Failed to configure provider: %v", err)
+		}
+		controllers = append(controllers, newProviderController(provider, len(names) > 1))
+	}
+	m.Providers = make(map[string]bool, len(names))
+	for _, name := range names {
+		m.Providers[name] = true
+	}
+}
+
+// setReloadableEnv applies the settings that a reload can change without
+// a restart, apart from the provider settings.
+func setReloadableEnv() error {
+	interval := time.Second
+	if value := os.Getenv("LB_POLL_INTERVAL"); len(value) != 0 {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("Invalid LB_POLL_INTERVAL value %q, expected a duration such as 1s", value)
+		}
+	}
+
+	managedServices, err := getManagedServices()
+	if err != nil {
+		return fmt.Errorf("Failed to read the list of managed services: %v", err)
+	}
+	var managed map[string]bool
+	if len(managedServices) != 0 {
+		logrus.Infof("Managing only the explicitly listed services: %v", managedServices)
+		managed = make(map[string]bool, len(managedServices))
+		for _, name := range managedServices {
+			managed[name] = true
+		}
+	}
+
+	pollInterval = interval
+	m.ManagedServices = managed
+	return nil
+}
+
+// getProviderNames returns the unique provider names given by the -provider flag.
+func getProviderNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(*providerName, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// getenvWithAlias returns the value of env, or else of its alias, and the
+// name of the variable it was read from.
+func getenvWithAlias(env string, alias string) (string, string) {
+	if value := os.Getenv(env); len(value) != 0 {
+		return value, env
+	}
+	return os.Getenv(alias), alias
+}
+
+func getConcurrency(env string, defaultValue int) int {
+	value := os.Getenv(env)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		logrus.Fatalf("Invalid %s value %q, expected a positive number of workers", env, value)
+	}
+	return concurrency
+}
+
+// defaultOwnerID returns the owner ID used when LB_OWNER_ID is not set.
+// It is the owner ID of the own service, see serviceOwnerID, so that a
+// replacement container or a new leader takes over the resources left
+// in place. Sources that do not know their own service fall back to
+// "<hostname>_<environment UUID>", except with leader election, where
+// all replicas must share the owner ID.
+func defaultOwnerID(hostname string, metadataSource metadata.Source, environmentUUID string, elected bool) (string, error) {
+	id, err := serviceOwnerID(metadataSource, environmentUUID)
+	if err == nil {
+		return id, nil
+	}
+	if elected {
+		return "", err
+	}
+	logrus.Warnf("Using the hostname in the owner ID, a replacement instance will not take over the provider resources unless LB_OWNER_ID is set: %v", err)
+	return hostname + "_" + environmentUUID, nil
+}
+
+// serviceOwnerID returns the owner ID shared by the containers of the
+// service this instance runs in, "<service>.<stack>_<environment UUID>".
+func serviceOwnerID(metadataSource metadata.Source, environmentUUID string) (string, error) {
+	if metadataSource == nil {
+		return "", fmt.Errorf("the source does not know its own service")
+	}
+	service, err := metadataSource.GetSelfService()
+	if err != nil {
+		return "", err
+	}
+	if len(service.Name) == 0 || len(service.StackName) == 0 {
+		return "", fmt.Errorf("the own service has no name")
+	}
+	return service.Name + "." + service.StackName + "_" + environmentUUID, nil
+}
+
+// getManagedServices returns the "stack/service" names listed in
+// LB_MANAGED_SERVICES (comma separated) and LB_MANAGED_SERVICES_FILE
+// (one per line, '#' starts a comment).
+func getManagedServices() ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("LB_MANAGED_SERVICES"), ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+
+	if path := os.Getenv("LB_MANAGED_SERVICES_FILE"); len(path) != 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			names = append(names, strings.TrimSpace(line))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var managed []string
+	for _, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		if parts := strings.Split(name, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid service name %q, expected stack/service", name)
+		}
+		managed = append(managed, name)
+	}
+	return managed, nil
+}
+
+// watchResult is the outcome of a source.Watch call made by watchVersion.
+type watchResult struct {
+	version string
+	err     error
+}
+
+// watchVersion watches the version of the source in the background, so
+// that sync requests and reloads do not wait for the long poll. When the
+// source returns early without a change the result is held back until
+// interval has elapsed, falling back to polling.
+func watchVersion(source sources.Source, version string, interval time.Duration) <-chan watchResult {
+	result := make(chan watchResult, 1)
+	go func() {
+		started := time.Now()
+		newVersion, err := source.Watch(version, versionWaitTimeout)
+		if err != nil || newVersion == version {
+			if elapsed := time.Since(started); elapsed < interval {
+				time.Sleep(interval - elapsed)
+			}
+		}
+		result <- watchResult{version: newVersion, err: err}
+	}()
+	return result
 }
 
 func main() {
 	logrus.Infof("Starting Rancher External LoadBalancer service")
 	setEnv()
-	logrus.Infof("Powered by %s", provider.GetName())
+	for _, c := range controllers {
+		logrus.Infof("Powered by %s", c.provider.GetName())
+		go c.run()
+	}
+	logEffectiveConfig()
 
 	go startHealthcheck()
+	go handleSignals()
 
 	version := "init"
 	lastUpdated := time.Now()
+	var watch <-chan watchResult
 	for {
-		newVersion, err := m.GetVersion()
+		if watch == nil {
+			watch = watchVersion(source, version, pollInterval)
+		}
 		update := false
 
-		if err != nil {
-			logrus.Errorf("Error reading metadata version: %v", err)
-		} else if version != newVersion {
-			logrus.Debugf("Metadata version has been changed. Old version: %s. New version: %s.", version, newVersion)
-			version = newVersion
-			update = true
-		} else {
-			//logrus.Debugf("No changes in metadata version: %s", newVersion)
-			if time.Since(lastUpdated).Minutes() >= forceUpdateInterval {
-				logrus.Debugf("Executing force update as metadata version hasn't been changed in: %v minutes", forceUpdateInterval)
+		select {
+		case result := <-watch:
+			watch = nil
+			if result.err != nil {
+				logrus.Errorf("Error reading metadata version: %v", result.err)
+			} else if version != result.version {
+				logrus.Debugf("Metadata version has been changed. Old version: %s. New version: %s.", version, result.version)
+				version = result.version
 				update = true
+			} else {
+				//logrus.Debugf("No changes in metadata version: %s", result.version)
+				if time.Since(lastUpdated).Minutes() >= forceUpdateInterval {
+					logrus.Debugf("Executing force update as metadata version hasn't been changed in: %v minutes", forceUpdateInterval)
+					update = true
+				}
 			}
+		case <-reloads:
+			reload()
+			update = true
+		case <-syncRequests:
+			logrus.Info("Executing update requested through the API")
+			update = true
+		}
+
+		if !update && stabilizationDue() {
+			logrus.Debugf("Executing update for LB configs that finished stabilizing")
+			update = true
+		}
+
+		if !update && removalDue() {
+			logrus.Debugf("Executing update for LB configs whose removal grace period ended")
+			update = true
+		}
+
+		if configFileChanged() {
+			logrus.Infof("Config file %s changed", *configFile)
+			requestReload()
+		}
+		select {
+		case <-reloads:
+			reload()
+			update = true
+		default:
+		}
+		select {
+		case <-syncRequests:
+			logrus.Info("Executing update requested through the API")
+			update = true
+		default:
+		}
+
+		if election.update() {
+			update = true
+		} else if update && !election.isLeader() {
+			// standing by, the leader reconciles
+			update = false
 		}
 
 		if update {
 			// get records from metadata
 
-			metadataLBConfigs, err := m.GetMetadataLBConfigs(lbEndpointServiceLabel, targetRancherSuffix)
+			pollStarted := time.Now()
+			metadataLBConfigs, err := source.GetLBConfigs(lbEndpointServiceLabel, targetRancherSuffix)
+			metadataPollDuration.Observe(time.Since(pollStarted).Seconds())
 			if err != nil {
-				logrus.Errorf("Error reading metadata lb entries: %v", err)
+				// an incomplete read would remove the LBs of the missing
+				// services, leave the providers alone until the next
+				// iteration reads them again
+				logrus.Errorf("Error reading metadata lb entries, skipping this update: %v", err)
+				lastUpdated = time.Time{}
+				heartbeat()
+				continue
 			}
+			labelErrorCount := 0
+			sourceLabelErrors := source.GetLabelErrors()
+			for _, errs := range sourceLabelErrors {
+				labelErrorCount += len(errs)
+			}
+			labelErrors.Set(float64(labelErrorCount))
+			recordMetadataState(metadataLBConfigs, sourceLabelErrors)
 			logrus.Debugf("LB configs from metadata: %v", metadataLBConfigs)
 
-			/*update provider*/
+			/*update providers*/
 
-			err = UpdateProviderLBConfigs(metadataLBConfigs)
-			if err != nil {
-				logrus.Errorf("Error reading provider lb entries: %v", err)
+			for _, c := range controllers {
+				c.sync(metadataLBConfigs)
 			}
 			lastUpdated = time.Now()
 		}
+		heartbeat()
+	}
+}
 
-		time.Sleep(time.Duration(poll) * time.Millisecond)
+func removalDue() bool {
+	for _, c := range controllers {
+		if c.collector.due() {
+			return true
+		}
+	}
+	return false
+}
+
+func stabilizationDue() bool {
+	for _, c := range controllers {
+		if c.stabilizer.due() {
+			return true
+		}
 	}
+	return false
 }
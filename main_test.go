@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/rancher/external-lb/sources"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func overrideEnv(key string, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestGetManagedServices(t *testing.T) {
+	file, err := ioutil.TempFile("", "managed-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# the frontends\napp/web\n\n  other/web  # the old one\n")
+	file.Close()
+
+	tests := []struct {
+		env      string
+		file     string
+		expected []string
+	}{
+		{"", "", nil},
+		{"app/web", "", []string{"app/web"}},
+		{" app/web , app/api,", "", []string{"app/web", "app/api"}},
+		{"", file.Name(), []string{"app/web", "other/web"}},
+		{"app/api", file.Name(), []string{"app/api", "app/web", "other/web"}},
+	}
+	for _, test := range tests {
+		restoreList := overrideEnv("LB_MANAGED_SERVICES", test.env)
+		restoreFile := overrideEnv("LB_MANAGED_SERVICES_FILE", test.file)
+		managed, err := getManagedServices()
+		restoreList()
+		restoreFile()
+		if err != nil {
+			t.Errorf("%q, %q: unexpected error: %v", test.env, test.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(managed, test.expected) {
+			t.Errorf("%q, %q: got %v, expected %v", test.env, test.file, managed, test.expected)
+		}
+	}
+}
+
+func TestGetManagedServicesInvalid(t *testing.T) {
+	for _, value := range []string{"web", "app/", "/web", "app/web/extra"} {
+		restore := overrideEnv("LB_MANAGED_SERVICES", value)
+		if _, err := getManagedServices(); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+		restore()
+	}
+
+	restoreList := overrideEnv("LB_MANAGED_SERVICES", "")
+	defer restoreList()
+	restoreFile := overrideEnv("LB_MANAGED_SERVICES_FILE", "/nonexistent/managed-services")
+	defer restoreFile()
+	if _, err := getManagedServices(); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestGetenvWithAlias(t *testing.T) {
+	defer overrideEnv("LB_PROVIDER_RATE_LIMIT", "")()
+	defer overrideEnv("PROVIDER_RATE_LIMIT_QPS", "")()
+
+	if value, env := getenvWithAlias("LB_PROVIDER_RATE_LIMIT", "PROVIDER_RATE_LIMIT_QPS"); value != "" || env != "PROVIDER_RATE_LIMIT_QPS" {
+		t.Errorf("got %q from %s with neither set", value, env)
+	}
+	os.Setenv("PROVIDER_RATE_LIMIT_QPS", "5")
+	if value, env := getenvWithAlias("LB_PROVIDER_RATE_LIMIT", "PROVIDER_RATE_LIMIT_QPS"); value != "5" || env != "PROVIDER_RATE_LIMIT_QPS" {
+		t.Errorf("got %q from %s, expected the alias", value, env)
+	}
+	os.Setenv("LB_PROVIDER_RATE_LIMIT", "10")
+	if value, env := getenvWithAlias("LB_PROVIDER_RATE_LIMIT", "PROVIDER_RATE_LIMIT_QPS"); value != "10" || env != "LB_PROVIDER_RATE_LIMIT" {
+		t.Errorf("got %q from %s, expected the variable to take precedence", value, env)
+	}
+}
+
+// watchSource is a sources.Source whose Watch returns the version sent on
+// versions.
+type watchSource struct {
+	sources.Source
+	versions chan string
+}
+
+func (s *watchSource) Watch(version string, maxWait time.Duration) (string, error) {
+	return <-s.versions, nil
+}
+
+func TestWatchVersionDoesNotBlock(t *testing.T) {
+	s := &watchSource{versions: make(chan string)}
+	watch := watchVersion(s, "1", 0)
+	select {
+	case result := <-watch:
+		t.Fatalf("got %v before the watch returned", result)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.versions <- "2"
+	select {
+	case result := <-watch:
+		if result.version != "2" || result.err != nil {
+			t.Errorf("got %v, expected version 2", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no result after the watch returned")
+	}
+}
+
+func TestWatchVersionHoldsBackEarlyUnchangedResults(t *testing.T) {
+	s := &watchSource{versions: make(chan string, 2)}
+	s.versions <- "1"
+	started := time.Now()
+	if result := <-watchVersion(s, "1", 50*time.Millisecond); result.version != "1" {
+		t.Errorf("got %v, expected version 1", result)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("an unchanged version was returned after %v, expected a poll interval", elapsed)
+	}
+
+	s.versions <- "2"
+	started = time.Now()
+	<-watchVersion(s, "1", time.Minute)
+	if elapsed := time.Since(started); elapsed >= time.Minute/2 {
+		t.Errorf("a changed version was held back for %v", elapsed)
+	}
+}
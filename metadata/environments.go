@@ -0,0 +1,172 @@
+package metadata
+
+import (
+	"fmt"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiEnvironmentSource is a Source aggregating the services of several
+// environments. MetadataClient adds the environment of a service to its
+// target pool names, so that equally named services do not collide.
+type MultiEnvironmentSource interface {
+	Source
+	// GetServiceEnvironment returns the name of the environment a service
+	// returned by the last GetServices call belongs to.
+	GetServiceEnvironment(service metadata.Service) string
+}
+
+// environmentsSource reads from the metadata servers of several
+// environments. The first one is the environment of this instance, which
+// provides the own stack, container and service.
+type environmentsSource struct {
+	sources []Source
+	names   []string
+
+	mu       sync.Mutex
+	services map[string]string
+}
+
+type versionResult struct {
+	index   int
+	version string
+	err     error
+}
+
+// NewEnvironmentsSource connects to the metadata servers at urls, the
+// first of them serving the environment of this instance.
+func NewEnvironmentsSource(urls []string) (MultiEnvironmentSource, error) {
+	s := &environmentsSource{}
+	poolNames := make(map[string]string, len(urls))
+	for _, url := range urls {
+		source, err := NewRancherSource(url)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", url, err)
+		}
+		stack, err := getSelfStack(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", url, err)
+		}
+		poolName := environmentPoolName(stack.EnvironmentName)
+		if other, ok := poolNames[poolName]; ok {
+			return nil, fmt.Errorf("The environments of %s and %s are both named %q in target pool names", other, url, poolName)
+		}
+		poolNames[poolName] = url
+		s.sources = append(s.sources, source)
+		s.names = append(s.names, stack.EnvironmentName)
+	}
+	return s, nil
+}
+
+// environmentPoolName returns the name of an environment as used in
+// target pool names: lower case, with anything but letters, digits and
+// dashes replaced by dashes.
+func environmentPoolName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+}
+
+// GetVersion returns the versions of all environments, comma separated.
+func (s *environmentsSource) GetVersion() (string, error) {
+	versions := make([]string, len(s.sources))
+	for i, source := range s.sources {
+		version, err := source.GetVersion()
+		if err != nil {
+			return "", fmt.Errorf("environment %s: %v", s.names[i], err)
+		}
+		versions[i] = version
+	}
+	return strings.Join(versions, ","), nil
+}
+
+// WaitForVersionChange waits on all environments at once, and returns as
+// soon as the version of one of them changed.
+func (s *environmentsSource) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	versions := strings.Split(version, ",")
+	if len(versions) != len(s.sources) {
+		return s.GetVersion()
+	}
+	// buffered, so that the waits still running when one returns a change
+	// do not block once they are done
+	results := make(chan versionResult, len(s.sources))
+	for i, source := range s.sources {
+		go func(i int, source Source) {
+			version, err := source.WaitForVersionChange(versions[i], maxWait)
+			results <- versionResult{index: i, version: version, err: err}
+		}(i, source)
+	}
+	for range s.sources {
+		result := <-results
+		if result.err != nil {
+			return "", fmt.Errorf("environment %s: %v", s.names[result.index], result.err)
+		}
+		if result.version != versions[result.index] {
+			versions[result.index] = result.version
+			break
+		}
+	}
+	return strings.Join(versions, ","), nil
+}
+
+// GetServices returns the services of all environments. It fails when one
+// of them cannot be read: leaving its services out would remove their LBs,
+// so no update is made until all environments can be read.
+func (s *environmentsSource) GetServices() ([]metadata.Service, error) {
+	var all []metadata.Service
+	environments := make(map[string]string)
+	for i, source := range s.sources {
+		services, err := source.GetServices()
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: %v", s.names[i], err)
+		}
+		for _, service := range services {
+			environments[service.UUID] = s.names[i]
+		}
+		all = append(all, services...)
+	}
+	s.mu.Lock()
+	s.services = environments
+	s.mu.Unlock()
+	return all, nil
+}
+
+func (s *environmentsSource) GetServiceEnvironment(service metadata.Service) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.services[service.UUID]
+}
+
+// GetHosts returns the hosts of all environments, and fails like
+// GetServices when one of them cannot be read.
+func (s *environmentsSource) GetHosts() ([]metadata.Host, error) {
+	var all []metadata.Host
+	for i, source := range s.sources {
+		hosts, err := source.GetHosts()
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: %v", s.names[i], err)
+		}
+		all = append(all, hosts...)
+	}
+	return all, nil
+}
+
+func (s *environmentsSource) GetSelfStack() (metadata.Stack, error) {
+	return s.sources[0].GetSelfStack()
+}
+
+func (s *environmentsSource) GetSelfContainer() (metadata.Container, error) {
+	return s.sources[0].GetSelfContainer()
+}
+
+func (s *environmentsSource) GetSelfService() (metadata.Service, error) {
+	return s.sources[0].GetSelfService()
+}
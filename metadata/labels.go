@@ -0,0 +1,355 @@
+package metadata
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"strconv"
+	"strings"
+)
+
+const (
+	// labelPrefix is shared by all service labels read by external-lb
+	labelPrefix = "io.rancher.service.external_lb_"
+
+	// targetIPSourceLabel overrides the target IP source for a single service
+	targetIPSourceLabel = labelPrefix + "target_ip_source"
+	// maxConnLabel limits the concurrent connections to each target of a service
+	maxConnLabel = labelPrefix + "max_conn"
+	// the health check labels override the provider's target health check
+	healthCheckPathLabel               = labelPrefix + "healthcheck_path"
+	healthCheckIntervalLabel           = labelPrefix + "healthcheck_interval"
+	healthCheckHealthyThresholdLabel   = labelPrefix + "healthcheck_healthy_threshold"
+	healthCheckUnhealthyThresholdLabel = labelPrefix + "healthcheck_unhealthy_threshold"
+	// trafficLabel puts a service on standby while another service with the
+	// same endpoint is active
+	trafficLabel = labelPrefix + "traffic"
+	// hostLabelLabel restricts the targets to containers on hosts carrying
+	// the given key=value host label
+	hostLabelLabel = labelPrefix + "host_label"
+	// protectLabel keeps the LB configs of a service from ever being removed
+	protectLabel = labelPrefix + "protect"
+	// providerLabel publishes a service through the given comma separated
+	// providers only
+	providerLabel = labelPrefix + "provider"
+	// portsLabel publishes several container ports, as a comma separated
+	// list of <frontend port>:<container port> pairs
+	portsLabel = labelPrefix + "ports"
+	// protocolLabel sets the protocol of the frontend
+	protocolLabel = labelPrefix + "protocol"
+	// stickinessLabel binds client sessions to a target, cookie or source_ip
+	stickinessLabel = labelPrefix + "stickiness"
+	// stickinessDurationLabel is the lifetime of a binding in seconds
+	stickinessDurationLabel = labelPrefix + "stickiness_duration"
+	// drainTimeoutLabel is the time in seconds removed targets are given to
+	// finish their in-flight connections
+	drainTimeoutLabel = labelPrefix + "drain_timeout"
+	// slowStartLabel is the time in seconds new targets ramp up their traffic
+	slowStartLabel = labelPrefix + "slow_start"
+	// proxyProtocolLabel sends the client address to the targets with the
+	// PROXY protocol v2
+	proxyProtocolLabel = labelPrefix + "proxy_protocol"
+	// attributeLabelPrefix prefixes the labels passing provider specific
+	// attributes, the rest of the label is the attribute name
+	attributeLabelPrefix = labelPrefix + "attr."
+)
+
+// LabelError describes an invalid external LB label on a service.
+type LabelError struct {
+	Service string
+	Label   string
+	Value   string
+	Reason  string
+}
+
+func (e LabelError) Error() string {
+	return fmt.Sprintf("invalid value %q for label %s on service %s: %s", e.Value, e.Label, e.Service, e.Reason)
+}
+
+// serviceLabels holds the validated external LB labels of a service.
+// Optional labels with invalid values fall back to their defaults.
+type serviceLabels struct {
+	endpoint       string
+	targetIPSource string
+	maxConn        int
+	healthCheck    model.HealthCheck
+	stickiness     model.Stickiness
+	drainTimeout   int
+	slowStart      int
+	proxyProtocol  bool
+	attributes     map[string]string
+	protocol       string
+	standby        bool
+	ports          []portMapping
+	hostLabelKey   string
+	hostLabelValue string
+	protect        bool
+	providers      []string
+}
+
+// portMapping maps a frontend port to the container port it forwards to.
+type portMapping struct {
+	frontendPort string
+	targetPort   string
+}
+
+// labelParsers validate and apply each known optional label.
+var labelParsers = map[string]func(m *MetadataClient, value string, labels *serviceLabels) string{
+	targetIPSourceLabel:                parseTargetIPSource,
+	maxConnLabel:                       parseMaxConn,
+	healthCheckPathLabel:               parseHealthCheckPath,
+	healthCheckIntervalLabel:           parseHealthCheckInterval,
+	healthCheckHealthyThresholdLabel:   parseHealthCheckHealthyThreshold,
+	healthCheckUnhealthyThresholdLabel: parseHealthCheckUnhealthyThreshold,
+	trafficLabel:                       parseTraffic,
+	portsLabel:                         parsePorts,
+	hostLabelLabel:                     parseHostLabel,
+	protectLabel:                       parseProtect,
+	providerLabel:                      parseProviders,
+	protocolLabel:                      parseProtocol,
+	stickinessLabel:                    parseStickiness,
+	stickinessDurationLabel:            parseStickinessDuration,
+	drainTimeoutLabel:                  parseDrainTimeout,
+	slowStartLabel:                     parseSlowStart,
+	proxyProtocolLabel:                 parseProxyProtocol,
+}
+
+// parseServiceLabels validates the external LB labels of a service.
+// The returned errors for optional labels are not fatal; the service is
+// only skipped if its endpoint label is unusable.
+func (m *MetadataClient) parseServiceLabels(service metadata.Service, lbEndpointServiceLabel string) (serviceLabels, []LabelError) {
+	serviceName := service.StackName + "/" + service.Name
+	labels := serviceLabels{
+		endpoint:       strings.TrimSpace(service.Labels[lbEndpointServiceLabel]),
+		targetIPSource: m.TargetIPSource,
+	}
+	if len(labels.targetIPSource) == 0 {
+		labels.targetIPSource = TargetIPSourceHost
+	}
+
+	var errs []LabelError
+	if len(labels.endpoint) == 0 {
+		errs = append(errs, LabelError{serviceName, lbEndpointServiceLabel, service.Labels[lbEndpointServiceLabel], "the LB endpoint must not be empty"})
+	} else if strings.ContainsAny(labels.endpoint, " \t\n") {
+		errs = append(errs, LabelError{serviceName, lbEndpointServiceLabel, labels.endpoint, "the LB endpoint must not contain whitespace"})
+		labels.endpoint = ""
+	}
+
+	for label, value := range service.Labels {
+		if label == lbEndpointServiceLabel || !strings.HasPrefix(label, labelPrefix) {
+			continue
+		}
+		if strings.HasPrefix(label, attributeLabelPrefix) {
+			if reason := labels.parseAttribute(strings.TrimPrefix(label, attributeLabelPrefix), value); reason != "" {
+				errs = append(errs, LabelError{serviceName, label, value, reason})
+			}
+			continue
+		}
+		parse, ok := labelParsers[label]
+		if !ok {
+			errs = append(errs, LabelError{serviceName, label, value, "unknown external LB label"})
+			continue
+		}
+		if reason := parse(m, value, &labels); reason != "" {
+			errs = append(errs, LabelError{serviceName, label, value, reason})
+		}
+	}
+	if labels.stickiness.Duration != 0 && len(labels.stickiness.Type) == 0 {
+		errs = append(errs, LabelError{serviceName, stickinessDurationLabel, service.Labels[stickinessDurationLabel], "requires the " + stickinessLabel + " label, sessions will not be sticky"})
+		labels.stickiness.Duration = 0
+	}
+	return labels, errs
+}
+
+func parseTargetIPSource(m *MetadataClient, value string, labels *serviceLabels) string {
+	if !IsValidTargetIPSource(value) {
+		return fmt.Sprintf("expected %q, %q, %q or %q, using the default target IP source", TargetIPSourceHost, TargetIPSourceContainer, TargetIPSourceAgent, TargetIPSourceHostLabel)
+	}
+	labels.targetIPSource = value
+	return ""
+}
+
+func parseMaxConn(m *MetadataClient, value string, labels *serviceLabels) string {
+	maxConn, err := strconv.Atoi(value)
+	if err != nil || maxConn < 0 {
+		return "expected a non-negative number, connections will not be limited"
+	}
+	labels.maxConn = maxConn
+	return ""
+}
+
+func parseHealthCheckPath(m *MetadataClient, value string, labels *serviceLabels) string {
+	if !strings.HasPrefix(value, "/") || strings.ContainsAny(value, " \t\n") {
+		return "expected an absolute path without whitespace, using the default health check"
+	}
+	labels.healthCheck.Path = value
+	return ""
+}
+
+func parseHealthCheckInterval(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.healthCheck.Interval)
+}
+
+func parseHealthCheckHealthyThreshold(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.healthCheck.HealthyThreshold)
+}
+
+func parseHealthCheckUnhealthyThreshold(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.healthCheck.UnhealthyThreshold)
+}
+
+func parsePorts(m *MetadataClient, value string, labels *serviceLabels) string {
+	const reason = "expected a comma separated list of <frontend port>:<container port>, only the first published port is used"
+	var ports []portMapping
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 || !isPort(parts[0]) || !isPort(parts[1]) {
+			return reason
+		}
+		if seen[parts[0]] {
+			return fmt.Sprintf("frontend port %s is listed twice, only the first published port is used", parts[0])
+		}
+		seen[parts[0]] = true
+		ports = append(ports, portMapping{frontendPort: parts[0], targetPort: parts[1]})
+	}
+	labels.ports = ports
+	return ""
+}
+
+func parseProtect(m *MetadataClient, value string, labels *serviceLabels) string {
+	protect, err := strconv.ParseBool(value)
+	if err != nil {
+		return "expected true or false, the LB config is not protected"
+	}
+	labels.protect = protect
+	return ""
+}
+
+func parseProviders(m *MetadataClient, value string, labels *serviceLabels) string {
+	var providers, unknown []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if !m.Providers[name] {
+			unknown = append(unknown, name)
+			continue
+		}
+		providers = append(providers, name)
+	}
+	labels.providers = providers
+	switch {
+	case len(unknown) != 0 && len(providers) == 0:
+		return fmt.Sprintf("the providers %v are not configured, publishing through all providers", unknown)
+	case len(unknown) != 0:
+		return fmt.Sprintf("the providers %v are not configured, ignoring them", unknown)
+	case len(providers) == 0:
+		return "expected a comma separated list of provider names, publishing through all providers"
+	}
+	return ""
+}
+
+func parseHostLabel(m *MetadataClient, value string, labels *serviceLabels) string {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return "expected <key>=<value>, containers on all hosts are registered"
+	}
+	labels.hostLabelKey = value[:i]
+	labels.hostLabelValue = value[i+1:]
+	return ""
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port < 65536 && strconv.Itoa(port) == s
+}
+
+func parseTraffic(m *MetadataClient, value string, labels *serviceLabels) string {
+	switch value {
+	case "active":
+		labels.standby = false
+	case "standby":
+		labels.standby = true
+	default:
+		return "expected \"active\" or \"standby\", the service is active"
+	}
+	return ""
+}
+
+func parseProtocol(m *MetadataClient, value string, labels *serviceLabels) string {
+	protocol := strings.ToLower(value)
+	switch protocol {
+	case model.ProtocolHTTP, model.ProtocolHTTPS, model.ProtocolTCP, model.ProtocolUDP, model.ProtocolTLS:
+		labels.protocol = protocol
+		return ""
+	}
+	return "expected http, https, tcp, udp or tls, using the provider default protocol"
+}
+
+func parseStickiness(m *MetadataClient, value string, labels *serviceLabels) string {
+	if value != model.StickinessCookie && value != model.StickinessSourceIP {
+		return fmt.Sprintf("expected %q or %q, sessions will not be sticky", model.StickinessCookie, model.StickinessSourceIP)
+	}
+	labels.stickiness.Type = value
+	return ""
+}
+
+func parseStickinessDuration(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.stickiness.Duration)
+}
+
+func parseDrainTimeout(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.drainTimeout)
+}
+
+func parseSlowStart(m *MetadataClient, value string, labels *serviceLabels) string {
+	return parsePositive(value, &labels.slowStart)
+}
+
+func parseProxyProtocol(m *MetadataClient, value string, labels *serviceLabels) string {
+	proxyProtocol, err := strconv.ParseBool(value)
+	if err != nil {
+		return "expected true or false, the PROXY protocol is not used"
+	}
+	labels.proxyProtocol = proxyProtocol
+	return ""
+}
+
+func (labels *serviceLabels) parseAttribute(name string, value string) string {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+		return "expected an attribute name without whitespace after " + attributeLabelPrefix + ", the attribute is not set"
+	}
+	if labels.attributes == nil {
+		labels.attributes = make(map[string]string)
+	}
+	labels.attributes[name] = value
+	return ""
+}
+
+// parsePositive parses the value of a positive numeric label into n.
+func parsePositive(value string, n *int) string {
+	i, err := strconv.Atoi(value)
+	if err != nil || i <= 0 {
+		return "expected a positive number, using the provider default"
+	}
+	*n = i
+	return ""
+}
+
+// IsValidTargetIPSource reports whether source names a supported target IP source.
+func IsValidTargetIPSource(source string) bool {
+	switch source {
+	case TargetIPSourceHost, TargetIPSourceContainer, TargetIPSourceAgent, TargetIPSourceHostLabel:
+		return true
+	}
+	return false
+}
+
+func logLabelErrors(errs []LabelError) {
+	for _, err := range errs {
+		logrus.Errorf("Label validation failed: %v", err)
+	}
+}
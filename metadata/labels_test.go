@@ -0,0 +1,174 @@
+package metadata
+
+import (
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func labelTestService(labels map[string]string) metadata.Service {
+	service := metadata.Service{Name: "web", StackName: "app", Labels: map[string]string{testEndpointLabel: "web.example.com"}}
+	for label, value := range labels {
+		service.Labels[label] = value
+	}
+	return service
+}
+
+func TestInvalidLabels(t *testing.T) {
+	tests := []struct {
+		label string
+		value string
+	}{
+		{targetIPSourceLabel, "overlay"},
+		{maxConnLabel, "many"},
+		{maxConnLabel, "-1"},
+		{healthCheckPathLabel, "healthz"},
+		{healthCheckPathLabel, "/health check"},
+		{healthCheckIntervalLabel, "5s"},
+		{healthCheckHealthyThresholdLabel, "0"},
+		{healthCheckUnhealthyThresholdLabel, "-2"},
+		{trafficLabel, "passive"},
+		{portsLabel, "80"},
+		{portsLabel, "80:http"},
+		{portsLabel, "80:8080,80:8081"},
+		{portsLabel, "0:8080"},
+		{portsLabel, "080:8080"},
+		{hostLabelLabel, "zone"},
+		{hostLabelLabel, "=eu"},
+		{protectLabel, "yes please"},
+		{providerLabel, "unknown"},
+		{providerLabel, " , "},
+		{protocolLabel, "ftp"},
+		{stickinessLabel, "session"},
+		{stickinessDurationLabel, "forever"},
+		{drainTimeoutLabel, "0"},
+		{slowStartLabel, "soon"},
+		{proxyProtocolLabel, "v2"},
+		{attributeLabelPrefix, "value"},
+		{attributeLabelPrefix + "idle timeout", "60"},
+		{labelPrefix + "max_connections", "100"},
+	}
+	m := &MetadataClient{Providers: map[string]bool{"route53": true}}
+	for _, test := range tests {
+		service := labelTestService(map[string]string{test.label: test.value})
+		// the duration is only checked for being positive with a type
+		if test.label == stickinessDurationLabel {
+			service.Labels[stickinessLabel] = "cookie"
+		}
+		labels, errs := m.parseServiceLabels(service, testEndpointLabel)
+		if len(errs) != 1 {
+			t.Errorf("%s=%q: got errors %v, expected one", test.label, test.value, errs)
+			continue
+		}
+		if errs[0].Label != test.label || errs[0].Value != test.value || errs[0].Service != "app/web" {
+			t.Errorf("%s=%q: error names the wrong label: %+v", test.label, test.value, errs[0])
+		}
+		if len(errs[0].Reason) == 0 {
+			t.Errorf("%s=%q: error gives no reason", test.label, test.value)
+		}
+		// the service is kept with the default of the invalid label
+		if labels.endpoint != "web.example.com" {
+			t.Errorf("%s=%q: endpoint is %q", test.label, test.value, labels.endpoint)
+		}
+		defaults, _ := m.parseServiceLabels(labelTestService(nil), testEndpointLabel)
+		if test.label == stickinessDurationLabel {
+			defaults.stickiness.Type = "cookie"
+		}
+		if !reflect.DeepEqual(labels, defaults) {
+			t.Errorf("%s=%q: invalid label changed the labels to %+v", test.label, test.value, labels)
+		}
+	}
+}
+
+func TestInvalidEndpointLabel(t *testing.T) {
+	m := &MetadataClient{}
+	for _, value := range []string{"", "  ", "web example.com", "web.example.com\tapi.example.com"} {
+		service := labelTestService(map[string]string{testEndpointLabel: value})
+		labels, errs := m.parseServiceLabels(service, testEndpointLabel)
+		if len(errs) != 1 || errs[0].Label != testEndpointLabel {
+			t.Errorf("%q: got errors %v, expected one for the endpoint label", value, errs)
+		}
+		if len(labels.endpoint) != 0 {
+			t.Errorf("%q: the invalid endpoint %q is used", value, labels.endpoint)
+		}
+	}
+}
+
+func TestStickinessDurationWithoutType(t *testing.T) {
+	m := &MetadataClient{}
+	labels, errs := m.parseServiceLabels(labelTestService(map[string]string{stickinessDurationLabel: "300"}), testEndpointLabel)
+	if len(errs) != 1 || errs[0].Label != stickinessDurationLabel || !strings.Contains(errs[0].Reason, stickinessLabel) {
+		t.Errorf("got errors %v, expected one naming the stickiness label", errs)
+	}
+	if labels.stickiness.Duration != 0 {
+		t.Errorf("the duration %d is used without a stickiness type", labels.stickiness.Duration)
+	}
+}
+
+func TestPartlyUnknownProviders(t *testing.T) {
+	m := &MetadataClient{Providers: map[string]bool{"route53": true}}
+	labels, errs := m.parseServiceLabels(labelTestService(map[string]string{providerLabel: "route53,unknown"}), testEndpointLabel)
+	if len(errs) != 1 || !strings.Contains(errs[0].Reason, "unknown") {
+		t.Errorf("got errors %v, expected one naming the unknown provider", errs)
+	}
+	if !reflect.DeepEqual(labels.providers, []string{"route53"}) {
+		t.Errorf("providers are %v, expected the configured one", labels.providers)
+	}
+}
+
+func TestValidLabels(t *testing.T) {
+	m := &MetadataClient{Providers: map[string]bool{"route53": true}}
+	service := labelTestService(map[string]string{
+		targetIPSourceLabel:                   TargetIPSourceContainer,
+		maxConnLabel:                          "100",
+		healthCheckPathLabel:                  "/healthz",
+		healthCheckIntervalLabel:              "10",
+		healthCheckHealthyThresholdLabel:      "2",
+		healthCheckUnhealthyThresholdLabel:    "3",
+		trafficLabel:                          "standby",
+		portsLabel:                            "80:8080, 443:8443",
+		hostLabelLabel:                        "zone=eu",
+		protectLabel:                          "true",
+		providerLabel:                         "route53",
+		protocolLabel:                         "HTTPS",
+		stickinessLabel:                       "cookie",
+		stickinessDurationLabel:               "300",
+		drainTimeoutLabel:                     "30",
+		slowStartLabel:                        "60",
+		proxyProtocolLabel:                    "true",
+		attributeLabelPrefix + "idle_timeout": "60",
+	})
+	labels, errs := m.parseServiceLabels(service, testEndpointLabel)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if labels.targetIPSource != TargetIPSourceContainer || labels.maxConn != 100 || !labels.standby ||
+		labels.healthCheck.Path != "/healthz" || labels.healthCheck.Interval != 10 ||
+		len(labels.ports) != 2 || labels.ports[1].targetPort != "8443" ||
+		labels.hostLabelKey != "zone" || labels.hostLabelValue != "eu" || !labels.protect ||
+		labels.protocol != "https" || labels.stickiness.Duration != 300 || labels.drainTimeout != 30 ||
+		labels.slowStart != 60 || !labels.proxyProtocol || labels.attributes["idle_timeout"] != "60" {
+		t.Errorf("labels were not applied: %+v", labels)
+	}
+}
+
+func TestLabelErrorsAreReported(t *testing.T) {
+	web := labelTestService(map[string]string{maxConnLabel: "many", protocolLabel: "ftp"})
+	api := testService("app", "api", "api.example.com", "10.0.0.1:81:8080/tcp")
+	m := newTestClient(&fakeSource{services: []metadata.Service{web, api}})
+
+	configs, err := m.GetMetadataLBConfigs(testEndpointLabel, "rancher.internal")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := configs["web.example.com"]; !ok {
+		t.Errorf("the service with invalid optional labels was skipped")
+	}
+	if errs := m.LabelErrors["app/web"]; len(errs) != 2 {
+		t.Errorf("got label errors %v for app/web, expected two", errs)
+	}
+	if errs, ok := m.LabelErrors["app/api"]; ok {
+		t.Errorf("got label errors %v for a valid service", errs)
+	}
+}
@@ -5,20 +5,112 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"net/url"
 	"strings"
+	"text/template"
 	"time"
 )
 
 const (
-	metadataUrl = "http://rancher-metadata/2015-12-19"
+	// DefaultMetadataURL is the metadata server of the own environment
+	DefaultMetadataURL = "http://rancher-metadata/2015-12-19"
+
+	// TargetIPSourceHost registers the host IP and public port of a container
+	TargetIPSourceHost = "host"
+	// TargetIPSourceContainer registers the container IP and private port
+	TargetIPSourceContainer = "container"
+	// TargetIPSourceAgent registers the agent IP of the host and the public port
+	TargetIPSourceAgent = "agent"
+	// TargetIPSourceHostLabel registers the IP given by a host label and the public port
+	TargetIPSourceHostLabel = "host_label"
+
+	// DefaultTargetIPHostLabel is the host label read by TargetIPSourceHostLabel
+	DefaultTargetIPHostLabel = "io.rancher.host.external_lb_ip"
 )
 
+// Source is the backend the services, hosts and the own stack and
+// container are read from, in the shape of Rancher metadata. It is the
+// Rancher metadata server by default, see NewRancherSource.
+type Source interface {
+	GetVersion() (string, error)
+	// WaitForVersionChange returns the current version once it differs
+	// from version or maxWait has elapsed. Sources without change
+	// notifications may return at once.
+	WaitForVersionChange(version string, maxWait time.Duration) (string, error)
+	GetServices() ([]metadata.Service, error)
+	GetHosts() ([]metadata.Host, error)
+	GetSelfStack() (metadata.Stack, error)
+	GetSelfContainer() (metadata.Container, error)
+	GetSelfService() (metadata.Service, error)
+}
+
+// rancherSource reads from the Rancher metadata server.
+type rancherSource struct {
+	*metadata.Client
+}
+
+// NewRancherSource connects to the Rancher metadata server at url.
+func NewRancherSource(url string) (Source, error) {
+	m, err := metadata.NewClientAndWait(url)
+	if err != nil {
+		return nil, err
+	}
+	return rancherSource{m}, nil
+}
+
+// WaitForVersionChange long-polls the metadata server until its version
+// differs from version or maxWait has elapsed, and returns the current
+// version. Metadata servers without long-poll support answer immediately.
+func (s rancherSource) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	path := fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d", url.QueryEscape(version), int(maxWait.Seconds()))
+	resp, err := s.SendRequest(path)
+	if err != nil {
+		return "", err
+	}
+	return string(resp), nil
+}
+
 type MetadataClient struct {
-	MetadataClient  *metadata.Client
+	MetadataClient  Source
 	EnvironmentUUID string
+	EnvironmentName string
+	// ManagedServices optionally restricts the services considered to
+	// the given set of "stack/service" names. All services carrying the
+	// endpoint label are managed when it is empty.
+	ManagedServices map[string]bool
+	// TargetIPSource selects the IP registered for each container, one
+	// of the TargetIPSource constants, TargetIPSourceHost by default.
+	TargetIPSource string
+	// TargetIPHostLabel is the host label holding the target IP for
+	// TargetIPSourceHostLabel.
+	TargetIPHostLabel string
+	// Providers holds the names of the configured providers, the only
+	// ones accepted by the provider label.
+	Providers map[string]bool
+	// PoolNameTemplate renders the names prefixing the target pool names
+	// of the services, see ParsePoolNameTemplate. The service name is used
+	// when it is nil.
+	PoolNameTemplate *template.Template
+	// OnlyHealthyTargets skips containers whose health check does not
+	// pass. Containers without a health check are always registered.
+	OnlyHealthyTargets bool
+	// LabelErrors holds the label validation errors of the last
+	// GetMetadataLBConfigs call, keyed by "stack/service".
+	LabelErrors map[string][]LabelError
+	// trafficServices holds the "stack/service" selected for each LB
+	// endpoint by the last GetMetadataLBConfigs call.
+	trafficServices map[string]string
+	// hosts caches the hosts by UUID during a GetMetadataLBConfigs call
+	hosts map[string]metadata.Host
+}
+
+// trafficCandidate is a service claiming an LB endpoint.
+type trafficCandidate struct {
+	service string
+	standby bool
 }
 
-func getEnvironmentUUID(m *metadata.Client) (string, error) {
+func getSelfStack(m Source) (metadata.Stack, error) {
 	timeout := 30 * time.Second
 	var err error
 	var stack metadata.Stack
@@ -28,26 +120,23 @@ func getEnvironmentUUID(m *metadata.Client) (string, error) {
 			logrus.Errorf("Error reading stack info: %v...will retry", err)
 			time.Sleep(i)
 		} else {
-			return stack.EnvironmentUUID, nil
+			return stack, nil
 		}
 	}
-	return "", fmt.Errorf("Error reading stack info: %v", err)
+	return stack, fmt.Errorf("Error reading stack info: %v", err)
 }
 
-func NewMetadataClient() (*MetadataClient, error) {
-	m, err := metadata.NewClientAndWait(metadataUrl)
-	if err != nil {
-		logrus.Fatalf("Failed to configure rancher-metadata: %v", err)
-	}
-
-	envUUID, err := getEnvironmentUUID(m)
+// NewMetadataClient reads the services from source.
+func NewMetadataClient(source Source) (*MetadataClient, error) {
+	stack, err := getSelfStack(source)
 	if err != nil {
 		logrus.Fatalf("Error reading stack metadata info: %v", err)
 	}
 
 	return &MetadataClient{
-		MetadataClient:  m,
-		EnvironmentUUID: envUUID,
+		MetadataClient:  source,
+		EnvironmentUUID: stack.EnvironmentUUID,
+		EnvironmentName: stack.EnvironmentName,
 	}, nil
 }
 
@@ -55,44 +144,171 @@ func (m *MetadataClient) GetVersion() (string, error) {
 	return m.MetadataClient.GetVersion()
 }
 
+// WaitForVersionChange waits for the version of the source to differ from
+// version, for at most maxWait, and returns the current version.
+func (m *MetadataClient) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	return m.MetadataClient.WaitForVersionChange(version, maxWait)
+}
+
 func (m *MetadataClient) GetMetadataLBConfigs(lbEndpointServiceLabel string, targetRancherSuffix string) (map[string]model.LBConfig, error) {
 	lbConfigs := make(map[string]model.LBConfig)
+	labelErrors := make(map[string][]LabelError)
+	defer func() { m.LabelErrors = labelErrors }()
+	selected := make(map[string]trafficCandidate)
+	m.hosts = nil
 
 	services, err := m.MetadataClient.GetServices()
-
 	if err != nil {
-		logrus.Infof("Error reading services %v", err)
-	} else {
-		for _, service := range services {
-			lb_endpoint, ok := service.Labels[lbEndpointServiceLabel]
-			if ok {
+		return nil, fmt.Errorf("Error reading services: %v", err)
+	}
+
+	for _, service := range services {
+		_, ok := service.Labels[lbEndpointServiceLabel]
+		if ok {
+			if !m.isManagedService(service) {
+				logrus.Debugf("Service is not in the list of managed services, will skip it : %s/%s", service.StackName, service.Name)
+				continue
+			}
+			labels, errs := m.parseServiceLabels(service, lbEndpointServiceLabel)
+			if len(errs) != 0 {
+				labelErrors[service.StackName+"/"+service.Name] = errs
+				logLabelErrors(errs)
+			}
+			if len(labels.endpoint) == 0 {
+				logrus.Errorf("LB endpoint label is invalid, will skip this service : %v", service.Name)
+				continue
+			}
+			candidate := trafficCandidate{service: service.StackName + "/" + service.Name, standby: labels.standby}
+			logrus.Debugf("LB label exists for service : %v", service.Name)
+			environment := m.EnvironmentName
+			if environments, ok := m.MetadataClient.(MultiEnvironmentSource); ok {
+				environment = environments.GetServiceEnvironment(service)
+			}
+			// like a failed read, as skipping the service would remove its LB
+			poolName, err := m.servicePoolName(service, environment)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to render the target pool name of service %s/%s: %v", service.StackName, service.Name, err)
+			}
+			for _, frontend := range serviceFrontends(poolName, labels) {
+				lb_endpoint := frontend.endpoint
 				//label exists, configure external LB
-				// Configure this service only if this endpoint is already not used by some other service so far
-				_, ok = lbConfigs[lb_endpoint]
-				if ok {
-					logrus.Errorf("LB Endpoint already used by another service, will skip this service : %v", service.Name)
+				// Configure this service only if this endpoint is already not used by some other service so far,
+				// unless it takes precedence over that service
+				if current, ok := selected[lb_endpoint]; ok && !m.takesPrecedence(lb_endpoint, candidate, current) {
+					if !candidate.standby && !current.standby {
+						logrus.Errorf("LB Endpoint %s already used by another service, will skip this service : %v", lb_endpoint, service.Name)
+					} else {
+						logrus.Debugf("LB endpoint %s is served by %s, will skip this service : %v", lb_endpoint, current.service, service.Name)
+					}
 					continue
 				}
 
-				logrus.Debugf("LB label exists for service : %v", service.Name)
 				lbConfig := model.LBConfig{}
 				lbConfig.LBEndpoint = lb_endpoint
-				lbConfig.LBTargetPoolName = service.Name + "_" + m.EnvironmentUUID + "_" + targetRancherSuffix
-				if err = m.getContainerLBTargets(&lbConfig, service); err != nil {
-					continue
+				lbConfig.LBTargetPoolName = frontend.poolName + "_" + m.EnvironmentUUID + "_" + targetRancherSuffix
+				lbConfig.Protocol = labels.protocol
+				lbConfig.Protected = labels.protect
+				lbConfig.Service = service.StackName + "/" + service.Name
+				lbConfig.Environment = environment
+				lbConfig.Providers = labels.providers
+				lbConfig.MaxConn = labels.maxConn
+				lbConfig.DrainTimeout = labels.drainTimeout
+				lbConfig.SlowStart = labels.slowStart
+				lbConfig.ProxyProtocol = labels.proxyProtocol
+				lbConfig.Attributes = labels.attributes
+				if labels.healthCheck != (model.HealthCheck{}) {
+					healthCheck := labels.healthCheck
+					lbConfig.HealthCheck = &healthCheck
+				}
+				if len(labels.stickiness.Type) != 0 {
+					stickiness := labels.stickiness
+					lbConfig.Stickiness = &stickiness
+				}
+				// skipping the service would remove its LB, a failed
+				// read fails the whole read instead
+				if err = m.getContainerLBTargets(&lbConfig, service, labels, frontend.targetPort); err != nil {
+					return nil, fmt.Errorf("Error reading the LB targets of service %s/%s: %v", service.StackName, service.Name, err)
 				}
 				lbConfigs[lb_endpoint] = lbConfig
-			} else {
-				continue
+				selected[lb_endpoint] = candidate
 			}
+		} else {
+			continue
+		}
+	}
+
+	trafficServices := make(map[string]string, len(selected))
+	for endpoint, candidate := range selected {
+		if candidate.standby && m.trafficServices[endpoint] != candidate.service {
+			logrus.Infof("All services of LB endpoint %s are on standby, it is not configured", endpoint)
+			delete(lbConfigs, endpoint)
+			continue
 		}
+		trafficServices[endpoint] = candidate.service
 	}
+	m.trafficServices = trafficServices
 
 	return lbConfigs, nil
 }
 
-func (m *MetadataClient) getContainerLBTargets(lbConfig *model.LBConfig, service metadata.Service) error {
+// takesPrecedence reports whether candidate should serve endpoint instead
+// of current. Active services win over standby ones. Between services in
+// the same traffic state, e.g. in the middle of flipping traffic from one
+// to the other, the previously selected service keeps serving the endpoint.
+// The flip then happens with the single label change that resolves it.
+func (m *MetadataClient) takesPrecedence(endpoint string, candidate trafficCandidate, current trafficCandidate) bool {
+	if candidate.standby != current.standby {
+		return !candidate.standby
+	}
+	return m.trafficServices[endpoint] == candidate.service
+}
+
+// frontend is one LB endpoint published by a service.
+type frontend struct {
+	endpoint string
+	// poolName prefixes the target pool name of the frontend
+	poolName string
+	// targetPort is the container port the frontend forwards to, empty
+	// for the first published port
+	targetPort string
+}
+
+// serviceFrontends returns the frontends of a service whose target pool
+// names start with poolName. Without a ports label the service publishes
+// its first port on the endpoint. Each frontend port of the ports label
+// becomes the LB endpoint "<endpoint>:<frontend port>" with its own
+// target pool.
+func serviceFrontends(poolName string, labels serviceLabels) []frontend {
+	if len(labels.ports) == 0 {
+		return []frontend{{endpoint: labels.endpoint, poolName: poolName}}
+	}
+	var frontends []frontend
+	for _, mapping := range labels.ports {
+		frontends = append(frontends, frontend{
+			endpoint:   labels.endpoint + ":" + mapping.frontendPort,
+			poolName:   poolName + "-" + mapping.frontendPort,
+			targetPort: mapping.targetPort,
+		})
+	}
+	return frontends
+}
+
+func (m *MetadataClient) isManagedService(service metadata.Service) bool {
+	if len(m.ManagedServices) == 0 {
+		return true
+	}
+	return m.ManagedServices[service.StackName+"/"+service.Name]
+}
+
+// getContainerLBTargets adds the containers of service to the targets of
+// lbConfig, using the published container port targetPort or the first
+// published port if it is empty. Host read errors of the host label
+// filter and the agent and host_label IP sources are returned, the
+// targets are incomplete then.
+func (m *MetadataClient) getContainerLBTargets(lbConfig *model.LBConfig, service metadata.Service, labels serviceLabels, targetPort string) error {
+	ipSource := labels.targetIPSource
 	containers := service.Containers
+	logrus.Debugf("Using %s IPs as LB targets for service : %v", ipSource, service.Name)
 
 	for _, container := range containers {
 		if len(container.ServiceName) == 0 {
@@ -112,12 +328,59 @@ func (m *MetadataClient) getContainerLBTargets(lbConfig *model.LBConfig, service
 			continue
 		}
 
+		if len(labels.hostLabelKey) != 0 {
+			host, err := m.getHost(container.HostUUID)
+			if err != nil {
+				return fmt.Errorf("host label filter of container %s: %v", container.Name, err)
+			}
+			if value, ok := host.Labels[labels.hostLabelKey]; !ok || value != labels.hostLabelValue {
+				logrus.Debugf("Skipping container, host %s does not have label %s=%s, container: %s, service: %s", host.Name, labels.hostLabelKey, labels.hostLabelValue, container.Name, container.ServiceName)
+				continue
+			}
+		}
+
+		if m.OnlyHealthyTargets && len(container.HealthState) != 0 && container.HealthState != "healthy" {
+			logrus.Debugf("Skipping container, health state is %s, container: %s, service: %s", container.HealthState, container.Name, container.ServiceName)
+			continue
+		}
+
+		publishedPort := container.Ports[0]
+		if len(targetPort) != 0 {
+			if publishedPort = findPublishedPort(container.Ports, targetPort); len(publishedPort) == 0 {
+				logrus.Debugf("Skipping container, port %s is not published, container: %s, service: %s, ports: %s", targetPort, container.Name, container.ServiceName, container.Ports)
+				continue
+			}
+		}
+
 		//split the container.Ports to get the publicip:port
-		portspec := strings.Split(container.Ports[0], ":")
+		portspec := strings.Split(publishedPort, ":")
 
 		if len(portspec) > 2 {
 			ip := portspec[0]
 			port := portspec[1]
+			switch ipSource {
+			case TargetIPSourceContainer:
+				if len(container.PrimaryIp) == 0 {
+					logrus.Debugf("Skipping container, container has no primary IP, container: %s, service: %s", container.Name, container.ServiceName)
+					continue
+				}
+				ip = container.PrimaryIp
+				port = strings.Split(portspec[2], "/")[0]
+			case TargetIPSourceAgent, TargetIPSourceHostLabel:
+				host, err := m.getHost(container.HostUUID)
+				if err != nil {
+					return fmt.Errorf("%s IP of container %s: %v", ipSource, container.Name, err)
+				}
+				if ipSource == TargetIPSourceAgent {
+					ip = host.AgentIP
+				} else {
+					ip = host.Labels[m.TargetIPHostLabel]
+				}
+				if len(ip) == 0 {
+					logrus.Debugf("Skipping container, host %s has no %s IP, container: %s, service: %s", host.Name, ipSource, container.Name, container.ServiceName)
+					continue
+				}
+			}
 
 			lbTarget := model.LBTarget{}
 			lbTarget.HostIP = ip
@@ -130,3 +393,64 @@ func (m *MetadataClient) getContainerLBTargets(lbConfig *model.LBConfig, service
 
 	return nil
 }
+
+// getHost returns the host with the given UUID, reading all hosts once per
+// GetMetadataLBConfigs call.
+func (m *MetadataClient) getHost(uuid string) (metadata.Host, error) {
+	if m.hosts == nil {
+		hosts, err := m.MetadataClient.GetHosts()
+		if err != nil {
+			return metadata.Host{}, fmt.Errorf("Error reading hosts: %v", err)
+		}
+		m.hosts = make(map[string]metadata.Host, len(hosts))
+		for _, host := range hosts {
+			m.hosts[host.UUID] = host
+		}
+	}
+	return m.hosts[uuid], nil
+}
+
+// findPublishedPort returns the port spec publishing the private port
+// privatePort, or an empty string.
+func findPublishedPort(ports []string, privatePort string) string {
+	for _, port := range ports {
+		portspec := strings.Split(port, ":")
+		if len(portspec) > 2 && strings.Split(portspec[2], "/")[0] == privatePort {
+			return port
+		}
+	}
+	return ""
+}
+
+// GetLeader returns the name of the leader among the containers of the
+// service this instance runs in, and whether it is this instance's own
+// container. The leader is the oldest container not reported unhealthy,
+// so leadership only changes when the leader goes away or fails its
+// health check. Every replica applies the same rule to the same
+// metadata, if there is no such container none of them leads.
+func (m *MetadataClient) GetLeader() (string, bool, error) {
+	self, err := m.MetadataClient.GetSelfContainer()
+	if err != nil {
+		return "", false, fmt.Errorf("Error reading self container: %v", err)
+	}
+	service, err := m.MetadataClient.GetSelfService()
+	if err != nil {
+		return "", false, fmt.Errorf("Error reading self service: %v", err)
+	}
+
+	var leader *metadata.Container
+	for i := range service.Containers {
+		container := &service.Containers[i]
+		if container.HealthState == "unhealthy" {
+			continue
+		}
+		if leader == nil || container.CreateIndex < leader.CreateIndex ||
+			(container.CreateIndex == leader.CreateIndex && container.Name < leader.Name) {
+			leader = container
+		}
+	}
+	if leader == nil {
+		return "", false, nil
+	}
+	return leader.Name, leader.UUID == self.UUID, nil
+}
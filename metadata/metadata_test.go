@@ -0,0 +1,222 @@
+package metadata
+
+import (
+	"fmt"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"testing"
+	"time"
+)
+
+const testEndpointLabel = labelPrefix + "endpoint"
+
+// fakeSource serves fixed services and hosts, failHosts makes GetHosts
+// fail.
+type fakeSource struct {
+	services  []metadata.Service
+	hosts     []metadata.Host
+	failHosts bool
+}
+
+func (s *fakeSource) GetVersion() (string, error) { return "1", nil }
+
+func (s *fakeSource) WaitForVersionChange(version string, maxWait time.Duration) (string, error) {
+	return "1", nil
+}
+
+func (s *fakeSource) GetServices() ([]metadata.Service, error) { return s.services, nil }
+
+func (s *fakeSource) GetHosts() ([]metadata.Host, error) {
+	if s.failHosts {
+		return nil, fmt.Errorf("hosts are not available")
+	}
+	return s.hosts, nil
+}
+
+func (s *fakeSource) GetSelfStack() (metadata.Stack, error) {
+	return metadata.Stack{EnvironmentUUID: "env1", EnvironmentName: "Default"}, nil
+}
+
+func (s *fakeSource) GetSelfContainer() (metadata.Container, error) { return metadata.Container{}, nil }
+func (s *fakeSource) GetSelfService() (metadata.Service, error)     { return metadata.Service{}, nil }
+
+func newTestClient(source *fakeSource) *MetadataClient {
+	return &MetadataClient{MetadataClient: source, EnvironmentUUID: "env1", EnvironmentName: "Default"}
+}
+
+// testService returns a service with one container per port spec, the
+// endpoint label is set when endpoint is not empty.
+func testService(stack string, name string, endpoint string, ports ...string) metadata.Service {
+	service := metadata.Service{Name: name, StackName: stack, Labels: map[string]string{}}
+	if len(endpoint) != 0 {
+		service.Labels[testEndpointLabel] = endpoint
+	}
+	for i, port := range ports {
+		service.Containers = append(service.Containers, metadata.Container{
+			Name:        fmt.Sprintf("%s-%s-%d", stack, name, i+1),
+			ServiceName: name,
+			StackName:   stack,
+			Ports:       []string{port},
+		})
+	}
+	return service
+}
+
+func TestManagedServicesAllowlist(t *testing.T) {
+	source := &fakeSource{services: []metadata.Service{
+		testService("app", "web", "web.example.com", "10.0.0.1:80:8080/tcp"),
+		testService("app", "api", "api.example.com", "10.0.0.1:81:8080/tcp"),
+		testService("other", "web", "other.example.com", "10.0.0.2:80:8080/tcp"),
+		testService("app", "db", "", "10.0.0.1:5432:5432/tcp"),
+	}}
+
+	tests := []struct {
+		managed   map[string]bool
+		endpoints []string
+	}{
+		{nil, []string{"web.example.com", "api.example.com", "other.example.com"}},
+		{map[string]bool{"app/web": true}, []string{"web.example.com"}},
+		{map[string]bool{"app/web": true, "other/web": true}, []string{"web.example.com", "other.example.com"}},
+		// an allowlisted service still needs the endpoint label
+		{map[string]bool{"app/db": true}, nil},
+		{map[string]bool{"missing/service": true}, nil},
+	}
+	for _, test := range tests {
+		m := newTestClient(source)
+		m.ManagedServices = test.managed
+		configs, err := m.GetMetadataLBConfigs(testEndpointLabel, "rancher.internal")
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.managed, err)
+		}
+		if len(configs) != len(test.endpoints) {
+			t.Errorf("%v: got %d configs, expected %v", test.managed, len(configs), test.endpoints)
+		}
+		for _, endpoint := range test.endpoints {
+			if _, ok := configs[endpoint]; !ok {
+				t.Errorf("%v: no config for %s", test.managed, endpoint)
+			}
+		}
+	}
+}
+
+func TestIsManagedService(t *testing.T) {
+	m := &MetadataClient{ManagedServices: map[string]bool{"app/web": true}}
+	tests := []struct {
+		stack   string
+		name    string
+		managed bool
+	}{
+		{"app", "web", true},
+		{"app", "api", false},
+		{"other", "web", false},
+		{"app/web", "", false},
+	}
+	for _, test := range tests {
+		service := metadata.Service{StackName: test.stack, Name: test.name}
+		if managed := m.isManagedService(service); managed != test.managed {
+			t.Errorf("%s/%s: managed is %v, expected %v", test.stack, test.name, managed, test.managed)
+		}
+	}
+
+	if !(&MetadataClient{}).isManagedService(metadata.Service{StackName: "app", Name: "api"}) {
+		t.Errorf("a service is not managed without an allowlist")
+	}
+}
+
+// multiIPService returns a service whose containers have a host IP in
+// their port spec, a container IP and hosts with an agent IP and
+// external IP label.
+func multiIPService() (metadata.Service, []metadata.Host) {
+	service := metadata.Service{Name: "web", StackName: "app", Labels: map[string]string{testEndpointLabel: "web.example.com"}}
+	var hosts []metadata.Host
+	for i := 1; i <= 2; i++ {
+		service.Containers = append(service.Containers, metadata.Container{
+			Name:        fmt.Sprintf("app-web-%d", i),
+			ServiceName: "web",
+			StackName:   "app",
+			PrimaryIp:   fmt.Sprintf("10.42.0.%d", i),
+			HostUUID:    fmt.Sprintf("host%d", i),
+			Ports:       []string{fmt.Sprintf("192.168.0.%d:8080:80/tcp", i)},
+		})
+		hosts = append(hosts, metadata.Host{
+			Name:    fmt.Sprintf("host%d", i),
+			UUID:    fmt.Sprintf("host%d", i),
+			AgentIP: fmt.Sprintf("172.16.0.%d", i),
+			Labels:  map[string]string{DefaultTargetIPHostLabel: fmt.Sprintf("203.0.113.%d", i)},
+		})
+	}
+	return service, hosts
+}
+
+func TestTargetIPSources(t *testing.T) {
+	tests := []struct {
+		source string
+		label  string
+		ips    []string
+		port   string
+	}{
+		{"", "", []string{"192.168.0.1", "192.168.0.2"}, "8080"},
+		{TargetIPSourceHost, "", []string{"192.168.0.1", "192.168.0.2"}, "8080"},
+		{TargetIPSourceContainer, "", []string{"10.42.0.1", "10.42.0.2"}, "80"},
+		{TargetIPSourceAgent, "", []string{"172.16.0.1", "172.16.0.2"}, "8080"},
+		{TargetIPSourceHostLabel, "", []string{"203.0.113.1", "203.0.113.2"}, "8080"},
+		// the service label overrides the configured source
+		{TargetIPSourceHost, TargetIPSourceContainer, []string{"10.42.0.1", "10.42.0.2"}, "80"},
+		{TargetIPSourceContainer, TargetIPSourceAgent, []string{"172.16.0.1", "172.16.0.2"}, "8080"},
+	}
+	for _, test := range tests {
+		service, hosts := multiIPService()
+		if len(test.label) != 0 {
+			service.Labels[targetIPSourceLabel] = test.label
+		}
+		m := newTestClient(&fakeSource{services: []metadata.Service{service}, hosts: hosts})
+		m.TargetIPSource = test.source
+		m.TargetIPHostLabel = DefaultTargetIPHostLabel
+
+		configs, err := m.GetMetadataLBConfigs(testEndpointLabel, "rancher.internal")
+		if err != nil {
+			t.Fatalf("%q/%q: unexpected error: %v", test.source, test.label, err)
+		}
+		targets := configs["web.example.com"].LBTargets
+		if len(targets) != len(test.ips) {
+			t.Errorf("%q/%q: got targets %v, expected IPs %v", test.source, test.label, targets, test.ips)
+			continue
+		}
+		for i, target := range targets {
+			if target.HostIP != test.ips[i] || target.Port != test.port {
+				t.Errorf("%q/%q: target %d is %s:%s, expected %s:%s", test.source, test.label, i, target.HostIP, target.Port, test.ips[i], test.port)
+			}
+		}
+	}
+}
+
+func TestTargetIPSourceSkipsContainersWithoutTheIP(t *testing.T) {
+	service, hosts := multiIPService()
+	service.Containers[1].PrimaryIp = ""
+	hosts[1].AgentIP = ""
+	delete(hosts[1].Labels, DefaultTargetIPHostLabel)
+
+	for _, source := range []string{TargetIPSourceContainer, TargetIPSourceAgent, TargetIPSourceHostLabel} {
+		m := newTestClient(&fakeSource{services: []metadata.Service{service}, hosts: hosts})
+		m.TargetIPSource = source
+		m.TargetIPHostLabel = DefaultTargetIPHostLabel
+		configs, err := m.GetMetadataLBConfigs(testEndpointLabel, "rancher.internal")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", source, err)
+		}
+		if targets := configs["web.example.com"].LBTargets; len(targets) != 1 {
+			t.Errorf("%s: got targets %v, expected only the first container", source, targets)
+		}
+	}
+}
+
+func TestTargetIPSourceFailsOnHostReadError(t *testing.T) {
+	service, hosts := multiIPService()
+	for _, source := range []string{TargetIPSourceAgent, TargetIPSourceHostLabel} {
+		m := newTestClient(&fakeSource{services: []metadata.Service{service}, hosts: hosts, failHosts: true})
+		m.TargetIPSource = source
+		m.TargetIPHostLabel = DefaultTargetIPHostLabel
+		if configs, err := m.GetMetadataLBConfigs(testEndpointLabel, "rancher.internal"); err == nil {
+			t.Errorf("%s: expected an error, got %v", source, configs)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"strings"
+	"text/template"
+)
+
+// PoolNameData is the data the target pool name template is rendered
+// with.
+type PoolNameData struct {
+	Service string
+	Stack   string
+	// Env is the environment name, lower case and with anything but
+	// letters, digits and dashes replaced by dashes.
+	Env string
+}
+
+// ParsePoolNameTemplate parses the template of the target pool names,
+// e.g. "{{.Service}}-{{.Stack}}-{{.Env}}", and checks that it renders a
+// name.
+func ParsePoolNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("pool name").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderPoolName(tmpl, PoolNameData{Service: "web", Stack: "app", Env: "default"}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func renderPoolName(tmpl *template.Template, data PoolNameData) (string, error) {
+	var name bytes.Buffer
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", err
+	}
+	if len(strings.TrimSpace(name.String())) == 0 {
+		return "", fmt.Errorf("the pool name template renders an empty name")
+	}
+	return name.String(), nil
+}
+
+// servicePoolName returns the name prefixing the target pool names of a
+// service in environment, the service name by default. Aggregated
+// environments add their name to the default.
+func (m *MetadataClient) servicePoolName(service metadata.Service, environment string) (string, error) {
+	if m.PoolNameTemplate != nil {
+		return renderPoolName(m.PoolNameTemplate, PoolNameData{
+			Service: service.Name,
+			Stack:   service.StackName,
+			Env:     environmentPoolName(environment),
+		})
+	}
+	if _, ok := m.MetadataClient.(MultiEnvironmentSource); ok {
+		return service.Name + "-" + environmentPoolName(environment), nil
+	}
+	return service.Name, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/rancher/external-lb/metrics"
+)
+
+var (
+	metadataPollDuration = metrics.NewHistogramVec(
+		"external_lb_metadata_poll_duration_seconds",
+		"Time taken to read the LB configs from Rancher metadata.",
+		metrics.DefBuckets)
+	providerUpdateDuration = metrics.NewHistogramVec(
+		"external_lb_provider_update_duration_seconds",
+		"Time taken to reconcile the LB configs of a provider.",
+		metrics.DefBuckets, "provider")
+	managedLBConfigs = metrics.NewGaugeVec(
+		"external_lb_managed_lb_configs",
+		"Number of LB configs managed on a provider.",
+		"provider")
+	providerUpdateErrors = metrics.NewCounterVec(
+		"external_lb_provider_update_errors_total",
+		"Number of failed provider operations.",
+		"provider", "op")
+	driftDetected = metrics.NewCounterVec(
+		"external_lb_drift_detected_total",
+		"Number of LB configs found changed outside of external-lb on a provider.",
+		"provider")
+	providerThrottled = metrics.NewCounterVec(
+		"external_lb_provider_throttled_total",
+		"Number of provider calls delayed by the client-side rate limit.",
+		"provider")
+	providerCircuitOpen = metrics.NewGaugeVec(
+		"external_lb_provider_circuit_open",
+		"Whether the circuit breaker of a provider is open or half-open.",
+		"provider")
+	leaderElected = metrics.NewGaugeVec(
+		"external_lb_leader",
+		"Whether this instance is the elected leader reconciling the providers.")
+	labelErrors = metrics.NewGaugeVec(
+		"external_lb_label_errors",
+		"Number of invalid external LB labels found on services in the last metadata poll.")
+)
@@ -1,9 +1,88 @@
 package model
 
 type LBConfig struct {
-	LBEndpoint   string
+	LBEndpoint       string
 	LBTargetPoolName string
-	LBTargets    []LBTarget
+	LBTargets        []LBTarget
+	// OwnerID identifies the external-lb instance managing this config.
+	// Providers persist it with the resources they create and report it
+	// back from GetLBConfigs.
+	OwnerID string
+	// MaxConn limits the concurrent connections to each target, 0 means unlimited.
+	MaxConn int
+	// HealthCheck overrides the provider's default health check of the
+	// targets, nil keeps the default.
+	HealthCheck *HealthCheck
+	// Stickiness binds the sessions of a client to one target, nil
+	// balances every connection or request on its own.
+	Stickiness *Stickiness
+	// Protocol is the protocol of the frontend, one of the Protocol
+	// constants. Empty leaves it to the provider configuration.
+	Protocol string
+	// DrainTimeout is the maximum number of seconds a removed target keeps
+	// serving its in-flight connections, 0 leaves it to the provider.
+	DrainTimeout int `json:",omitempty"`
+	// SlowStart is the number of seconds over which a new target ramps up
+	// to its full share of the traffic, 0 sends it its full share at once.
+	SlowStart int `json:",omitempty"`
+	// ProxyProtocol prepends a PROXY protocol v2 header carrying the client
+	// address to the connections to the targets.
+	ProxyProtocol bool `json:",omitempty"`
+	// Attributes holds provider specific settings passed through as is,
+	// e.g. load_balancing.cross_zone.enabled=true.
+	Attributes map[string]string `json:",omitempty"`
+	// Protected keeps the config from being removed from the provider once
+	// its service is gone. It is only tracked by external-lb itself and is
+	// not passed on to providers.
+	Protected bool `json:"-"`
+	// Service is the "stack/service" name of the Rancher service the
+	// config was built from. Like Protected it is not passed on to
+	// providers, configs read from a provider leave it empty.
+	Service string `json:"-"`
+	// Environment is the name of the Rancher environment of the service.
+	// Providers supporting free-form tags record it along with Service,
+	// it is not reported back from GetLBConfigs.
+	Environment string `json:"-"`
+	// Providers restricts the providers the config is published through,
+	// empty means all of them. It is not passed on to providers either.
+	Providers []string `json:"-"`
+}
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+	ProtocolTCP   = "tcp"
+	ProtocolUDP   = "udp"
+	ProtocolTLS   = "tls"
+)
+
+const (
+	// StickinessCookie binds HTTP clients to a target through a cookie.
+	StickinessCookie = "cookie"
+	// StickinessSourceIP binds clients to a target by their source IP.
+	StickinessSourceIP = "source_ip"
+)
+
+// Stickiness describes the session affinity of a config.
+type Stickiness struct {
+	// Type is StickinessCookie or StickinessSourceIP.
+	Type string
+	// Duration is the lifetime of a binding in seconds, 0 keeps the
+	// provider default.
+	Duration int
+}
+
+// HealthCheck describes how the targets of a config are health checked.
+// Zero values keep the provider defaults.
+type HealthCheck struct {
+	// Path is requested by HTTP health checks, empty means TCP checks.
+	Path string
+	// Interval is the time between two checks in seconds.
+	Interval int
+	// HealthyThreshold is the number of passed checks marking a target up.
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of failed checks marking a target down.
+	UnhealthyThreshold int
 }
 
 type LBTarget struct {
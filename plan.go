@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reconcilePlan is the set of provider changes computed by a reconcile.
+// Both the log output and the machine-readable dry-run output are
+// rendered from it so the two never diverge.
+type reconcilePlan struct {
+	provider string
+	toRemove []model.LBConfig
+	toAdd    []model.LBConfig
+	toUpdate []model.LBConfig
+	actions  []planAction
+}
+
+// planAction describes a single planned change of an LB endpoint.
+type planAction struct {
+	Op                string   `json:"op"`
+	Endpoint          string   `json:"endpoint"`
+	Service           string   `json:"service,omitempty"`
+	TargetPool        string   `json:"target_pool"`
+	PrevTargetPool    string   `json:"previous_target_pool,omitempty"`
+	Targets           []string `json:"targets,omitempty"`
+	AddTargets        []string `json:"add_targets,omitempty"`
+	RemoveTargets     []string `json:"remove_targets,omitempty"`
+	Protocol          string   `json:"protocol,omitempty"`
+	PrevProtocol      *string  `json:"previous_protocol,omitempty"`
+	MaxConn           int      `json:"max_conn,omitempty"`
+	PrevMaxConn       *int     `json:"previous_max_conn,omitempty"`
+	DrainTimeout      int      `json:"drain_timeout,omitempty"`
+	PrevDrainTimeout  *int     `json:"previous_drain_timeout,omitempty"`
+	SlowStart         int      `json:"slow_start,omitempty"`
+	PrevSlowStart     *int     `json:"previous_slow_start,omitempty"`
+	ProxyProtocol     bool     `json:"proxy_protocol,omitempty"`
+	PrevProxyProtocol *bool    `json:"previous_proxy_protocol,omitempty"`
+	// HealthCheck is only set for configs with a custom health check
+	HealthCheck        *model.HealthCheck `json:"health_check,omitempty"`
+	HealthCheckChanged bool               `json:"health_check_changed,omitempty"`
+	Attributes         map[string]string  `json:"attributes,omitempty"`
+	AttributesChanged  bool               `json:"attributes_changed,omitempty"`
+	Stickiness         *model.Stickiness  `json:"stickiness,omitempty"`
+	StickinessChanged  bool               `json:"stickiness_changed,omitempty"`
+}
+
+// planOutput is the JSON document written in dry-run mode.
+type planOutput struct {
+	Time     time.Time    `json:"time"`
+	Provider string       `json:"provider"`
+	OwnerID  string       `json:"owner_id"`
+	Actions  []planAction `json:"actions"`
+}
+
+func (c *providerController) newReconcilePlan(metadataConfigs map[string]model.LBConfig, providerConfigs map[string]model.LBConfig) *reconcilePlan {
+	plan := &reconcilePlan{
+		provider: c.provider.GetName(),
+		toRemove: c.collector.filter(c.withoutProtected(removeExtraConfigs(metadataConfigs, providerConfigs))),
+		toAdd:    c.stabilizer.filter(metadataConfigs, addMissingConfigs(metadataConfigs, providerConfigs)),
+		toUpdate: updateExistingConfigs(metadataConfigs, providerConfigs),
+	}
+
+	for _, config := range plan.toRemove {
+		plan.actions = append(plan.actions, planAction{
+			Op:         Remove.Name,
+			Endpoint:   config.LBEndpoint,
+			Service:    config.Service,
+			TargetPool: config.LBTargetPoolName,
+			Targets:    targetNames(config.LBTargets),
+			Protocol:   config.Protocol,
+			MaxConn:    config.MaxConn,
+		})
+	}
+	for _, config := range plan.toAdd {
+		plan.actions = append(plan.actions, planAction{
+			Op:            Add.Name,
+			Endpoint:      config.LBEndpoint,
+			Service:       config.Service,
+			TargetPool:    config.LBTargetPoolName,
+			Targets:       targetNames(config.LBTargets),
+			Protocol:      config.Protocol,
+			MaxConn:       config.MaxConn,
+			DrainTimeout:  config.DrainTimeout,
+			SlowStart:     config.SlowStart,
+			ProxyProtocol: config.ProxyProtocol,
+			Attributes:    config.Attributes,
+			HealthCheck:   config.HealthCheck,
+			Stickiness:    config.Stickiness,
+		})
+	}
+	for _, config := range plan.toUpdate {
+		current := providerConfigs[config.LBEndpoint]
+		action := planAction{
+			Op:            Update.Name,
+			Endpoint:      config.LBEndpoint,
+			Service:       config.Service,
+			TargetPool:    config.LBTargetPoolName,
+			Targets:       targetNames(config.LBTargets),
+			AddTargets:    targetNames(targetsMissing(config.LBTargets, current.LBTargets)),
+			RemoveTargets: targetNames(targetsMissing(current.LBTargets, config.LBTargets)),
+			Protocol:      config.Protocol,
+			MaxConn:       config.MaxConn,
+			DrainTimeout:  config.DrainTimeout,
+			SlowStart:     config.SlowStart,
+			ProxyProtocol: config.ProxyProtocol,
+			Attributes:    config.Attributes,
+			HealthCheck:   config.HealthCheck,
+			Stickiness:    config.Stickiness,
+		}
+		if !strings.EqualFold(current.LBTargetPoolName, config.LBTargetPoolName) {
+			action.PrevTargetPool = current.LBTargetPoolName
+		}
+		if current.Protocol != config.Protocol {
+			prevProtocol := current.Protocol
+			action.PrevProtocol = &prevProtocol
+		}
+		if current.MaxConn != config.MaxConn {
+			prevMaxConn := current.MaxConn
+			action.PrevMaxConn = &prevMaxConn
+		}
+		if current.DrainTimeout != config.DrainTimeout {
+			prevDrainTimeout := current.DrainTimeout
+			action.PrevDrainTimeout = &prevDrainTimeout
+		}
+		if current.SlowStart != config.SlowStart {
+			prevSlowStart := current.SlowStart
+			action.PrevSlowStart = &prevSlowStart
+		}
+		if current.ProxyProtocol != config.ProxyProtocol {
+			prevProxyProtocol := current.ProxyProtocol
+			action.PrevProxyProtocol = &prevProxyProtocol
+		}
+		action.HealthCheckChanged = !healthCheckEqual(current.HealthCheck, config.HealthCheck)
+		action.StickinessChanged = !stickinessEqual(current.Stickiness, config.Stickiness)
+		action.AttributesChanged = !attributesEqual(current.Attributes, config.Attributes)
+		plan.actions = append(plan.actions, action)
+	}
+	sort.Sort(byOpAndEndpoint(plan.actions))
+	return plan
+}
+
+type byOpAndEndpoint []planAction
+
+func (a byOpAndEndpoint) Len() int      { return len(a) }
+func (a byOpAndEndpoint) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byOpAndEndpoint) Less(i, j int) bool {
+	if a[i].Op != a[j].Op {
+		return a[i].Op < a[j].Op
+	}
+	return a[i].Endpoint < a[j].Endpoint
+}
+
+// describeHealthCheck renders a health check for the plan log.
+func describeHealthCheck(check *model.HealthCheck) string {
+	if check == nil {
+		return "the provider default"
+	}
+	return fmt.Sprintf("path %q, interval %ds, healthy threshold %d, unhealthy threshold %d",
+		check.Path, check.Interval, check.HealthyThreshold, check.UnhealthyThreshold)
+}
+
+// describeStickiness renders a stickiness for the plan log.
+func describeStickiness(stickiness *model.Stickiness) string {
+	if stickiness == nil {
+		return "none"
+	}
+	if stickiness.Duration == 0 {
+		return stickiness.Type
+	}
+	return fmt.Sprintf("%s for %ds", stickiness.Type, stickiness.Duration)
+}
+
+func (p *reconcilePlan) empty() bool {
+	return len(p.actions) == 0
+}
+
+// log writes the human readable form of the plan.
+func (p *reconcilePlan) log(log *logrus.Entry) {
+	if p.empty() {
+		log.Debug("No LB configs to add, update or remove")
+		return
+	}
+	log.Infof("Planned changes: %d to add, %d to update, %d to remove", len(p.toAdd), len(p.toUpdate), len(p.toRemove))
+	for _, action := range p.actions {
+		log := log.WithFields(lbFields(action.Endpoint, action.Service, action.Op))
+		switch action.Op {
+		case Update.Name:
+			log.Infof("Planned %s of LB endpoint %s: target pool %s, add targets %v, remove targets %v",
+				action.Op, action.Endpoint, action.TargetPool, action.AddTargets, action.RemoveTargets)
+			if len(action.PrevTargetPool) != 0 {
+				log.Infof("Planned %s of LB endpoint %s: target pool renamed from %s", action.Op, action.Endpoint, action.PrevTargetPool)
+			}
+			if action.PrevProtocol != nil {
+				log.Infof("Planned %s of LB endpoint %s: protocol changed from %q to %q", action.Op, action.Endpoint, *action.PrevProtocol, action.Protocol)
+			}
+			if action.PrevMaxConn != nil {
+				log.Infof("Planned %s of LB endpoint %s: connection limit changed from %d to %d", action.Op, action.Endpoint, *action.PrevMaxConn, action.MaxConn)
+			}
+			if action.PrevDrainTimeout != nil {
+				log.Infof("Planned %s of LB endpoint %s: drain timeout changed from %ds to %ds", action.Op, action.Endpoint, *action.PrevDrainTimeout, action.DrainTimeout)
+			}
+			if action.PrevSlowStart != nil {
+				log.Infof("Planned %s of LB endpoint %s: slow start changed from %ds to %ds", action.Op, action.Endpoint, *action.PrevSlowStart, action.SlowStart)
+			}
+			if action.PrevProxyProtocol != nil {
+				log.Infof("Planned %s of LB endpoint %s: PROXY protocol changed from %v to %v", action.Op, action.Endpoint, *action.PrevProxyProtocol, action.ProxyProtocol)
+			}
+			if action.HealthCheckChanged {
+				log.Infof("Planned %s of LB endpoint %s: health check changed to %s", action.Op, action.Endpoint, describeHealthCheck(action.HealthCheck))
+			}
+			if action.StickinessChanged {
+				log.Infof("Planned %s of LB endpoint %s: stickiness changed to %s", action.Op, action.Endpoint, describeStickiness(action.Stickiness))
+			}
+			if action.AttributesChanged {
+				log.Infof("Planned %s of LB endpoint %s: attributes changed to %v", action.Op, action.Endpoint, action.Attributes)
+			}
+		default:
+			log.Infof("Planned %s of LB endpoint %s: target pool %s, targets %v",
+				action.Op, action.Endpoint, action.TargetPool, action.Targets)
+		}
+	}
+}
+
+// write renders the plan as JSON to path, "-" meaning stdout. Nothing is
+// written if path is empty.
+func (p *reconcilePlan) write(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	output := planOutput{
+		Time:     time.Now(),
+		Provider: p.provider,
+		OwnerID:  ownerID,
+		Actions:  p.actions,
+	}
+	if output.Actions == nil {
+		output.Actions = []planAction{}
+	}
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func targetNames(targets []model.LBTarget) []string {
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.HostIP+":"+target.Port)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func writeTestPlan(t *testing.T, plan *reconcilePlan) map[string]interface{} {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plan.json")
+	if err := plan.write(path); err != nil {
+		t.Fatalf("writing the plan failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal(data, &output); err != nil {
+		t.Fatalf("the plan is not valid JSON: %v\n%s", err, data)
+	}
+	return output
+}
+
+func TestPlanJSONOutput(t *testing.T) {
+	defer func(previous string) { ownerID = previous }(ownerID)
+	ownerID = "owner1"
+
+	added := model.LBConfig{
+		LBEndpoint:       "new.example.com",
+		Service:          "app/new",
+		LBTargetPoolName: "new_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.2", Port: "80"}, {HostIP: "10.0.0.1", Port: "80"}},
+		MaxConn:          10,
+	}
+	current := model.LBConfig{
+		LBEndpoint:       "web.example.com",
+		Service:          "app/web",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.3", Port: "80"}, {HostIP: "10.0.0.4", Port: "80"}},
+	}
+	updated := current
+	updated.LBTargetPoolName = "frontend_env1_rancher.internal"
+	updated.LBTargets = []model.LBTarget{{HostIP: "10.0.0.4", Port: "80"}, {HostIP: "10.0.0.5", Port: "80"}}
+	updated.MaxConn = 50
+	removed := model.LBConfig{
+		LBEndpoint:       "old.example.com",
+		Service:          "app/old",
+		LBTargetPoolName: "old_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.6", Port: "80"}},
+	}
+
+	c := newTestController(newFakeProvider())
+	c.state = &stateStore{Services: map[string]*serviceState{}}
+	plan := c.newReconcilePlan(
+		map[string]model.LBConfig{added.LBEndpoint: added, updated.LBEndpoint: updated},
+		map[string]model.LBConfig{current.LBEndpoint: current, removed.LBEndpoint: removed},
+	)
+	output := writeTestPlan(t, plan)
+
+	if output["provider"] != "fake" || output["owner_id"] != "owner1" {
+		t.Errorf("wrong provider or owner in %v", output)
+	}
+	if _, ok := output["time"].(string); !ok {
+		t.Errorf("the plan has no time: %v", output)
+	}
+	actions, _ := output["actions"].([]interface{})
+	if len(actions) != 3 {
+		t.Fatalf("got actions %v, expected three", output["actions"])
+	}
+	byOp := make(map[string]map[string]interface{})
+	for _, action := range actions {
+		action := action.(map[string]interface{})
+		byOp[action["op"].(string)] = action
+	}
+
+	expected := map[string]map[string]interface{}{
+		Add.Name: {
+			"op":          Add.Name,
+			"endpoint":    "new.example.com",
+			"service":     "app/new",
+			"target_pool": "new_env1_rancher.internal",
+			"targets":     []interface{}{"10.0.0.1:80", "10.0.0.2:80"},
+			"max_conn":    float64(10),
+		},
+		Update.Name: {
+			"op":                   Update.Name,
+			"endpoint":             "web.example.com",
+			"service":              "app/web",
+			"target_pool":          "frontend_env1_rancher.internal",
+			"previous_target_pool": "web_env1_rancher.internal",
+			"targets":              []interface{}{"10.0.0.4:80", "10.0.0.5:80"},
+			"add_targets":          []interface{}{"10.0.0.5:80"},
+			"remove_targets":       []interface{}{"10.0.0.3:80"},
+			"max_conn":             float64(50),
+			"previous_max_conn":    float64(0),
+		},
+		Remove.Name: {
+			"op":          Remove.Name,
+			"endpoint":    "old.example.com",
+			"service":     "app/old",
+			"target_pool": "old_env1_rancher.internal",
+			"targets":     []interface{}{"10.0.0.6:80"},
+		},
+	}
+	for op, fields := range expected {
+		if !reflect.DeepEqual(byOp[op], fields) {
+			t.Errorf("%s action is\n%v\nexpected\n%v", op, byOp[op], fields)
+		}
+	}
+}
+
+func TestPlanActionsAreSorted(t *testing.T) {
+	metadataConfigs := make(map[string]model.LBConfig)
+	providerConfigs := make(map[string]model.LBConfig)
+	for _, config := range fakeConfigs(8) {
+		switch config.LBEndpoint {
+		case "ep0", "ep3", "ep6":
+			metadataConfigs[config.LBEndpoint] = config
+		case "ep1", "ep4", "ep7":
+			providerConfigs[config.LBEndpoint] = config
+		default:
+			providerConfigs[config.LBEndpoint] = config
+			config.MaxConn = 10
+			metadataConfigs[config.LBEndpoint] = config
+		}
+	}
+	expected := []string{
+		Add.Name + " ep0", Add.Name + " ep3", Add.Name + " ep6",
+		Remove.Name + " ep1", Remove.Name + " ep4", Remove.Name + " ep7",
+		Update.Name + " ep2", Update.Name + " ep5",
+	}
+
+	c := newTestController(newFakeProvider())
+	c.state = &stateStore{Services: map[string]*serviceState{}}
+	for i := 0; i < 10; i++ {
+		plan := c.newReconcilePlan(metadataConfigs, providerConfigs)
+		var actions []string
+		for _, action := range plan.actions {
+			actions = append(actions, action.Op+" "+action.Endpoint)
+		}
+		if !reflect.DeepEqual(actions, expected) {
+			t.Fatalf("got actions %v, expected %v", actions, expected)
+		}
+		for _, configs := range [][]model.LBConfig{plan.toAdd, plan.toRemove, plan.toUpdate} {
+			if !sort.IsSorted(byEndpoint(configs)) {
+				t.Fatalf("configs %v are not sorted by LB endpoint", configs)
+			}
+		}
+	}
+}
+
+func TestPlanJSONOutputWithoutChanges(t *testing.T) {
+	configs := map[string]model.LBConfig{}
+	for _, config := range fakeConfigs(2) {
+		configs[config.LBEndpoint] = config
+	}
+	c := newTestController(newFakeProvider())
+	c.state = &stateStore{Services: map[string]*serviceState{}}
+	plan := c.newReconcilePlan(configs, configs)
+	if !plan.empty() {
+		t.Fatalf("got actions %v for unchanged configs", plan.actions)
+	}
+
+	// an empty plan is written with an empty list, not null
+	actions, ok := writeTestPlan(t, plan)["actions"].([]interface{})
+	if !ok || len(actions) != 0 {
+		t.Errorf("got actions %v, expected an empty list", actions)
+	}
+}
+
+func TestPlanNotWrittenWithoutPath(t *testing.T) {
+	plan := newTestController(newFakeProvider()).newReconcilePlan(nil, nil)
+	if err := plan.write(""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
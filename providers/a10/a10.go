@@ -0,0 +1,521 @@
+package a10
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	name = "a10"
+
+	// ownerTagPrefix marks the service group user-tag carrying the owner ID
+	ownerTagPrefix = "managed-by external-lb "
+	// maxGroupNameLength is the longest service group name ACOS accepts
+	maxGroupNameLength = 127
+)
+
+var (
+	baseURL         string
+	user            string
+	password        string
+	settings        map[string]string
+	client          = &http.Client{Timeout: 30 * time.Second}
+	errNotFound     = fmt.Errorf("not found")
+	errUnauthorized = fmt.Errorf("unauthorized")
+
+	// signatureLock guards signature, which is renewed when it expired
+	signatureLock sync.Mutex
+	signature     string
+)
+
+func init() {
+	a10Handler := &A10Handler{}
+	if err := providers.RegisterProvider(name, a10Handler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// A10Handler manages service groups of existing A10 Thunder virtual server
+// ports through aXAPI v3. The LB endpoint is "<virtual server>:<port>",
+// e.g. web-vip:80, the port must already be configured on the virtual
+// server. A service group named after the target pool is assigned to it,
+// with one member per target.
+type A10Handler struct {
+}
+
+type serviceGroup struct {
+	Name       string   `json:"name"`
+	Protocol   string   `json:"protocol"`
+	UserTag    string   `json:"user-tag,omitempty"`
+	MemberList []member `json:"member-list"`
+}
+
+type member struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+type server struct {
+	Name     string       `json:"name"`
+	Host     string       `json:"host"`
+	PortList []serverPort `json:"port-list"`
+}
+
+type serverPort struct {
+	PortNumber int    `json:"port-number"`
+	Protocol   string `json:"protocol"`
+	ConnLimit  int    `json:"conn-limit,omitempty"`
+}
+
+type virtualServer struct {
+	Name     string  `json:"name"`
+	PortList []vPort `json:"port-list"`
+}
+
+type vPort struct {
+	PortNumber   int    `json:"port-number"`
+	Protocol     string `json:"protocol"`
+	ServiceGroup string `json:"service-group"`
+}
+
+func (*A10Handler) Init() error {
+	host := os.Getenv("A10_HOST")
+	if len(host) == 0 {
+		return fmt.Errorf("A10_HOST is not set")
+	}
+	user = os.Getenv("A10_USER")
+	if len(user) == 0 {
+		return fmt.Errorf("A10_USER is not set")
+	}
+	password = os.Getenv("A10_PWD")
+	if len(password) == 0 {
+		return fmt.Errorf("A10_PWD is not set")
+	}
+	baseURL = strings.TrimSuffix(host, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	settings = map[string]string{
+		"A10_HOST": host,
+		"A10_USER": user,
+		"A10_PWD":  providers.Redacted,
+	}
+
+	if _, err := authenticate(""); err != nil {
+		return fmt.Errorf("Connecting to A10 host %v does not work, error: %v", host, err)
+	}
+	return nil
+}
+
+func (*A10Handler) GetName() string {
+	return name
+}
+
+func (*A10Handler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*A10Handler) ValidatePoolName(groupName string) error {
+	if len(groupName) > maxGroupNameLength {
+		return fmt.Errorf("service group names are limited to %d characters", maxGroupNameLength)
+	}
+	return nil
+}
+
+func (*A10Handler) AddLBConfig(config model.LBConfig) error {
+	vsName, port, err := parseEndpoint(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("a10 AddLBConfig: %v\n", err)
+		return err
+	}
+	vp, err := getVirtualPort(vsName, port)
+	if err != nil {
+		logrus.Errorf("a10 AddLBConfig: Error getting port %d of virtual server %s, cannot add the config: %v\n", port, vsName, err)
+		return err
+	}
+	if len(vp.ServiceGroup) != 0 {
+		if err := checkServiceGroupOwner(vp.ServiceGroup, config.OwnerID); err != nil {
+			logrus.Errorf("a10 AddLBConfig: %v\n", err)
+			return err
+		}
+	}
+
+	protocol := memberProtocol(vp.Protocol)
+	group := serviceGroup{
+		Name:       config.LBTargetPoolName,
+		Protocol:   protocol,
+		UserTag:    ownerTagPrefix + config.OwnerID,
+		MemberList: []member{},
+	}
+	for _, target := range config.LBTargets {
+		targetPort, err := strconv.Atoi(target.Port)
+		if err != nil {
+			err = fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+			logrus.Errorf("a10 AddLBConfig: %v\n", err)
+			return err
+		}
+		if err := ensureServer(target.HostIP, targetPort, protocol, config.MaxConn); err != nil {
+			logrus.Errorf("a10 AddLBConfig: Error configuring server %s: %v\n", target.HostIP, err)
+			return err
+		}
+		group.MemberList = append(group.MemberList, member{Name: target.HostIP, Port: targetPort})
+	}
+
+	_, err = getServiceGroup(group.Name)
+	if err == errNotFound {
+		err = doRequest("POST", "/slb/service-group", map[string]interface{}{"service-group": group}, nil)
+	} else if err == nil {
+		if err = checkServiceGroupOwner(group.Name, config.OwnerID); err == nil {
+			err = doRequest("PUT", "/slb/service-group/"+url.QueryEscape(group.Name), map[string]interface{}{"service-group": group}, nil)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("a10 AddLBConfig: Error writing service group %s: %v\n", group.Name, err)
+		return err
+	}
+
+	if vp.ServiceGroup != group.Name {
+		body := map[string]interface{}{"port": map[string]interface{}{
+			"port-number":   vp.PortNumber,
+			"protocol":      vp.Protocol,
+			"service-group": group.Name,
+		}}
+		if err := doRequest("POST", virtualPortPath(vsName, vp), body, nil); err != nil {
+			logrus.Errorf("a10 AddLBConfig: Error assigning service group %s to %s: %v\n", group.Name, config.LBEndpoint, err)
+			return err
+		}
+	}
+	logrus.Debugf("a10 AddLBConfig: Done")
+	return nil
+}
+
+func (h *A10Handler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*A10Handler) RemoveLBConfig(config model.LBConfig) error {
+	groupName := config.LBTargetPoolName
+	if err := checkServiceGroupOwner(groupName, config.OwnerID); err != nil {
+		logrus.Errorf("a10 RemoveLBConfig: %v\n", err)
+		return err
+	}
+	vsName, port, err := parseEndpoint(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("a10 RemoveLBConfig: %v\n", err)
+		return err
+	}
+	vp, err := getVirtualPort(vsName, port)
+	if err != nil && err != errNotFound {
+		logrus.Errorf("a10 RemoveLBConfig: Error getting port %d of virtual server %s: %v\n", port, vsName, err)
+		return err
+	}
+	if err == nil && vp.ServiceGroup == groupName {
+		// PUT replaces the port, so write it back without the service group
+		var raw map[string]map[string]interface{}
+		if err := doRequest("GET", virtualPortPath(vsName, vp), nil, &raw); err != nil {
+			logrus.Errorf("a10 RemoveLBConfig: Error reading %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+		delete(raw["port"], "service-group")
+		delete(raw["port"], "uuid")
+		delete(raw["port"], "a10-url")
+		if err := doRequest("PUT", virtualPortPath(vsName, vp), raw, nil); err != nil {
+			logrus.Errorf("a10 RemoveLBConfig: Error unassigning service group %s from %s: %v\n", groupName, config.LBEndpoint, err)
+			return err
+		}
+	}
+	if err := doRequest("DELETE", "/slb/service-group/"+url.QueryEscape(groupName), nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("a10 RemoveLBConfig: Error deleting service group %s: %v\n", groupName, err)
+		return err
+	}
+	logrus.Debugf("a10 RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the members of the service groups, the groups stay assigned
+func (*A10Handler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		group, err := getServiceGroup(config.LBTargetPoolName)
+		if err == errNotFound {
+			continue
+		} else if err == nil {
+			err = checkServiceGroupOwner(group.Name, config.OwnerID)
+		}
+		if err == nil {
+			group.MemberList = []member{}
+			err = doRequest("PUT", "/slb/service-group/"+url.QueryEscape(group.Name), map[string]interface{}{"service-group": group}, nil)
+		}
+		if err != nil {
+			logrus.Errorf("a10 CleanupLBConfigs: Error removing the members of service group %s: %v\n", config.LBTargetPoolName, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("a10 CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*A10Handler) GetLBConfigs() ([]model.LBConfig, error) {
+	var resp struct {
+		VirtualServers []virtualServer `json:"virtual-server-list"`
+	}
+	if err := doRequest("GET", "/slb/virtual-server", nil, &resp); err != nil && err != errNotFound {
+		logrus.Errorf("a10 GetLBConfigs: Error listing virtual servers: %v\n", err)
+		return nil, err
+	}
+	servers := make(map[string]*server)
+	var lbConfigs []model.LBConfig
+	for _, vs := range resp.VirtualServers {
+		for _, vp := range vs.PortList {
+			if len(vp.ServiceGroup) == 0 {
+				continue
+			}
+			group, err := getServiceGroup(vp.ServiceGroup)
+			if err == errNotFound {
+				continue
+			} else if err != nil {
+				logrus.Errorf("a10 GetLBConfigs: Error getting service group %s: %v\n", vp.ServiceGroup, err)
+				return nil, err
+			}
+			config := model.LBConfig{
+				LBEndpoint:       fmt.Sprintf("%s:%d", vs.Name, vp.PortNumber),
+				LBTargetPoolName: group.Name,
+			}
+			if strings.HasPrefix(group.UserTag, ownerTagPrefix) {
+				config.OwnerID = strings.TrimPrefix(group.UserTag, ownerTagPrefix)
+			}
+			for _, m := range group.MemberList {
+				config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: m.Name, Port: strconv.Itoa(m.Port)})
+			}
+			// the connection limit is kept on the server ports
+			if len(group.MemberList) != 0 {
+				m := group.MemberList[0]
+				s, ok := servers[m.Name]
+				if !ok {
+					s, err = getServer(m.Name)
+					if err != nil && err != errNotFound {
+						logrus.Errorf("a10 GetLBConfigs: Error getting server %s: %v\n", m.Name, err)
+						return nil, err
+					}
+					servers[m.Name] = s
+				}
+				if s != nil {
+					for _, p := range s.PortList {
+						if p.PortNumber == m.Port {
+							config.MaxConn = p.ConnLimit
+						}
+					}
+				}
+			}
+			lbConfigs = append(lbConfigs, config)
+		}
+	}
+	return lbConfigs, nil
+}
+
+func (*A10Handler) TestConnection() error {
+	return doRequest("GET", "/version/oper", nil, nil)
+}
+
+// the connection limit is read back from the server ports
+func (*A10Handler) AppliesMaxConn() bool {
+	return true
+}
+
+// parseEndpoint splits a "<virtual server>:<port>" LB endpoint.
+func parseEndpoint(endpoint string) (string, int, error) {
+	i := strings.LastIndex(endpoint, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid LB endpoint %s, expected <virtual server>:<port>", endpoint)
+	}
+	port, err := strconv.Atoi(endpoint[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid LB endpoint %s, expected <virtual server>:<port>", endpoint)
+	}
+	return endpoint[:i], port, nil
+}
+
+// memberProtocol maps a virtual port protocol to the protocol of the
+// service group and server ports behind it.
+func memberProtocol(protocol string) string {
+	if protocol == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func virtualPortPath(vsName string, vp *vPort) string {
+	return fmt.Sprintf("/slb/virtual-server/%s/port/%d+%s", url.QueryEscape(vsName), vp.PortNumber, vp.Protocol)
+}
+
+func getVirtualPort(vsName string, port int) (*vPort, error) {
+	var resp struct {
+		VirtualServer virtualServer `json:"virtual-server"`
+	}
+	if err := doRequest("GET", "/slb/virtual-server/"+url.QueryEscape(vsName), nil, &resp); err != nil {
+		return nil, err
+	}
+	for i := range resp.VirtualServer.PortList {
+		if resp.VirtualServer.PortList[i].PortNumber == port {
+			return &resp.VirtualServer.PortList[i], nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func getServiceGroup(groupName string) (*serviceGroup, error) {
+	var resp struct {
+		ServiceGroup serviceGroup `json:"service-group"`
+	}
+	if err := doRequest("GET", "/slb/service-group/"+url.QueryEscape(groupName), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.ServiceGroup, nil
+}
+
+// checkServiceGroupOwner refuses access to a service group owned by someone else.
+func checkServiceGroupOwner(groupName string, ownerID string) error {
+	group, err := getServiceGroup(groupName)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(group.UserTag, ownerTagPrefix) {
+		return nil
+	}
+	owner := strings.TrimPrefix(group.UserTag, ownerTagPrefix)
+	if owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("service group %s is owned by %s, refusing to modify it as %s", groupName, owner, ownerID)
+}
+
+func getServer(serverName string) (*server, error) {
+	var resp struct {
+		Server server `json:"server"`
+	}
+	if err := doRequest("GET", "/slb/server/"+url.QueryEscape(serverName), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Server, nil
+}
+
+// ensureServer creates the server of a target, named after its IP, and
+// sets the connection limit of the target port on it.
+func ensureServer(ip string, port int, protocol string, connLimit int) error {
+	s, err := getServer(ip)
+	if err == errNotFound {
+		s = &server{Name: ip, Host: ip, PortList: []serverPort{{PortNumber: port, Protocol: protocol, ConnLimit: connLimit}}}
+		return doRequest("POST", "/slb/server", map[string]interface{}{"server": s}, nil)
+	} else if err != nil {
+		return err
+	}
+	for _, p := range s.PortList {
+		if p.PortNumber == port && p.Protocol == protocol && p.ConnLimit == connLimit {
+			return nil
+		}
+	}
+	body := map[string]interface{}{"port": serverPort{PortNumber: port, Protocol: protocol, ConnLimit: connLimit}}
+	path := fmt.Sprintf("/slb/server/%s/port/%d+%s", url.QueryEscape(ip), port, protocol)
+	err = doRequest("POST", path, body, nil)
+	if err == errNotFound {
+		// the port is not configured on the server yet
+		err = doRequest("POST", "/slb/server/"+url.QueryEscape(ip)+"/port", body, nil)
+	}
+	return err
+}
+
+// authenticate issues a new session signature unless the current one
+// differs from expired, i.e. it was renewed concurrently, and returns it.
+func authenticate(expired string) (string, error) {
+	signatureLock.Lock()
+	defer signatureLock.Unlock()
+	if len(signature) != 0 && signature != expired {
+		return signature, nil
+	}
+	body := map[string]interface{}{"credentials": map[string]string{"username": user, "password": password}}
+	var resp struct {
+		AuthResponse struct {
+			Signature string `json:"signature"`
+		} `json:"authresponse"`
+	}
+	if err := sendRequest("", "POST", "/auth", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.AuthResponse.Signature) == 0 {
+		return "", fmt.Errorf("no signature in the auth response")
+	}
+	signature = resp.AuthResponse.Signature
+	return signature, nil
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	current, err := authenticate("")
+	if err != nil {
+		return err
+	}
+	err = sendRequest(current, method, path, body, out)
+	if err == errUnauthorized {
+		// the session expired, log in again and retry once
+		if current, err = authenticate(current); err != nil {
+			return err
+		}
+		err = sendRequest(current, method, path, body, out)
+	}
+	return err
+}
+
+func sendRequest(authSignature string, method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, baseURL+"/axapi/v3"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(authSignature) != 0 {
+		req.Header.Set("Authorization", "A10 "+authSignature)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
@@ -0,0 +1,469 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	name = "avi"
+
+	// ownerDescriptionPrefix marks the pool description carrying the owner ID
+	ownerDescriptionPrefix = "managed-by external-lb "
+
+	defaultAPIVersion = "18.2.1"
+)
+
+var (
+	controllerURL   string
+	user            string
+	password        string
+	tenant          string
+	apiVersion      string
+	settings        map[string]string
+	client          *http.Client
+	errNotFound     = fmt.Errorf("not found")
+	errUnauthorized = fmt.Errorf("unauthorized")
+
+	// loginLock serializes logins when the session expired
+	loginLock sync.Mutex
+)
+
+func init() {
+	aviHandler := &AviHandler{}
+	if err := providers.RegisterProvider(name, aviHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// AviHandler manages the pools of existing Avi Vantage virtual services.
+// The LB endpoint is the name of the virtual service, a pool named after
+// the target pool is created for it and its servers are reconciled on every
+// metadata change.
+type AviHandler struct {
+}
+
+type virtualService struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	PoolRef string `json:"pool_ref"`
+}
+
+type pool struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	MaxConn     int      `json:"max_concurrent_connections_per_server"`
+	Servers     []server `json:"servers"`
+}
+
+type server struct {
+	IP   ipAddr `json:"ip"`
+	Port int    `json:"port"`
+}
+
+type ipAddr struct {
+	Addr string `json:"addr"`
+	Type string `json:"type"`
+}
+
+func (*AviHandler) Init() error {
+	controllerURL = strings.TrimSuffix(os.Getenv("AVI_CONTROLLER"), "/")
+	if len(controllerURL) == 0 {
+		return fmt.Errorf("AVI_CONTROLLER is not set")
+	}
+	if !strings.Contains(controllerURL, "://") {
+		controllerURL = "https://" + controllerURL
+	}
+	user = os.Getenv("AVI_USER")
+	if len(user) == 0 {
+		return fmt.Errorf("AVI_USER is not set")
+	}
+	password = os.Getenv("AVI_PWD")
+	if len(password) == 0 {
+		return fmt.Errorf("AVI_PWD is not set")
+	}
+	tenant = os.Getenv("AVI_TENANT")
+	if len(tenant) == 0 {
+		tenant = "admin"
+	}
+	apiVersion = os.Getenv("AVI_API_VERSION")
+	if len(apiVersion) == 0 {
+		apiVersion = defaultAPIVersion
+	}
+
+	settings = map[string]string{
+		"AVI_CONTROLLER":  controllerURL,
+		"AVI_USER":        user,
+		"AVI_PWD":         providers.Redacted,
+		"AVI_TENANT":      tenant,
+		"AVI_API_VERSION": apiVersion,
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client = &http.Client{Timeout: 30 * time.Second, Jar: jar}
+	if err := login(); err != nil {
+		return fmt.Errorf("Connecting to Avi controller %v does not work, error: %v", controllerURL, err)
+	}
+	return nil
+}
+
+func (*AviHandler) GetName() string {
+	return name
+}
+
+func (*AviHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*AviHandler) AddLBConfig(config model.LBConfig) error {
+	vs, err := getVirtualService(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("avi AddLBConfig: Error getting virtual service %s, cannot add the config: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if len(vs.PoolRef) != 0 {
+		current, err := getPoolByRef(vs.PoolRef)
+		if err != nil && err != errNotFound {
+			logrus.Errorf("avi AddLBConfig: Error getting the pool of virtual service %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+		if err == nil {
+			if err := checkPoolOwner(current, config.OwnerID); err != nil {
+				logrus.Errorf("avi AddLBConfig: %v\n", err)
+				return err
+			}
+		}
+	}
+
+	desired := pool{
+		Name:        config.LBTargetPoolName,
+		Description: ownerDescriptionPrefix + config.OwnerID,
+		MaxConn:     config.MaxConn,
+	}
+	for _, target := range config.LBTargets {
+		port, err := strconv.Atoi(target.Port)
+		if err != nil {
+			err = fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+			logrus.Errorf("avi AddLBConfig: %v\n", err)
+			return err
+		}
+		desired.Servers = append(desired.Servers, server{IP: ipAddr{Addr: target.HostIP, Type: "V4"}, Port: port})
+	}
+
+	existing, err := getPoolByName(config.LBTargetPoolName)
+	var poolUUID string
+	if err == errNotFound {
+		var created pool
+		if err := doRequest("POST", "/api/pool", desired, &created); err != nil {
+			logrus.Errorf("avi AddLBConfig: Error creating pool %s: %v\n", desired.Name, err)
+			return err
+		}
+		poolUUID = created.UUID
+	} else if err != nil {
+		logrus.Errorf("avi AddLBConfig: Error getting pool %s: %v\n", desired.Name, err)
+		return err
+	} else {
+		if err := checkPoolOwner(existing, config.OwnerID); err != nil {
+			logrus.Errorf("avi AddLBConfig: %v\n", err)
+			return err
+		}
+		replace := map[string]interface{}{
+			"description":                           desired.Description,
+			"max_concurrent_connections_per_server": desired.MaxConn,
+			"servers":                               desired.Servers,
+		}
+		if err := doRequest("PATCH", "/api/pool/"+existing.UUID, map[string]interface{}{"replace": replace}, nil); err != nil {
+			logrus.Errorf("avi AddLBConfig: Error modifying pool %s: %v\n", desired.Name, err)
+			return err
+		}
+		poolUUID = existing.UUID
+	}
+
+	if refUUID(vs.PoolRef) != poolUUID {
+		replace := map[string]interface{}{"pool_ref": "/api/pool/" + poolUUID}
+		if err := doRequest("PATCH", "/api/virtualservice/"+vs.UUID, map[string]interface{}{"replace": replace}, nil); err != nil {
+			logrus.Errorf("avi AddLBConfig: Error assigning pool %s to virtual service %s: %v\n", desired.Name, config.LBEndpoint, err)
+			return err
+		}
+	}
+	logrus.Debugf("avi AddLBConfig: Done")
+	return nil
+}
+
+func (h *AviHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*AviHandler) RemoveLBConfig(config model.LBConfig) error {
+	existing, err := getPoolByName(config.LBTargetPoolName)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		logrus.Errorf("avi RemoveLBConfig: Error getting pool %s: %v\n", config.LBTargetPoolName, err)
+		return err
+	}
+	if err := checkPoolOwner(existing, config.OwnerID); err != nil {
+		logrus.Errorf("avi RemoveLBConfig: %v\n", err)
+		return err
+	}
+	vs, err := getVirtualService(config.LBEndpoint)
+	if err != nil && err != errNotFound {
+		logrus.Errorf("avi RemoveLBConfig: Error getting virtual service %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if err == nil && refUUID(vs.PoolRef) == existing.UUID {
+		body := map[string]interface{}{"delete": map[string]interface{}{"pool_ref": vs.PoolRef}}
+		if err := doRequest("PATCH", "/api/virtualservice/"+vs.UUID, body, nil); err != nil {
+			logrus.Errorf("avi RemoveLBConfig: Error unassigning pool from virtual service %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+	}
+	if err := doRequest("DELETE", "/api/pool/"+existing.UUID, nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("avi RemoveLBConfig: Error deleting pool %s: %v\n", config.LBTargetPoolName, err)
+		return err
+	}
+	logrus.Debugf("avi RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the servers of the pools, the pools stay assigned
+func (*AviHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		existing, err := getPoolByName(config.LBTargetPoolName)
+		if err == errNotFound {
+			continue
+		} else if err == nil {
+			err = checkPoolOwner(existing, config.OwnerID)
+		}
+		if err == nil {
+			replace := map[string]interface{}{"servers": []server{}}
+			err = doRequest("PATCH", "/api/pool/"+existing.UUID, map[string]interface{}{"replace": replace}, nil)
+		}
+		if err != nil {
+			logrus.Errorf("avi CleanupLBConfigs: Error removing the servers of pool %s: %v\n", config.LBTargetPoolName, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("avi CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*AviHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	var lbConfigs []model.LBConfig
+	next := "/api/virtualservice?fields=name,pool_ref"
+	for len(next) != 0 {
+		var page struct {
+			Results []virtualService `json:"results"`
+			Next    string           `json:"next"`
+		}
+		if err := doRequest("GET", next, nil, &page); err != nil {
+			logrus.Errorf("avi GetLBConfigs: Error listing virtual services: %v\n", err)
+			return nil, err
+		}
+		for _, vs := range page.Results {
+			if len(vs.PoolRef) == 0 {
+				continue
+			}
+			p, err := getPoolByRef(vs.PoolRef)
+			if err == errNotFound {
+				continue
+			} else if err != nil {
+				logrus.Errorf("avi GetLBConfigs: Error getting the pool of virtual service %s: %v\n", vs.Name, err)
+				return nil, err
+			}
+			lbConfigs = append(lbConfigs, poolLBConfig(vs.Name, p))
+		}
+		next = ""
+		if len(page.Next) != 0 {
+			if u, err := url.Parse(page.Next); err == nil {
+				next = u.RequestURI()
+			}
+		}
+	}
+	return lbConfigs, nil
+}
+
+func (*AviHandler) TestConnection() error {
+	return doRequest("GET", "/api/cluster", nil, nil)
+}
+
+// the connection limit is read back from the pool
+func (*AviHandler) AppliesMaxConn() bool {
+	return true
+}
+
+func poolLBConfig(endpoint string, p *pool) model.LBConfig {
+	config := model.LBConfig{
+		LBEndpoint:       endpoint,
+		LBTargetPoolName: p.Name,
+		MaxConn:          p.MaxConn,
+	}
+	if strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		config.OwnerID = strings.TrimPrefix(p.Description, ownerDescriptionPrefix)
+	}
+	for _, s := range p.Servers {
+		config.LBTargets = append(config.LBTargets, model.LBTarget{
+			HostIP: s.IP.Addr,
+			Port:   strconv.Itoa(s.Port),
+		})
+	}
+	return config
+}
+
+// checkPoolOwner refuses access to a pool owned by someone else.
+func checkPoolOwner(p *pool, ownerID string) error {
+	if !strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		return nil
+	}
+	owner := strings.TrimPrefix(p.Description, ownerDescriptionPrefix)
+	if owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("pool %s is owned by %s, refusing to modify it as %s", p.Name, owner, ownerID)
+}
+
+// refUUID returns the UUID an object reference URL points to.
+func refUUID(ref string) string {
+	if i := strings.Index(ref, "#"); i >= 0 {
+		ref = ref[:i]
+	}
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+func getVirtualService(name string) (*virtualService, error) {
+	var page struct {
+		Results []virtualService `json:"results"`
+	}
+	if err := doRequest("GET", "/api/virtualservice?name="+url.QueryEscape(name), nil, &page); err != nil {
+		return nil, err
+	}
+	if len(page.Results) == 0 {
+		return nil, errNotFound
+	}
+	return &page.Results[0], nil
+}
+
+func getPoolByName(name string) (*pool, error) {
+	var page struct {
+		Results []pool `json:"results"`
+	}
+	if err := doRequest("GET", "/api/pool?name="+url.QueryEscape(name), nil, &page); err != nil {
+		return nil, err
+	}
+	if len(page.Results) == 0 {
+		return nil, errNotFound
+	}
+	return &page.Results[0], nil
+}
+
+func getPoolByRef(ref string) (*pool, error) {
+	var p pool
+	if err := doRequest("GET", "/api/pool/"+refUUID(ref), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func login() error {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+	data, err := json.Marshal(map[string]string{"username": user, "password": password})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(controllerURL+"/login", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login returned %s", resp.Status)
+	}
+	return nil
+}
+
+func csrfToken() string {
+	u, err := url.Parse(controllerURL)
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range client.Jar.Cookies(u) {
+		if cookie.Name == "csrftoken" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	err := sendRequest(method, path, body, out)
+	if err == errUnauthorized {
+		// the session expired, log in again and retry once
+		if err = login(); err != nil {
+			return err
+		}
+		err = sendRequest(method, path, body, out)
+	}
+	return err
+}
+
+func sendRequest(method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, controllerURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Avi-Version", apiVersion)
+	req.Header.Set("X-Avi-Tenant", tenant)
+	req.Header.Set("X-CSRFToken", csrfToken())
+	req.Header.Set("Referer", controllerURL)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
@@ -0,0 +1,480 @@
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	name = "cloudflare"
+
+	apiURL = "https://api.cloudflare.com/client/v4"
+
+	// ownerDescriptionPrefix marks the pool description carrying the
+	// poolRecord of a managed pool
+	ownerDescriptionPrefix = "managed-by external-lb "
+)
+
+var (
+	apiToken  string
+	zoneID    string
+	accountID string
+	proxied   bool
+	settings  map[string]string
+	client    = &http.Client{Timeout: 30 * time.Second}
+)
+
+func init() {
+	cloudflareHandler := &CloudflareHandler{}
+	if err := providers.RegisterProvider(name, cloudflareHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// CloudflareHandler manages Cloudflare load balancers and their pools. The
+// LB endpoint is the load balancer hostname, e.g. app.example.com. Load
+// balancers are created on demand with a single pool named after the
+// target pool, holding one origin per target.
+//
+// Cloudflare origins have no port, traffic is sent to the standard ports
+// of the origin IP. The target port is only kept in the origin name.
+type CloudflareHandler struct {
+}
+
+type loadBalancer struct {
+	ID           string   `json:"id,omitempty"`
+	Name         string   `json:"name"`
+	DefaultPools []string `json:"default_pools"`
+	FallbackPool string   `json:"fallback_pool"`
+	Proxied      bool     `json:"proxied"`
+}
+
+type pool struct {
+	ID          string   `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Enabled     bool     `json:"enabled"`
+	Origins     []origin `json:"origins"`
+}
+
+type origin struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+// poolRecord is kept in the description of managed pools, pool names may
+// only contain alphanumeric characters, hyphens and underscores.
+type poolRecord struct {
+	TargetPoolName string `json:"pool"`
+	OwnerID        string `json:"owner,omitempty"`
+}
+
+type response struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+func (*CloudflareHandler) Init() error {
+	apiToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	if len(apiToken) == 0 {
+		return fmt.Errorf("CLOUDFLARE_API_TOKEN is not set")
+	}
+	zoneID = os.Getenv("CLOUDFLARE_ZONE_ID")
+	if len(zoneID) == 0 {
+		return fmt.Errorf("CLOUDFLARE_ZONE_ID is not set")
+	}
+	accountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	if len(accountID) == 0 {
+		return fmt.Errorf("CLOUDFLARE_ACCOUNT_ID is not set")
+	}
+	proxied = os.Getenv("CLOUDFLARE_PROXIED") != "false"
+
+	settings = map[string]string{
+		"CLOUDFLARE_API_TOKEN":  providers.Redacted,
+		"CLOUDFLARE_ZONE_ID":    zoneID,
+		"CLOUDFLARE_ACCOUNT_ID": accountID,
+		"CLOUDFLARE_PROXIED":    fmt.Sprintf("%t", proxied),
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to Cloudflare does not work, error: %v", err)
+	}
+	return nil
+}
+
+func (*CloudflareHandler) GetName() string {
+	return name
+}
+
+func (*CloudflareHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*CloudflareHandler) AddLBConfig(config model.LBConfig) error {
+	pools, err := listPools()
+	if err != nil {
+		logrus.Errorf("cloudflare AddLBConfig: Error listing pools: %v\n", err)
+		return err
+	}
+	lb, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("cloudflare AddLBConfig: Error getting load balancer %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if lb != nil {
+		for _, poolID := range lb.DefaultPools {
+			if p, ok := pools[poolID]; ok {
+				if err := checkPoolOwner(p, config.OwnerID); err != nil {
+					logrus.Errorf("cloudflare AddLBConfig: %v\n", err)
+					return err
+				}
+			}
+		}
+	}
+
+	desired, err := newPool(config)
+	if err != nil {
+		logrus.Errorf("cloudflare AddLBConfig: %v\n", err)
+		return err
+	}
+	poolsPath := "/accounts/" + accountID + "/load_balancers/pools"
+	var result pool
+	if existing := findPool(pools, desired.Name); existing == nil {
+		err = doRequest("POST", poolsPath, desired, &result)
+	} else if err = checkPoolOwner(existing, config.OwnerID); err == nil {
+		err = doRequest("PUT", poolsPath+"/"+existing.ID, desired, &result)
+	}
+	if err != nil {
+		logrus.Errorf("cloudflare AddLBConfig: Error writing pool %s: %v\n", desired.Name, err)
+		return err
+	}
+
+	lbPath := "/zones/" + zoneID + "/load_balancers"
+	if lb == nil {
+		lb = &loadBalancer{
+			Name:         config.LBEndpoint,
+			DefaultPools: []string{result.ID},
+			FallbackPool: result.ID,
+			Proxied:      proxied,
+		}
+		err = doRequest("POST", lbPath, lb, nil)
+	} else if len(lb.DefaultPools) != 1 || lb.DefaultPools[0] != result.ID || lb.FallbackPool != result.ID {
+		lb.DefaultPools = []string{result.ID}
+		lb.FallbackPool = result.ID
+		err = doRequest("PUT", lbPath+"/"+lb.ID, lb, nil)
+	}
+	if err != nil {
+		logrus.Errorf("cloudflare AddLBConfig: Error writing load balancer %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	logrus.Debugf("cloudflare AddLBConfig: Done")
+	return nil
+}
+
+func (h *CloudflareHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+// RemoveLBConfig deletes the load balancer and then its pool, a pool cannot
+// be deleted while a load balancer still uses it.
+func (*CloudflareHandler) RemoveLBConfig(config model.LBConfig) error {
+	pools, err := listPools()
+	if err != nil {
+		logrus.Errorf("cloudflare RemoveLBConfig: Error listing pools: %v\n", err)
+		return err
+	}
+	existing := findPool(pools, poolName(config.LBTargetPoolName))
+	if existing != nil {
+		if err := checkPoolOwner(existing, config.OwnerID); err != nil {
+			logrus.Errorf("cloudflare RemoveLBConfig: %v\n", err)
+			return err
+		}
+	}
+	lb, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("cloudflare RemoveLBConfig: Error getting load balancer %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if lb != nil {
+		if err := doRequest("DELETE", "/zones/"+zoneID+"/load_balancers/"+lb.ID, nil, nil); err != nil {
+			logrus.Errorf("cloudflare RemoveLBConfig: Error deleting load balancer %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+	}
+	if existing != nil {
+		if err := doRequest("DELETE", "/accounts/"+accountID+"/load_balancers/pools/"+existing.ID, nil, nil); err != nil {
+			logrus.Errorf("cloudflare RemoveLBConfig: Error deleting pool %s: %v\n", existing.Name, err)
+			return err
+		}
+	}
+	logrus.Debugf("cloudflare RemoveLBConfig: Done")
+	return nil
+}
+
+// disable the origins of the pools, the load balancers are kept
+func (*CloudflareHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	pools, err := listPools()
+	if err != nil {
+		logrus.Errorf("cloudflare CleanupLBConfigs: Error listing pools: %v\n", err)
+		return err
+	}
+	var lastErr error
+	for _, config := range configs {
+		existing := findPool(pools, poolName(config.LBTargetPoolName))
+		if existing == nil {
+			continue
+		}
+		err := checkPoolOwner(existing, config.OwnerID)
+		if err == nil {
+			// a pool needs at least one origin, disable them instead
+			for i := range existing.Origins {
+				existing.Origins[i].Enabled = false
+			}
+			err = doRequest("PUT", "/accounts/"+accountID+"/load_balancers/pools/"+existing.ID, existing, nil)
+		}
+		if err != nil {
+			logrus.Errorf("cloudflare CleanupLBConfigs: Error disabling the origins of pool %s: %v\n", existing.Name, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("cloudflare CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*CloudflareHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	pools, err := listPools()
+	if err != nil {
+		logrus.Errorf("cloudflare GetLBConfigs: Error listing pools: %v\n", err)
+		return nil, err
+	}
+	var lbs []loadBalancer
+	if err := doPagedRequest("/zones/"+zoneID+"/load_balancers", func(result json.RawMessage) error {
+		var page []loadBalancer
+		if err := json.Unmarshal(result, &page); err != nil {
+			return err
+		}
+		lbs = append(lbs, page...)
+		return nil
+	}); err != nil {
+		logrus.Errorf("cloudflare GetLBConfigs: Error listing load balancers: %v\n", err)
+		return nil, err
+	}
+
+	var lbConfigs []model.LBConfig
+	for _, lb := range lbs {
+		for _, poolID := range lb.DefaultPools {
+			p, ok := pools[poolID]
+			if !ok {
+				continue
+			}
+			record, ok := getPoolRecord(p)
+			if !ok {
+				continue
+			}
+			config := model.LBConfig{
+				LBEndpoint:       lb.Name,
+				LBTargetPoolName: record.TargetPoolName,
+				OwnerID:          record.OwnerID,
+			}
+			for _, o := range p.Origins {
+				if !o.Enabled {
+					continue
+				}
+				port := ""
+				if i := strings.LastIndex(o.Name, ":"); i >= 0 {
+					port = o.Name[i+1:]
+				}
+				config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: o.Address, Port: port})
+			}
+			lbConfigs = append(lbConfigs, config)
+			break
+		}
+	}
+	return lbConfigs, nil
+}
+
+func (*CloudflareHandler) TestConnection() error {
+	return checkConnection()
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/user/tokens/verify", nil, nil)
+}
+
+func newPool(config model.LBConfig) (*pool, error) {
+	record, err := json.Marshal(poolRecord{
+		TargetPoolName: config.LBTargetPoolName,
+		OwnerID:        config.OwnerID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &pool{
+		Name:        poolName(config.LBTargetPoolName),
+		Description: ownerDescriptionPrefix + string(record),
+		Enabled:     true,
+	}
+	for _, target := range config.LBTargets {
+		p.Origins = append(p.Origins, origin{
+			Name:    target.HostIP + ":" + target.Port,
+			Address: target.HostIP,
+			Enabled: true,
+		})
+	}
+	if len(p.Origins) == 0 {
+		return nil, fmt.Errorf("pool %s has no targets, cloudflare pools need at least one origin", p.Name)
+	}
+	return p, nil
+}
+
+// poolName maps a target pool name to the characters allowed in pool names.
+func poolName(targetPoolName string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, targetPoolName)
+}
+
+func getPoolRecord(p *pool) (poolRecord, bool) {
+	var record poolRecord
+	if !strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		return record, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(p.Description, ownerDescriptionPrefix)), &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// checkPoolOwner refuses access to a pool owned by someone else.
+func checkPoolOwner(p *pool, ownerID string) error {
+	record, ok := getPoolRecord(p)
+	if !ok || len(record.OwnerID) == 0 || record.OwnerID == ownerID {
+		return nil
+	}
+	return fmt.Errorf("pool %s is owned by %s, refusing to modify it as %s", p.Name, record.OwnerID, ownerID)
+}
+
+func findPool(pools map[string]*pool, name string) *pool {
+	for _, p := range pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func listPools() (map[string]*pool, error) {
+	var result []pool
+	if err := doRequest("GET", "/accounts/"+accountID+"/load_balancers/pools", nil, &result); err != nil {
+		return nil, err
+	}
+	pools := make(map[string]*pool, len(result))
+	for i := range result {
+		pools[result[i].ID] = &result[i]
+	}
+	return pools, nil
+}
+
+func findLoadBalancer(hostname string) (*loadBalancer, error) {
+	var found *loadBalancer
+	err := doPagedRequest("/zones/"+zoneID+"/load_balancers", func(result json.RawMessage) error {
+		var page []loadBalancer
+		if err := json.Unmarshal(result, &page); err != nil {
+			return err
+		}
+		for i := range page {
+			if strings.EqualFold(page[i].Name, hostname) {
+				found = &page[i]
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func doPagedRequest(path string, handle func(result json.RawMessage) error) error {
+	for page := 1; ; page++ {
+		resp, err := sendRequest("GET", fmt.Sprintf("%s?page=%d&per_page=50", path, page), nil)
+		if err != nil {
+			return err
+		}
+		if err := handle(resp.Result); err != nil {
+			return err
+		}
+		if resp.ResultInfo.TotalPages <= page {
+			return nil
+		}
+	}
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	resp, err := sendRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	if out != nil && len(resp.Result) != 0 {
+		return json.Unmarshal(resp.Result, out)
+	}
+	return nil
+}
+
+func sendRequest(method string, path string, body interface{}) (*response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, apiURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respData, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, path, httpResp.Status, strings.TrimSpace(string(respData)))
+	}
+	if !resp.Success {
+		var messages []string
+		for _, e := range resp.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, path, httpResp.Status, strings.Join(messages, ", "))
+	}
+	return &resp, nil
+}
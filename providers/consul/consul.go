@@ -0,0 +1,380 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "consul"
+
+	metaPool    = "external-lb-pool"
+	metaOwner   = "external-lb-owner"
+	metaMaxConn = "external-lb-max-conn"
+	// metaHealthCheck holds the JSON encoded custom health check
+	metaHealthCheck = "external-lb-health-check"
+
+	defaultAddr          = "http://127.0.0.1:8500"
+	defaultCheckInterval = "10s"
+)
+
+var (
+	addr          string
+	aclToken      string
+	checkInterval string
+	serviceTags   []string
+	settings      map[string]string
+	client        = &http.Client{Timeout: 30 * time.Second}
+)
+
+func init() {
+	consulHandler := &ConsulHandler{}
+	if err := providers.RegisterProvider(name, consulHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// ConsulHandler registers the targets of each LB config as instances of a
+// Consul service through the local agent, each with a TCP health check.
+// The LB endpoint is the Consul service name, the target pool name and
+// owner are recorded in the service meta data.
+type ConsulHandler struct {
+}
+
+type agentService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+type serviceRegistration struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Meta    map[string]string `json:"Meta"`
+	Check   serviceCheck      `json:"Check"`
+}
+
+type serviceCheck struct {
+	TCP                    string `json:"TCP,omitempty"`
+	HTTP                   string `json:"HTTP,omitempty"`
+	Interval               string `json:"Interval"`
+	SuccessBeforePassing   int    `json:"SuccessBeforePassing,omitempty"`
+	FailuresBeforeCritical int    `json:"FailuresBeforeCritical,omitempty"`
+}
+
+func (*ConsulHandler) Init() error {
+	addr = strings.TrimSuffix(os.Getenv("CONSUL_HTTP_ADDR"), "/")
+	if len(addr) == 0 {
+		addr = defaultAddr
+	} else if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	aclToken = os.Getenv("CONSUL_HTTP_TOKEN")
+	checkInterval = os.Getenv("CONSUL_CHECK_INTERVAL")
+	if len(checkInterval) == 0 {
+		checkInterval = defaultCheckInterval
+	} else if _, err := time.ParseDuration(checkInterval); err != nil {
+		return fmt.Errorf("Invalid CONSUL_CHECK_INTERVAL value %q, expected a duration such as 10s", checkInterval)
+	}
+	serviceTags = nil
+	for _, tag := range strings.Split(os.Getenv("CONSUL_SERVICE_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); len(tag) != 0 {
+			serviceTags = append(serviceTags, tag)
+		}
+	}
+
+	settings = map[string]string{
+		"CONSUL_HTTP_ADDR":      addr,
+		"CONSUL_CHECK_INTERVAL": checkInterval,
+		"CONSUL_SERVICE_TAGS":   strings.Join(serviceTags, ","),
+	}
+	if len(aclToken) != 0 {
+		settings["CONSUL_HTTP_TOKEN"] = providers.Redacted
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to consul agent %v does not work, error: %v", addr, err)
+	}
+	return nil
+}
+
+func (*ConsulHandler) GetName() string {
+	return name
+}
+
+func (*ConsulHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*ConsulHandler) AddLBConfig(config model.LBConfig) error {
+	instances, err := getServiceInstances(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("consul AddLBConfig: Error listing instances of service %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if err := checkOwner(config, instances); err != nil {
+		logrus.Errorf("consul AddLBConfig: %v\n", err)
+		return err
+	}
+
+	desired := make(map[string]bool, len(config.LBTargets))
+	for _, target := range config.LBTargets {
+		port, err := strconv.Atoi(target.Port)
+		if err != nil {
+			err = fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+			logrus.Errorf("consul AddLBConfig: %v\n", err)
+			return err
+		}
+		registration := serviceRegistration{
+			ID:      instanceID(config, target),
+			Name:    config.LBEndpoint,
+			Address: target.HostIP,
+			Port:    port,
+			Tags:    serviceTags,
+			Meta:    map[string]string{},
+			Check: serviceCheck{
+				TCP:      target.HostIP + ":" + target.Port,
+				Interval: checkInterval,
+			},
+		}
+		for key, value := range providers.ResourceTags(config) {
+			registration.Meta[key] = value
+		}
+		registration.Meta[metaPool] = config.LBTargetPoolName
+		registration.Meta[metaOwner] = config.OwnerID
+		if config.MaxConn > 0 {
+			registration.Meta[metaMaxConn] = strconv.Itoa(config.MaxConn)
+		}
+		if check := config.HealthCheck; check != nil {
+			data, err := json.Marshal(check)
+			if err != nil {
+				logrus.Errorf("consul AddLBConfig: %v\n", err)
+				return err
+			}
+			registration.Meta[metaHealthCheck] = string(data)
+			if len(check.Path) != 0 {
+				registration.Check.TCP = ""
+				registration.Check.HTTP = "http://" + target.HostIP + ":" + target.Port + check.Path
+			}
+			if check.Interval > 0 {
+				registration.Check.Interval = fmt.Sprintf("%ds", check.Interval)
+			}
+			registration.Check.SuccessBeforePassing = check.HealthyThreshold
+			registration.Check.FailuresBeforeCritical = check.UnhealthyThreshold
+		}
+		desired[registration.ID] = true
+		if err := doRequest("PUT", "/v1/agent/service/register", registration, nil); err != nil {
+			logrus.Errorf("consul AddLBConfig: Error registering instance %s: %v\n", registration.ID, err)
+			return err
+		}
+	}
+
+	for _, instance := range instances {
+		if desired[instance.ID] {
+			continue
+		}
+		if err := deregister(instance.ID); err != nil {
+			logrus.Errorf("consul AddLBConfig: Error deregistering instance %s: %v\n", instance.ID, err)
+			return err
+		}
+	}
+	logrus.Debugf("consul AddLBConfig: Done")
+	return nil
+}
+
+func (h *ConsulHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*ConsulHandler) RemoveLBConfig(config model.LBConfig) error {
+	if err := deregisterAll(config); err != nil {
+		logrus.Errorf("consul RemoveLBConfig: %v\n", err)
+		return err
+	}
+	logrus.Debugf("consul RemoveLBConfig: Done")
+	return nil
+}
+
+// a consul service only exists through its instances, so deregistering the
+// targets is the same as removing the config
+func (*ConsulHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		if err := deregisterAll(config); err != nil {
+			logrus.Errorf("consul CleanupLBConfigs: %v\n", err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("consul CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*ConsulHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	services, err := getManagedServices()
+	if err != nil {
+		logrus.Errorf("consul GetLBConfigs: Error listing agent services: %v\n", err)
+		return nil, err
+	}
+	configs := make(map[string]*model.LBConfig)
+	for _, service := range services {
+		config, ok := configs[service.Service]
+		if !ok {
+			config = &model.LBConfig{
+				LBEndpoint:       service.Service,
+				LBTargetPoolName: service.Meta[metaPool],
+				OwnerID:          service.Meta[metaOwner],
+			}
+			config.MaxConn, _ = strconv.Atoi(service.Meta[metaMaxConn])
+			if data, ok := service.Meta[metaHealthCheck]; ok {
+				config.HealthCheck = &model.HealthCheck{}
+				if err := json.Unmarshal([]byte(data), config.HealthCheck); err != nil {
+					logrus.Warnf("consul GetLBConfigs: Invalid health check of service %s: %v", service.Service, err)
+				}
+			}
+			configs[service.Service] = config
+		}
+		config.LBTargets = append(config.LBTargets, model.LBTarget{
+			HostIP: service.Address,
+			Port:   strconv.Itoa(service.Port),
+		})
+	}
+	var lbConfigs []model.LBConfig
+	for _, config := range configs {
+		lbConfigs = append(lbConfigs, *config)
+	}
+	return lbConfigs, nil
+}
+
+func (*ConsulHandler) TestConnection() error {
+	return checkConnection()
+}
+
+// the connection limit is recorded in the service meta data
+func (*ConsulHandler) AppliesMaxConn() bool {
+	return true
+}
+
+// the health check is recorded in the service meta data
+func (*ConsulHandler) AppliesHealthChecks() bool {
+	return true
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/v1/agent/self", nil, nil)
+}
+
+func instanceID(config model.LBConfig, target model.LBTarget) string {
+	return config.LBTargetPoolName + "-" + target.HostIP + "-" + target.Port
+}
+
+// checkOwner refuses to touch a service that has instances registered by
+// someone else.
+func checkOwner(config model.LBConfig, instances []agentService) error {
+	for _, instance := range instances {
+		owner := instance.Meta[metaOwner]
+		if len(owner) != 0 && owner != config.OwnerID {
+			return fmt.Errorf("service %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, owner, config.OwnerID)
+		}
+	}
+	return nil
+}
+
+func deregisterAll(config model.LBConfig) error {
+	instances, err := getServiceInstances(config.LBEndpoint)
+	if err != nil {
+		return fmt.Errorf("Error listing instances of service %s: %v", config.LBEndpoint, err)
+	}
+	if err := checkOwner(config, instances); err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if err := deregister(instance.ID); err != nil {
+			return fmt.Errorf("Error deregistering instance %s: %v", instance.ID, err)
+		}
+	}
+	return nil
+}
+
+func deregister(id string) error {
+	return doRequest("PUT", "/v1/agent/service/deregister/"+url.QueryEscape(id), nil, nil)
+}
+
+// getManagedServices returns the agent services registered by external-lb,
+// registrations of older versions are only marked by the pool meta key.
+func getManagedServices() ([]agentService, error) {
+	var services map[string]agentService
+	if err := doRequest("GET", "/v1/agent/services", nil, &services); err != nil {
+		return nil, err
+	}
+	var managed []agentService
+	for _, service := range services {
+		if service.Meta[providers.ManagedByTag] == providers.ManagedBy || len(service.Meta[metaPool]) != 0 {
+			managed = append(managed, service)
+		}
+	}
+	return managed, nil
+}
+
+func getServiceInstances(serviceName string) ([]agentService, error) {
+	services, err := getManagedServices()
+	if err != nil {
+		return nil, err
+	}
+	var instances []agentService
+	for _, service := range services {
+		if service.Service == serviceName {
+			instances = append(instances, service)
+		}
+	}
+	return instances, nil
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, addr+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(aclToken) != 0 {
+		req.Header.Set("X-Consul-Token", aclToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
@@ -0,0 +1,715 @@
+package digitalocean
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "digitalocean"
+
+	// tagPrefix begins the tags recording the LB configs, the fields of
+	// a tag are separated by "::"
+	tagPrefix = "elb::"
+	// maxTagLength is the longest tag name DigitalOcean accepts
+	maxTagLength = 255
+
+	// maximum time to wait for a new load balancer to become active
+	activeTimeout = 5 * time.Minute
+)
+
+var (
+	apiURL      = "https://api.digitalocean.com/v2"
+	apiToken    string
+	region      string
+	sizeUnit    int
+	vpc         string
+	settings    map[string]string
+	client      = &http.Client{Timeout: 30 * time.Second}
+	errNotFound = fmt.Errorf("not found")
+)
+
+func init() {
+	doHandler := &DigitalOceanHandler{}
+	if err := providers.RegisterProvider(name, doHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// DigitalOceanHandler manages DigitalOcean load balancers, one per LB
+// endpoint with a single TCP forwarding rule. The droplets running the
+// targets are selected by a tag, which also records the owner, target pool
+// name and LB endpoint. Load balancers selecting other droplets are never
+// touched.
+type DigitalOceanHandler struct {
+}
+
+type loadBalancer struct {
+	ID                  string           `json:"id,omitempty"`
+	Name                string           `json:"name"`
+	Status              string           `json:"status,omitempty"`
+	Region              json.RawMessage  `json:"region"`
+	SizeUnit            int              `json:"size_unit,omitempty"`
+	Tag                 string           `json:"tag"`
+	ForwardingRules     []forwardingRule `json:"forwarding_rules"`
+	HealthCheck         healthCheck      `json:"health_check"`
+	EnableProxyProtocol bool             `json:"enable_proxy_protocol"`
+	VPC                 string           `json:"vpc_uuid,omitempty"`
+}
+
+type forwardingRule struct {
+	EntryProtocol  string `json:"entry_protocol"`
+	EntryPort      int    `json:"entry_port"`
+	TargetProtocol string `json:"target_protocol"`
+	TargetPort     int    `json:"target_port"`
+}
+
+type healthCheck struct {
+	Protocol               string `json:"protocol"`
+	Port                   int    `json:"port"`
+	CheckIntervalSeconds   int    `json:"check_interval_seconds"`
+	ResponseTimeoutSeconds int    `json:"response_timeout_seconds"`
+	HealthyThreshold       int    `json:"healthy_threshold"`
+	UnhealthyThreshold     int    `json:"unhealthy_threshold"`
+}
+
+type droplet struct {
+	ID       int      `json:"id"`
+	Tags     []string `json:"tags"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+}
+
+// tagRecord is the LB config recorded in a tag. Network is the type of the
+// droplet network holding the target IPs, "public" or "private".
+type tagRecord struct {
+	OwnerID        string
+	TargetPoolName string
+	Endpoint       string
+	Network        string
+}
+
+func (*DigitalOceanHandler) Init() error {
+	apiToken = os.Getenv("DIGITALOCEAN_TOKEN")
+	if len(apiToken) == 0 {
+		return fmt.Errorf("DIGITALOCEAN_TOKEN is not set")
+	}
+	region = os.Getenv("DIGITALOCEAN_REGION")
+	if len(region) == 0 {
+		return fmt.Errorf("DIGITALOCEAN_REGION is not set")
+	}
+	sizeUnit = 1
+	if value := os.Getenv("DIGITALOCEAN_LB_SIZE_UNIT"); len(value) != 0 {
+		var err error
+		if sizeUnit, err = strconv.Atoi(value); err != nil || sizeUnit <= 0 {
+			return fmt.Errorf("Invalid DIGITALOCEAN_LB_SIZE_UNIT value %q, expected a number of nodes", value)
+		}
+	}
+	vpc = os.Getenv("DIGITALOCEAN_VPC")
+
+	settings = map[string]string{
+		"DIGITALOCEAN_TOKEN":        providers.Redacted,
+		"DIGITALOCEAN_REGION":       region,
+		"DIGITALOCEAN_LB_SIZE_UNIT": strconv.Itoa(sizeUnit),
+		"DIGITALOCEAN_VPC":          vpc,
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to DigitalOcean does not work, error: %v", err)
+	}
+	return nil
+}
+
+func (*DigitalOceanHandler) GetName() string {
+	return name
+}
+
+func (*DigitalOceanHandler) GetConfig() map[string]string {
+	return settings
+}
+
+// the PROXY protocol is a setting of the load balancer
+func (*DigitalOceanHandler) AppliesProxyProtocol() bool {
+	return true
+}
+
+func (*DigitalOceanHandler) AddLBConfig(config model.LBConfig) error {
+	rule, err := newForwardingRule(config)
+	if err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: %v\n", err)
+		return err
+	}
+	droplets, err := listDroplets()
+	if err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: Error listing droplets: %v\n", err)
+		return err
+	}
+	targets, network, err := targetDroplets(config, droplets)
+	if err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: %v\n", err)
+		return err
+	}
+	tag, err := encodeTag(tagRecord{
+		OwnerID:        config.OwnerID,
+		TargetPoolName: config.LBTargetPoolName,
+		Endpoint:       config.LBEndpoint,
+		Network:        network,
+	})
+	if err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: %v\n", err)
+		return err
+	}
+
+	lb, record, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: Error listing load balancers: %v\n", err)
+		return err
+	}
+	if lb != nil {
+		if err := checkOwner(lb, record, config.OwnerID); err != nil {
+			logrus.Errorf("digitalocean AddLBConfig: %v\n", err)
+			return err
+		}
+	}
+
+	// the droplets are tagged before the load balancer selects the tag
+	if err := doRequest("POST", "/tags", map[string]string{"name": tag}, nil); err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: Error creating tag %s: %v\n", tag, err)
+		return err
+	}
+	if err := setTaggedDroplets(tag, targets, droplets); err != nil {
+		logrus.Errorf("digitalocean AddLBConfig: Error tagging the droplets of LB endpoint %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+
+	desired := loadBalancer{
+		Name:                lbName(config.LBEndpoint),
+		Tag:                 tag,
+		ForwardingRules:     []forwardingRule{rule},
+		HealthCheck:         newHealthCheck(rule.TargetPort),
+		EnableProxyProtocol: config.ProxyProtocol,
+	}
+	if lb == nil {
+		if err := createLoadBalancer(desired); err != nil {
+			logrus.Errorf("digitalocean AddLBConfig: Error creating load balancer %s: %v\n", desired.Name, err)
+			return err
+		}
+		logrus.Debugf("digitalocean AddLBConfig: Done")
+		return nil
+	}
+
+	if lb.Name != desired.Name || lb.Tag != desired.Tag || lb.EnableProxyProtocol != desired.EnableProxyProtocol ||
+		len(lb.ForwardingRules) != 1 || lb.ForwardingRules[0] != rule || lb.HealthCheck != desired.HealthCheck {
+		desired.Region = lb.Region
+		desired.SizeUnit = lb.SizeUnit
+		desired.VPC = lb.VPC
+		if err := doRequest("PUT", "/load_balancers/"+lb.ID, updateBody(desired), nil); err != nil {
+			logrus.Errorf("digitalocean AddLBConfig: Error updating load balancer %s: %v\n", lb.Name, err)
+			return err
+		}
+	}
+	if lb.Tag != tag {
+		// deleting the tag untags the droplets
+		if err := doRequest("DELETE", "/tags/"+lb.Tag, nil, nil); err != nil && err != errNotFound {
+			logrus.Errorf("digitalocean AddLBConfig: Error deleting tag %s: %v\n", lb.Tag, err)
+			return err
+		}
+	}
+	logrus.Debugf("digitalocean AddLBConfig: Done")
+	return nil
+}
+
+func (h *DigitalOceanHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*DigitalOceanHandler) RemoveLBConfig(config model.LBConfig) error {
+	lb, record, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("digitalocean RemoveLBConfig: Error listing load balancers: %v\n", err)
+		return err
+	}
+	if lb == nil {
+		return nil
+	}
+	if err := checkOwner(lb, record, config.OwnerID); err != nil {
+		logrus.Errorf("digitalocean RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if err := doRequest("DELETE", "/load_balancers/"+lb.ID, nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("digitalocean RemoveLBConfig: Error deleting load balancer %s: %v\n", lb.Name, err)
+		return err
+	}
+	if err := doRequest("DELETE", "/tags/"+lb.Tag, nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("digitalocean RemoveLBConfig: Error deleting tag %s: %v\n", lb.Tag, err)
+		return err
+	}
+	logrus.Debugf("digitalocean RemoveLBConfig: Done")
+	return nil
+}
+
+// untag the droplets of the load balancers, the load balancers are kept
+func (*DigitalOceanHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	droplets, err := listDroplets()
+	if err != nil {
+		logrus.Errorf("digitalocean CleanupLBConfigs: Error listing droplets: %v\n", err)
+		return err
+	}
+	var lastErr error
+	for _, config := range configs {
+		lb, record, err := findLoadBalancer(config.LBEndpoint)
+		if err == nil && lb != nil {
+			if err = checkOwner(lb, record, config.OwnerID); err == nil {
+				err = setTaggedDroplets(lb.Tag, nil, droplets)
+			}
+		}
+		if err != nil {
+			logrus.Errorf("digitalocean CleanupLBConfigs: Error removing the droplets of LB endpoint %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("digitalocean CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*DigitalOceanHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lbs, err := listLoadBalancers()
+	if err != nil {
+		logrus.Errorf("digitalocean GetLBConfigs: Error listing load balancers: %v\n", err)
+		return nil, err
+	}
+	droplets, err := listDroplets()
+	if err != nil {
+		logrus.Errorf("digitalocean GetLBConfigs: Error listing droplets: %v\n", err)
+		return nil, err
+	}
+
+	var lbConfigs []model.LBConfig
+	for _, lb := range lbs {
+		record, ok := decodeTag(lb.Tag)
+		if !ok {
+			continue
+		}
+		config := model.LBConfig{
+			LBEndpoint:       record.Endpoint,
+			LBTargetPoolName: record.TargetPoolName,
+			OwnerID:          record.OwnerID,
+			ProxyProtocol:    lb.EnableProxyProtocol,
+		}
+		port := ""
+		if len(lb.ForwardingRules) != 0 {
+			port = strconv.Itoa(lb.ForwardingRules[0].TargetPort)
+		}
+		for _, d := range droplets {
+			if !hasTag(d, lb.Tag) {
+				continue
+			}
+			if ip := dropletIP(d, record.Network); len(ip) != 0 {
+				config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: ip, Port: port})
+			}
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*DigitalOceanHandler) TestConnection() error {
+	return checkConnection()
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/account", nil, nil)
+}
+
+// lbName is the name of the load balancer of an LB endpoint.
+func lbName(endpoint string) string {
+	return strings.Replace(endpoint, ":", "-", -1)
+}
+
+// newForwardingRule returns the forwarding rule of an LB endpoint. It
+// listens on the port following the last colon of the LB endpoint, or else
+// on the port of the targets. A load balancer forwards to a single target
+// port on all droplets.
+func newForwardingRule(config model.LBConfig) (forwardingRule, error) {
+	rule := forwardingRule{EntryProtocol: "tcp", TargetProtocol: "tcp"}
+	if i := strings.LastIndex(config.LBEndpoint, ":"); i >= 0 {
+		port, err := strconv.Atoi(config.LBEndpoint[i+1:])
+		if err != nil {
+			return rule, fmt.Errorf("invalid port in LB endpoint %s, expected <name>:<port>", config.LBEndpoint)
+		}
+		rule.EntryPort = port
+	}
+	for _, t := range config.LBTargets {
+		port, err := strconv.Atoi(t.Port)
+		if err != nil {
+			return rule, fmt.Errorf("invalid port %q of target %s", t.Port, t.HostIP)
+		}
+		if rule.TargetPort != 0 && port != rule.TargetPort {
+			return rule, fmt.Errorf("the targets of LB endpoint %s listen on the ports %d and %d, DigitalOcean load balancers have a single target port",
+				config.LBEndpoint, rule.TargetPort, port)
+		}
+		rule.TargetPort = port
+	}
+	switch {
+	case rule.EntryPort == 0 && rule.TargetPort == 0:
+		return rule, fmt.Errorf("LB endpoint %s has no port and no targets, expected <name>:<port>", config.LBEndpoint)
+	case rule.EntryPort == 0:
+		rule.EntryPort = rule.TargetPort
+	case rule.TargetPort == 0:
+		rule.TargetPort = rule.EntryPort
+	}
+	return rule, nil
+}
+
+func newHealthCheck(port int) healthCheck {
+	return healthCheck{
+		Protocol:               "tcp",
+		Port:                   port,
+		CheckIntervalSeconds:   10,
+		ResponseTimeoutSeconds: 5,
+		HealthyThreshold:       5,
+		UnhealthyThreshold:     3,
+	}
+}
+
+// targetDroplets returns the IDs of the droplets with the target IPs, and
+// the type of the network holding them. The targets of a load balancer are
+// all public or all private IPs, as only droplets are recorded.
+func targetDroplets(config model.LBConfig, droplets []droplet) (map[int]bool, string, error) {
+	targets := make(map[int]bool)
+	network := "public"
+	for i, t := range config.LBTargets {
+		found := false
+		for _, d := range droplets {
+			for _, n := range d.Networks.V4 {
+				if n.IPAddress != t.HostIP {
+					continue
+				}
+				if i == 0 {
+					network = n.Type
+				} else if n.Type != network {
+					return nil, "", fmt.Errorf("the targets of LB endpoint %s mix public and private droplet IPs", config.LBEndpoint)
+				}
+				targets[d.ID] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("no droplet in the account has the IP %s of a target of LB endpoint %s", t.HostIP, config.LBEndpoint)
+		}
+	}
+	return targets, network, nil
+}
+
+func dropletIP(d droplet, network string) string {
+	for _, n := range d.Networks.V4 {
+		if n.Type == network {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+func hasTag(d droplet, tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// setTaggedDroplets tags the droplets in targets and untags all others.
+func setTaggedDroplets(tag string, targets map[int]bool, droplets []droplet) error {
+	var add, remove []map[string]string
+	for _, d := range droplets {
+		resource := map[string]string{"resource_id": strconv.Itoa(d.ID), "resource_type": "droplet"}
+		switch tagged := hasTag(d, tag); {
+		case targets[d.ID] && !tagged:
+			add = append(add, resource)
+		case !targets[d.ID] && tagged:
+			remove = append(remove, resource)
+		}
+	}
+	if len(add) != 0 {
+		if err := doRequest("POST", "/tags/"+tag+"/resources", map[string]interface{}{"resources": add}, nil); err != nil {
+			return err
+		}
+	}
+	if len(remove) != 0 {
+		if err := doRequest("DELETE", "/tags/"+tag+"/resources", map[string]interface{}{"resources": remove}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTag records an LB config in a tag name. Tag names may only contain
+// letters, digits, dashes, underscores and colons, other characters are
+// escaped as a colon followed by two hex digits.
+func encodeTag(record tagRecord) (string, error) {
+	tag := tagPrefix + strings.Join([]string{
+		escapeTag(record.OwnerID),
+		escapeTag(record.TargetPoolName),
+		escapeTag(record.Endpoint),
+		record.Network,
+	}, "::")
+	if len(tag) > maxTagLength {
+		return "", fmt.Errorf("the owner, target pool name and LB endpoint %s do not fit into a tag of %d characters", record.Endpoint, maxTagLength)
+	}
+	return tag, nil
+}
+
+// decodeTag returns the LB config recorded in a tag name, false if the tag
+// does not record one.
+func decodeTag(tag string) (tagRecord, bool) {
+	if !strings.HasPrefix(tag, tagPrefix) {
+		return tagRecord{}, false
+	}
+	fields := strings.Split(strings.TrimPrefix(tag, tagPrefix), "::")
+	if len(fields) != 4 {
+		return tagRecord{}, false
+	}
+	record := tagRecord{Network: fields[3]}
+	for i, field := range []*string{&record.OwnerID, &record.TargetPoolName, &record.Endpoint} {
+		value, ok := unescapeTag(fields[i])
+		if !ok {
+			return tagRecord{}, false
+		}
+		*field = value
+	}
+	return record, true
+}
+
+func escapeTag(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, ":%02x", c)
+		}
+	}
+	return buf.String()
+}
+
+func unescapeTag(value string) (string, bool) {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != ':' {
+			buf.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		buf.WriteByte(byte(c))
+		i += 2
+	}
+	return buf.String(), true
+}
+
+// checkOwner refuses access to a load balancer owned by someone else.
+func checkOwner(lb *loadBalancer, record tagRecord, ownerID string) error {
+	if len(record.OwnerID) == 0 || record.OwnerID == ownerID {
+		return nil
+	}
+	return fmt.Errorf("load balancer %s is owned by %s, refusing to modify it as %s", lb.Name, record.OwnerID, ownerID)
+}
+
+func createLoadBalancer(desired loadBalancer) error {
+	lbs, err := listLoadBalancers()
+	if err != nil {
+		return err
+	}
+	for _, lb := range lbs {
+		if lb.Name == desired.Name {
+			return fmt.Errorf("a load balancer named %s exists that is not managed by external-lb", desired.Name)
+		}
+	}
+	desired.Region, _ = json.Marshal(region)
+	desired.SizeUnit = sizeUnit
+	desired.VPC = vpc
+	var resp struct {
+		LoadBalancer loadBalancer `json:"load_balancer"`
+	}
+	if err := doRequest("POST", "/load_balancers", desired, &resp); err != nil {
+		return err
+	}
+	return waitForActive(resp.LoadBalancer.ID)
+}
+
+// updateBody returns the body of an update request, which has the region
+// slug in place of the region object returned by the API.
+func updateBody(lb loadBalancer) loadBalancer {
+	var r struct {
+		Slug string `json:"slug"`
+	}
+	if json.Unmarshal(lb.Region, &r) == nil && len(r.Slug) != 0 {
+		lb.Region, _ = json.Marshal(r.Slug)
+	}
+	return lb
+}
+
+// waitForActive waits until a new load balancer can be updated.
+func waitForActive(id string) error {
+	deadline := time.Now().Add(activeTimeout)
+	for {
+		var resp struct {
+			LoadBalancer loadBalancer `json:"load_balancer"`
+		}
+		if err := doRequest("GET", "/load_balancers/"+id, nil, &resp); err != nil {
+			return err
+		}
+		switch resp.LoadBalancer.Status {
+		case "active":
+			return nil
+		case "errored":
+			return fmt.Errorf("load balancer %s errored", resp.LoadBalancer.Name)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for load balancer %s, status %s", resp.LoadBalancer.Name, resp.LoadBalancer.Status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// findLoadBalancer returns the managed load balancer of an LB endpoint and
+// its record, nil if there is none.
+func findLoadBalancer(endpoint string) (*loadBalancer, tagRecord, error) {
+	lbs, err := listLoadBalancers()
+	if err != nil {
+		return nil, tagRecord{}, err
+	}
+	for i := range lbs {
+		if record, ok := decodeTag(lbs[i].Tag); ok && record.Endpoint == endpoint {
+			return &lbs[i], record, nil
+		}
+	}
+	return nil, tagRecord{}, nil
+}
+
+func listLoadBalancers() ([]loadBalancer, error) {
+	var lbs []loadBalancer
+	err := doPagedRequest("/load_balancers", func(data []byte) error {
+		var page struct {
+			LoadBalancers []loadBalancer `json:"load_balancers"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		lbs = append(lbs, page.LoadBalancers...)
+		return nil
+	})
+	return lbs, err
+}
+
+func listDroplets() ([]droplet, error) {
+	var droplets []droplet
+	err := doPagedRequest("/droplets", func(data []byte) error {
+		var page struct {
+			Droplets []droplet `json:"droplets"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		droplets = append(droplets, page.Droplets...)
+		return nil
+	})
+	return droplets, err
+}
+
+// doPagedRequest calls handle with the response of every page of a list
+// request, following the next page links.
+func doPagedRequest(path string, handle func(data []byte) error) error {
+	next := apiURL + path + "?per_page=200"
+	for len(next) != 0 {
+		var data json.RawMessage
+		if err := doRequest("GET", next, nil, &data); err != nil {
+			return err
+		}
+		if err := handle(data); err != nil {
+			return err
+		}
+		var links struct {
+			Links struct {
+				Pages struct {
+					Next string `json:"next"`
+				} `json:"pages"`
+			} `json:"links"`
+		}
+		if err := json.Unmarshal(data, &links); err != nil {
+			return err
+		}
+		next = links.Links.Pages.Next
+	}
+	return nil
+}
+
+// doRequest sends a request to path, which is relative to the API URL
+// unless it is a page link.
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(path, apiURL) {
+		path = apiURL + path
+	}
+	req, err := http.NewRequest(method, path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		var apiErr struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respData, &apiErr) == nil && len(apiErr.Message) != 0 {
+			return fmt.Errorf("%s %s returned %s: %s: %s", method, path, resp.Status, apiErr.ID, apiErr.Message)
+		}
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package digitalocean
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTagRecordsTheConfig(t *testing.T) {
+	record := tagRecord{
+		OwnerID:        "external-lb.lb_1234",
+		TargetPoolName: "web_12345678-90ab_rancher.internal",
+		Endpoint:       "web.example.com:443",
+		Network:        "private",
+	}
+	tag, err := encodeTag(record)
+	if err != nil {
+		t.Fatalf("encoding the tag failed: %v", err)
+	}
+	for _, c := range strings.TrimPrefix(tag, tagPrefix) {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':') {
+			t.Fatalf("tag %q has the invalid character %q", tag, c)
+		}
+	}
+	if decoded, ok := decodeTag(tag); !ok || decoded != record {
+		t.Errorf("got %+v, %v back from tag %q", decoded, ok, tag)
+	}
+	if _, ok := decodeTag("production"); ok {
+		t.Errorf("a tag not written by external-lb was decoded")
+	}
+	record.TargetPoolName = strings.Repeat("web", 100)
+	if _, err := encodeTag(record); err == nil {
+		t.Errorf("expected an error for a tag longer than %d characters", maxTagLength)
+	}
+}
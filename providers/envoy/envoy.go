@@ -0,0 +1,427 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	name = "envoy"
+
+	clusterType    = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	assignmentType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	// metadataKey is the filter metadata namespace the LB config of a
+	// cluster is recorded under
+	metadataKey = "external-lb"
+
+	defaultCDSPath        = "/etc/envoy/cds.json"
+	defaultEDSPath        = "/etc/envoy/eds.json"
+	defaultConnectTimeout = "5s"
+)
+
+var (
+	cdsPath        string
+	edsPath        string
+	connectTimeout string
+	settings       map[string]string
+
+	// lock serializes the read-modify-write cycles on the xDS files
+	lock sync.Mutex
+)
+
+func init() {
+	envoyHandler := &EnvoyHandler{}
+	if err := providers.RegisterProvider(name, envoyHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// EnvoyHandler writes the LB configs as filesystem xDS resources: a CDS
+// file with one EDS cluster per LB endpoint and an EDS file with the
+// endpoints of every cluster. Envoy picks up both files when they are
+// moved into place. The LB endpoint is the cluster name.
+type EnvoyHandler struct {
+}
+
+type discoveryResponse struct {
+	VersionInfo string            `json:"version_info"`
+	Resources   []json.RawMessage `json:"resources"`
+}
+
+type cluster struct {
+	Type             string           `json:"@type"`
+	Name             string           `json:"name"`
+	DiscoveryType    string           `json:"type"`
+	ConnectTimeout   string           `json:"connect_timeout"`
+	EDSClusterConfig edsClusterConfig `json:"eds_cluster_config"`
+	CircuitBreakers  *circuitBreakers `json:"circuit_breakers,omitempty"`
+	Metadata         clusterMetadata  `json:"metadata"`
+}
+
+type edsClusterConfig struct {
+	EDSConfig struct {
+		PathConfigSource struct {
+			Path string `json:"path"`
+		} `json:"path_config_source"`
+		ResourceAPIVersion string `json:"resource_api_version"`
+	} `json:"eds_config"`
+}
+
+type circuitBreakers struct {
+	PerHostThresholds []threshold `json:"per_host_thresholds"`
+}
+
+type threshold struct {
+	MaxConnections int `json:"max_connections"`
+}
+
+type clusterMetadata struct {
+	FilterMetadata map[string]clusterRecord `json:"filter_metadata"`
+}
+
+// clusterRecord is the LB config recorded in the cluster metadata.
+type clusterRecord struct {
+	TargetPoolName string `json:"pool"`
+	OwnerID        string `json:"owner,omitempty"`
+	MaxConn        int    `json:"max_conn,omitempty"`
+}
+
+type clusterLoadAssignment struct {
+	Type        string              `json:"@type"`
+	ClusterName string              `json:"cluster_name"`
+	Endpoints   []localityEndpoints `json:"endpoints"`
+}
+
+type localityEndpoints struct {
+	LBEndpoints []lbEndpoint `json:"lb_endpoints"`
+}
+
+type lbEndpoint struct {
+	Endpoint struct {
+		Address struct {
+			SocketAddress struct {
+				Address   string `json:"address"`
+				PortValue int    `json:"port_value"`
+			} `json:"socket_address"`
+		} `json:"address"`
+	} `json:"endpoint"`
+}
+
+func (*EnvoyHandler) Init() error {
+	cdsPath = os.Getenv("ENVOY_CDS_PATH")
+	if len(cdsPath) == 0 {
+		cdsPath = defaultCDSPath
+	}
+	edsPath = os.Getenv("ENVOY_EDS_PATH")
+	if len(edsPath) == 0 {
+		edsPath = defaultEDSPath
+	}
+	connectTimeout = os.Getenv("ENVOY_CONNECT_TIMEOUT")
+	if len(connectTimeout) == 0 {
+		connectTimeout = defaultConnectTimeout
+	} else if _, err := time.ParseDuration(connectTimeout); err != nil {
+		return fmt.Errorf("Invalid ENVOY_CONNECT_TIMEOUT value %q, expected a duration such as 5s", connectTimeout)
+	}
+
+	settings = map[string]string{
+		"ENVOY_CDS_PATH":        cdsPath,
+		"ENVOY_EDS_PATH":        edsPath,
+		"ENVOY_CONNECT_TIMEOUT": connectTimeout,
+	}
+
+	if err := checkDirs(); err != nil {
+		return fmt.Errorf("Envoy xDS files are not usable, error: %v", err)
+	}
+	return nil
+}
+
+func (*EnvoyHandler) GetName() string {
+	return name
+}
+
+func (*EnvoyHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*EnvoyHandler) AddLBConfig(config model.LBConfig) error {
+	return modifyConfigs("AddLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+func (*EnvoyHandler) RemoveLBConfig(config model.LBConfig) error {
+	return modifyConfigs("RemoveLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		delete(configs, config.LBEndpoint)
+		return nil
+	})
+}
+
+func (*EnvoyHandler) UpdateLBConfig(config model.LBConfig) error {
+	return modifyConfigs("UpdateLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+// remove the endpoints of the clusters, the clusters are kept
+func (*EnvoyHandler) CleanupLBConfigs(cleanup []model.LBConfig) error {
+	return modifyConfigs("CleanupLBConfigs", func(configs map[string]model.LBConfig) error {
+		for _, config := range cleanup {
+			if err := checkOwner(configs, config); err != nil {
+				return err
+			}
+			if existing, ok := configs[config.LBEndpoint]; ok {
+				existing.LBTargets = nil
+				configs[config.LBEndpoint] = existing
+			}
+		}
+		return nil
+	})
+}
+
+func (*EnvoyHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("envoy GetLBConfigs: Error reading xDS files: %v\n", err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, config := range configs {
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*EnvoyHandler) TestConnection() error {
+	return checkDirs()
+}
+
+// the connection limit is part of the cluster record
+func (*EnvoyHandler) AppliesMaxConn() bool {
+	return true
+}
+
+func checkDirs() error {
+	for _, path := range []string{cdsPath, edsPath} {
+		dir := filepath.Dir(path)
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// checkOwner refuses to touch an existing cluster owned by someone else.
+func checkOwner(configs map[string]model.LBConfig, config model.LBConfig) error {
+	existing, ok := configs[config.LBEndpoint]
+	if !ok || len(existing.OwnerID) == 0 || existing.OwnerID == config.OwnerID {
+		return nil
+	}
+	return fmt.Errorf("cluster %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, existing.OwnerID, config.OwnerID)
+}
+
+func modifyConfigs(caller string, modify func(configs map[string]model.LBConfig) error) error {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("envoy %s: Error reading xDS files: %v\n", caller, err)
+		return err
+	}
+	if err := modify(configs); err != nil {
+		logrus.Errorf("envoy %s: %v\n", caller, err)
+		return err
+	}
+	if err := writeConfigs(configs); err != nil {
+		logrus.Errorf("envoy %s: Error writing xDS files: %v\n", caller, err)
+		return err
+	}
+	logrus.Debugf("envoy %s: Done", caller)
+	return nil
+}
+
+// readConfigs rebuilds the LB configs from the clusters in the CDS file and
+// their endpoints in the EDS file.
+func readConfigs() (map[string]model.LBConfig, error) {
+	configs := make(map[string]model.LBConfig)
+
+	var cds discoveryResponse
+	if err := readFile(cdsPath, &cds); err != nil {
+		return nil, err
+	}
+	for _, resource := range cds.Resources {
+		var c cluster
+		if err := json.Unmarshal(resource, &c); err != nil {
+			return nil, err
+		}
+		record, ok := c.Metadata.FilterMetadata[metadataKey]
+		if !ok {
+			continue
+		}
+		configs[c.Name] = model.LBConfig{
+			LBEndpoint:       c.Name,
+			LBTargetPoolName: record.TargetPoolName,
+			OwnerID:          record.OwnerID,
+			MaxConn:          record.MaxConn,
+		}
+	}
+
+	var eds discoveryResponse
+	if err := readFile(edsPath, &eds); err != nil {
+		return nil, err
+	}
+	for _, resource := range eds.Resources {
+		var assignment clusterLoadAssignment
+		if err := json.Unmarshal(resource, &assignment); err != nil {
+			return nil, err
+		}
+		config, ok := configs[assignment.ClusterName]
+		if !ok {
+			continue
+		}
+		for _, locality := range assignment.Endpoints {
+			for _, e := range locality.LBEndpoints {
+				address := e.Endpoint.Address.SocketAddress
+				config.LBTargets = append(config.LBTargets, model.LBTarget{
+					HostIP: address.Address,
+					Port:   strconv.Itoa(address.PortValue),
+				})
+			}
+		}
+		configs[assignment.ClusterName] = config
+	}
+	return configs, nil
+}
+
+func readFile(path string, out interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// writeConfigs writes the EDS file before the CDS file, so new clusters
+// find their endpoints when Envoy loads them.
+func writeConfigs(configs map[string]model.LBConfig) error {
+	var endpoints []string
+	for endpoint := range configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	version := strconv.FormatInt(time.Now().UnixNano(), 10)
+	cds := discoveryResponse{VersionInfo: version, Resources: []json.RawMessage{}}
+	eds := discoveryResponse{VersionInfo: version, Resources: []json.RawMessage{}}
+	for _, endpoint := range endpoints {
+		config := configs[endpoint]
+
+		c := cluster{
+			Type:           clusterType,
+			Name:           config.LBEndpoint,
+			DiscoveryType:  "EDS",
+			ConnectTimeout: connectTimeout,
+			Metadata: clusterMetadata{FilterMetadata: map[string]clusterRecord{
+				metadataKey: {
+					TargetPoolName: config.LBTargetPoolName,
+					OwnerID:        config.OwnerID,
+					MaxConn:        config.MaxConn,
+				},
+			}},
+		}
+		c.EDSClusterConfig.EDSConfig.PathConfigSource.Path = edsPath
+		c.EDSClusterConfig.EDSConfig.ResourceAPIVersion = "V3"
+		if config.MaxConn > 0 {
+			c.CircuitBreakers = &circuitBreakers{
+				PerHostThresholds: []threshold{{MaxConnections: config.MaxConn}},
+			}
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		cds.Resources = append(cds.Resources, data)
+
+		locality := localityEndpoints{LBEndpoints: []lbEndpoint{}}
+		for _, target := range config.LBTargets {
+			port, err := strconv.Atoi(target.Port)
+			if err != nil {
+				return fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+			}
+			var e lbEndpoint
+			e.Endpoint.Address.SocketAddress.Address = target.HostIP
+			e.Endpoint.Address.SocketAddress.PortValue = port
+			locality.LBEndpoints = append(locality.LBEndpoints, e)
+		}
+		assignment := clusterLoadAssignment{
+			Type:        assignmentType,
+			ClusterName: config.LBEndpoint,
+			Endpoints:   []localityEndpoints{locality},
+		}
+		if data, err = json.Marshal(assignment); err != nil {
+			return err
+		}
+		eds.Resources = append(eds.Resources, data)
+	}
+
+	if err := writeFile(edsPath, eds); err != nil {
+		return err
+	}
+	return writeFile(cdsPath, cds)
+}
+
+// writeFile atomically replaces path, Envoy only reloads files that are
+// moved into place.
+func writeFile(path string, response discoveryResponse) error {
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
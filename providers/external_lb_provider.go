@@ -2,27 +2,165 @@ package providers
 
 import (
 	"fmt"
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
+	"sort"
+	"strings"
 )
 
 type Provider interface {
+	// Init reads the provider configuration and connects to the provider.
+	// It is only called for providers that have been selected.
+	Init() error
 	GetName() string
 	AddLBConfig(config model.LBConfig) error
 	RemoveLBConfig(config model.LBConfig) error
 	UpdateLBConfig(config model.LBConfig) error
 	GetLBConfigs() ([]model.LBConfig, error)
+	// CleanupLBConfigs drains and deregisters the targets of the given
+	// configs while leaving the LB endpoints themselves in place.
+	CleanupLBConfigs(configs []model.LBConfig) error
 	TestConnection() error
 }
 
+// ConfigReporter is implemented by providers that can describe their
+// effective settings. Secrets must be redacted by the provider.
+type ConfigReporter interface {
+	GetConfig() map[string]string
+}
+
+// EndpointReader is implemented by providers that can read the config of
+// a single LB endpoint, allowing the provider state to be read concurrently.
+type EndpointReader interface {
+	ListLBEndpoints() ([]string, error)
+	GetLBConfig(endpoint string) (config model.LBConfig, found bool, err error)
+}
+
+// TargetUpdater is implemented by providers that can add and remove single
+// targets of an existing LB config. Updates that only change the targets
+// are sent as UpdateLBTargets calls instead of UpdateLBConfig.
+type TargetUpdater interface {
+	UpdateLBTargets(config model.LBConfig, add []model.LBTarget, remove []model.LBTarget) error
+}
+
+// HealthCheckApplier is implemented by providers that apply the health
+// check settings of LB configs and report them back from GetLBConfigs.
+// Health check settings are dropped from the configs of other providers.
+type HealthCheckApplier interface {
+	AppliesHealthChecks() bool
+}
+
+// StickinessApplier is implemented by providers that apply the stickiness
+// of LB configs and report it back from GetLBConfigs. The stickiness is
+// dropped from the configs of other providers.
+type StickinessApplier interface {
+	AppliesStickiness() bool
+}
+
+// DrainTimeoutApplier is implemented by providers that apply the drain
+// timeout of LB configs and report it back from GetLBConfigs. The drain
+// timeout is dropped from the configs of other providers.
+type DrainTimeoutApplier interface {
+	AppliesDrainTimeout() bool
+}
+
+// SlowStartApplier is implemented by providers that apply the slow start
+// of LB configs and report it back from GetLBConfigs. The slow start is
+// dropped from the configs of other providers.
+type SlowStartApplier interface {
+	AppliesSlowStart() bool
+}
+
+// ProxyProtocolApplier is implemented by providers that can send the
+// PROXY protocol to the targets of LB configs and report it back from
+// GetLBConfigs. The setting is dropped from the configs of other providers.
+type ProxyProtocolApplier interface {
+	AppliesProxyProtocol() bool
+}
+
+// AttributesApplier is implemented by providers that apply the attributes
+// of LB configs and report them back from GetLBConfigs. The attributes are
+// dropped from the configs of other providers.
+type AttributesApplier interface {
+	AppliesAttributes() bool
+}
+
+// MaxConnApplier is implemented by providers that apply the connection
+// limit of LB configs and report it back from GetLBConfigs. The limit is
+// dropped from the configs of other providers.
+type MaxConnApplier interface {
+	AppliesMaxConn() bool
+}
+
+// ProtocolApplier is implemented by providers that apply the frontend
+// protocol of LB configs and report it back from GetLBConfigs. The
+// protocol is dropped from the configs of other providers.
+type ProtocolApplier interface {
+	AppliesProtocol() bool
+}
+
+// PoolNameValidator is implemented by providers restricting the names of
+// their target pools. LB configs whose target pool names are rejected are
+// not passed to the provider.
+type PoolNameValidator interface {
+	ValidatePoolName(name string) error
+}
+
+// Redacted replaces secret setting values in reported configurations.
+const Redacted = "<redacted>"
+
+const (
+	// ManagedByTag marks the resources created by external-lb in
+	// providers supporting free-form tags, ManagedBy is its value.
+	ManagedByTag = "managed-by"
+	ManagedBy    = "external-lb"
+
+	EnvironmentTag = "rancher-environment"
+	StackTag       = "rancher-stack"
+	ServiceTag     = "rancher-service"
+)
+
+// ResourceTags returns the tags describing the Rancher service a config
+// was built from, for providers that can tag the resources they create.
+// Names that are not known, like for configs read back from a provider,
+// are left out.
+func ResourceTags(config model.LBConfig) map[string]string {
+	tags := map[string]string{ManagedByTag: ManagedBy}
+	if len(config.Environment) != 0 {
+		tags[EnvironmentTag] = config.Environment
+	}
+	if i := strings.Index(config.Service, "/"); i > 0 {
+		tags[StackTag] = config.Service[:i]
+		tags[ServiceTag] = config.Service[i+1:]
+	}
+	return tags
+}
+
 var (
 	providers map[string]Provider
 )
 
-func GetProvider(name string) Provider {
-	if provider, ok := providers[name]; ok {
-		return provider
+// GetProvider returns the initialized provider registered under name.
+func GetProvider(name string) (Provider, error) {
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s, available providers: %v", name, ListProviders())
+	}
+	if err := provider.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize provider %s: %v", name, err)
+	}
+	logrus.Infof("Configured %s LB provider", provider.GetName())
+	return provider, nil
+}
+
+// ListProviders returns the names of all registered providers.
+func ListProviders() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
 	}
-	return providers["f5"]
+	sort.Strings(names)
+	return names
 }
 
 func RegisterProvider(name string, provider Provider) error {
@@ -1,6 +1,8 @@
 package f5
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/external-lb/model"
 	"github.com/rancher/external-lb/providers"
@@ -11,52 +13,62 @@ import (
 
 const (
 	name = "f5_BigIP"
+
+	// ownerDescriptionPrefix marks the pool description carrying the owner ID
+	ownerDescriptionPrefix = "managed-by external-lb "
 )
 
 var (
-	client *bigip.BigIP
+	client   *bigip.BigIP
+	settings map[string]string
 )
 
 func init() {
+	f5BigIPHandler := &F5BigIPHandler{}
+	if err := providers.RegisterProvider(name, f5BigIPHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+type F5BigIPHandler struct {
+}
+
+func (*F5BigIPHandler) Init() error {
 	f5_host := os.Getenv("F5_BIGIP_HOST")
 	if len(f5_host) == 0 {
-		logrus.Fatalf("F5_BIGIP_HOST is not set, skipping init of %s provider", name)
-		return
+		return fmt.Errorf("F5_BIGIP_HOST is not set")
 	}
 	f5_admin := os.Getenv("F5_BIGIP_USER")
 	if len(f5_admin) == 0 {
-		logrus.Fatalf("F5_BIGIP_USER is not set, skipping init of %s provider", name)
-		return
+		return fmt.Errorf("F5_BIGIP_USER is not set")
 	}
 	f5_pwd := os.Getenv("F5_BIGIP_PWD")
 	if len(f5_pwd) == 0 {
-		logrus.Fatalf("F5_BIGIP_PWD is not set, skipping init of %s provider", name)
-		return
+		return fmt.Errorf("F5_BIGIP_PWD is not set")
+	}
+
+	settings = map[string]string{
+		"F5_BIGIP_HOST": f5_host,
+		"F5_BIGIP_USER": f5_admin,
+		"F5_BIGIP_PWD":  providers.Redacted,
 	}
 
 	client = bigip.NewSession(f5_host, f5_admin, f5_pwd)
 	err := checkF5Connection()
 	if err != nil {
-		logrus.Fatalf("Connecting to f5 host %v does not work, error: %v", f5_host, err)
-		return
-	}
-
-	f5BigIPHandler := &F5BigIPHandler{}
-	if err := providers.RegisterProvider(name, f5BigIPHandler); err != nil {
-		logrus.Fatalf("Could not register %s provider", name)
+		return fmt.Errorf("Connecting to f5 host %v does not work, error: %v", f5_host, err)
 	}
-
-	logrus.Infof("Configured %s LB provider", f5BigIPHandler.GetName())
-
-}
-
-type F5BigIPHandler struct {
+	return nil
 }
 
 func (*F5BigIPHandler) GetName() string {
 	return name
 }
 
+func (*F5BigIPHandler) GetConfig() map[string]string {
+	return settings
+}
+
 func (*F5BigIPHandler) AddLBConfig(config model.LBConfig) error {
 
 	vServer, err := client.GetVirtualServer(config.LBEndpoint)
@@ -64,6 +76,13 @@ func (*F5BigIPHandler) AddLBConfig(config model.LBConfig) error {
 		logrus.Errorf("f5 AddLBConfig: Error getting f5 virtual server, cannot add the config: %v\n", err)
 		return err
 	} else {
+		if vServer.Pool != "" {
+			if err := checkPoolOwner(strings.TrimPrefix(vServer.Pool, "/Common/"), config.OwnerID); err != nil {
+				logrus.Errorf("f5 AddLBConfig: %v\n", err)
+				return err
+			}
+		}
+
 		//virtualserver exists, add nodes and pool
 
 		nodes := config.LBTargets
@@ -104,6 +123,11 @@ func (*F5BigIPHandler) AddLBConfig(config model.LBConfig) error {
 				logrus.Errorf("f5 AddLBConfig: Error modifying the pool: %v\n", err)
 				return err
 			}
+			err = setPoolOwner(poolName, config.OwnerID)
+			if err != nil {
+				logrus.Errorf("f5 AddLBConfig: Error setting the owner of the pool: %v\n", err)
+				return err
+			}
 		}
 
 		// Add members to our pool if not already present
@@ -114,13 +138,19 @@ func (*F5BigIPHandler) AddLBConfig(config model.LBConfig) error {
 			return err
 		}
 		for _, node := range nodes {
-			if !poolMemberExists(poolMembers, node.HostIP+":"+node.Port) {
-				err = client.AddPoolMember(poolName, node.HostIP+":"+node.Port)
+			member := node.HostIP + ":" + node.Port
+			if !poolMemberExists(poolMembers, member) {
+				err = client.AddPoolMember(poolName, member)
 				if err != nil {
 					logrus.Errorf("f5 AddLBConfig: Error adding member to pool: %v\n", err)
 					return err
 				}
 			}
+			err = setPoolMemberConnectionLimit(poolName, member, config.MaxConn)
+			if err != nil {
+				logrus.Errorf("f5 AddLBConfig: Error setting the connection limit of pool member %s: %v\n", member, err)
+				return err
+			}
 		}
 
 		//Add pool to virtualserver provided
@@ -167,6 +197,99 @@ func poolExists(name string) bool {
 	return false
 }
 
+type poolDescription struct {
+	Description string `json:"description"`
+}
+
+// getPoolOwner returns the owner ID recorded in the description of the pool,
+// or an empty string if the pool has no owner.
+func getPoolOwner(name string) (string, error) {
+	resp, err := client.SafeGet("ltm/pool/" + name)
+	if err != nil || resp == nil {
+		return "", err
+	}
+	var desc poolDescription
+	if err := json.Unmarshal(resp, &desc); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(desc.Description, ownerDescriptionPrefix) {
+		return "", nil
+	}
+	return strings.TrimPrefix(desc.Description, ownerDescriptionPrefix), nil
+}
+
+func setPoolOwner(name string, owner string) error {
+	body, err := json.Marshal(poolDescription{Description: ownerDescriptionPrefix + owner})
+	if err != nil {
+		return err
+	}
+	_, err = client.APICall(&bigip.APIRequest{
+		Method:      "put",
+		URL:         "ltm/pool/" + name,
+		Body:        string(body),
+		ContentType: "application/json",
+	})
+	return err
+}
+
+// checkPoolOwner returns an error if the pool is owned by someone other than owner.
+func checkPoolOwner(name string, owner string) error {
+	poolOwner, err := getPoolOwner(name)
+	if err != nil {
+		return fmt.Errorf("Error getting the owner of pool %s: %v", name, err)
+	}
+	if poolOwner != "" && poolOwner != owner {
+		return fmt.Errorf("Pool %s is owned by %s, refusing to modify it", name, poolOwner)
+	}
+	return nil
+}
+
+type poolMemberConnectionLimit struct {
+	Name            string `json:"name,omitempty"`
+	ConnectionLimit int    `json:"connectionLimit"`
+}
+
+type poolMembersConnectionLimits struct {
+	Members []poolMemberConnectionLimit `json:"items"`
+}
+
+func setPoolMemberConnectionLimit(pool string, member string, limit int) error {
+	body, err := json.Marshal(poolMemberConnectionLimit{ConnectionLimit: limit})
+	if err != nil {
+		return err
+	}
+	_, err = client.APICall(&bigip.APIRequest{
+		Method:      "put",
+		URL:         fmt.Sprintf("ltm/pool/%s/members/%s", pool, member),
+		Body:        string(body),
+		ContentType: "application/json",
+	})
+	return err
+}
+
+// getPoolConnectionLimit returns the connection limit shared by all members
+// of the pool. If the members disagree -1 is returned so that the config
+// gets updated.
+func getPoolConnectionLimit(pool string) (int, error) {
+	resp, err := client.SafeGet(fmt.Sprintf("ltm/pool/%s/members", pool))
+	if err != nil || resp == nil {
+		return 0, err
+	}
+	var members poolMembersConnectionLimits
+	if err := json.Unmarshal(resp, &members); err != nil {
+		return 0, err
+	}
+	limit := 0
+	for i, member := range members.Members {
+		if i == 0 {
+			limit = member.ConnectionLimit
+		} else if member.ConnectionLimit != limit {
+			return -1, nil
+		}
+	}
+	return limit, nil
+}
+
 func poolMemberExists(poolMembers []string, member string) bool {
 	for _, a := range poolMembers {
 		if a == member {
@@ -183,6 +306,10 @@ func (*F5BigIPHandler) RemoveLBConfig(config model.LBConfig) error {
 		logrus.Errorf("f5 RemoveLBConfig: Error getting f5 virtual server: %v\n", err)
 		return err
 	}
+	if err := checkPoolOwner(config.LBTargetPoolName, config.OwnerID); err != nil {
+		logrus.Errorf("f5 RemoveLBConfig: %v\n", err)
+		return err
+	}
 	//virtualserver exists,
 	//Remove pool from virtualserver provided
 	updatedVs := bigip.VirtualServer{}
@@ -198,24 +325,25 @@ func (*F5BigIPHandler) RemoveLBConfig(config model.LBConfig) error {
 	poolName := config.LBTargetPoolName
 
 	poolMembers, err := client.PoolMembers(poolName)
-	var nodes []model.LBTarget
 	if err != nil {
 		logrus.Errorf("f5 RemoveLBConfig: Error listing pool members for pool: %s, err: %v\n", poolName, err)
-	} else {
-		for _, member := range poolMembers {
-			nodeParts := strings.Split(member, ":")
-			if len(nodeParts) == 2 {
-				node := model.LBTarget{}
-				node.HostIP = nodeParts[0]
-				node.Port = nodeParts[1]
-				nodes = append(nodes, node)
-			}
+		return err
+	}
+	var nodes []model.LBTarget
+	for _, member := range poolMembers {
+		nodeParts := strings.Split(member, ":")
+		if len(nodeParts) == 2 {
+			node := model.LBTarget{}
+			node.HostIP = nodeParts[0]
+			node.Port = nodeParts[1]
+			nodes = append(nodes, node)
 		}
 	}
 	//remove the pool
 	err = client.DeletePool(poolName)
 	if err != nil {
 		logrus.Errorf("f5 RemoveLBConfig: Error removing pool: %s , err: %v\n", poolName, err)
+		return err
 	}
 	//remove the nodes under the pool
 	for _, node := range nodes {
@@ -249,6 +377,81 @@ func (f *F5BigIPHandler) UpdateLBConfig(config model.LBConfig) error {
 	return nil
 }
 
+//add and remove pool members in place, the pool and virtual server are kept
+func (*F5BigIPHandler) UpdateLBTargets(config model.LBConfig, add []model.LBTarget, remove []model.LBTarget) error {
+	poolName := config.LBTargetPoolName
+	if err := checkPoolOwner(poolName, config.OwnerID); err != nil {
+		logrus.Errorf("f5 UpdateLBTargets: %v\n", err)
+		return err
+	}
+
+	for _, node := range add {
+		if !nodeExists(node.HostIP, node.HostIP) {
+			if err := client.CreateNode(node.HostIP, node.HostIP); err != nil {
+				logrus.Errorf("f5 UpdateLBTargets: Error creating node on f5: %v\n", err)
+				return err
+			}
+		}
+		member := node.HostIP + ":" + node.Port
+		if err := client.AddPoolMember(poolName, member); err != nil {
+			logrus.Errorf("f5 UpdateLBTargets: Error adding member %s to pool %s: %v\n", member, poolName, err)
+			return err
+		}
+		if err := setPoolMemberConnectionLimit(poolName, member, config.MaxConn); err != nil {
+			logrus.Errorf("f5 UpdateLBTargets: Error setting the connection limit of pool member %s: %v\n", member, err)
+			return err
+		}
+	}
+
+	for _, node := range remove {
+		member := node.HostIP + ":" + node.Port
+		if err := client.DeletePoolMember(poolName, member); err != nil {
+			logrus.Errorf("f5 UpdateLBTargets: Error removing member %s from pool %s: %v\n", member, poolName, err)
+			return err
+		}
+		//the node may still be a member of other pools
+		if err := client.DeleteNode(node.HostIP); err != nil {
+			logrus.Debugf("f5 UpdateLBTargets: Not removing node %s: %v", node.HostIP, err)
+		}
+	}
+
+	logrus.Debugf("f5 UpdateLBTargets: Success")
+	return nil
+}
+
+//disable and remove the members of the pools, the pools and virtual servers are kept
+func (*F5BigIPHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		poolName := config.LBTargetPoolName
+		if err := checkPoolOwner(poolName, config.OwnerID); err != nil {
+			logrus.Errorf("f5 CleanupLBConfigs: %v\n", err)
+			lastErr = err
+			continue
+		}
+		poolMembers, err := client.PoolMembers(poolName)
+		if err != nil {
+			logrus.Errorf("f5 CleanupLBConfigs: Error listing pool members for pool: %s, err: %v\n", poolName, err)
+			lastErr = err
+			continue
+		}
+		for _, member := range poolMembers {
+			if err := client.PoolMemberStatus(poolName, member, "disable"); err != nil {
+				logrus.Errorf("f5 CleanupLBConfigs: Error disabling pool member %s of pool %s: %v\n", member, poolName, err)
+				lastErr = err
+			}
+		}
+		for _, member := range poolMembers {
+			if err := client.DeletePoolMember(poolName, member); err != nil {
+				logrus.Errorf("f5 CleanupLBConfigs: Error removing pool member %s from pool %s: %v\n", member, poolName, err)
+				lastErr = err
+			}
+		}
+	}
+	logrus.Debugf("f5 CleanupLBConfigs: Done")
+	return lastErr
+}
+
 func (*F5BigIPHandler) GetLBConfigs() ([]model.LBConfig, error) {
 	//list all virtualServers
 	// for each vs -> LBEndpoint
@@ -264,33 +467,10 @@ func (*F5BigIPHandler) GetLBConfigs() ([]model.LBConfig, error) {
 
 	for _, vServer := range vServers.VirtualServers {
 		if vServer.Pool != "" {
-			pool, err := client.GetPool(strings.TrimPrefix(vServer.Pool, "/Common/"))
+			lbConfig, err := getVirtualServerLBConfig(vServer)
 			if err != nil {
-				logrus.Errorf("f5 GetLBConfigs: Error getting the pool: %s, err: %v\n", vServer.Pool, err)
 				continue
 			}
-			lbConfig := model.LBConfig{}
-			lbConfig.LBEndpoint = vServer.Name
-			lbConfig.LBTargetPoolName = pool.Name
-
-			var nodes []model.LBTarget
-
-			poolMembers, err := client.PoolMembers(pool.Name)
-			if err != nil {
-				logrus.Errorf("f5 GetLBConfigs: Error listing pool members for pool: %s, err: %v\n", pool.Name, err)
-			} else {
-				for _, member := range poolMembers {
-					nodeParts := strings.Split(member, ":")
-					if len(nodeParts) == 2 {
-						node := model.LBTarget{}
-						node.HostIP = nodeParts[0]
-						node.Port = nodeParts[1]
-						nodes = append(nodes, node)
-					}
-				}
-			}
-
-			lbConfig.LBTargets = nodes
 			lbConfigs = append(lbConfigs, lbConfig)
 		}
 	}
@@ -301,10 +481,91 @@ func (*F5BigIPHandler) GetLBConfigs() ([]model.LBConfig, error) {
 
 }
 
+func (*F5BigIPHandler) ListLBEndpoints() ([]string, error) {
+	var endpoints []string
+
+	vServers, err := client.VirtualServers()
+	if err != nil {
+		logrus.Errorf("f5 ListLBEndpoints: Error listing f5 virtual servers: %v\n", err)
+		return endpoints, err
+	}
+
+	for _, vServer := range vServers.VirtualServers {
+		if vServer.Pool != "" {
+			endpoints = append(endpoints, vServer.Name)
+		}
+	}
+	return endpoints, nil
+}
+
+func (*F5BigIPHandler) GetLBConfig(endpoint string) (model.LBConfig, bool, error) {
+	vServer, err := client.GetVirtualServer(endpoint)
+	if err != nil {
+		logrus.Errorf("f5 GetLBConfig: Error getting f5 virtual server: %s, err: %v\n", endpoint, err)
+		return model.LBConfig{}, false, err
+	}
+	if vServer == nil || vServer.Pool == "" {
+		return model.LBConfig{}, false, nil
+	}
+	lbConfig, err := getVirtualServerLBConfig(*vServer)
+	if err != nil {
+		return model.LBConfig{}, false, err
+	}
+	return lbConfig, true, nil
+}
+
+// getVirtualServerLBConfig builds the LB config of a virtual server from
+// its pool and pool members.
+func getVirtualServerLBConfig(vServer bigip.VirtualServer) (model.LBConfig, error) {
+	lbConfig := model.LBConfig{}
+	pool, err := client.GetPool(strings.TrimPrefix(vServer.Pool, "/Common/"))
+	if err != nil {
+		logrus.Errorf("f5 GetLBConfigs: Error getting the pool: %s, err: %v\n", vServer.Pool, err)
+		return lbConfig, err
+	}
+	lbConfig.LBEndpoint = vServer.Name
+	lbConfig.LBTargetPoolName = pool.Name
+	lbConfig.OwnerID, err = getPoolOwner(pool.Name)
+	if err != nil {
+		logrus.Errorf("f5 GetLBConfigs: Error getting the owner of pool: %s, err: %v\n", pool.Name, err)
+		return lbConfig, err
+	}
+
+	var nodes []model.LBTarget
+
+	poolMembers, err := client.PoolMembers(pool.Name)
+	if err != nil {
+		logrus.Errorf("f5 GetLBConfigs: Error listing pool members for pool: %s, err: %v\n", pool.Name, err)
+		return lbConfig, err
+	}
+	for _, member := range poolMembers {
+		nodeParts := strings.Split(member, ":")
+		if len(nodeParts) == 2 {
+			node := model.LBTarget{}
+			node.HostIP = nodeParts[0]
+			node.Port = nodeParts[1]
+			nodes = append(nodes, node)
+		}
+	}
+
+	lbConfig.LBTargets = nodes
+	lbConfig.MaxConn, err = getPoolConnectionLimit(pool.Name)
+	if err != nil {
+		logrus.Errorf("f5 GetLBConfigs: Error getting the connection limit of pool: %s, err: %v\n", pool.Name, err)
+		return lbConfig, err
+	}
+	return lbConfig, nil
+}
+
 func (*F5BigIPHandler) TestConnection() error {
 	return checkF5Connection()
 }
 
+// the connection limit is read back from the pool members
+func (*F5BigIPHandler) AppliesMaxConn() bool {
+	return true
+}
+
 func checkF5Connection() error {
 	_, err := client.Pools()
 	if err != nil {
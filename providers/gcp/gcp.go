@@ -0,0 +1,956 @@
+package gcp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	name = "gcp"
+
+	computeScope    = "https://www.googleapis.com/auth/compute"
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+	// ownerDescriptionPrefix marks the target pool description carrying
+	// the poolRecord of a managed target pool
+	ownerDescriptionPrefix = "managed-by external-lb "
+	// ruleDescription marks the managed forwarding rules
+	ruleDescription = "managed-by external-lb"
+	// maxNameLength is the longest resource name Compute Engine accepts
+	maxNameLength = 63
+
+	// maximum time to wait for an operation to finish
+	operationTimeout = 5 * time.Minute
+	// access tokens are renewed this long before they expire
+	tokenRenewal = time.Minute
+)
+
+var (
+	computeURL  = "https://compute.googleapis.com/compute/v1"
+	metadataURL = "http://metadata.google.internal/computeMetadata/v1"
+
+	project         string
+	region          string
+	account         *serviceAccount
+	settings        map[string]string
+	client          = &http.Client{Timeout: 30 * time.Second}
+	errNotFound     = fmt.Errorf("not found")
+	errUnauthorized = fmt.Errorf("unauthorized")
+
+	// tokenLock guards token and tokenExpiry, the token is renewed shortly
+	// before it expires
+	tokenLock   sync.Mutex
+	token       string
+	tokenExpiry time.Time
+)
+
+func init() {
+	gcpHandler := &GCPHandler{}
+	if err := providers.RegisterProvider(name, gcpHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// GCPHandler manages Google Cloud network load balancers, a regional
+// forwarding rule per LB endpoint sending the traffic to a target pool of
+// the Compute Engine instances running the targets. The forwarding rule is
+// named after the LB endpoint, the target pool after the target pool name.
+//
+// Target pool descriptions cannot be changed, so the pool name carries a
+// hash of its poolRecord. A changed record creates a new target pool, the
+// forwarding rule is pointed at it and the old one is deleted.
+type GCPHandler struct {
+}
+
+// serviceAccount is the key file of a service account, as referenced by
+// GOOGLE_APPLICATION_CREDENTIALS.
+type serviceAccount struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+type instance struct {
+	Name              string `json:"name"`
+	SelfLink          string `json:"selfLink"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+type targetPool struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Instances   []string `json:"instances"`
+	SelfLink    string   `json:"selfLink,omitempty"`
+}
+
+type forwardingRule struct {
+	Name                string `json:"name"`
+	Description         string `json:"description"`
+	IPAddress           string `json:"IPAddress,omitempty"`
+	IPProtocol          string `json:"IPProtocol"`
+	PortRange           string `json:"portRange"`
+	Target              string `json:"target"`
+	LoadBalancingScheme string `json:"loadBalancingScheme"`
+}
+
+type operation struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	SelfLink   string `json:"selfLink"`
+	TargetLink string `json:"targetLink"`
+	Error      *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// poolRecord is kept in the description of managed target pools. External
+// is set when the targets were matched to the external IPs of their
+// instances, so that they are reported back the same way.
+type poolRecord struct {
+	Endpoint       string `json:"endpoint"`
+	TargetPoolName string `json:"pool"`
+	OwnerID        string `json:"owner,omitempty"`
+	External       bool   `json:"external,omitempty"`
+}
+
+func (*GCPHandler) Init() error {
+	account = nil
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); len(path) != 0 {
+		var err error
+		if account, err = loadServiceAccount(path); err != nil {
+			return fmt.Errorf("Reading the service account key %s failed, error: %v", path, err)
+		}
+	}
+	resetToken()
+
+	project = os.Getenv("GCP_PROJECT")
+	if len(project) == 0 && account != nil {
+		project = account.ProjectID
+	}
+	if len(project) == 0 {
+		var err error
+		if project, err = metadataProject(); err != nil {
+			return fmt.Errorf("GCP_PROJECT is not set and the project could not be read from the metadata server: %v", err)
+		}
+	}
+	region = os.Getenv("GCP_REGION")
+	if len(region) == 0 {
+		return fmt.Errorf("GCP_REGION is not set")
+	}
+
+	credentials := "metadata server"
+	if account != nil {
+		credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	settings = map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS": credentials,
+		"GCP_PROJECT":                    project,
+		"GCP_REGION":                     region,
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to Compute Engine does not work, error: %v", err)
+	}
+	return nil
+}
+
+func (*GCPHandler) GetName() string {
+	return name
+}
+
+func (*GCPHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*GCPHandler) AddLBConfig(config model.LBConfig) error {
+	port, err := listenPort(config)
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: %v\n", err)
+		return err
+	}
+	instances, err := listInstances()
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: Error listing instances: %v\n", err)
+		return err
+	}
+	links, external, err := instanceLinks(config.LBTargets, instances)
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: %v\n", err)
+		return err
+	}
+
+	ruleName := resourceName(config.LBEndpoint)
+	rule, current, err := getEndpoint(ruleName, config)
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: %v\n", err)
+		return err
+	}
+
+	record := poolRecord{
+		Endpoint:       config.LBEndpoint,
+		TargetPoolName: config.LBTargetPoolName,
+		OwnerID:        config.OwnerID,
+		External:       external,
+	}
+	desired, err := newTargetPool(record, links)
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: %v\n", err)
+		return err
+	}
+	existing, err := getTargetPool(desired.Name)
+	if err == errNotFound {
+		var op operation
+		if err = doRequest("POST", regionPath("/targetPools"), desired, &op); err == nil {
+			err = waitForOperation(&op)
+		}
+	} else if err == nil {
+		err = setInstances(existing, links)
+	}
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: Error writing target pool %s: %v\n", desired.Name, err)
+		return err
+	}
+
+	poolLink := computeURL + "/projects/" + project + regionPath("/targetPools/"+desired.Name)
+	switch {
+	case rule == nil:
+		err = createForwardingRule(ruleName, port, poolLink)
+	case rule.PortRange != port+"-"+port:
+		// the port of a forwarding rule cannot be changed
+		err = deleteResource(regionPath("/forwardingRules/" + ruleName))
+		if err == nil {
+			err = createForwardingRule(ruleName, port, poolLink)
+		}
+	case lastSegment(rule.Target) != desired.Name:
+		var op operation
+		if err = doRequest("POST", regionPath("/forwardingRules/"+ruleName+"/setTarget"), map[string]string{"target": poolLink}, &op); err == nil {
+			err = waitForOperation(&op)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("gcp AddLBConfig: Error writing forwarding rule %s: %v\n", ruleName, err)
+		return err
+	}
+
+	if current != nil && current.Name != desired.Name {
+		if err := deleteResource(regionPath("/targetPools/" + current.Name)); err != nil {
+			logrus.Errorf("gcp AddLBConfig: Error deleting the previous target pool %s: %v\n", current.Name, err)
+			return err
+		}
+	}
+	logrus.Debugf("gcp AddLBConfig: Done")
+	return nil
+}
+
+func (h *GCPHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+// RemoveLBConfig deletes the forwarding rule and then the target pools of
+// the LB endpoint, a target pool cannot be deleted while a forwarding rule
+// still uses it.
+func (*GCPHandler) RemoveLBConfig(config model.LBConfig) error {
+	ruleName := resourceName(config.LBEndpoint)
+	rule, _, err := getEndpoint(ruleName, config)
+	if err != nil {
+		logrus.Errorf("gcp RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if rule != nil {
+		if err := deleteResource(regionPath("/forwardingRules/" + ruleName)); err != nil {
+			logrus.Errorf("gcp RemoveLBConfig: Error deleting forwarding rule %s: %v\n", ruleName, err)
+			return err
+		}
+	}
+	pools, err := listTargetPools()
+	if err != nil {
+		logrus.Errorf("gcp RemoveLBConfig: Error listing target pools: %v\n", err)
+		return err
+	}
+	for _, p := range pools {
+		record, ok := getPoolRecord(p)
+		if !ok || record.Endpoint != config.LBEndpoint {
+			continue
+		}
+		if err := checkPoolOwner(p, config.OwnerID); err != nil {
+			logrus.Errorf("gcp RemoveLBConfig: %v\n", err)
+			return err
+		}
+		if err := deleteResource(regionPath("/targetPools/" + p.Name)); err != nil {
+			logrus.Errorf("gcp RemoveLBConfig: Error deleting target pool %s: %v\n", p.Name, err)
+			return err
+		}
+	}
+	logrus.Debugf("gcp RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the instances from the target pools, the forwarding rules are kept
+func (*GCPHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		_, current, err := getEndpoint(resourceName(config.LBEndpoint), config)
+		if err == nil && current != nil {
+			err = setInstances(current, nil)
+		}
+		if err != nil {
+			logrus.Errorf("gcp CleanupLBConfigs: Error removing the instances of LB endpoint %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("gcp CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*GCPHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	var rules []forwardingRule
+	if err := listItems(regionPath("/forwardingRules"), func(items json.RawMessage) error {
+		var page []forwardingRule
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		rules = append(rules, page...)
+		return nil
+	}); err != nil {
+		logrus.Errorf("gcp GetLBConfigs: Error listing forwarding rules: %v\n", err)
+		return nil, err
+	}
+	pools, err := listTargetPools()
+	if err != nil {
+		logrus.Errorf("gcp GetLBConfigs: Error listing target pools: %v\n", err)
+		return nil, err
+	}
+	instances, err := listInstances()
+	if err != nil {
+		logrus.Errorf("gcp GetLBConfigs: Error listing instances: %v\n", err)
+		return nil, err
+	}
+	byLink := make(map[string]*instance, len(instances))
+	for i := range instances {
+		byLink[resourcePath(instances[i].SelfLink)] = &instances[i]
+	}
+
+	var lbConfigs []model.LBConfig
+	for _, rule := range rules {
+		p, ok := pools[lastSegment(rule.Target)]
+		if !ok {
+			continue
+		}
+		record, ok := getPoolRecord(p)
+		if !ok {
+			continue
+		}
+		config := model.LBConfig{
+			LBEndpoint:       record.Endpoint,
+			LBTargetPoolName: record.TargetPoolName,
+			OwnerID:          record.OwnerID,
+		}
+		port := strings.SplitN(rule.PortRange, "-", 2)[0]
+		for _, link := range p.Instances {
+			if i, ok := byLink[resourcePath(link)]; ok {
+				if ip := instanceIP(i, record.External); len(ip) != 0 {
+					config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: ip, Port: port})
+				}
+			}
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*GCPHandler) TestConnection() error {
+	return checkConnection()
+}
+
+func checkConnection() error {
+	return doRequest("GET", regionPath(""), nil, nil)
+}
+
+// listenPort returns the port of the forwarding rule, the port following
+// the last colon of the LB endpoint or else the port of the targets.
+// Network load balancers do not translate ports, so the targets must
+// listen on the same port.
+func listenPort(config model.LBConfig) (string, error) {
+	port := ""
+	if i := strings.LastIndex(config.LBEndpoint, ":"); i >= 0 {
+		port = config.LBEndpoint[i+1:]
+	} else if len(config.LBTargets) != 0 {
+		port = config.LBTargets[0].Port
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("LB endpoint %s has no port, expected <name>:<port> or targets with a port", config.LBEndpoint)
+	}
+	for _, target := range config.LBTargets {
+		if target.Port != port {
+			return "", fmt.Errorf("target %s:%s of LB endpoint %s does not listen on port %s, network load balancers do not translate ports",
+				target.HostIP, target.Port, config.LBEndpoint, port)
+		}
+	}
+	return port, nil
+}
+
+// instanceLinks returns the instance URLs of the targets, and whether they
+// were matched by the external IPs of the instances.
+func instanceLinks(targets []model.LBTarget, instances []instance) ([]string, bool, error) {
+	internal := make(map[string]string)
+	external := make(map[string]string)
+	for i := range instances {
+		internal[instanceIP(&instances[i], false)] = instances[i].SelfLink
+		external[instanceIP(&instances[i], true)] = instances[i].SelfLink
+	}
+	delete(internal, "")
+	delete(external, "")
+	var links []string
+	byExternalIP := false
+	for _, target := range targets {
+		link, ok := internal[target.HostIP]
+		if !ok {
+			if link, ok = external[target.HostIP]; ok {
+				byExternalIP = true
+			}
+		}
+		if !ok {
+			return nil, false, fmt.Errorf("target %s is not an instance in region %s", target.HostIP, region)
+		}
+		links = append(links, link)
+	}
+	return links, byExternalIP, nil
+}
+
+// instanceIP returns the internal or external IP of the first network
+// interface of an instance, which the load balancer sends the traffic to.
+func instanceIP(i *instance, external bool) string {
+	if len(i.NetworkInterfaces) == 0 {
+		return ""
+	}
+	nic := i.NetworkInterfaces[0]
+	if !external {
+		return nic.NetworkIP
+	}
+	for _, access := range nic.AccessConfigs {
+		if len(access.NatIP) != 0 {
+			return access.NatIP
+		}
+	}
+	return ""
+}
+
+func newTargetPool(record poolRecord, links []string) (*targetPool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(data)
+	return &targetPool{
+		Name:        shortName(resourceName(record.TargetPoolName), maxNameLength-9) + "-" + hex.EncodeToString(sum[:4]),
+		Description: ownerDescriptionPrefix + string(data),
+		Instances:   links,
+	}, nil
+}
+
+// resourceName maps s to a Compute Engine resource name of lower case
+// letters, digits and dashes, starting with a letter. Names that are too
+// long are shortened and get a hash of s appended to stay unique.
+func resourceName(s string) string {
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, s), "-")
+	if len(name) == 0 || name[0] < 'a' || name[0] > 'z' {
+		name = "elb-" + name
+	}
+	if len(name) > maxNameLength {
+		sum := sha1.Sum([]byte(s))
+		name = shortName(name, maxNameLength-9) + "-" + hex.EncodeToString(sum[:4])
+	}
+	return strings.TrimRight(name, "-")
+}
+
+func shortName(name string, length int) string {
+	if len(name) > length {
+		name = name[:length]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+func lastSegment(link string) string {
+	return link[strings.LastIndex(link, "/")+1:]
+}
+
+// resourcePath strips the API URL from a resource link.
+func resourcePath(link string) string {
+	if i := strings.Index(link, "/projects/"); i >= 0 {
+		return link[i:]
+	}
+	return link
+}
+
+func regionPath(path string) string {
+	return "/regions/" + region + path
+}
+
+func getPoolRecord(p *targetPool) (poolRecord, bool) {
+	var record poolRecord
+	if !strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		return record, false
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(p.Description, ownerDescriptionPrefix)), &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// checkPoolOwner refuses access to a target pool owned by someone else.
+func checkPoolOwner(p *targetPool, ownerID string) error {
+	record, ok := getPoolRecord(p)
+	if !ok || len(record.OwnerID) == 0 || record.OwnerID == ownerID {
+		return nil
+	}
+	return fmt.Errorf("target pool %s is owned by %s, refusing to modify it as %s", p.Name, record.OwnerID, ownerID)
+}
+
+// getEndpoint returns the forwarding rule of an LB endpoint and the target
+// pool it sends the traffic to, nil if they do not exist. Forwarding rules
+// that are not managed, or that belong to another endpoint or owner, are
+// refused.
+func getEndpoint(ruleName string, config model.LBConfig) (*forwardingRule, *targetPool, error) {
+	var rule forwardingRule
+	err := doRequest("GET", regionPath("/forwardingRules/"+ruleName), nil, &rule)
+	if err == errNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Error getting forwarding rule %s: %v", ruleName, err)
+	}
+	p, err := getTargetPool(lastSegment(rule.Target))
+	if err == errNotFound && rule.Description == ruleDescription {
+		return &rule, nil, nil
+	} else if err == errNotFound {
+		return nil, nil, fmt.Errorf("forwarding rule %s is not managed by external-lb", ruleName)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Error getting the target pool of forwarding rule %s: %v", ruleName, err)
+	}
+	record, ok := getPoolRecord(p)
+	switch {
+	case !ok:
+		return nil, nil, fmt.Errorf("forwarding rule %s is not managed by external-lb", ruleName)
+	case record.Endpoint != config.LBEndpoint:
+		return nil, nil, fmt.Errorf("forwarding rule %s belongs to LB endpoint %s", ruleName, record.Endpoint)
+	}
+	if err := checkPoolOwner(p, config.OwnerID); err != nil {
+		return nil, nil, err
+	}
+	return &rule, p, nil
+}
+
+func getTargetPool(poolName string) (*targetPool, error) {
+	var p targetPool
+	if err := doRequest("GET", regionPath("/targetPools/"+poolName), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func listTargetPools() (map[string]*targetPool, error) {
+	pools := make(map[string]*targetPool)
+	err := listItems(regionPath("/targetPools"), func(items json.RawMessage) error {
+		var page []targetPool
+		if err := json.Unmarshal(items, &page); err != nil {
+			return err
+		}
+		for i := range page {
+			pools[page[i].Name] = &page[i]
+		}
+		return nil
+	})
+	return pools, err
+}
+
+// listInstances returns the instances in the zones of the region.
+func listInstances() ([]instance, error) {
+	var instances []instance
+	err := listItems("/aggregated/instances", func(items json.RawMessage) error {
+		var zones map[string]struct {
+			Instances []instance `json:"instances"`
+		}
+		if err := json.Unmarshal(items, &zones); err != nil {
+			return err
+		}
+		for zone, scoped := range zones {
+			if strings.HasPrefix(zone, "zones/"+region+"-") {
+				instances = append(instances, scoped.Instances...)
+			}
+		}
+		return nil
+	})
+	return instances, err
+}
+
+// setInstances adds and removes the instances of a target pool to match
+// links.
+func setInstances(p *targetPool, links []string) error {
+	current := make(map[string]bool, len(p.Instances))
+	for _, link := range p.Instances {
+		current[resourcePath(link)] = true
+	}
+	desired := make(map[string]bool, len(links))
+	var add, remove []map[string]string
+	for _, link := range links {
+		desired[resourcePath(link)] = true
+		if !current[resourcePath(link)] {
+			add = append(add, map[string]string{"instance": link})
+		}
+	}
+	for _, link := range p.Instances {
+		if !desired[resourcePath(link)] {
+			remove = append(remove, map[string]string{"instance": link})
+		}
+	}
+	if len(add) != 0 {
+		var op operation
+		if err := doRequest("POST", regionPath("/targetPools/"+p.Name+"/addInstance"), map[string]interface{}{"instances": add}, &op); err != nil {
+			return err
+		}
+		if err := waitForOperation(&op); err != nil {
+			return err
+		}
+	}
+	if len(remove) != 0 {
+		var op operation
+		if err := doRequest("POST", regionPath("/targetPools/"+p.Name+"/removeInstance"), map[string]interface{}{"instances": remove}, &op); err != nil {
+			return err
+		}
+		if err := waitForOperation(&op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createForwardingRule creates a TCP forwarding rule. A regional address
+// reserved with the name of the rule is used as its IP, so that the IP is
+// kept when the rule has to be recreated.
+func createForwardingRule(ruleName string, port string, poolLink string) error {
+	rule := forwardingRule{
+		Name:                ruleName,
+		Description:         ruleDescription,
+		IPProtocol:          "TCP",
+		PortRange:           port + "-" + port,
+		Target:              poolLink,
+		LoadBalancingScheme: "EXTERNAL",
+	}
+	var address struct {
+		Address string `json:"address"`
+	}
+	err := doRequest("GET", regionPath("/addresses/"+ruleName), nil, &address)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	rule.IPAddress = address.Address
+	var op operation
+	if err := doRequest("POST", regionPath("/forwardingRules"), rule, &op); err != nil {
+		return err
+	}
+	return waitForOperation(&op)
+}
+
+func deleteResource(path string) error {
+	var op operation
+	err := doRequest("DELETE", path, nil, &op)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return waitForOperation(&op)
+}
+
+func waitForOperation(op *operation) error {
+	deadline := time.Now().Add(operationTimeout)
+	for {
+		if op.Status == "DONE" {
+			if op.Error != nil && len(op.Error.Errors) != 0 {
+				var messages []string
+				for _, e := range op.Error.Errors {
+					messages = append(messages, e.Code+": "+e.Message)
+				}
+				return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, ", "))
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for operation %s, status %s", op.Name, op.Status)
+		}
+		time.Sleep(2 * time.Second)
+		if err := doRequest("GET", op.SelfLink, nil, op); err != nil {
+			return err
+		}
+	}
+}
+
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a serviceAccount
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	if a.Type != "service_account" {
+		return nil, fmt.Errorf("credentials of type %q are not supported, expected a service account key", a.Type)
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("the private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("parsing the private key failed: %v", err)
+		}
+	}
+	var ok bool
+	if a.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("the private key is not an RSA key")
+	}
+	if len(a.TokenURI) == 0 {
+		a.TokenURI = defaultTokenURI
+	}
+	return &a, nil
+}
+
+// assertion returns the signed JWT exchanged for an access token.
+func (a *serviceAccount) assertion(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": computeScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func resetToken() {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	token = ""
+}
+
+// accessToken returns the current access token, and requests a new one
+// from the token URI of the service account, or from the metadata server,
+// when it expires soon or when its value is expired, i.e. it was rejected.
+func accessToken(expired string) (string, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	if len(token) != 0 && token != expired && time.Now().Before(tokenExpiry.Add(-tokenRenewal)) {
+		return token, nil
+	}
+
+	var resp *http.Response
+	var err error
+	if account != nil {
+		var assertion string
+		if assertion, err = account.assertion(time.Now()); err != nil {
+			return "", err
+		}
+		resp, err = client.PostForm(account.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	} else {
+		resp, err = getMetadata("/instance/service-accounts/default/token")
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting an access token returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	if len(result.AccessToken) == 0 {
+		return "", fmt.Errorf("no access token in the token response")
+	}
+	token = result.AccessToken
+	tokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return token, nil
+}
+
+func getMetadata(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", metadataURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return client.Do(req)
+}
+
+func metadataProject() (string, error) {
+	resp, err := getMetadata("/project/project-id")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the metadata server returned %s", resp.Status)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// listItems calls handle with the items of every page of a list request.
+func listItems(path string, handle func(items json.RawMessage) error) error {
+	pageToken := ""
+	for {
+		pagePath := path + "?maxResults=500"
+		if len(pageToken) != 0 {
+			pagePath += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		var page struct {
+			Items         json.RawMessage `json:"items"`
+			NextPageToken string          `json:"nextPageToken"`
+		}
+		if err := doRequest("GET", pagePath, nil, &page); err != nil {
+			return err
+		}
+		if len(page.Items) != 0 {
+			if err := handle(page.Items); err != nil {
+				return err
+			}
+		}
+		if len(page.NextPageToken) == 0 {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	current, err := accessToken("")
+	if err != nil {
+		return err
+	}
+	err = sendRequest(current, method, path, body, out)
+	if err == errUnauthorized {
+		// the token was revoked or expired early, renew it and retry once
+		if current, err = accessToken(current); err != nil {
+			return err
+		}
+		err = sendRequest(current, method, path, body, out)
+	}
+	return err
+}
+
+// sendRequest sends a request to path below the project, or to path itself
+// if it is a link returned by the API.
+func sendRequest(authToken string, method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	requestURL := path
+	if !strings.HasPrefix(path, "http") {
+		requestURL = computeURL + "/projects/" + project + path
+	}
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(respData, &apiErr) == nil && len(apiErr.Error.Message) != 0 {
+			return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
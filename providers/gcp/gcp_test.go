@@ -0,0 +1,147 @@
+package gcp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeServiceAccount writes a service account key file for tokenURI and
+// returns its path and key.
+func writeServiceAccount(t *testing.T, dir string, tokenURI string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "test-project",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "external-lb@test-project.iam.gserviceaccount.com",
+		"token_uri":    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestAccessTokenFromServiceAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var key *rsa.PrivateKey
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("wrong grant type %q", r.FormValue("grant_type"))
+		}
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Errorf("the assertion %q is not a JWT", r.FormValue("assertion"))
+			http.Error(w, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+			t.Errorf("the assertion signature does not verify: %v", err)
+		}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(data, &claims)
+		if claims["scope"] != computeScope || claims["aud"] != "http://"+r.Host+"/token" {
+			t.Errorf("wrong claims %v", claims)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token1", "expires_in": 3600})
+	}))
+	defer server.Close()
+
+	var path string
+	path, key = writeServiceAccount(t, dir, server.URL+"/token")
+	if account, err = loadServiceAccount(path); err != nil {
+		t.Fatalf("loading the service account failed: %v", err)
+	}
+	defer func() { account = nil }()
+	resetToken()
+
+	for i := 0; i < 2; i++ {
+		if current, err := accessToken(""); err != nil || current != "token1" {
+			t.Fatalf("got token %q, %v", current, err)
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	if count() != 1 {
+		t.Errorf("the token was requested %d times, expected it to be reused", count())
+	}
+	if _, err := accessToken("token1"); err != nil || count() != 2 {
+		t.Errorf("a rejected token was not renewed: %v", err)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	long := strings.Repeat("web", 30)
+	for value, expected := range map[string]string{
+		"web:443":         "web-443",
+		"App.Example.com": "app-example-com",
+		"1web":            "elb-1web",
+		"-web-":           "web",
+	} {
+		if name := resourceName(value); name != expected {
+			t.Errorf("resourceName(%q) is %q, expected %q", value, name, expected)
+		}
+	}
+	name := resourceName(long)
+	if len(name) > maxNameLength || !strings.HasPrefix(name, "webweb") {
+		t.Errorf("resourceName of a long name is %q", name)
+	}
+	if name == resourceName(long+"x") {
+		t.Errorf("long names differing at the end map to the same name %q", name)
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	targets := []model.LBTarget{{HostIP: "10.0.0.1", Port: "443"}, {HostIP: "10.0.0.2", Port: "443"}}
+	if port, err := listenPort(model.LBConfig{LBEndpoint: "web", LBTargets: targets}); err != nil || port != "443" {
+		t.Errorf("got port %q, %v from the targets", port, err)
+	}
+	if port, err := listenPort(model.LBConfig{LBEndpoint: "web:443", LBTargets: targets}); err != nil || port != "443" {
+		t.Errorf("got port %q, %v from the endpoint", port, err)
+	}
+	if _, err := listenPort(model.LBConfig{LBEndpoint: "web:80", LBTargets: targets}); err == nil {
+		t.Errorf("expected an error for targets on another port than the endpoint")
+	}
+}
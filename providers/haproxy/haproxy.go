@@ -0,0 +1,429 @@
+package haproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	name = "haproxy"
+
+	// configMarker prefixes the comment line holding the LB config a
+	// frontend was rendered from, the rendered file is the provider state
+	configMarker = "# external-lb: "
+
+	defaultConfigPath = "/etc/haproxy/haproxy.cfg"
+)
+
+var (
+	configPath     string
+	baseConfigPath string
+	reloadCmd      string
+	mode           string
+	settings       map[string]string
+
+	// lock serializes the read-modify-write cycles on the config file
+	lock sync.Mutex
+	// reloadFailed is set while the written config file may not be the
+	// one HAProxy runs, guarded by lock
+	reloadFailed bool
+)
+
+func init() {
+	haproxyHandler := &HAProxyHandler{}
+	if err := providers.RegisterProvider(name, haproxyHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// HAProxyHandler renders the LB configs into an HAProxy configuration
+// file, one frontend and backend per LB endpoint, and reloads HAProxy
+// whenever the rendered file changes. The LB endpoint is used as the
+// frontend bind address.
+type HAProxyHandler struct {
+}
+
+func (*HAProxyHandler) Init() error {
+	configPath = os.Getenv("HAPROXY_CONFIG")
+	if len(configPath) == 0 {
+		configPath = defaultConfigPath
+	}
+	baseConfigPath = os.Getenv("HAPROXY_BASE_CONFIG")
+	reloadCmd = os.Getenv("HAPROXY_RELOAD_CMD")
+	mode = os.Getenv("HAPROXY_MODE")
+	if len(mode) == 0 {
+		mode = "tcp"
+	} else if mode != "tcp" && mode != "http" {
+		return fmt.Errorf("Invalid HAPROXY_MODE value %q, expected tcp or http", mode)
+	}
+
+	settings = map[string]string{
+		"HAPROXY_CONFIG":      configPath,
+		"HAPROXY_BASE_CONFIG": baseConfigPath,
+		"HAPROXY_RELOAD_CMD":  reloadCmd,
+		"HAPROXY_MODE":        mode,
+	}
+
+	if err := checkConfigDir(); err != nil {
+		return fmt.Errorf("HAProxy config %s is not usable, error: %v", configPath, err)
+	}
+	return nil
+}
+
+func (*HAProxyHandler) GetName() string {
+	return name
+}
+
+func (*HAProxyHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*HAProxyHandler) AddLBConfig(config model.LBConfig) error {
+	return modifyConfigs("AddLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		if _, err := proxyMode(config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+func (*HAProxyHandler) RemoveLBConfig(config model.LBConfig) error {
+	return modifyConfigs("RemoveLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		delete(configs, config.LBEndpoint)
+		return nil
+	})
+}
+
+func (*HAProxyHandler) UpdateLBConfig(config model.LBConfig) error {
+	return modifyConfigs("UpdateLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		if _, err := proxyMode(config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+// remove the servers of the backends, the frontends are kept
+func (*HAProxyHandler) CleanupLBConfigs(cleanup []model.LBConfig) error {
+	return modifyConfigs("CleanupLBConfigs", func(configs map[string]model.LBConfig) error {
+		for _, config := range cleanup {
+			if err := checkOwner(configs, config); err != nil {
+				return err
+			}
+			if existing, ok := configs[config.LBEndpoint]; ok {
+				existing.LBTargets = nil
+				configs[config.LBEndpoint] = existing
+			}
+		}
+		return nil
+	})
+}
+
+func (*HAProxyHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("haproxy GetLBConfigs: Error reading %s: %v\n", configPath, err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, config := range configs {
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*HAProxyHandler) TestConnection() error {
+	return checkConfigDir()
+}
+
+// the connection limit is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesMaxConn() bool {
+	return true
+}
+
+// the health check is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesHealthChecks() bool {
+	return true
+}
+
+// the protocol is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesProtocol() bool {
+	return true
+}
+
+// the slow start is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesSlowStart() bool {
+	return true
+}
+
+// the PROXY protocol is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesProxyProtocol() bool {
+	return true
+}
+
+// the stickiness is part of the config recorded in the rendered file
+func (*HAProxyHandler) AppliesStickiness() bool {
+	return true
+}
+
+func checkConfigDir() error {
+	dir := filepath.Dir(configPath)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if len(baseConfigPath) != 0 {
+		if _, err := os.Stat(baseConfigPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOwner refuses to touch an existing frontend owned by someone else.
+func checkOwner(configs map[string]model.LBConfig, config model.LBConfig) error {
+	existing, ok := configs[config.LBEndpoint]
+	if !ok || len(existing.OwnerID) == 0 || existing.OwnerID == config.OwnerID {
+		return nil
+	}
+	return fmt.Errorf("frontend %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, existing.OwnerID, config.OwnerID)
+}
+
+func modifyConfigs(caller string, modify func(configs map[string]model.LBConfig) error) error {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("haproxy %s: Error reading %s: %v\n", caller, configPath, err)
+		return err
+	}
+	if err := modify(configs); err != nil {
+		logrus.Errorf("haproxy %s: %v\n", caller, err)
+		return err
+	}
+	changed, err := writeConfigs(configs)
+	if err != nil {
+		logrus.Errorf("haproxy %s: Error writing %s: %v\n", caller, configPath, err)
+		return err
+	}
+	if !changed && !reloadFailed {
+		logrus.Debugf("haproxy %s: %s is unchanged, not reloading", caller, configPath)
+		return nil
+	}
+	if err := reload(); err != nil {
+		reloadFailed = true
+		logrus.Errorf("haproxy %s: Error reloading haproxy: %v\n", caller, err)
+		return err
+	}
+	reloadFailed = false
+	logrus.Debugf("haproxy %s: Done", caller)
+	return nil
+}
+
+// readConfigs parses the LB configs recorded in the rendered config file.
+func readConfigs() (map[string]model.LBConfig, error) {
+	configs := make(map[string]model.LBConfig)
+	file, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return configs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, configMarker) {
+			continue
+		}
+		var config model.LBConfig
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, configMarker)), &config); err != nil {
+			return nil, fmt.Errorf("invalid LB config comment %q: %v", line, err)
+		}
+		configs[config.LBEndpoint] = config
+	}
+	return configs, scanner.Err()
+}
+
+// writeConfigs renders the configs into the config file and reports
+// whether its content changed. An unchanged file is not rewritten.
+func writeConfigs(configs map[string]model.LBConfig) (bool, error) {
+	var buf bytes.Buffer
+	if len(baseConfigPath) != 0 {
+		base, err := ioutil.ReadFile(baseConfigPath)
+		if err != nil {
+			return false, err
+		}
+		buf.Write(base)
+		buf.WriteString("\n")
+	}
+
+	var endpoints []string
+	for endpoint := range configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		if err := renderConfig(&buf, configs[endpoint]); err != nil {
+			return false, err
+		}
+	}
+	if current, err := ioutil.ReadFile(configPath); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), filepath.Base(configPath)+".")
+	if err != nil {
+		return false, err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), configPath)
+}
+
+func renderConfig(buf *bytes.Buffer, config model.LBConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configMode, err := proxyMode(config)
+	if err != nil {
+		return err
+	}
+	backend := "be_" + sanitizeName(config.LBTargetPoolName)
+	fmt.Fprintf(buf, "%s%s\n", configMarker, data)
+	fmt.Fprintf(buf, "frontend fe_%s\n", sanitizeName(config.LBEndpoint))
+	fmt.Fprintf(buf, "    bind %s\n", config.LBEndpoint)
+	fmt.Fprintf(buf, "    mode %s\n", configMode)
+	fmt.Fprintf(buf, "    default_backend %s\n\n", backend)
+	fmt.Fprintf(buf, "backend %s\n", backend)
+	fmt.Fprintf(buf, "    mode %s\n", configMode)
+	stickiness := config.Stickiness
+	cookie := stickiness != nil && stickiness.Type == model.StickinessCookie && configMode == "http"
+	switch {
+	case cookie:
+		fmt.Fprintf(buf, "    balance roundrobin\n")
+		fmt.Fprintf(buf, "    cookie SRV insert indirect nocache")
+		if stickiness.Duration > 0 {
+			fmt.Fprintf(buf, " maxlife %ds", stickiness.Duration)
+		}
+		buf.WriteString("\n")
+	case stickiness != nil:
+		// cookies need http mode, tcp backends fall back to the source IP
+		fmt.Fprintf(buf, "    balance source\n")
+	default:
+		fmt.Fprintf(buf, "    balance roundrobin\n")
+	}
+	check := config.HealthCheck
+	if check != nil && len(check.Path) != 0 {
+		fmt.Fprintf(buf, "    option httpchk GET %s\n", check.Path)
+	}
+	for _, target := range config.LBTargets {
+		serverName := sanitizeName(target.HostIP + "_" + target.Port)
+		fmt.Fprintf(buf, "    server %s %s:%s check", serverName, target.HostIP, target.Port)
+		if cookie {
+			fmt.Fprintf(buf, " cookie %s", serverName)
+		}
+		if check != nil {
+			if check.Interval > 0 {
+				fmt.Fprintf(buf, " inter %ds", check.Interval)
+			}
+			if check.HealthyThreshold > 0 {
+				fmt.Fprintf(buf, " rise %d", check.HealthyThreshold)
+			}
+			if check.UnhealthyThreshold > 0 {
+				fmt.Fprintf(buf, " fall %d", check.UnhealthyThreshold)
+			}
+		}
+		if config.MaxConn > 0 {
+			fmt.Fprintf(buf, " maxconn %d", config.MaxConn)
+		}
+		if config.SlowStart > 0 {
+			fmt.Fprintf(buf, " slowstart %ds", config.SlowStart)
+		}
+		if config.ProxyProtocol {
+			fmt.Fprintf(buf, " send-proxy-v2")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	return nil
+}
+
+// proxyMode returns the HAProxy mode serving the protocol of config. TLS is
+// passed through in tcp mode, HTTPS would need certificates and UDP is not
+// supported by HAProxy.
+func proxyMode(config model.LBConfig) (string, error) {
+	switch config.Protocol {
+	case "":
+		return mode, nil
+	case model.ProtocolHTTP:
+		return "http", nil
+	case model.ProtocolTCP, model.ProtocolTLS:
+		return "tcp", nil
+	}
+	return "", fmt.Errorf("protocol %s of LB endpoint %s is not supported, expected http, tcp or tls", config.Protocol, config.LBEndpoint)
+}
+
+// sanitizeName maps s to the characters allowed in HAProxy proxy and
+// server names.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func reload() error {
+	if len(reloadCmd) == 0 {
+		return nil
+	}
+	output, err := exec.Command("sh", "-c", reloadCmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
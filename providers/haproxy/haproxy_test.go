@@ -0,0 +1,122 @@
+package haproxy
+
+import (
+	"bytes"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func renderTestConfig(t *testing.T, config model.LBConfig) []string {
+	var buf bytes.Buffer
+	if err := renderConfig(&buf, config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var servers []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "server ") {
+			servers = append(servers, line)
+		}
+	}
+	return servers
+}
+
+func TestRenderConfigMaxConn(t *testing.T) {
+	mode = "tcp"
+	config := model.LBConfig{
+		LBEndpoint:       "0.0.0.0:80",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "8080"}, {HostIP: "10.0.0.2", Port: "8080"}},
+		MaxConn:          100,
+	}
+	servers := renderTestConfig(t, config)
+	if len(servers) != 2 {
+		t.Fatalf("got server lines %q, expected two", servers)
+	}
+	for _, server := range servers {
+		if !strings.HasSuffix(server, " maxconn 100") {
+			t.Errorf("server line %q does not limit the connections to 100", server)
+		}
+	}
+
+	config.MaxConn = 0
+	for _, server := range renderTestConfig(t, config) {
+		if strings.Contains(server, "maxconn") {
+			t.Errorf("server line %q limits the connections without a max_conn", server)
+		}
+	}
+}
+
+// useTestConfig points the provider at a config file in a temporary
+// directory, with a reload command counting the reloads.
+func useTestConfig(t *testing.T) (string, func() int) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath = filepath.Join(dir, "haproxy.cfg")
+	baseConfigPath = ""
+	mode = "tcp"
+	reloadFailed = false
+	reloads := filepath.Join(dir, "reloads")
+	reloadCmd = "echo >> " + reloads
+	return dir, func() int {
+		data, _ := ioutil.ReadFile(reloads)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+func TestReloadOnlyWhenTheConfigChanged(t *testing.T) {
+	dir, reloads := useTestConfig(t)
+	defer os.RemoveAll(dir)
+	h := &HAProxyHandler{}
+	config := model.LBConfig{
+		LBEndpoint:       "0.0.0.0:80",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "8080"}},
+	}
+
+	if err := h.AddLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := reloads(); n != 1 {
+		t.Fatalf("got %d reloads after adding a config, expected 1", n)
+	}
+	if err := h.UpdateLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := reloads(); n != 1 {
+		t.Errorf("an update without changes reloaded haproxy, %d reloads", n)
+	}
+	config.MaxConn = 100
+	if err := h.UpdateLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := reloads(); n != 2 {
+		t.Errorf("got %d reloads after changing the config, expected 2", n)
+	}
+}
+
+func TestReloadRetriedAfterAFailedReload(t *testing.T) {
+	dir, reloads := useTestConfig(t)
+	defer os.RemoveAll(dir)
+	h := &HAProxyHandler{}
+	config := model.LBConfig{LBEndpoint: "0.0.0.0:80", LBTargetPoolName: "web_env1_rancher.internal"}
+
+	countingCmd := reloadCmd
+	reloadCmd = "exit 1"
+	if err := h.AddLBConfig(config); err == nil {
+		t.Fatalf("expected the failed reload to fail the add")
+	}
+	// the file is written already, the retry of the add must reload
+	reloadCmd = countingCmd
+	if err := h.AddLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := reloads(); n != 1 {
+		t.Errorf("got %d reloads after retrying the add, expected 1", n)
+	}
+}
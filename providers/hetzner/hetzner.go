@@ -0,0 +1,795 @@
+package hetzner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "hetzner"
+
+	// the labels recording the managed state of a load balancer, values
+	// longer than a label value continue in "<label>-2", "<label>-3"...
+	// Label values have no colons, so the port of an LB endpoint is kept
+	// in a label of its own.
+	endpointLabel = "external-lb/endpoint"
+	portLabel     = "external-lb/port"
+	poolLabel     = "external-lb/pool"
+	ownerLabel    = "external-lb/owner"
+	// maxLabelLength is the longest label value hcloud accepts
+	maxLabelLength = 63
+
+	defaultLBType = "lb11"
+
+	// maximum time to wait for an action to finish
+	actionTimeout = 5 * time.Minute
+)
+
+var (
+	apiURL      = "https://api.hetzner.cloud/v1"
+	apiToken    string
+	location    string
+	networkZone string
+	lbType      string
+	network     int
+	settings    map[string]string
+	client      = &http.Client{Timeout: 30 * time.Second}
+	errNotFound = fmt.Errorf("not found")
+)
+
+func init() {
+	hetznerHandler := &HetznerHandler{}
+	if err := providers.RegisterProvider(name, hetznerHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// HetznerHandler manages Hetzner Cloud load balancers, one per LB endpoint
+// with a single TCP service. The servers running the targets are attached
+// as server targets, other target IPs as IP targets. The LB endpoint,
+// target pool name and owner are recorded in labels of the load balancer,
+// load balancers without them are never touched.
+type HetznerHandler struct {
+}
+
+type loadBalancer struct {
+	ID       int               `json:"id"`
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels"`
+	Services []service         `json:"services"`
+	Targets  []target          `json:"targets"`
+}
+
+type service struct {
+	Protocol        string       `json:"protocol"`
+	ListenPort      int          `json:"listen_port"`
+	DestinationPort int          `json:"destination_port"`
+	ProxyProtocol   bool         `json:"proxyprotocol"`
+	HealthCheck     *healthCheck `json:"health_check,omitempty"`
+}
+
+type healthCheck struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+	Retries  int    `json:"retries"`
+}
+
+type target struct {
+	Type   string `json:"type"`
+	Server *struct {
+		ID int `json:"id"`
+	} `json:"server,omitempty"`
+	IP *struct {
+		IP string `json:"ip"`
+	} `json:"ip,omitempty"`
+	UsePrivateIP bool `json:"use_private_ip,omitempty"`
+}
+
+type server struct {
+	ID        int `json:"id"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+	} `json:"public_net"`
+	PrivateNet []struct {
+		Network int    `json:"network"`
+		IP      string `json:"ip"`
+	} `json:"private_net"`
+}
+
+type action struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (*HetznerHandler) Init() error {
+	apiToken = os.Getenv("HCLOUD_TOKEN")
+	if len(apiToken) == 0 {
+		return fmt.Errorf("HCLOUD_TOKEN is not set")
+	}
+	location = os.Getenv("HCLOUD_LOCATION")
+	networkZone = os.Getenv("HCLOUD_NETWORK_ZONE")
+	if len(location) == 0 && len(networkZone) == 0 {
+		return fmt.Errorf("HCLOUD_LOCATION or HCLOUD_NETWORK_ZONE must be set")
+	}
+	lbType = os.Getenv("HCLOUD_LB_TYPE")
+	if len(lbType) == 0 {
+		lbType = defaultLBType
+	}
+	network = 0
+	if value := os.Getenv("HCLOUD_NETWORK"); len(value) != 0 {
+		var err error
+		if network, err = strconv.Atoi(value); err != nil || network <= 0 {
+			return fmt.Errorf("Invalid HCLOUD_NETWORK value %q, expected the ID of a network", value)
+		}
+	}
+
+	settings = map[string]string{
+		"HCLOUD_TOKEN":        providers.Redacted,
+		"HCLOUD_LOCATION":     location,
+		"HCLOUD_NETWORK_ZONE": networkZone,
+		"HCLOUD_LB_TYPE":      lbType,
+		"HCLOUD_NETWORK":      os.Getenv("HCLOUD_NETWORK"),
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to Hetzner Cloud does not work, error: %v", err)
+	}
+	return nil
+}
+
+func (*HetznerHandler) GetName() string {
+	return name
+}
+
+func (*HetznerHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*HetznerHandler) ValidatePoolName(poolName string) error {
+	return setLabel(map[string]string{}, poolLabel, poolName)
+}
+
+// the PROXY protocol is a setting of the service
+func (*HetznerHandler) AppliesProxyProtocol() bool {
+	return true
+}
+
+func (*HetznerHandler) AddLBConfig(config model.LBConfig) error {
+	desired, err := newService(config)
+	if err != nil {
+		logrus.Errorf("hetzner AddLBConfig: %v\n", err)
+		return err
+	}
+	labels, err := configLabels(config)
+	if err != nil {
+		logrus.Errorf("hetzner AddLBConfig: %v\n", err)
+		return err
+	}
+	servers, err := listServers()
+	if err != nil {
+		logrus.Errorf("hetzner AddLBConfig: Error listing servers: %v\n", err)
+		return err
+	}
+	targets := newTargets(config.LBTargets, servers)
+
+	lb, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("hetzner AddLBConfig: Error listing load balancers: %v\n", err)
+		return err
+	}
+	if lb == nil {
+		if err := createLoadBalancer(config, labels, desired, targets); err != nil {
+			logrus.Errorf("hetzner AddLBConfig: Error creating load balancer %s: %v\n", lbName(config.LBEndpoint), err)
+			return err
+		}
+		logrus.Debugf("hetzner AddLBConfig: Done")
+		return nil
+	}
+	if err := checkOwner(lb, config.OwnerID); err != nil {
+		logrus.Errorf("hetzner AddLBConfig: %v\n", err)
+		return err
+	}
+
+	if !labelsEqual(lb.Labels, labels) {
+		if err := doRequest("PUT", fmt.Sprintf("/load_balancers/%d", lb.ID), map[string]interface{}{"labels": labels}, nil); err != nil {
+			logrus.Errorf("hetzner AddLBConfig: Error updating the labels of load balancer %s: %v\n", lb.Name, err)
+			return err
+		}
+	}
+	if err := setService(lb, desired); err != nil {
+		logrus.Errorf("hetzner AddLBConfig: Error updating the service of load balancer %s: %v\n", lb.Name, err)
+		return err
+	}
+	if err := setTargets(lb, targets); err != nil {
+		logrus.Errorf("hetzner AddLBConfig: Error updating the targets of load balancer %s: %v\n", lb.Name, err)
+		return err
+	}
+	logrus.Debugf("hetzner AddLBConfig: Done")
+	return nil
+}
+
+func (h *HetznerHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*HetznerHandler) RemoveLBConfig(config model.LBConfig) error {
+	lb, err := findLoadBalancer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("hetzner RemoveLBConfig: Error listing load balancers: %v\n", err)
+		return err
+	}
+	if lb == nil {
+		return nil
+	}
+	if err := checkOwner(lb, config.OwnerID); err != nil {
+		logrus.Errorf("hetzner RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if err := doRequest("DELETE", fmt.Sprintf("/load_balancers/%d", lb.ID), nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("hetzner RemoveLBConfig: Error deleting load balancer %s: %v\n", lb.Name, err)
+		return err
+	}
+	logrus.Debugf("hetzner RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the targets of the load balancers, the load balancers are kept
+func (*HetznerHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		lb, err := findLoadBalancer(config.LBEndpoint)
+		if err == nil && lb != nil {
+			if err = checkOwner(lb, config.OwnerID); err == nil {
+				err = setTargets(lb, nil)
+			}
+		}
+		if err != nil {
+			logrus.Errorf("hetzner CleanupLBConfigs: Error removing the targets of LB endpoint %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("hetzner CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*HetznerHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lbs, err := listLoadBalancers()
+	if err != nil {
+		logrus.Errorf("hetzner GetLBConfigs: Error listing load balancers: %v\n", err)
+		return nil, err
+	}
+	servers, err := listServers()
+	if err != nil {
+		logrus.Errorf("hetzner GetLBConfigs: Error listing servers: %v\n", err)
+		return nil, err
+	}
+	byID := make(map[int]*server, len(servers))
+	for i := range servers {
+		byID[servers[i].ID] = &servers[i]
+	}
+
+	var lbConfigs []model.LBConfig
+	for _, lb := range lbs {
+		endpoint := getEndpoint(lb.Labels)
+		if len(endpoint) == 0 {
+			continue
+		}
+		config := model.LBConfig{
+			LBEndpoint:       endpoint,
+			LBTargetPoolName: getLabel(lb.Labels, poolLabel),
+			OwnerID:          getLabel(lb.Labels, ownerLabel),
+		}
+		port := ""
+		if len(lb.Services) != 0 {
+			port = strconv.Itoa(lb.Services[0].DestinationPort)
+			config.ProxyProtocol = lb.Services[0].ProxyProtocol
+		}
+		for _, t := range lb.Targets {
+			ip := ""
+			switch {
+			case t.Type == "server" && t.Server != nil:
+				if s, ok := byID[t.Server.ID]; ok {
+					ip = serverIP(s, t.UsePrivateIP)
+				}
+			case t.Type == "ip" && t.IP != nil:
+				ip = t.IP.IP
+			}
+			if len(ip) != 0 {
+				config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: ip, Port: port})
+			}
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*HetznerHandler) TestConnection() error {
+	return checkConnection()
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/load_balancer_types?name="+url.QueryEscape(lbType), nil, nil)
+}
+
+// lbName is the name of the load balancer of an LB endpoint.
+func lbName(endpoint string) string {
+	return strings.Replace(endpoint, ":", "-", -1)
+}
+
+// newService returns the service of an LB endpoint. It listens on the port
+// following the last colon of the LB endpoint, or else on the port of the
+// targets. The targets of a service share a single destination port.
+func newService(config model.LBConfig) (service, error) {
+	s := service{Protocol: "tcp", ProxyProtocol: config.ProxyProtocol}
+	if i := strings.LastIndex(config.LBEndpoint, ":"); i >= 0 {
+		port, err := strconv.Atoi(config.LBEndpoint[i+1:])
+		if err != nil {
+			return s, fmt.Errorf("invalid port in LB endpoint %s, expected <name>:<port>", config.LBEndpoint)
+		}
+		s.ListenPort = port
+	}
+	for _, t := range config.LBTargets {
+		port, err := strconv.Atoi(t.Port)
+		if err != nil {
+			return s, fmt.Errorf("invalid port %q of target %s", t.Port, t.HostIP)
+		}
+		if s.DestinationPort != 0 && port != s.DestinationPort {
+			return s, fmt.Errorf("the targets of LB endpoint %s listen on the ports %d and %d, hcloud services have a single destination port",
+				config.LBEndpoint, s.DestinationPort, port)
+		}
+		s.DestinationPort = port
+	}
+	switch {
+	case s.ListenPort == 0 && s.DestinationPort == 0:
+		return s, fmt.Errorf("LB endpoint %s has no port and no targets, expected <name>:<port>", config.LBEndpoint)
+	case s.ListenPort == 0:
+		s.ListenPort = s.DestinationPort
+	case s.DestinationPort == 0:
+		s.DestinationPort = s.ListenPort
+	}
+	s.HealthCheck = &healthCheck{Protocol: "tcp", Port: s.DestinationPort, Interval: 15, Timeout: 10, Retries: 3}
+	return s, nil
+}
+
+func configLabels(config model.LBConfig) (map[string]string, error) {
+	labels := make(map[string]string)
+	for key, value := range providers.ResourceTags(config) {
+		// the descriptive labels are left out when they are no valid values
+		if validLabelValue(value) {
+			labels[key] = value
+		}
+	}
+	endpoint := config.LBEndpoint
+	if i := strings.LastIndex(endpoint, ":"); i >= 0 {
+		labels[portLabel] = endpoint[i+1:]
+		endpoint = endpoint[:i]
+	}
+	if err := setLabel(labels, endpointLabel, endpoint); err != nil {
+		return nil, err
+	}
+	if err := setLabel(labels, poolLabel, config.LBTargetPoolName); err != nil {
+		return nil, err
+	}
+	if err := setLabel(labels, ownerLabel, config.OwnerID); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// setLabel stores value in labels[key], continued in "<key>-2" and so on
+// when it is longer than a label value. Label values begin and end with a
+// letter or digit, so the value is only split between two of them.
+func setLabel(labels map[string]string, key string, value string) error {
+	for part := 1; len(value) != 0; part++ {
+		n := len(value)
+		if n > maxLabelLength {
+			n = maxLabelLength
+			for n > 0 && !(isAlphanumeric(value[n-1]) && isAlphanumeric(value[n])) {
+				n--
+			}
+		}
+		if n == 0 || !validLabelValue(value[:n]) {
+			return fmt.Errorf("%q can not be stored in hcloud labels, it may only contain letters, digits, dashes, underscores and dots and must begin and end with a letter or digit", value)
+		}
+		labels[labelPart(key, part)] = value[:n]
+		value = value[n:]
+	}
+	return nil
+}
+
+func getLabel(labels map[string]string, key string) string {
+	value := ""
+	for part := 1; ; part++ {
+		chunk, ok := labels[labelPart(key, part)]
+		if !ok {
+			return value
+		}
+		value += chunk
+	}
+}
+
+// getEndpoint returns the LB endpoint recorded in labels.
+func getEndpoint(labels map[string]string) string {
+	endpoint := getLabel(labels, endpointLabel)
+	if port, ok := labels[portLabel]; ok && len(endpoint) != 0 {
+		return endpoint + ":" + port
+	}
+	return endpoint
+}
+
+func labelPart(key string, part int) string {
+	if part == 1 {
+		return key
+	}
+	return key + "-" + strconv.Itoa(part)
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func validLabelValue(value string) bool {
+	if len(value) == 0 || len(value) > maxLabelLength || !isAlphanumeric(value[0]) || !isAlphanumeric(value[len(value)-1]) {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !isAlphanumeric(value[i]) && value[i] != '-' && value[i] != '_' && value[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func labelsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkOwner refuses access to a load balancer owned by someone else.
+func checkOwner(lb *loadBalancer, ownerID string) error {
+	owner := getLabel(lb.Labels, ownerLabel)
+	if len(owner) == 0 || owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("load balancer %s is owned by %s, refusing to modify it as %s", lb.Name, owner, ownerID)
+}
+
+// newTargets maps the target IPs to the servers with that public or
+// private IP, other IPs become IP targets.
+func newTargets(lbTargets []model.LBTarget, servers []server) []target {
+	public := make(map[string]int)
+	private := make(map[string]int)
+	for _, s := range servers {
+		if len(s.PublicNet.IPv4.IP) != 0 {
+			public[s.PublicNet.IPv4.IP] = s.ID
+		}
+		if ip := serverIP(&s, true); len(ip) != 0 {
+			private[ip] = s.ID
+		}
+	}
+	var targets []target
+	seen := make(map[string]bool)
+	for _, lbTarget := range lbTargets {
+		var t target
+		if id, ok := public[lbTarget.HostIP]; ok {
+			t = serverTarget(id, false)
+		} else if id, ok := private[lbTarget.HostIP]; ok {
+			t = serverTarget(id, true)
+		} else {
+			t.Type = "ip"
+			t.IP = &struct {
+				IP string `json:"ip"`
+			}{lbTarget.HostIP}
+		}
+		if !seen[targetKey(t)] {
+			seen[targetKey(t)] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+func serverTarget(id int, usePrivateIP bool) target {
+	t := target{Type: "server", UsePrivateIP: usePrivateIP}
+	t.Server = &struct {
+		ID int `json:"id"`
+	}{id}
+	return t
+}
+
+// serverIP returns the public IPv4 of a server, or its IP in the network
+// of HCLOUD_NETWORK, or in its first network without it.
+func serverIP(s *server, private bool) string {
+	if !private {
+		return s.PublicNet.IPv4.IP
+	}
+	for _, n := range s.PrivateNet {
+		if network == 0 || n.Network == network {
+			return n.IP
+		}
+	}
+	return ""
+}
+
+func targetKey(t target) string {
+	switch {
+	case t.Server != nil:
+		return fmt.Sprintf("server:%d:%t", t.Server.ID, t.UsePrivateIP)
+	case t.IP != nil:
+		return "ip:" + t.IP.IP
+	}
+	return t.Type
+}
+
+func createLoadBalancer(config model.LBConfig, labels map[string]string, s service, targets []target) error {
+	lbName := lbName(config.LBEndpoint)
+	var existing struct {
+		LoadBalancers []loadBalancer `json:"load_balancers"`
+	}
+	if err := doRequest("GET", "/load_balancers?name="+url.QueryEscape(lbName), nil, &existing); err != nil {
+		return err
+	}
+	if len(existing.LoadBalancers) != 0 {
+		return fmt.Errorf("a load balancer named %s exists that is not managed by external-lb for LB endpoint %s", lbName, config.LBEndpoint)
+	}
+	body := map[string]interface{}{
+		"name":               lbName,
+		"load_balancer_type": lbType,
+		"labels":             labels,
+		"services":           []service{s},
+		"targets":            targets,
+		"algorithm":          map[string]string{"type": "round_robin"},
+	}
+	if len(location) != 0 {
+		body["location"] = location
+	} else {
+		body["network_zone"] = networkZone
+	}
+	if network != 0 {
+		body["network"] = network
+	}
+	if targets == nil {
+		body["targets"] = []target{}
+	}
+	var resp struct {
+		Action action `json:"action"`
+	}
+	if err := doRequest("POST", "/load_balancers", body, &resp); err != nil {
+		return err
+	}
+	return waitForAction(&resp.Action)
+}
+
+// setService makes desired the only service of the load balancer.
+func setService(lb *loadBalancer, desired service) error {
+	found := false
+	for _, s := range lb.Services {
+		switch {
+		case s.ListenPort != desired.ListenPort:
+			if err := doAction(lb, "delete_service", map[string]int{"listen_port": s.ListenPort}); err != nil {
+				return err
+			}
+		case s.DestinationPort != desired.DestinationPort || s.ProxyProtocol != desired.ProxyProtocol || s.Protocol != desired.Protocol:
+			found = true
+			if err := doAction(lb, "update_service", desired); err != nil {
+				return err
+			}
+		default:
+			found = true
+		}
+	}
+	if found {
+		return nil
+	}
+	return doAction(lb, "add_service", desired)
+}
+
+// setTargets adds and removes the targets of the load balancer to match
+// targets.
+func setTargets(lb *loadBalancer, targets []target) error {
+	current := make(map[string]bool, len(lb.Targets))
+	for _, t := range lb.Targets {
+		current[targetKey(t)] = true
+	}
+	desired := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		desired[targetKey(t)] = true
+		if !current[targetKey(t)] {
+			if err := doAction(lb, "add_target", t); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range lb.Targets {
+		if !desired[targetKey(t)] {
+			if err := doAction(lb, "remove_target", t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findLoadBalancer returns the managed load balancer of an LB endpoint, nil
+// if there is none.
+func findLoadBalancer(endpoint string) (*loadBalancer, error) {
+	lbs, err := listLoadBalancers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range lbs {
+		if getEndpoint(lbs[i].Labels) == endpoint {
+			return &lbs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func listLoadBalancers() ([]loadBalancer, error) {
+	var lbs []loadBalancer
+	selector := url.QueryEscape(providers.ManagedByTag + "=" + providers.ManagedBy)
+	err := doPagedRequest("/load_balancers?label_selector="+selector, func(data []byte) error {
+		var page struct {
+			LoadBalancers []loadBalancer `json:"load_balancers"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		lbs = append(lbs, page.LoadBalancers...)
+		return nil
+	})
+	return lbs, err
+}
+
+func listServers() ([]server, error) {
+	var servers []server
+	err := doPagedRequest("/servers", func(data []byte) error {
+		var page struct {
+			Servers []server `json:"servers"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		servers = append(servers, page.Servers...)
+		return nil
+	})
+	return servers, err
+}
+
+func doAction(lb *loadBalancer, command string, body interface{}) error {
+	var resp struct {
+		Action action `json:"action"`
+	}
+	if err := doRequest("POST", fmt.Sprintf("/load_balancers/%d/actions/%s", lb.ID, command), body, &resp); err != nil {
+		return err
+	}
+	return waitForAction(&resp.Action)
+}
+
+func waitForAction(a *action) error {
+	deadline := time.Now().Add(actionTimeout)
+	for {
+		switch a.Status {
+		case "success":
+			return nil
+		case "error":
+			if a.Error != nil {
+				return fmt.Errorf("action %d failed: %s: %s", a.ID, a.Error.Code, a.Error.Message)
+			}
+			return fmt.Errorf("action %d failed", a.ID)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for action %d, status %s", a.ID, a.Status)
+		}
+		time.Sleep(time.Second)
+		var resp struct {
+			Action action `json:"action"`
+		}
+		if err := doRequest("GET", fmt.Sprintf("/actions/%d", a.ID), nil, &resp); err != nil {
+			return err
+		}
+		*a = resp.Action
+	}
+}
+
+// doPagedRequest calls handle with the response of every page of a list
+// request.
+func doPagedRequest(path string, handle func(data []byte) error) error {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	for page := 1; page != 0; {
+		var data json.RawMessage
+		if err := doRequest("GET", fmt.Sprintf("%s%spage=%d&per_page=50", path, separator, page), nil, &data); err != nil {
+			return err
+		}
+		if err := handle(data); err != nil {
+			return err
+		}
+		var meta struct {
+			Meta struct {
+				Pagination struct {
+					NextPage int `json:"next_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		page = meta.Meta.Pagination.NextPage
+	}
+	return nil
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, apiURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(respData, &apiErr) == nil && len(apiErr.Error.Message) != 0 {
+			return fmt.Errorf("%s %s returned %s: %s: %s", method, path, resp.Status, apiErr.Error.Code, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
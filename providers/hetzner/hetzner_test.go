@@ -0,0 +1,45 @@
+package hetzner
+
+import (
+	"github.com/rancher/external-lb/model"
+	"strings"
+	"testing"
+)
+
+func TestLabelsRecordLongValues(t *testing.T) {
+	pool := strings.Repeat("web_stack_", 10) + "12345678-90ab-cdef-1234-567890abcdef_rancher.internal"
+	config := model.LBConfig{
+		LBEndpoint:       "web.example.com:443",
+		LBTargetPoolName: pool,
+		OwnerID:          "external-lb.lb_1234",
+	}
+	labels, err := configLabels(config)
+	if err != nil {
+		t.Fatalf("storing the config in labels failed: %v", err)
+	}
+	for key, value := range labels {
+		if !validLabelValue(value) {
+			t.Errorf("label %s has the invalid value %q", key, value)
+		}
+	}
+	if _, ok := labels[poolLabel+"-2"]; !ok {
+		t.Errorf("the long pool name was not continued in a second label: %v", labels)
+	}
+	if endpoint := getEndpoint(labels); endpoint != config.LBEndpoint {
+		t.Errorf("got LB endpoint %q back", endpoint)
+	}
+	if name := getLabel(labels, poolLabel); name != pool {
+		t.Errorf("got pool name %q back", name)
+	}
+	if owner := getLabel(labels, ownerLabel); owner != config.OwnerID {
+		t.Errorf("got owner %q back", owner)
+	}
+}
+
+func TestSetLabelRejectsInvalidValues(t *testing.T) {
+	for _, value := range []string{"web/pool", "-web", "web_", strings.Repeat("a", 63) + "-" + strings.Repeat("-b", 40)} {
+		if err := setLabel(map[string]string{}, poolLabel, value); err == nil {
+			t.Errorf("%q was stored in labels", value)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package keepalived
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	name = "keepalived"
+
+	// configMarker prefixes the comment line holding the LB config a
+	// virtual server was rendered from, the rendered file is the provider state
+	configMarker = "# external-lb: "
+
+	defaultConfigPath = "/etc/keepalived/external-lb.conf"
+
+	// defaultPersistenceTimeout is used for sticky configs without a duration
+	defaultPersistenceTimeout = 300
+)
+
+var (
+	configPath string
+	reloadCmd  string
+	lbKind     string
+	lbAlgo     string
+	settings   map[string]string
+
+	// lock serializes the read-modify-write cycles on the config file
+	lock sync.Mutex
+)
+
+func init() {
+	keepalivedHandler := &KeepalivedHandler{}
+	if err := providers.RegisterProvider(name, keepalivedHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// KeepalivedHandler renders the LB configs into IPVS virtual_server blocks
+// of a keepalived configuration file and reloads keepalived, which programs
+// the IPVS virtual services and real servers. The LB endpoint is the
+// virtual server address, e.g. 10.0.0.100:80 or 10.0.0.100:53/udp. The
+// file is meant to be included from the keepalived.conf defining the VRRP
+// instances holding the virtual IPs.
+type KeepalivedHandler struct {
+}
+
+func (*KeepalivedHandler) Init() error {
+	configPath = os.Getenv("KEEPALIVED_CONFIG")
+	if len(configPath) == 0 {
+		configPath = defaultConfigPath
+	}
+	reloadCmd = os.Getenv("KEEPALIVED_RELOAD_CMD")
+	lbKind = strings.ToUpper(os.Getenv("KEEPALIVED_LB_KIND"))
+	if len(lbKind) == 0 {
+		lbKind = "NAT"
+	} else if lbKind != "NAT" && lbKind != "DR" && lbKind != "TUN" {
+		return fmt.Errorf("Invalid KEEPALIVED_LB_KIND value %q, expected NAT, DR or TUN", lbKind)
+	}
+	lbAlgo = os.Getenv("KEEPALIVED_LB_ALGO")
+	if len(lbAlgo) == 0 {
+		lbAlgo = "rr"
+	}
+
+	settings = map[string]string{
+		"KEEPALIVED_CONFIG":     configPath,
+		"KEEPALIVED_RELOAD_CMD": reloadCmd,
+		"KEEPALIVED_LB_KIND":    lbKind,
+		"KEEPALIVED_LB_ALGO":    lbAlgo,
+	}
+
+	if err := checkConfigDir(); err != nil {
+		return fmt.Errorf("keepalived config %s is not usable, error: %v", configPath, err)
+	}
+	return nil
+}
+
+func (*KeepalivedHandler) GetName() string {
+	return name
+}
+
+func (*KeepalivedHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*KeepalivedHandler) AddLBConfig(config model.LBConfig) error {
+	return modifyConfigs("AddLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+func (*KeepalivedHandler) RemoveLBConfig(config model.LBConfig) error {
+	return modifyConfigs("RemoveLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		delete(configs, config.LBEndpoint)
+		return nil
+	})
+}
+
+func (*KeepalivedHandler) UpdateLBConfig(config model.LBConfig) error {
+	return modifyConfigs("UpdateLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+// remove the servers of the backends, the frontends are kept
+func (*KeepalivedHandler) CleanupLBConfigs(cleanup []model.LBConfig) error {
+	return modifyConfigs("CleanupLBConfigs", func(configs map[string]model.LBConfig) error {
+		for _, config := range cleanup {
+			if err := checkOwner(configs, config); err != nil {
+				return err
+			}
+			if existing, ok := configs[config.LBEndpoint]; ok {
+				existing.LBTargets = nil
+				configs[config.LBEndpoint] = existing
+			}
+		}
+		return nil
+	})
+}
+
+func (*KeepalivedHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("keepalived GetLBConfigs: Error reading %s: %v\n", configPath, err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, config := range configs {
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*KeepalivedHandler) TestConnection() error {
+	return checkConfigDir()
+}
+
+// the connection limit is part of the config recorded in the rendered file
+func (*KeepalivedHandler) AppliesMaxConn() bool {
+	return true
+}
+
+// the protocol is part of the config recorded in the rendered file
+func (*KeepalivedHandler) AppliesProtocol() bool {
+	return true
+}
+
+// the stickiness is part of the config recorded in the rendered file
+func (*KeepalivedHandler) AppliesStickiness() bool {
+	return true
+}
+
+func checkConfigDir() error {
+	dir := filepath.Dir(configPath)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// checkOwner refuses to touch an existing virtual server owned by someone else.
+func checkOwner(configs map[string]model.LBConfig, config model.LBConfig) error {
+	existing, ok := configs[config.LBEndpoint]
+	if !ok || len(existing.OwnerID) == 0 || existing.OwnerID == config.OwnerID {
+		return nil
+	}
+	return fmt.Errorf("virtual server %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, existing.OwnerID, config.OwnerID)
+}
+
+func modifyConfigs(caller string, modify func(configs map[string]model.LBConfig) error) error {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("keepalived %s: Error reading %s: %v\n", caller, configPath, err)
+		return err
+	}
+	if err := modify(configs); err != nil {
+		logrus.Errorf("keepalived %s: %v\n", caller, err)
+		return err
+	}
+	if err := writeConfigs(configs); err != nil {
+		logrus.Errorf("keepalived %s: Error writing %s: %v\n", caller, configPath, err)
+		return err
+	}
+	if err := reload(); err != nil {
+		logrus.Errorf("keepalived %s: Error reloading keepalived: %v\n", caller, err)
+		return err
+	}
+	logrus.Debugf("keepalived %s: Done", caller)
+	return nil
+}
+
+// readConfigs parses the LB configs recorded in the rendered config file.
+func readConfigs() (map[string]model.LBConfig, error) {
+	configs := make(map[string]model.LBConfig)
+	file, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return configs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, configMarker) {
+			continue
+		}
+		var config model.LBConfig
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, configMarker)), &config); err != nil {
+			return nil, fmt.Errorf("invalid LB config comment %q: %v", line, err)
+		}
+		configs[config.LBEndpoint] = config
+	}
+	return configs, scanner.Err()
+}
+
+func writeConfigs(configs map[string]model.LBConfig) error {
+	var buf bytes.Buffer
+
+	var endpoints []string
+	for endpoint := range configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		if err := renderConfig(&buf, configs[endpoint]); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), filepath.Base(configPath)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+func renderConfig(buf *bytes.Buffer, config model.LBConfig) error {
+	address, port, protocol, err := parseEndpoint(config.LBEndpoint)
+	if err != nil {
+		return err
+	}
+	// IPVS works on L4, the protocol label overrides the endpoint suffix
+	switch config.Protocol {
+	case model.ProtocolUDP:
+		protocol = "UDP"
+	case "":
+	default:
+		protocol = "TCP"
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(buf, "%s%s\n", configMarker, data)
+	fmt.Fprintf(buf, "virtual_server %s %s {\n", address, port)
+	fmt.Fprintf(buf, "    delay_loop 6\n")
+	fmt.Fprintf(buf, "    lb_algo %s\n", lbAlgo)
+	fmt.Fprintf(buf, "    lb_kind %s\n", lbKind)
+	fmt.Fprintf(buf, "    protocol %s\n", protocol)
+	// IPVS only knows source IP persistence, cookies fall back to it
+	if stickiness := config.Stickiness; stickiness != nil {
+		timeout := stickiness.Duration
+		if timeout == 0 {
+			timeout = defaultPersistenceTimeout
+		}
+		fmt.Fprintf(buf, "    persistence_timeout %d\n", timeout)
+	}
+	for _, target := range config.LBTargets {
+		fmt.Fprintf(buf, "    real_server %s %s {\n", target.HostIP, target.Port)
+		fmt.Fprintf(buf, "        weight 1\n")
+		if config.MaxConn > 0 {
+			fmt.Fprintf(buf, "        uthreshold %d\n", config.MaxConn)
+		}
+		if protocol == "TCP" {
+			fmt.Fprintf(buf, "        TCP_CHECK {\n")
+			fmt.Fprintf(buf, "            connect_timeout 3\n")
+			fmt.Fprintf(buf, "        }\n")
+		}
+		fmt.Fprintf(buf, "    }\n")
+	}
+	fmt.Fprintf(buf, "}\n\n")
+	return nil
+}
+
+// parseEndpoint splits an "address:port[/protocol]" LB endpoint.
+func parseEndpoint(endpoint string) (string, string, string, error) {
+	protocol := "TCP"
+	if i := strings.LastIndex(endpoint, "/"); i >= 0 {
+		protocol = strings.ToUpper(endpoint[i+1:])
+		endpoint = endpoint[:i]
+	}
+	if protocol != "TCP" && protocol != "UDP" {
+		return "", "", "", fmt.Errorf("invalid protocol %s of LB endpoint %s, expected tcp or udp", protocol, endpoint)
+	}
+	i := strings.LastIndex(endpoint, ":")
+	if i <= 0 || i == len(endpoint)-1 {
+		return "", "", "", fmt.Errorf("invalid LB endpoint %s, expected address:port", endpoint)
+	}
+	return endpoint[:i], endpoint[i+1:], protocol, nil
+}
+
+func reload() error {
+	if len(reloadCmd) == 0 {
+		return nil
+	}
+	output, err := exec.Command("sh", "-c", reloadCmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
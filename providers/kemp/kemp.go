@@ -0,0 +1,428 @@
+package kemp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "kemp"
+
+	// nickNamePrefix marks the virtual services managed by external-lb, the
+	// nickname continues with "<target pool name>@<owner ID>"
+	nickNamePrefix = "external-lb:"
+)
+
+var (
+	baseURL  string
+	user     string
+	password string
+	apiKey   string
+	settings map[string]string
+	client   = &http.Client{Timeout: 30 * time.Second}
+)
+
+func init() {
+	kempHandler := &KempHandler{}
+	if err := providers.RegisterProvider(name, kempHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// KempHandler manages virtual services and their real servers on a Kemp
+// LoadMaster through its RESTful API. The LB endpoint is the address of the
+// virtual service, the target pool name and owner are recorded in its
+// nickname. Virtual services with other nicknames are never touched.
+type KempHandler struct {
+}
+
+type response struct {
+	Stat            string           `xml:"stat,attr"`
+	Code            string           `xml:"code,attr"`
+	Error           string           `xml:"Error"`
+	VirtualServices []virtualService `xml:"Success>Data>VS"`
+}
+
+type virtualService struct {
+	Index       string       `xml:"Index"`
+	Address     string       `xml:"VSAddress"`
+	Port        string       `xml:"VSPort"`
+	Protocol    string       `xml:"Protocol"`
+	NickName    string       `xml:"NickName"`
+	RealServers []realServer `xml:"Rs"`
+}
+
+type realServer struct {
+	Address string `xml:"Addr"`
+	Port    string `xml:"Port"`
+	Limit   int    `xml:"Limit"`
+}
+
+func (*KempHandler) Init() error {
+	host := os.Getenv("KEMP_HOST")
+	if len(host) == 0 {
+		return fmt.Errorf("KEMP_HOST is not set")
+	}
+	apiKey = os.Getenv("KEMP_API_KEY")
+	user = os.Getenv("KEMP_USER")
+	password = os.Getenv("KEMP_PWD")
+	if len(apiKey) == 0 {
+		if len(user) == 0 {
+			return fmt.Errorf("KEMP_USER or KEMP_API_KEY is not set")
+		}
+		if len(password) == 0 {
+			return fmt.Errorf("KEMP_PWD is not set")
+		}
+	}
+	baseURL = strings.TrimSuffix(host, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	settings = map[string]string{
+		"KEMP_HOST": host,
+		"KEMP_USER": user,
+	}
+	if len(password) != 0 {
+		settings["KEMP_PWD"] = providers.Redacted
+	}
+	if len(apiKey) != 0 {
+		settings["KEMP_API_KEY"] = providers.Redacted
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to LoadMaster %v does not work, error: %v", host, err)
+	}
+	return nil
+}
+
+func (*KempHandler) GetName() string {
+	return name
+}
+
+func (*KempHandler) GetConfig() map[string]string {
+	return settings
+}
+
+// the connection limit is the limit of the real servers
+func (*KempHandler) AppliesMaxConn() bool {
+	return true
+}
+
+func (*KempHandler) AddLBConfig(config model.LBConfig) error {
+	params, err := endpointParams(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("kemp AddLBConfig: %v\n", err)
+		return err
+	}
+	vs, err := findVirtualService(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("kemp AddLBConfig: Error listing virtual services: %v\n", err)
+		return err
+	}
+	nickName := nickNamePrefix + config.LBTargetPoolName + "@" + config.OwnerID
+	if vs == nil {
+		vs = &virtualService{}
+		if err := doRequest("addvs", withParam(params, "NickName", nickName), nil); err != nil {
+			logrus.Errorf("kemp AddLBConfig: Error adding virtual service %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+	} else {
+		if err := checkOwner(vs, config.OwnerID); err != nil {
+			logrus.Errorf("kemp AddLBConfig: %v\n", err)
+			return err
+		}
+		if vs.NickName != nickName {
+			if err := doRequest("modvs", withParam(params, "NickName", nickName), nil); err != nil {
+				logrus.Errorf("kemp AddLBConfig: Error renaming virtual service %s: %v\n", config.LBEndpoint, err)
+				return err
+			}
+		}
+	}
+
+	current := make(map[string]realServer, len(vs.RealServers))
+	for _, rs := range vs.RealServers {
+		current[net.JoinHostPort(rs.Address, rs.Port)] = rs
+	}
+	desired := make(map[string]bool, len(config.LBTargets))
+	for _, target := range config.LBTargets {
+		key := net.JoinHostPort(target.HostIP, target.Port)
+		desired[key] = true
+		rsParams := withParam(withParam(params, "rs", target.HostIP), "rsport", target.Port)
+		rsParams.Set("limit", strconv.Itoa(config.MaxConn))
+		rs, ok := current[key]
+		switch {
+		case !ok:
+			err = doRequest("addrs", rsParams, nil)
+		case rs.Limit != config.MaxConn:
+			err = doRequest("modrs", rsParams, nil)
+		}
+		if err != nil {
+			logrus.Errorf("kemp AddLBConfig: Error setting real server %s of virtual service %s: %v\n", key, config.LBEndpoint, err)
+			return err
+		}
+	}
+	for key, rs := range current {
+		if desired[key] {
+			continue
+		}
+		if err := removeRealServer(params, rs); err != nil {
+			logrus.Errorf("kemp AddLBConfig: Error removing real server %s of virtual service %s: %v\n", key, config.LBEndpoint, err)
+			return err
+		}
+	}
+	logrus.Debugf("kemp AddLBConfig: Done")
+	return nil
+}
+
+func (h *KempHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*KempHandler) RemoveLBConfig(config model.LBConfig) error {
+	vs, err := findVirtualService(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("kemp RemoveLBConfig: Error listing virtual services: %v\n", err)
+		return err
+	}
+	if vs == nil {
+		return nil
+	}
+	if err := checkOwner(vs, config.OwnerID); err != nil {
+		logrus.Errorf("kemp RemoveLBConfig: %v\n", err)
+		return err
+	}
+	params, err := endpointParams(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("kemp RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if err := doRequest("delvs", params, nil); err != nil {
+		logrus.Errorf("kemp RemoveLBConfig: Error deleting virtual service %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	logrus.Debugf("kemp RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the real servers of the virtual services, the virtual services
+// are kept
+func (*KempHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		vs, err := findVirtualService(config.LBEndpoint)
+		if err == nil && vs != nil {
+			err = checkOwner(vs, config.OwnerID)
+		}
+		if err == nil && vs != nil {
+			var params url.Values
+			if params, err = endpointParams(config.LBEndpoint); err == nil {
+				for _, rs := range vs.RealServers {
+					if err = removeRealServer(params, rs); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			logrus.Errorf("kemp CleanupLBConfigs: Error removing the real servers of virtual service %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("kemp CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*KempHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	vss, err := listVirtualServices()
+	if err != nil {
+		logrus.Errorf("kemp GetLBConfigs: Error listing virtual services: %v\n", err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, vs := range vss {
+		poolName, ownerID, ok := parseNickName(vs.NickName)
+		if !ok {
+			continue
+		}
+		config := model.LBConfig{
+			LBEndpoint:       vsEndpoint(vs),
+			LBTargetPoolName: poolName,
+			OwnerID:          ownerID,
+		}
+		for _, rs := range vs.RealServers {
+			config.LBTargets = append(config.LBTargets, model.LBTarget{HostIP: rs.Address, Port: rs.Port})
+			config.MaxConn = rs.Limit
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*KempHandler) TestConnection() error {
+	return checkConnection()
+}
+
+func checkConnection() error {
+	_, err := listVirtualServices()
+	return err
+}
+
+// endpointParams returns the parameters selecting the virtual service of
+// an LB endpoint <address>:<port>, followed by /udp for UDP services.
+func endpointParams(endpoint string) (url.Values, error) {
+	protocol := "tcp"
+	hostPort := endpoint
+	if strings.HasSuffix(endpoint, "/udp") {
+		protocol = "udp"
+		hostPort = strings.TrimSuffix(endpoint, "/udp")
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid LB endpoint %s, expected <address>:<port> or <address>:<port>/udp", endpoint)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("invalid port in LB endpoint %s", endpoint)
+	}
+	return url.Values{"vs": {host}, "port": {port}, "prot": {protocol}}, nil
+}
+
+// vsEndpoint is the LB endpoint of a virtual service.
+func vsEndpoint(vs virtualService) string {
+	endpoint := net.JoinHostPort(vs.Address, vs.Port)
+	if strings.ToLower(vs.Protocol) == "udp" {
+		endpoint += "/udp"
+	}
+	return endpoint
+}
+
+func withParam(params url.Values, key string, value string) url.Values {
+	copied := url.Values{}
+	for k, v := range params {
+		copied[k] = v
+	}
+	copied.Set(key, value)
+	return copied
+}
+
+// parseNickName returns the target pool name and owner recorded in the
+// nickname of a virtual service, false if it is not managed by external-lb.
+// Owner IDs have no @, so the pool name ends at the last one.
+func parseNickName(nickName string) (string, string, bool) {
+	if !strings.HasPrefix(nickName, nickNamePrefix) {
+		return "", "", false
+	}
+	record := strings.TrimPrefix(nickName, nickNamePrefix)
+	i := strings.LastIndex(record, "@")
+	if i < 0 {
+		return "", "", false
+	}
+	return record[:i], record[i+1:], true
+}
+
+// checkOwner refuses access to virtual services that are not managed by
+// external-lb or owned by someone else.
+func checkOwner(vs *virtualService, ownerID string) error {
+	_, owner, ok := parseNickName(vs.NickName)
+	if !ok {
+		return fmt.Errorf("virtual service %s exists and is not managed by external-lb, refusing to modify it", vsEndpoint(*vs))
+	}
+	if len(owner) == 0 || owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("virtual service %s is owned by %s, refusing to modify it as %s", vsEndpoint(*vs), owner, ownerID)
+}
+
+func removeRealServer(params url.Values, rs realServer) error {
+	return doRequest("delrs", withParam(withParam(params, "rs", rs.Address), "rsport", rs.Port), nil)
+}
+
+// findVirtualService returns the virtual service of an LB endpoint, nil if
+// there is none.
+func findVirtualService(endpoint string) (*virtualService, error) {
+	vss, err := listVirtualServices()
+	if err != nil {
+		return nil, err
+	}
+	for i := range vss {
+		if vsEndpoint(vss[i]) == endpoint {
+			return &vss[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func listVirtualServices() ([]virtualService, error) {
+	var resp response
+	if err := doRequest("listvs", url.Values{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.VirtualServices, nil
+}
+
+// doRequest runs a command of the RESTful API, which answers with an XML
+// document whose stat attribute is the status of the command.
+func doRequest(command string, params url.Values, out *response) error {
+	if len(apiKey) != 0 {
+		params = withParam(params, "apikey", apiKey)
+	}
+	req, err := http.NewRequest("GET", baseURL+"/access/"+command+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if len(apiKey) == 0 {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result response
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charsetReader
+	if err := decoder.Decode(&result); err != nil {
+		return fmt.Errorf("%s returned %s: %s", command, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result.Stat != "200" || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s: %s", command, resp.Status, result.Error)
+	}
+	if out != nil {
+		*out = result
+	}
+	return nil
+}
+
+// charsetReader converts the ISO-8859-1 documents of the LoadMaster to
+// UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if !strings.EqualFold(charset, "ISO-8859-1") {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		runes[i] = rune(c)
+	}
+	return strings.NewReader(string(runes)), nil
+}
@@ -0,0 +1,69 @@
+package kemp
+
+import (
+	"github.com/rancher/external-lb/model"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+const listResponse = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<Response stat="200" code="ok">
+<Success><Data>
+<VS><Index>1</Index><VSAddress>10.0.0.100</VSAddress><VSPort>80</VSPort><Protocol>tcp</Protocol><NickName>external-lb:web_env_rancher.internal@external-lb.lb_1</NickName>
+<Rs><RsIndex>1</RsIndex><Addr>10.0.1.1</Addr><Port>8080</Port><Limit>100</Limit></Rs>
+<Rs><RsIndex>2</RsIndex><Addr>10.0.1.2</Addr><Port>8080</Port><Limit>100</Limit></Rs>
+</VS>
+<VS><Index>2</Index><VSAddress>10.0.0.101</VSAddress><VSPort>53</VSPort><Protocol>udp</Protocol><NickName>dns</NickName></VS>
+</Data></Success>
+</Response>`
+
+func TestAddLBConfig(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if u, p, ok := r.BasicAuth(); !ok || u != "bal" || p != "secret" {
+			t.Errorf("wrong credentials %q, %q", u, p)
+		}
+		if r.URL.Path == "/access/listvs" {
+			w.Write([]byte(listResponse))
+			return
+		}
+		commands = append(commands, r.URL.Path[len("/access/"):]+" "+r.URL.Query().Get("rs")+" "+r.URL.Query().Get("limit"))
+		w.Write([]byte(`<Response stat="200" code="ok"><Success>Command completed ok</Success></Response>`))
+	}))
+	defer server.Close()
+	baseURL, user, password, apiKey = server.URL, "bal", "secret", ""
+
+	configs, err := (&KempHandler{}).GetLBConfigs()
+	if err != nil {
+		t.Fatalf("listing the LB configs failed: %v", err)
+	}
+	if len(configs) != 1 || configs[0].LBEndpoint != "10.0.0.100:80" || configs[0].LBTargetPoolName != "web_env_rancher.internal" ||
+		configs[0].OwnerID != "external-lb.lb_1" || configs[0].MaxConn != 100 || len(configs[0].LBTargets) != 2 {
+		t.Fatalf("got LB configs %+v", configs)
+	}
+
+	config := configs[0]
+	config.LBTargets = []model.LBTarget{{HostIP: "10.0.1.2", Port: "8080"}, {HostIP: "10.0.1.3", Port: "8080"}}
+	if err := (&KempHandler{}).AddLBConfig(config); err != nil {
+		t.Fatalf("updating the LB config failed: %v", err)
+	}
+	mu.Lock()
+	if len(commands) != 2 || commands[0] != "addrs 10.0.1.3 100" || commands[1] != "delrs 10.0.1.1 " {
+		t.Errorf("got commands %q", commands)
+	}
+	mu.Unlock()
+
+	config.OwnerID = "external-lb.lb_2"
+	if err := (&KempHandler{}).RemoveLBConfig(config); err == nil {
+		t.Errorf("removed a virtual service of another owner")
+	}
+	config.LBEndpoint = "10.0.0.101:53/udp"
+	if err := (&KempHandler{}).RemoveLBConfig(config); err == nil {
+		t.Errorf("removed a virtual service not managed by external-lb")
+	}
+}
@@ -0,0 +1,486 @@
+package netscaler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "netscaler"
+
+	// ownerCommentPrefix marks the service group comment carrying the owner ID
+	ownerCommentPrefix = "managed-by external-lb "
+	// maxGroupNameLength is the longest service group name NetScaler accepts
+	maxGroupNameLength = 127
+)
+
+var (
+	baseURL     string
+	user        string
+	password    string
+	settings    map[string]string
+	client      = &http.Client{Timeout: 30 * time.Second}
+	errNotFound = fmt.Errorf("not found")
+)
+
+func init() {
+	netscalerHandler := &NetScalerHandler{}
+	if err := providers.RegisterProvider(name, netscalerHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// NetScalerHandler manages service groups bound to existing lbvservers
+// through the NITRO API. Like for f5 BIG-IP the LB endpoint is the name of
+// the lbvserver, so services keep their labels when switching providers.
+type NetScalerHandler struct {
+}
+
+type lbvserver struct {
+	Name        string `json:"name"`
+	ServiceType string `json:"servicetype"`
+}
+
+type lbvserverBinding struct {
+	Name             string `json:"name"`
+	ServiceGroupName string `json:"servicegroupname"`
+}
+
+type serviceGroup struct {
+	ServiceGroupName string   `json:"servicegroupname"`
+	ServiceType      string   `json:"servicetype,omitempty"`
+	Comment          string   `json:"comment,omitempty"`
+	MaxClient        nitroInt `json:"maxclient"`
+}
+
+type serviceGroupMember struct {
+	ServiceGroupName string   `json:"servicegroupname"`
+	IP               string   `json:"ip"`
+	Port             nitroInt `json:"port"`
+}
+
+// nitroInt decodes the numbers NITRO returns either as JSON numbers or as
+// strings.
+type nitroInt int
+
+func (n *nitroInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if len(s) == 0 || s == "null" {
+		*n = 0
+		return nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*n = nitroInt(i)
+	return nil
+}
+
+func (n nitroInt) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(int(n))), nil
+}
+
+func (*NetScalerHandler) Init() error {
+	host := os.Getenv("NETSCALER_HOST")
+	if len(host) == 0 {
+		return fmt.Errorf("NETSCALER_HOST is not set")
+	}
+	user = os.Getenv("NETSCALER_USER")
+	if len(user) == 0 {
+		return fmt.Errorf("NETSCALER_USER is not set")
+	}
+	password = os.Getenv("NETSCALER_PWD")
+	if len(password) == 0 {
+		return fmt.Errorf("NETSCALER_PWD is not set")
+	}
+	baseURL = strings.TrimSuffix(host, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	settings = map[string]string{
+		"NETSCALER_HOST": host,
+		"NETSCALER_USER": user,
+		"NETSCALER_PWD":  providers.Redacted,
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to NetScaler %v does not work, error: %v", host, err)
+	}
+	return nil
+}
+
+func (*NetScalerHandler) GetName() string {
+	return name
+}
+
+func (*NetScalerHandler) GetConfig() map[string]string {
+	return settings
+}
+
+// ValidatePoolName checks the target pool name against the service group
+// name rules: it starts with a letter or underscore and only contains
+// letters, digits and the characters _#. :@=-
+func (*NetScalerHandler) ValidatePoolName(groupName string) error {
+	if len(groupName) > maxGroupNameLength {
+		return fmt.Errorf("service group names are limited to %d characters", maxGroupNameLength)
+	}
+	for i, r := range groupName {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case i > 0 && (r >= '0' && r <= '9' || strings.ContainsRune("#. :@=-", r)):
+		default:
+			return fmt.Errorf("service group names cannot contain %q at position %d", r, i)
+		}
+	}
+	return nil
+}
+
+func (*NetScalerHandler) AddLBConfig(config model.LBConfig) error {
+	vServer, err := getLBVServer(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("netscaler AddLBConfig: Error getting lbvserver %s, cannot add the config: %v\n", config.LBEndpoint, err)
+		return err
+	}
+
+	groupName := config.LBTargetPoolName
+	bound, err := getBoundServiceGroups(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("netscaler AddLBConfig: Error getting the service groups of lbvserver %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	for _, boundGroup := range bound {
+		if err := checkServiceGroupOwner(boundGroup, config.OwnerID); err != nil {
+			logrus.Errorf("netscaler AddLBConfig: %v\n", err)
+			return err
+		}
+	}
+
+	group := serviceGroup{
+		ServiceGroupName: groupName,
+		Comment:          ownerCommentPrefix + config.OwnerID,
+		MaxClient:        nitroInt(config.MaxConn),
+	}
+	if _, err := getServiceGroup(groupName); err == errNotFound {
+		group.ServiceType = vServer.ServiceType
+		err = doRequest("POST", "/servicegroup", map[string]interface{}{"servicegroup": group}, nil)
+		if err != nil {
+			logrus.Errorf("netscaler AddLBConfig: Error creating service group %s: %v\n", groupName, err)
+			return err
+		}
+	} else if err != nil {
+		logrus.Errorf("netscaler AddLBConfig: Error getting service group %s: %v\n", groupName, err)
+		return err
+	} else {
+		if err := checkServiceGroupOwner(groupName, config.OwnerID); err != nil {
+			logrus.Errorf("netscaler AddLBConfig: %v\n", err)
+			return err
+		}
+		err = doRequest("PUT", "/servicegroup", map[string]interface{}{"servicegroup": group}, nil)
+		if err != nil {
+			logrus.Errorf("netscaler AddLBConfig: Error modifying service group %s: %v\n", groupName, err)
+			return err
+		}
+	}
+
+	if err := syncMembers(groupName, config.LBTargets); err != nil {
+		logrus.Errorf("netscaler AddLBConfig: Error updating members of service group %s: %v\n", groupName, err)
+		return err
+	}
+
+	// bind our service group to the lbvserver and release the ones this
+	// instance bound before, e.g. after a target pool rename
+	isBound := false
+	for _, boundGroup := range bound {
+		if boundGroup == groupName {
+			isBound = true
+			continue
+		}
+		if err := unbindServiceGroup(config.LBEndpoint, boundGroup); err != nil {
+			logrus.Errorf("netscaler AddLBConfig: Error unbinding service group %s: %v\n", boundGroup, err)
+			return err
+		}
+	}
+	if !isBound {
+		binding := lbvserverBinding{Name: config.LBEndpoint, ServiceGroupName: groupName}
+		err = doRequest("PUT", "/lbvserver_servicegroup_binding", map[string]interface{}{"lbvserver_servicegroup_binding": binding}, nil)
+		if err != nil {
+			logrus.Errorf("netscaler AddLBConfig: Error binding service group %s to lbvserver %s: %v\n", groupName, config.LBEndpoint, err)
+			return err
+		}
+	}
+	logrus.Debugf("netscaler AddLBConfig: Done")
+	return nil
+}
+
+func (h *NetScalerHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*NetScalerHandler) RemoveLBConfig(config model.LBConfig) error {
+	groupName := config.LBTargetPoolName
+	if err := checkServiceGroupOwner(groupName, config.OwnerID); err != nil {
+		logrus.Errorf("netscaler RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if err := unbindServiceGroup(config.LBEndpoint, groupName); err != nil && err != errNotFound {
+		logrus.Errorf("netscaler RemoveLBConfig: Error unbinding service group %s from lbvserver %s: %v\n", groupName, config.LBEndpoint, err)
+		return err
+	}
+	if err := doRequest("DELETE", "/servicegroup/"+groupName, nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("netscaler RemoveLBConfig: Error deleting service group %s: %v\n", groupName, err)
+		return err
+	}
+	logrus.Debugf("netscaler RemoveLBConfig: Done")
+	return nil
+}
+
+// unbind the members of the service groups, the groups stay bound
+func (*NetScalerHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		if err := syncMembers(config.LBTargetPoolName, nil); err != nil {
+			logrus.Errorf("netscaler CleanupLBConfigs: Error removing members of service group %s: %v\n", config.LBTargetPoolName, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("netscaler CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (h *NetScalerHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	endpoints, err := h.ListLBEndpoints()
+	if err != nil {
+		logrus.Errorf("netscaler GetLBConfigs: Error listing lbvservers: %v\n", err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, endpoint := range endpoints {
+		config, found, err := h.GetLBConfig(endpoint)
+		if err != nil {
+			logrus.Errorf("netscaler GetLBConfigs: Error reading lbvserver %s: %v\n", endpoint, err)
+			return nil, err
+		}
+		if found {
+			lbConfigs = append(lbConfigs, config)
+		}
+	}
+	return lbConfigs, nil
+}
+
+func (*NetScalerHandler) ListLBEndpoints() ([]string, error) {
+	var resp struct {
+		LBVServers []lbvserver `json:"lbvserver"`
+	}
+	if err := doRequest("GET", "/lbvserver", nil, &resp); err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, vServer := range resp.LBVServers {
+		endpoints = append(endpoints, vServer.Name)
+	}
+	return endpoints, nil
+}
+
+// GetLBConfig returns the config of an lbvserver from the first service
+// group bound to it.
+func (*NetScalerHandler) GetLBConfig(endpoint string) (model.LBConfig, bool, error) {
+	config := model.LBConfig{LBEndpoint: endpoint}
+	bound, err := getBoundServiceGroups(endpoint)
+	if err == errNotFound || (err == nil && len(bound) == 0) {
+		return config, false, nil
+	} else if err != nil {
+		return config, false, err
+	}
+	group, err := getServiceGroup(bound[0])
+	if err != nil {
+		return config, false, err
+	}
+	config.LBTargetPoolName = group.ServiceGroupName
+	config.MaxConn = int(group.MaxClient)
+	if strings.HasPrefix(group.Comment, ownerCommentPrefix) {
+		config.OwnerID = strings.TrimPrefix(group.Comment, ownerCommentPrefix)
+	}
+	members, err := getMembers(group.ServiceGroupName)
+	if err != nil {
+		return config, false, err
+	}
+	for _, member := range members {
+		config.LBTargets = append(config.LBTargets, model.LBTarget{
+			HostIP: member.IP,
+			Port:   strconv.Itoa(int(member.Port)),
+		})
+	}
+	return config, true, nil
+}
+
+func (*NetScalerHandler) TestConnection() error {
+	return checkConnection()
+}
+
+// the connection limit is read back from the service group
+func (*NetScalerHandler) AppliesMaxConn() bool {
+	return true
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/nsconfig", nil, nil)
+}
+
+func getLBVServer(name string) (*lbvserver, error) {
+	var resp struct {
+		LBVServers []lbvserver `json:"lbvserver"`
+	}
+	if err := doRequest("GET", "/lbvserver/"+name, nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.LBVServers) == 0 {
+		return nil, errNotFound
+	}
+	return &resp.LBVServers[0], nil
+}
+
+func getBoundServiceGroups(vServer string) ([]string, error) {
+	var resp struct {
+		Bindings []lbvserverBinding `json:"lbvserver_servicegroup_binding"`
+	}
+	if err := doRequest("GET", "/lbvserver_servicegroup_binding/"+vServer, nil, &resp); err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, binding := range resp.Bindings {
+		groups = append(groups, binding.ServiceGroupName)
+	}
+	return groups, nil
+}
+
+func unbindServiceGroup(vServer string, groupName string) error {
+	return doRequest("DELETE", "/lbvserver_servicegroup_binding/"+vServer+"?args=servicegroupname:"+groupName, nil, nil)
+}
+
+func getServiceGroup(groupName string) (*serviceGroup, error) {
+	var resp struct {
+		ServiceGroups []serviceGroup `json:"servicegroup"`
+	}
+	if err := doRequest("GET", "/servicegroup/"+groupName, nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.ServiceGroups) == 0 {
+		return nil, errNotFound
+	}
+	return &resp.ServiceGroups[0], nil
+}
+
+// checkServiceGroupOwner refuses access to a service group owned by someone else.
+func checkServiceGroupOwner(groupName string, ownerID string) error {
+	group, err := getServiceGroup(groupName)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	owner := ""
+	if strings.HasPrefix(group.Comment, ownerCommentPrefix) {
+		owner = strings.TrimPrefix(group.Comment, ownerCommentPrefix)
+	}
+	if len(owner) == 0 || owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("service group %s is owned by %s, refusing to modify it as %s", groupName, owner, ownerID)
+}
+
+func getMembers(groupName string) ([]serviceGroupMember, error) {
+	var resp struct {
+		Members []serviceGroupMember `json:"servicegroup_servicegroupmember_binding"`
+	}
+	if err := doRequest("GET", "/servicegroup_servicegroupmember_binding/"+groupName, nil, &resp); err != nil && err != errNotFound {
+		return nil, err
+	}
+	return resp.Members, nil
+}
+
+func syncMembers(groupName string, targets []model.LBTarget) error {
+	members, err := getMembers(groupName)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]model.LBTarget, len(targets))
+	for _, target := range targets {
+		desired[target.HostIP+":"+target.Port] = target
+	}
+	existing := make(map[string]bool, len(members))
+	for _, member := range members {
+		key := fmt.Sprintf("%s:%d", member.IP, int(member.Port))
+		if _, ok := desired[key]; ok {
+			existing[key] = true
+			continue
+		}
+		path := fmt.Sprintf("/servicegroup_servicegroupmember_binding/%s?args=ip:%s,port:%d", groupName, member.IP, int(member.Port))
+		if err := doRequest("DELETE", path, nil, nil); err != nil {
+			return err
+		}
+	}
+	for key, target := range desired {
+		if existing[key] {
+			continue
+		}
+		port, err := strconv.Atoi(target.Port)
+		if err != nil {
+			return fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+		}
+		member := serviceGroupMember{ServiceGroupName: groupName, IP: target.HostIP, Port: nitroInt(port)}
+		if err := doRequest("PUT", "/servicegroup_servicegroupmember_binding", map[string]interface{}{"servicegroup_servicegroupmember_binding": member}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, baseURL+"/nitro/v1/config"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-NITRO-USER", user)
+	req.Header.Set("X-NITRO-PASS", password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package nginxplus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	name = "nginx_plus"
+
+	peerStateDraining = "draining"
+)
+
+var (
+	apiURL      string
+	keyvalZone  string
+	user        string
+	password    string
+	settings    map[string]string
+	client      = &http.Client{Timeout: 30 * time.Second}
+	errNotFound = fmt.Errorf("not found")
+)
+
+func init() {
+	nginxPlusHandler := &NginxPlusHandler{}
+	if err := providers.RegisterProvider(name, nginxPlusHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// NginxPlusHandler manages the servers of upstream groups through the
+// NGINX Plus API. The LB endpoint is the name of an upstream group with a
+// shared memory zone configured in NGINX. The target pool name and owner of
+// each managed upstream are kept in a key-value zone, since upstream groups
+// cannot carry any metadata themselves.
+type NginxPlusHandler struct {
+}
+
+// upstreamRecord is the value stored in the key-value zone for an upstream.
+type upstreamRecord struct {
+	TargetPoolName string `json:"pool"`
+	OwnerID        string `json:"owner,omitempty"`
+	MaxConn        int    `json:"max_conn,omitempty"`
+	DrainTimeout   int    `json:"drain_timeout,omitempty"`
+	SlowStart      int    `json:"slow_start,omitempty"`
+	// Draining holds the Unix time each draining server, keyed by its
+	// peer ID, started draining, for the drain timeout to be enforced
+	Draining map[string]int64 `json:"draining,omitempty"`
+}
+
+type upstream struct {
+	Peers []peer `json:"peers"`
+}
+
+type peer struct {
+	ID       int    `json:"id"`
+	Server   string `json:"server"`
+	State    string `json:"state"`
+	Active   int    `json:"active"`
+	MaxConns int    `json:"max_conns"`
+}
+
+func (*NginxPlusHandler) Init() error {
+	apiURL = strings.TrimSuffix(os.Getenv("NGINX_PLUS_API_URL"), "/")
+	if len(apiURL) == 0 {
+		return fmt.Errorf("NGINX_PLUS_API_URL is not set")
+	}
+	keyvalZone = os.Getenv("NGINX_PLUS_KEYVAL_ZONE")
+	if len(keyvalZone) == 0 {
+		return fmt.Errorf("NGINX_PLUS_KEYVAL_ZONE is not set")
+	}
+	user = os.Getenv("NGINX_PLUS_USER")
+	password = os.Getenv("NGINX_PLUS_PWD")
+
+	settings = map[string]string{
+		"NGINX_PLUS_API_URL":     apiURL,
+		"NGINX_PLUS_KEYVAL_ZONE": keyvalZone,
+		"NGINX_PLUS_USER":        user,
+	}
+	if len(password) != 0 {
+		settings["NGINX_PLUS_PWD"] = providers.Redacted
+	}
+
+	if err := checkConnection(); err != nil {
+		return fmt.Errorf("Connecting to NGINX Plus API %v does not work, error: %v", apiURL, err)
+	}
+	return nil
+}
+
+func (*NginxPlusHandler) GetName() string {
+	return name
+}
+
+func (*NginxPlusHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*NginxPlusHandler) AddLBConfig(config model.LBConfig) error {
+	records, err := getRecords()
+	if err != nil {
+		logrus.Errorf("nginx_plus AddLBConfig: Error reading key-value zone %s: %v\n", keyvalZone, err)
+		return err
+	}
+	record, exists := records[config.LBEndpoint]
+	if exists && len(record.OwnerID) != 0 && record.OwnerID != config.OwnerID {
+		err = fmt.Errorf("upstream %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, record.OwnerID, config.OwnerID)
+		logrus.Errorf("nginx_plus AddLBConfig: %v\n", err)
+		return err
+	}
+	record = upstreamRecord{
+		TargetPoolName: config.LBTargetPoolName,
+		OwnerID:        config.OwnerID,
+		MaxConn:        config.MaxConn,
+		DrainTimeout:   config.DrainTimeout,
+		SlowStart:      config.SlowStart,
+		Draining:       record.Draining,
+	}
+	if err = setRecord(config.LBEndpoint, &record, exists); err != nil {
+		logrus.Errorf("nginx_plus AddLBConfig: Error recording upstream %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if err = syncPeers(config.LBEndpoint, config.LBTargets, &record); err != nil {
+		logrus.Errorf("nginx_plus AddLBConfig: Error updating servers of upstream %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	logrus.Debugf("nginx_plus AddLBConfig: Done")
+	return nil
+}
+
+func (h *NginxPlusHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+// RemoveLBConfig drains all servers of the upstream. Drained servers are
+// deleted once their connections are closed, and the upstream is forgotten
+// after its last server has been deleted; until then it keeps being
+// reported so the removal is retried on the next reconcile.
+func (*NginxPlusHandler) RemoveLBConfig(config model.LBConfig) error {
+	records, err := getRecords()
+	if err != nil {
+		logrus.Errorf("nginx_plus RemoveLBConfig: Error reading key-value zone %s: %v\n", keyvalZone, err)
+		return err
+	}
+	record, exists := records[config.LBEndpoint]
+	if !exists {
+		return nil
+	}
+	if len(record.OwnerID) != 0 && record.OwnerID != config.OwnerID {
+		err = fmt.Errorf("upstream %s is owned by %s, refusing to remove it as %s", config.LBEndpoint, record.OwnerID, config.OwnerID)
+		logrus.Errorf("nginx_plus RemoveLBConfig: %v\n", err)
+		return err
+	}
+	if err = syncPeers(config.LBEndpoint, nil, &record); err != nil {
+		logrus.Errorf("nginx_plus RemoveLBConfig: Error draining servers of upstream %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	peers, err := getPeers(config.LBEndpoint)
+	if err != nil && err != errNotFound {
+		logrus.Errorf("nginx_plus RemoveLBConfig: Error reading upstream %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if len(peers) != 0 {
+		logrus.Infof("nginx_plus RemoveLBConfig: Waiting for %d servers of upstream %s to drain", len(peers), config.LBEndpoint)
+		return nil
+	}
+	if err = setRecord(config.LBEndpoint, nil, true); err != nil {
+		logrus.Errorf("nginx_plus RemoveLBConfig: Error forgetting upstream %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	logrus.Debugf("nginx_plus RemoveLBConfig: Done")
+	return nil
+}
+
+// drain the servers of the upstreams, the upstreams stay recorded
+func (*NginxPlusHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	records, err := getRecords()
+	if err != nil {
+		logrus.Errorf("nginx_plus CleanupLBConfigs: Error reading key-value zone %s: %v\n", keyvalZone, err)
+		return err
+	}
+	var lastErr error
+	for _, config := range configs {
+		record, ok := records[config.LBEndpoint]
+		if !ok {
+			continue
+		}
+		if err := syncPeers(config.LBEndpoint, nil, &record); err != nil {
+			logrus.Errorf("nginx_plus CleanupLBConfigs: Error draining servers of upstream %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("nginx_plus CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (*NginxPlusHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	records, err := getRecords()
+	if err != nil {
+		logrus.Errorf("nginx_plus GetLBConfigs: Error reading key-value zone %s: %v\n", keyvalZone, err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for endpoint, record := range records {
+		config, err := getUpstreamLBConfig(endpoint, record)
+		if err != nil {
+			logrus.Errorf("nginx_plus GetLBConfigs: Error reading upstream %s: %v\n", endpoint, err)
+			return nil, err
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*NginxPlusHandler) ListLBEndpoints() ([]string, error) {
+	records, err := getRecords()
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for endpoint := range records {
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+func (*NginxPlusHandler) GetLBConfig(endpoint string) (model.LBConfig, bool, error) {
+	records, err := getRecords()
+	if err != nil {
+		return model.LBConfig{}, false, err
+	}
+	record, ok := records[endpoint]
+	if !ok {
+		return model.LBConfig{}, false, nil
+	}
+	config, err := getUpstreamLBConfig(endpoint, record)
+	return config, err == nil, err
+}
+
+func (*NginxPlusHandler) TestConnection() error {
+	return checkConnection()
+}
+
+// the connection limit is part of the upstream record
+func (*NginxPlusHandler) AppliesMaxConn() bool {
+	return true
+}
+
+// the drain timeout is part of the upstream record
+func (*NginxPlusHandler) AppliesDrainTimeout() bool {
+	return true
+}
+
+// the slow start is part of the upstream record, it is set on the servers
+// as they are added
+func (*NginxPlusHandler) AppliesSlowStart() bool {
+	return true
+}
+
+func checkConnection() error {
+	return doRequest("GET", "/nginx", nil, nil)
+}
+
+// getUpstreamLBConfig returns the LB config of a recorded upstream. Servers
+// that are still draining are reported as targets, so the config differs
+// from the desired one until they are gone and the next reconcile updates
+// the upstream again.
+func getUpstreamLBConfig(endpoint string, record upstreamRecord) (model.LBConfig, error) {
+	config := model.LBConfig{
+		LBEndpoint:       endpoint,
+		LBTargetPoolName: record.TargetPoolName,
+		OwnerID:          record.OwnerID,
+		MaxConn:          record.MaxConn,
+		DrainTimeout:     record.DrainTimeout,
+		SlowStart:        record.SlowStart,
+	}
+	peers, err := getPeers(endpoint)
+	if err == errNotFound {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	for _, p := range peers {
+		i := strings.LastIndex(p.Server, ":")
+		if i < 0 {
+			continue
+		}
+		config.LBTargets = append(config.LBTargets, model.LBTarget{
+			HostIP: p.Server[:i],
+			Port:   p.Server[i+1:],
+		})
+	}
+	return config, nil
+}
+
+// syncPeers adds the missing targets to the upstream, drains the servers
+// that are no longer targets and deletes drained servers without any
+// active connection, or once they have been draining for the drain
+// timeout of the record. The record is updated in the key-value zone when
+// servers start or finish draining.
+func syncPeers(endpoint string, targets []model.LBTarget, record *upstreamRecord) error {
+	peers, err := getPeers(endpoint)
+	if err != nil {
+		return err
+	}
+	maxConn := record.MaxConn
+	draining := make(map[string]int64, len(record.Draining))
+	now := time.Now().Unix()
+	desired := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		desired[target.HostIP+":"+target.Port] = true
+	}
+	serversPath := "/http/upstreams/" + endpoint + "/servers"
+
+	existing := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		path := fmt.Sprintf("%s/%d", serversPath, p.ID)
+		id := strconv.Itoa(p.ID)
+		if p.State == peerStateDraining {
+			since, ok := record.Draining[id]
+			if !ok {
+				since = now
+			}
+			draining[id] = since
+		}
+		switch {
+		case desired[p.Server] && p.State != peerStateDraining:
+			existing[p.Server] = true
+			if p.MaxConns != maxConn {
+				err = doRequest("PATCH", path, map[string]int{"max_conns": maxConn}, nil)
+			}
+		case p.State != peerStateDraining:
+			logrus.Debugf("nginx_plus: Draining server %s of upstream %s", p.Server, endpoint)
+			if err = doRequest("PATCH", path, map[string]bool{"drain": true}, nil); err == nil {
+				draining[id] = now
+			}
+		case p.Active == 0:
+			// drained servers cannot be resumed, a returning target is added again
+			logrus.Debugf("nginx_plus: Deleting drained server %s of upstream %s", p.Server, endpoint)
+			if err = doRequest("DELETE", path, nil, nil); err == nil {
+				delete(draining, id)
+			}
+		case record.DrainTimeout > 0 && now-draining[id] >= int64(record.DrainTimeout):
+			logrus.Infof("nginx_plus: Deleting server %s of upstream %s after draining for %ds, %d connections are still active", p.Server, endpoint, record.DrainTimeout, p.Active)
+			if err = doRequest("DELETE", path, nil, nil); err == nil {
+				delete(draining, id)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !drainingEqual(draining, record.Draining) {
+		if len(draining) == 0 {
+			draining = nil
+		}
+		record.Draining = draining
+		if recordErr := setRecord(endpoint, record, true); recordErr != nil && err == nil {
+			err = recordErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for server := range desired {
+		if existing[server] {
+			continue
+		}
+		body := map[string]interface{}{"server": server}
+		if maxConn > 0 {
+			body["max_conns"] = maxConn
+		}
+		if record.SlowStart > 0 {
+			body["slow_start"] = fmt.Sprintf("%ds", record.SlowStart)
+		}
+		if err := doRequest("POST", serversPath, body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func drainingEqual(a map[string]int64, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, since := range a {
+		if other, ok := b[id]; !ok || other != since {
+			return false
+		}
+	}
+	return true
+}
+
+func getPeers(endpoint string) ([]peer, error) {
+	var u upstream
+	if err := doRequest("GET", "/http/upstreams/"+endpoint, nil, &u); err != nil {
+		return nil, err
+	}
+	return u.Peers, nil
+}
+
+func getRecords() (map[string]upstreamRecord, error) {
+	var values map[string]string
+	if err := doRequest("GET", "/http/keyvals/"+keyvalZone, nil, &values); err != nil && err != errNotFound {
+		return nil, err
+	}
+	records := make(map[string]upstreamRecord, len(values))
+	for endpoint, value := range values {
+		var record upstreamRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			// not written by us
+			continue
+		}
+		records[endpoint] = record
+	}
+	return records, nil
+}
+
+// setRecord stores the record of an upstream in the key-value zone, a nil
+// record deletes it.
+func setRecord(endpoint string, record *upstreamRecord, exists bool) error {
+	path := "/http/keyvals/" + keyvalZone
+	if record == nil {
+		return doRequest("PATCH", path, map[string]interface{}{endpoint: nil}, nil)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	method := "POST"
+	if exists {
+		method = "PATCH"
+	}
+	return doRequest(method, path, map[string]string{endpoint: string(data)}, nil)
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, apiURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(user) != 0 {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) != 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
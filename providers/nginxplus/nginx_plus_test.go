@@ -0,0 +1,126 @@
+package nginxplus
+
+import (
+	"encoding/json"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPI serves the key-value zone and the servers of the upstreams of
+// the NGINX Plus API, and records the bodies of the server requests.
+type fakeAPI struct {
+	mu       sync.Mutex
+	keyvals  map[string]string
+	peers    map[string][]peer
+	requests []string
+}
+
+func newFakeAPI() (*fakeAPI, func()) {
+	api := &fakeAPI{keyvals: map[string]string{}, peers: map[string][]peer{}}
+	server := httptest.NewServer(http.HandlerFunc(api.serve))
+	apiURL = server.URL
+	keyvalZone = "external_lb"
+	return api, server.Close
+}
+
+func (api *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/http/keyvals/"+keyvalZone:
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(api.keyvals)
+			return
+		}
+		var values map[string]string
+		json.Unmarshal(body, &values)
+		for key, value := range values {
+			api.keyvals[key] = value
+		}
+	case len(parts) == 3 && parts[1] == "upstreams" && r.Method == "GET":
+		json.NewEncoder(w).Encode(upstream{Peers: api.peers[parts[2]]})
+	case len(parts) >= 4 && parts[1] == "upstreams" && parts[3] == "servers":
+		api.requests = append(api.requests, r.Method+" "+r.URL.Path+" "+string(body))
+		if r.Method == "POST" {
+			var p peer
+			json.Unmarshal(body, &p)
+			p.ID = len(api.peers[parts[2]])
+			api.peers[parts[2]] = append(api.peers[parts[2]], p)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAddLBConfigSetsMaxConns(t *testing.T) {
+	api, stop := newFakeAPI()
+	defer stop()
+	// the existing server was added without a limit
+	api.peers["web"] = []peer{{ID: 0, Server: "10.0.0.1:8080", State: "up"}}
+
+	config := model.LBConfig{
+		LBEndpoint:       "web",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "8080"}, {HostIP: "10.0.0.2", Port: "8080"}},
+		MaxConn:          50,
+	}
+	if err := (&NginxPlusHandler{}).AddLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]bool{
+		`PATCH /http/upstreams/web/servers/0 {"max_conns":50}`:                       true,
+		`POST /http/upstreams/web/servers {"max_conns":50,"server":"10.0.0.2:8080"}`: true,
+	}
+	if len(api.requests) != len(expected) {
+		t.Errorf("got server requests %q, expected %d", api.requests, len(expected))
+	}
+	for _, request := range api.requests {
+		if !expected[request] {
+			t.Errorf("unexpected server request %q", request)
+		}
+	}
+
+	read, ok, err := (&NginxPlusHandler{}).GetLBConfig("web")
+	if err != nil || !ok {
+		t.Fatalf("reading the upstream failed: %v, %v", ok, err)
+	}
+	if read.MaxConn != 50 {
+		t.Errorf("the upstream is recorded with max_conn %d, expected 50", read.MaxConn)
+	}
+}
+
+func TestAddLBConfigWithoutMaxConns(t *testing.T) {
+	api, stop := newFakeAPI()
+	defer stop()
+
+	config := model.LBConfig{
+		LBEndpoint:       "web",
+		LBTargetPoolName: "web_env1_rancher.internal",
+		LBTargets:        []model.LBTarget{{HostIP: "10.0.0.1", Port: "8080"}},
+	}
+	if err := (&NginxPlusHandler{}).AddLBConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, request := range api.requests {
+		if strings.Contains(request, "max_conns") {
+			t.Errorf("server request %q limits the connections without a max_conn", request)
+		}
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("got server requests %q, expected one", api.requests)
+	}
+	var record upstreamRecord
+	json.Unmarshal([]byte(api.keyvals["web"]), &record)
+	if record.MaxConn != 0 {
+		t.Errorf("the upstream is recorded with max_conn %d", record.MaxConn)
+	}
+}
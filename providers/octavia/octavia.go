@@ -0,0 +1,588 @@
+package octavia
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	name = "octavia"
+
+	// ownerDescriptionPrefix marks the pool description carrying the owner ID
+	ownerDescriptionPrefix = "managed-by external-lb "
+	// maxPoolNameLength is the longest pool name Octavia accepts
+	maxPoolNameLength = 255
+
+	// maximum time to wait for a load balancer to become ACTIVE after a change
+	provisioningTimeout = 5 * time.Minute
+)
+
+var (
+	authURL         string
+	endpointURL     string
+	authBody        []byte
+	region          string
+	settings        map[string]string
+	client          = &http.Client{Timeout: 30 * time.Second}
+	errNotFound     = fmt.Errorf("not found")
+	errUnauthorized = fmt.Errorf("unauthorized")
+
+	// tokenLock guards token, which is renewed when it expired
+	tokenLock sync.Mutex
+	token     string
+)
+
+func init() {
+	octaviaHandler := &OctaviaHandler{}
+	if err := providers.RegisterProvider(name, octaviaHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// OctaviaHandler manages the pools and members of existing OpenStack
+// Octavia listeners. The LB endpoint is the listener name, a pool named
+// after the target pool is created on its load balancer and made the
+// default pool of the listener.
+type OctaviaHandler struct {
+}
+
+type listener struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Protocol      string `json:"protocol"`
+	DefaultPoolID string `json:"default_pool_id"`
+	LoadBalancers []struct {
+		ID string `json:"id"`
+	} `json:"loadbalancers"`
+}
+
+type pool struct {
+	ID          string   `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type member struct {
+	Address      string `json:"address"`
+	ProtocolPort int    `json:"protocol_port"`
+}
+
+func (*OctaviaHandler) Init() error {
+	authURL = strings.TrimSuffix(os.Getenv("OS_AUTH_URL"), "/")
+	if len(authURL) == 0 {
+		return fmt.Errorf("OS_AUTH_URL is not set")
+	}
+	username := os.Getenv("OS_USERNAME")
+	if len(username) == 0 {
+		return fmt.Errorf("OS_USERNAME is not set")
+	}
+	password := os.Getenv("OS_PASSWORD")
+	if len(password) == 0 {
+		return fmt.Errorf("OS_PASSWORD is not set")
+	}
+	project := os.Getenv("OS_PROJECT_NAME")
+	if len(project) == 0 {
+		return fmt.Errorf("OS_PROJECT_NAME is not set")
+	}
+	userDomain := getEnvDefault("OS_USER_DOMAIN_NAME", "Default")
+	projectDomain := getEnvDefault("OS_PROJECT_DOMAIN_NAME", "Default")
+	region = os.Getenv("OS_REGION_NAME")
+	endpointURL = strings.TrimSuffix(os.Getenv("OCTAVIA_ENDPOINT"), "/")
+
+	settings = map[string]string{
+		"OS_AUTH_URL":            authURL,
+		"OS_USERNAME":            username,
+		"OS_PASSWORD":            providers.Redacted,
+		"OS_PROJECT_NAME":        project,
+		"OS_USER_DOMAIN_NAME":    userDomain,
+		"OS_PROJECT_DOMAIN_NAME": projectDomain,
+		"OS_REGION_NAME":         region,
+		"OCTAVIA_ENDPOINT":       endpointURL,
+	}
+
+	var err error
+	authBody, err = json.Marshal(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     username,
+						"password": password,
+						"domain":   map[string]string{"name": userDomain},
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   project,
+					"domain": map[string]string{"name": projectDomain},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := authenticate(""); err != nil {
+		return fmt.Errorf("Authenticating with keystone %v does not work, error: %v", authURL, err)
+	}
+	return nil
+}
+
+func getEnvDefault(env string, defaultValue string) string {
+	if value := os.Getenv(env); len(value) != 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func (*OctaviaHandler) GetName() string {
+	return name
+}
+
+func (*OctaviaHandler) ValidatePoolName(poolName string) error {
+	if len(poolName) > maxPoolNameLength {
+		return fmt.Errorf("pool names are limited to %d characters", maxPoolNameLength)
+	}
+	return nil
+}
+
+func (*OctaviaHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*OctaviaHandler) AddLBConfig(config model.LBConfig) error {
+	l, err := getListener(config.LBEndpoint)
+	if err != nil {
+		logrus.Errorf("octavia AddLBConfig: Error getting listener %s, cannot add the config: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	if len(l.LoadBalancers) == 0 {
+		err = fmt.Errorf("listener %s is not attached to a load balancer", config.LBEndpoint)
+		logrus.Errorf("octavia AddLBConfig: %v\n", err)
+		return err
+	}
+	lbID := l.LoadBalancers[0].ID
+	if len(l.DefaultPoolID) != 0 {
+		current, err := getPool(l.DefaultPoolID)
+		if err != nil && err != errNotFound {
+			logrus.Errorf("octavia AddLBConfig: Error getting the default pool of listener %s: %v\n", config.LBEndpoint, err)
+			return err
+		}
+		if err == nil {
+			if err := checkPoolOwner(current, config.OwnerID); err != nil {
+				logrus.Errorf("octavia AddLBConfig: %v\n", err)
+				return err
+			}
+		}
+	}
+
+	desired := pool{
+		Name:        config.LBTargetPoolName,
+		Description: ownerDescriptionPrefix + config.OwnerID,
+		Tags:        resourceTags(config),
+	}
+
+	existing, err := findPool(config.LBTargetPoolName)
+	if err == errNotFound {
+		protocol := l.Protocol
+		if protocol == "TERMINATED_HTTPS" {
+			protocol = "HTTP"
+		}
+		body := map[string]interface{}{"pool": map[string]interface{}{
+			"name":            desired.Name,
+			"description":     desired.Description,
+			"tags":            desired.Tags,
+			"loadbalancer_id": lbID,
+			"protocol":        protocol,
+			"lb_algorithm":    "ROUND_ROBIN",
+		}}
+		var resp struct {
+			Pool pool `json:"pool"`
+		}
+		if err := doLBRequest(lbID, "POST", "/v2/lbaas/pools", body, &resp); err != nil {
+			logrus.Errorf("octavia AddLBConfig: Error creating pool %s: %v\n", desired.Name, err)
+			return err
+		}
+		existing = &resp.Pool
+	} else if err != nil {
+		logrus.Errorf("octavia AddLBConfig: Error getting pool %s: %v\n", desired.Name, err)
+		return err
+	} else {
+		if err := checkPoolOwner(existing, config.OwnerID); err != nil {
+			logrus.Errorf("octavia AddLBConfig: %v\n", err)
+			return err
+		}
+		body := map[string]interface{}{"pool": map[string]interface{}{
+			"description": desired.Description,
+			"tags":        desired.Tags,
+		}}
+		if err := doLBRequest(lbID, "PUT", "/v2/lbaas/pools/"+existing.ID, body, nil); err != nil {
+			logrus.Errorf("octavia AddLBConfig: Error modifying pool %s: %v\n", desired.Name, err)
+			return err
+		}
+	}
+
+	if err := setMembers(lbID, existing.ID, config.LBTargets); err != nil {
+		logrus.Errorf("octavia AddLBConfig: Error updating members of pool %s: %v\n", desired.Name, err)
+		return err
+	}
+
+	if l.DefaultPoolID != existing.ID {
+		body := map[string]interface{}{"listener": map[string]string{"default_pool_id": existing.ID}}
+		if err := doLBRequest(lbID, "PUT", "/v2/lbaas/listeners/"+l.ID, body, nil); err != nil {
+			logrus.Errorf("octavia AddLBConfig: Error making pool %s the default pool of listener %s: %v\n", desired.Name, config.LBEndpoint, err)
+			return err
+		}
+	}
+	logrus.Debugf("octavia AddLBConfig: Done")
+	return nil
+}
+
+func (h *OctaviaHandler) UpdateLBConfig(config model.LBConfig) error {
+	return h.AddLBConfig(config)
+}
+
+func (*OctaviaHandler) RemoveLBConfig(config model.LBConfig) error {
+	existing, err := findPool(config.LBTargetPoolName)
+	if err == errNotFound {
+		return nil
+	} else if err != nil {
+		logrus.Errorf("octavia RemoveLBConfig: Error getting pool %s: %v\n", config.LBTargetPoolName, err)
+		return err
+	}
+	if err := checkPoolOwner(existing, config.OwnerID); err != nil {
+		logrus.Errorf("octavia RemoveLBConfig: %v\n", err)
+		return err
+	}
+	l, err := getListener(config.LBEndpoint)
+	if err != nil && err != errNotFound {
+		logrus.Errorf("octavia RemoveLBConfig: Error getting listener %s: %v\n", config.LBEndpoint, err)
+		return err
+	}
+	lbID := ""
+	if l != nil && len(l.LoadBalancers) != 0 {
+		lbID = l.LoadBalancers[0].ID
+	}
+	// deleting the pool also removes its members and unsets it as the
+	// default pool of the listener
+	if err := doLBRequest(lbID, "DELETE", "/v2/lbaas/pools/"+existing.ID, nil, nil); err != nil && err != errNotFound {
+		logrus.Errorf("octavia RemoveLBConfig: Error deleting pool %s: %v\n", config.LBTargetPoolName, err)
+		return err
+	}
+	logrus.Debugf("octavia RemoveLBConfig: Done")
+	return nil
+}
+
+// remove the members of the pools, the pools stay the default pools
+func (*OctaviaHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	var lastErr error
+	for _, config := range configs {
+		l, err := getListener(config.LBEndpoint)
+		if err == errNotFound {
+			continue
+		}
+		if err == nil && len(l.DefaultPoolID) != 0 && len(l.LoadBalancers) != 0 {
+			err = setMembers(l.LoadBalancers[0].ID, l.DefaultPoolID, nil)
+		}
+		if err != nil {
+			logrus.Errorf("octavia CleanupLBConfigs: Error removing the members of listener %s: %v\n", config.LBEndpoint, err)
+			lastErr = err
+		}
+	}
+	logrus.Debugf("octavia CleanupLBConfigs: Done")
+	return lastErr
+}
+
+func (h *OctaviaHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	var resp struct {
+		Listeners []listener `json:"listeners"`
+	}
+	if err := doRequest("GET", "/v2/lbaas/listeners", nil, &resp); err != nil {
+		logrus.Errorf("octavia GetLBConfigs: Error listing listeners: %v\n", err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, l := range resp.Listeners {
+		if len(l.DefaultPoolID) == 0 {
+			continue
+		}
+		config, err := getListenerLBConfig(&l)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			logrus.Errorf("octavia GetLBConfigs: Error reading listener %s: %v\n", l.Name, err)
+			return nil, err
+		}
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*OctaviaHandler) TestConnection() error {
+	return doRequest("GET", "/v2/lbaas/loadbalancers?limit=1", nil, nil)
+}
+
+func getListenerLBConfig(l *listener) (model.LBConfig, error) {
+	config := model.LBConfig{LBEndpoint: l.Name}
+	p, err := getPool(l.DefaultPoolID)
+	if err != nil {
+		return config, err
+	}
+	config.LBTargetPoolName = p.Name
+	if strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		config.OwnerID = strings.TrimPrefix(p.Description, ownerDescriptionPrefix)
+	}
+	var resp struct {
+		Members []member `json:"members"`
+	}
+	if err := doRequest("GET", "/v2/lbaas/pools/"+p.ID+"/members", nil, &resp); err != nil {
+		return config, err
+	}
+	for _, m := range resp.Members {
+		config.LBTargets = append(config.LBTargets, model.LBTarget{
+			HostIP: m.Address,
+			Port:   strconv.Itoa(m.ProtocolPort),
+		})
+	}
+	return config, nil
+}
+
+// resourceTags renders the Rancher resource tags of config as sorted
+// "key=value" pool tags.
+func resourceTags(config model.LBConfig) []string {
+	var tags []string
+	for key, value := range providers.ResourceTags(config) {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// checkPoolOwner refuses access to a pool owned by someone else.
+func checkPoolOwner(p *pool, ownerID string) error {
+	if !strings.HasPrefix(p.Description, ownerDescriptionPrefix) {
+		return nil
+	}
+	owner := strings.TrimPrefix(p.Description, ownerDescriptionPrefix)
+	if owner == ownerID {
+		return nil
+	}
+	return fmt.Errorf("pool %s is owned by %s, refusing to modify it as %s", p.Name, owner, ownerID)
+}
+
+func getListener(name string) (*listener, error) {
+	var resp struct {
+		Listeners []listener `json:"listeners"`
+	}
+	if err := doRequest("GET", "/v2/lbaas/listeners?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Listeners) == 0 {
+		return nil, errNotFound
+	}
+	return &resp.Listeners[0], nil
+}
+
+func findPool(name string) (*pool, error) {
+	var resp struct {
+		Pools []pool `json:"pools"`
+	}
+	if err := doRequest("GET", "/v2/lbaas/pools?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Pools) == 0 {
+		return nil, errNotFound
+	}
+	return &resp.Pools[0], nil
+}
+
+func getPool(id string) (*pool, error) {
+	var resp struct {
+		Pool pool `json:"pool"`
+	}
+	if err := doRequest("GET", "/v2/lbaas/pools/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Pool, nil
+}
+
+// setMembers replaces the members of a pool in a single batch update.
+func setMembers(lbID string, poolID string, targets []model.LBTarget) error {
+	members := []member{}
+	for _, target := range targets {
+		port, err := strconv.Atoi(target.Port)
+		if err != nil {
+			return fmt.Errorf("invalid port %q of target %s", target.Port, target.HostIP)
+		}
+		members = append(members, member{Address: target.HostIP, ProtocolPort: port})
+	}
+	return doLBRequest(lbID, "PUT", "/v2/lbaas/pools/"+poolID+"/members", map[string]interface{}{"members": members}, nil)
+}
+
+// doLBRequest sends a change to a load balancer and waits for it to be
+// provisioned, Octavia rejects changes while a previous one is pending.
+func doLBRequest(lbID string, method string, path string, body interface{}, out interface{}) error {
+	if err := waitForLB(lbID); err != nil {
+		return err
+	}
+	if err := doRequest(method, path, body, out); err != nil {
+		return err
+	}
+	return waitForLB(lbID)
+}
+
+func waitForLB(lbID string) error {
+	if len(lbID) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(provisioningTimeout)
+	for {
+		var resp struct {
+			LoadBalancer struct {
+				ProvisioningStatus string `json:"provisioning_status"`
+			} `json:"loadbalancer"`
+		}
+		if err := doRequest("GET", "/v2/lbaas/loadbalancers/"+lbID, nil, &resp); err != nil {
+			return err
+		}
+		switch status := resp.LoadBalancer.ProvisioningStatus; {
+		case status == "ACTIVE":
+			return nil
+		case status == "ERROR":
+			return fmt.Errorf("load balancer %s is in provisioning status ERROR", lbID)
+		case time.Now().After(deadline):
+			return fmt.Errorf("timed out waiting for load balancer %s, provisioning status %s", lbID, status)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// authenticate issues a new keystone token unless the current token differs
+// from expired, i.e. it was renewed concurrently, and returns it.
+func authenticate(expired string) (string, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	if len(token) != 0 && token != expired {
+		return token, nil
+	}
+
+	resp, err := client.Post(authURL+"/auth/tokens", "application/json", bytes.NewReader(authBody))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("keystone returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if len(endpointURL) == 0 {
+		var catalog struct {
+			Token struct {
+				Catalog []struct {
+					Type      string `json:"type"`
+					Endpoints []struct {
+						Interface string `json:"interface"`
+						Region    string `json:"region"`
+						URL       string `json:"url"`
+					} `json:"endpoints"`
+				} `json:"catalog"`
+			} `json:"token"`
+		}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return "", err
+		}
+		for _, service := range catalog.Token.Catalog {
+			if service.Type != "load-balancer" {
+				continue
+			}
+			for _, endpoint := range service.Endpoints {
+				if endpoint.Interface == "public" && (len(region) == 0 || endpoint.Region == region) {
+					endpointURL = strings.TrimSuffix(endpoint.URL, "/")
+					break
+				}
+			}
+		}
+		if len(endpointURL) == 0 {
+			return "", fmt.Errorf("no public load-balancer endpoint in the service catalog, set OCTAVIA_ENDPOINT")
+		}
+	}
+
+	token = resp.Header.Get("X-Subject-Token")
+	return token, nil
+}
+
+func doRequest(method string, path string, body interface{}, out interface{}) error {
+	current, err := authenticate("")
+	if err != nil {
+		return err
+	}
+	err = sendRequest(current, method, path, body, out)
+	if err == errUnauthorized {
+		// the token expired, renew it and retry once
+		if current, err = authenticate(current); err != nil {
+			return err
+		}
+		err = sendRequest(current, method, path, body, out)
+	}
+	return err
+}
+
+func sendRequest(authToken string, method string, path string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpointURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", authToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+	}
+	if out != nil && len(respData) != 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
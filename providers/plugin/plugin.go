@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	name = "plugin"
+
+	commandInit    = "init"
+	commandGet     = "get"
+	commandAdd     = "add"
+	commandUpdate  = "update"
+	commandRemove  = "remove"
+	commandCleanup = "cleanup"
+	commandTest    = "test"
+
+	defaultTimeout = 60 * time.Second
+)
+
+var (
+	pluginCmd string
+	timeout   time.Duration
+	settings  map[string]string
+	// healthChecks, stickiness, protocol, drainTimeout, slowStart,
+	// proxyProtocol, attributes and maxConn are set when the plugin declared
+	// applying the health check, stickiness, protocol, drain timeout, slow
+	// start, PROXY protocol, attributes and connection limit of configs
+	healthChecks  bool
+	stickiness    bool
+	protocol      bool
+	drainTimeout  bool
+	slowStart     bool
+	proxyProtocol bool
+	attributes    bool
+	maxConn       bool
+)
+
+func init() {
+	pluginHandler := &PluginHandler{}
+	if err := providers.RegisterProvider(name, pluginHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// PluginHandler delegates to an external binary so providers for other load
+// balancers can be written without changing this repository. Every call
+// runs "<PLUGIN_CMD> <command>" with a JSON request on stdin and expects a
+// JSON response on stdout, see request and response below and
+// lbconfig.schema.json for the LBConfig format. A non-zero exit status
+// fails the call, with stderr as the error message. The plugin inherits the
+// environment, so it reads its own settings from there.
+type PluginHandler struct {
+}
+
+// request is written to the plugin's stdin. Config is set for add, update
+// and remove, Configs for cleanup.
+type request struct {
+	Command string           `json:"command"`
+	Config  *model.LBConfig  `json:"config,omitempty"`
+	Configs []model.LBConfig `json:"configs,omitempty"`
+}
+
+// response is read from the plugin's stdout. Configs is returned by get,
+// Settings and the HealthChecks, Stickiness, Protocol, DrainTimeout,
+// SlowStart, ProxyProtocol, Attributes and MaxConn capabilities
+// optionally by init, the settings with secrets already redacted. An empty response is valid for the other commands.
+type response struct {
+	Configs       []model.LBConfig  `json:"configs"`
+	Settings      map[string]string `json:"settings"`
+	HealthChecks  bool              `json:"health_checks"`
+	Stickiness    bool              `json:"stickiness"`
+	Protocol      bool              `json:"protocol"`
+	DrainTimeout  bool              `json:"drain_timeout"`
+	SlowStart     bool              `json:"slow_start"`
+	ProxyProtocol bool              `json:"proxy_protocol"`
+	Attributes    bool              `json:"attributes"`
+	MaxConn       bool              `json:"max_conn"`
+	Error         string            `json:"error"`
+}
+
+func (*PluginHandler) Init() error {
+	pluginCmd = os.Getenv("PLUGIN_CMD")
+	if len(pluginCmd) == 0 {
+		return fmt.Errorf("PLUGIN_CMD is not set")
+	}
+	timeout = defaultTimeout
+	if value := os.Getenv("PLUGIN_TIMEOUT"); len(value) != 0 {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid PLUGIN_TIMEOUT value %q, expected a duration such as 60s", value)
+		}
+	}
+
+	settings = map[string]string{
+		"PLUGIN_CMD":     pluginCmd,
+		"PLUGIN_TIMEOUT": timeout.String(),
+	}
+
+	resp, err := run(request{Command: commandInit})
+	if err != nil {
+		return fmt.Errorf("Initializing plugin %s failed, error: %v", pluginCmd, err)
+	}
+	for key, value := range resp.Settings {
+		settings[key] = value
+	}
+	healthChecks = resp.HealthChecks
+	stickiness = resp.Stickiness
+	protocol = resp.Protocol
+	drainTimeout = resp.DrainTimeout
+	slowStart = resp.SlowStart
+	proxyProtocol = resp.ProxyProtocol
+	attributes = resp.Attributes
+	maxConn = resp.MaxConn
+	return nil
+}
+
+func (*PluginHandler) GetName() string {
+	return name
+}
+
+func (*PluginHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*PluginHandler) AddLBConfig(config model.LBConfig) error {
+	return apply("AddLBConfig", request{Command: commandAdd, Config: &config})
+}
+
+func (*PluginHandler) UpdateLBConfig(config model.LBConfig) error {
+	return apply("UpdateLBConfig", request{Command: commandUpdate, Config: &config})
+}
+
+func (*PluginHandler) RemoveLBConfig(config model.LBConfig) error {
+	return apply("RemoveLBConfig", request{Command: commandRemove, Config: &config})
+}
+
+func (*PluginHandler) CleanupLBConfigs(configs []model.LBConfig) error {
+	return apply("CleanupLBConfigs", request{Command: commandCleanup, Configs: configs})
+}
+
+func (*PluginHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	resp, err := run(request{Command: commandGet})
+	if err != nil {
+		logrus.Errorf("plugin GetLBConfigs: %v\n", err)
+		return nil, err
+	}
+	return resp.Configs, nil
+}
+
+func (*PluginHandler) TestConnection() error {
+	_, err := run(request{Command: commandTest})
+	return err
+}
+
+func (*PluginHandler) AppliesHealthChecks() bool {
+	return healthChecks
+}
+
+func (*PluginHandler) AppliesStickiness() bool {
+	return stickiness
+}
+
+func (*PluginHandler) AppliesProtocol() bool {
+	return protocol
+}
+
+func (*PluginHandler) AppliesDrainTimeout() bool {
+	return drainTimeout
+}
+
+func (*PluginHandler) AppliesSlowStart() bool {
+	return slowStart
+}
+
+func (*PluginHandler) AppliesProxyProtocol() bool {
+	return proxyProtocol
+}
+
+func (*PluginHandler) AppliesAttributes() bool {
+	return attributes
+}
+
+func (*PluginHandler) AppliesMaxConn() bool {
+	return maxConn
+}
+
+func apply(caller string, req request) error {
+	if _, err := run(req); err != nil {
+		logrus.Errorf("plugin %s: %v\n", caller, err)
+		return err
+	}
+	logrus.Debugf("plugin %s: Done", caller)
+	return nil
+}
+
+// run executes the plugin for one request, killing it after the timeout.
+func run(req request) (*response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(pluginCmd, req.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// run the plugin in its own process group so a timeout also kills the
+	// processes it started, which would otherwise keep stdout open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("%s %s timed out after %v", pluginCmd, req.Command, timeout)
+	}
+	if stderr.Len() != 0 {
+		logrus.Debugf("plugin %s: %s", req.Command, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) == 0 {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s %s failed: %s", pluginCmd, req.Command, msg)
+	}
+
+	resp := &response{}
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) != 0 {
+		if err := json.Unmarshal(out, resp); err != nil {
+			return nil, fmt.Errorf("invalid response of %s %s: %v", pluginCmd, req.Command, err)
+		}
+	}
+	if len(resp.Error) != 0 {
+		return nil, fmt.Errorf("%s %s failed: %s", pluginCmd, req.Command, resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,403 @@
+package traefik
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"github.com/rancher/external-lb/providers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	name = "traefik"
+
+	// configMarker prefixes the comment line holding the LB config a router
+	// was rendered from, the rendered file is the provider state
+	configMarker = "# external-lb: "
+
+	modeHTTP = "http"
+	modeTCP  = "tcp"
+
+	defaultConfigPath = "/etc/traefik/dynamic/external-lb.yml"
+)
+
+var (
+	configPath  string
+	mode        string
+	entryPoints []string
+	settings    map[string]string
+
+	// lock serializes the read-modify-write cycles on the config file
+	lock sync.Mutex
+)
+
+func init() {
+	traefikHandler := &TraefikHandler{}
+	if err := providers.RegisterProvider(name, traefikHandler); err != nil {
+		logrus.Fatalf("Could not register %s provider", name)
+	}
+}
+
+// TraefikHandler writes a dynamic configuration file for the Traefik file
+// provider with one router and service per LB endpoint. In http mode the LB
+// endpoint is the host name matched by the router, in tcp mode it is the
+// entry point the router listens on.
+//
+// The file is written as JSON, which Traefik reads as YAML.
+type TraefikHandler struct {
+}
+
+type dynamicConfig struct {
+	HTTP *httpConfig `json:"http,omitempty"`
+	TCP  *tcpConfig  `json:"tcp,omitempty"`
+}
+
+type httpConfig struct {
+	Routers  map[string]router      `json:"routers"`
+	Services map[string]httpService `json:"services"`
+}
+
+type tcpConfig struct {
+	Routers  map[string]router     `json:"routers"`
+	Services map[string]tcpService `json:"services"`
+}
+
+type router struct {
+	EntryPoints []string `json:"entryPoints,omitempty"`
+	Rule        string   `json:"rule"`
+	Service     string   `json:"service"`
+}
+
+type httpService struct {
+	LoadBalancer struct {
+		Servers     []httpServer     `json:"servers"`
+		HealthCheck *httpHealthCheck `json:"healthCheck,omitempty"`
+		Sticky      *sticky          `json:"sticky,omitempty"`
+	} `json:"loadBalancer"`
+}
+
+type sticky struct {
+	Cookie struct {
+		Name   string `json:"name"`
+		MaxAge int    `json:"maxAge,omitempty"`
+	} `json:"cookie"`
+}
+
+type httpHealthCheck struct {
+	Path     string `json:"path"`
+	Interval string `json:"interval,omitempty"`
+}
+
+type httpServer struct {
+	URL string `json:"url"`
+}
+
+type tcpService struct {
+	LoadBalancer struct {
+		Servers       []tcpServer    `json:"servers"`
+		ProxyProtocol *proxyProtocol `json:"proxyProtocol,omitempty"`
+	} `json:"loadBalancer"`
+}
+
+type proxyProtocol struct {
+	Version int `json:"version"`
+}
+
+type tcpServer struct {
+	Address string `json:"address"`
+}
+
+func (*TraefikHandler) Init() error {
+	configPath = os.Getenv("TRAEFIK_CONFIG")
+	if len(configPath) == 0 {
+		configPath = defaultConfigPath
+	}
+	mode = os.Getenv("TRAEFIK_MODE")
+	if len(mode) == 0 {
+		mode = modeHTTP
+	} else if mode != modeHTTP && mode != modeTCP {
+		return fmt.Errorf("Invalid TRAEFIK_MODE value %q, expected %s or %s", mode, modeHTTP, modeTCP)
+	}
+	entryPoints = nil
+	for _, entryPoint := range strings.Split(os.Getenv("TRAEFIK_ENTRYPOINTS"), ",") {
+		if entryPoint = strings.TrimSpace(entryPoint); len(entryPoint) != 0 {
+			entryPoints = append(entryPoints, entryPoint)
+		}
+	}
+
+	settings = map[string]string{
+		"TRAEFIK_CONFIG":      configPath,
+		"TRAEFIK_MODE":        mode,
+		"TRAEFIK_ENTRYPOINTS": strings.Join(entryPoints, ","),
+	}
+
+	if err := checkConfigDir(); err != nil {
+		return fmt.Errorf("Traefik config %s is not usable, error: %v", configPath, err)
+	}
+	return nil
+}
+
+func (*TraefikHandler) GetName() string {
+	return name
+}
+
+func (*TraefikHandler) GetConfig() map[string]string {
+	return settings
+}
+
+func (*TraefikHandler) AddLBConfig(config model.LBConfig) error {
+	return modifyConfigs("AddLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+func (*TraefikHandler) RemoveLBConfig(config model.LBConfig) error {
+	return modifyConfigs("RemoveLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		delete(configs, config.LBEndpoint)
+		return nil
+	})
+}
+
+func (*TraefikHandler) UpdateLBConfig(config model.LBConfig) error {
+	return modifyConfigs("UpdateLBConfig", func(configs map[string]model.LBConfig) error {
+		if err := checkOwner(configs, config); err != nil {
+			return err
+		}
+		configs[config.LBEndpoint] = config
+		return nil
+	})
+}
+
+// remove the servers of the services, the routers are kept
+func (*TraefikHandler) CleanupLBConfigs(cleanup []model.LBConfig) error {
+	return modifyConfigs("CleanupLBConfigs", func(configs map[string]model.LBConfig) error {
+		for _, config := range cleanup {
+			if err := checkOwner(configs, config); err != nil {
+				return err
+			}
+			if existing, ok := configs[config.LBEndpoint]; ok {
+				existing.LBTargets = nil
+				configs[config.LBEndpoint] = existing
+			}
+		}
+		return nil
+	})
+}
+
+func (*TraefikHandler) GetLBConfigs() ([]model.LBConfig, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("traefik GetLBConfigs: Error reading %s: %v\n", configPath, err)
+		return nil, err
+	}
+	var lbConfigs []model.LBConfig
+	for _, config := range configs {
+		lbConfigs = append(lbConfigs, config)
+	}
+	return lbConfigs, nil
+}
+
+func (*TraefikHandler) TestConnection() error {
+	return checkConfigDir()
+}
+
+// health checks are only supported by http services
+func (*TraefikHandler) AppliesHealthChecks() bool {
+	return mode == modeHTTP
+}
+
+// only http services can be sticky, through a cookie
+func (*TraefikHandler) AppliesStickiness() bool {
+	return mode == modeHTTP
+}
+
+// only tcp services can send the PROXY protocol
+func (*TraefikHandler) AppliesProxyProtocol() bool {
+	return mode == modeTCP
+}
+
+func checkConfigDir() error {
+	dir := filepath.Dir(configPath)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// checkOwner refuses to touch an existing router owned by someone else.
+func checkOwner(configs map[string]model.LBConfig, config model.LBConfig) error {
+	existing, ok := configs[config.LBEndpoint]
+	if !ok || len(existing.OwnerID) == 0 || existing.OwnerID == config.OwnerID {
+		return nil
+	}
+	return fmt.Errorf("router for %s is owned by %s, refusing to modify it as %s", config.LBEndpoint, existing.OwnerID, config.OwnerID)
+}
+
+func modifyConfigs(caller string, modify func(configs map[string]model.LBConfig) error) error {
+	lock.Lock()
+	defer lock.Unlock()
+	configs, err := readConfigs()
+	if err != nil {
+		logrus.Errorf("traefik %s: Error reading %s: %v\n", caller, configPath, err)
+		return err
+	}
+	if err := modify(configs); err != nil {
+		logrus.Errorf("traefik %s: %v\n", caller, err)
+		return err
+	}
+	if err := writeConfigs(configs); err != nil {
+		logrus.Errorf("traefik %s: Error writing %s: %v\n", caller, configPath, err)
+		return err
+	}
+	logrus.Debugf("traefik %s: Done", caller)
+	return nil
+}
+
+// readConfigs parses the LB configs recorded in the rendered config file.
+func readConfigs() (map[string]model.LBConfig, error) {
+	configs := make(map[string]model.LBConfig)
+	file, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return configs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, configMarker) {
+			continue
+		}
+		var config model.LBConfig
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, configMarker)), &config); err != nil {
+			return nil, fmt.Errorf("invalid LB config comment %q: %v", line, err)
+		}
+		configs[config.LBEndpoint] = config
+	}
+	return configs, scanner.Err()
+}
+
+func writeConfigs(configs map[string]model.LBConfig) error {
+	var endpoints []string
+	for endpoint := range configs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	var buf bytes.Buffer
+	var dynamic dynamicConfig
+	if mode == modeHTTP {
+		dynamic.HTTP = &httpConfig{Routers: map[string]router{}, Services: map[string]httpService{}}
+	} else {
+		dynamic.TCP = &tcpConfig{Routers: map[string]router{}, Services: map[string]tcpService{}}
+	}
+	for _, endpoint := range endpoints {
+		config := configs[endpoint]
+		data, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s%s\n", configMarker, data)
+
+		serviceName := sanitizeName(config.LBTargetPoolName)
+		if mode == modeHTTP {
+			var service httpService
+			service.LoadBalancer.Servers = []httpServer{}
+			for _, target := range config.LBTargets {
+				service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, httpServer{URL: "http://" + target.HostIP + ":" + target.Port})
+			}
+			if stickiness := config.Stickiness; stickiness != nil && stickiness.Type == model.StickinessCookie {
+				service.LoadBalancer.Sticky = &sticky{}
+				service.LoadBalancer.Sticky.Cookie.Name = "lb_" + serviceName
+				service.LoadBalancer.Sticky.Cookie.MaxAge = stickiness.Duration
+			}
+			// traefik only checks http services, and always needs a path
+			if check := config.HealthCheck; check != nil && len(check.Path) != 0 {
+				service.LoadBalancer.HealthCheck = &httpHealthCheck{Path: check.Path}
+				if check.Interval > 0 {
+					service.LoadBalancer.HealthCheck.Interval = fmt.Sprintf("%ds", check.Interval)
+				}
+			}
+			dynamic.HTTP.Services[serviceName] = service
+			dynamic.HTTP.Routers[sanitizeName(config.LBEndpoint)] = router{
+				EntryPoints: entryPoints,
+				Rule:        "Host(`" + config.LBEndpoint + "`)",
+				Service:     serviceName,
+			}
+		} else {
+			var service tcpService
+			service.LoadBalancer.Servers = []tcpServer{}
+			for _, target := range config.LBTargets {
+				service.LoadBalancer.Servers = append(service.LoadBalancer.Servers, tcpServer{Address: target.HostIP + ":" + target.Port})
+			}
+			if config.ProxyProtocol {
+				service.LoadBalancer.ProxyProtocol = &proxyProtocol{Version: 2}
+			}
+			dynamic.TCP.Services[serviceName] = service
+			dynamic.TCP.Routers[sanitizeName(config.LBEndpoint)] = router{
+				EntryPoints: []string{config.LBEndpoint},
+				Rule:        "HostSNI(`*`)",
+				Service:     serviceName,
+			}
+		}
+	}
+	data, err := json.MarshalIndent(dynamic, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	buf.WriteString("\n")
+
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), "."+filepath.Base(configPath)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// sanitizeName maps s to the characters allowed in router and service names.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, s)
+}
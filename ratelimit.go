@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket pacing the provider calls so that no more
+// than the configured number of operations per second reach the provider,
+// with bursts of up to burst operations after a quiet period.
+// A nil *rateLimiter never blocks.
+type rateLimiter struct {
+	mu       sync.Mutex
+	provider string
+	log      *logrus.Entry
+	interval time.Duration
+	burst    int
+	// next is the time the bucket will be full again minus one interval
+	next time.Time
+}
+
+func newRateLimiter(provider string, log *logrus.Entry, opsPerSecond float64, burst int) *rateLimiter {
+	if opsPerSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		provider: provider,
+		log:      log,
+		interval: time.Duration(float64(time.Second) / opsPerSecond),
+		burst:    burst,
+	}
+}
+
+// Wait blocks until the next operation is allowed to proceed.
+func (r *rateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	// a full bucket holds burst tokens, unused tokens do not pile up
+	if full := now.Add(-time.Duration(r.burst-1) * r.interval); r.next.Before(full) {
+		r.next = full
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	if wait > 0 {
+		r.log.Debugf("Provider rate limit reached, delaying the call by %v", wait)
+		providerThrottled.Inc(r.provider)
+		time.Sleep(wait)
+	}
+}
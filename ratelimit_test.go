@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSpacesCalls(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	r := newRateLimiter("fake", logrus.WithField("provider", "fake"), 20, 2)
+
+	var calls []time.Time
+	for i := 0; i < 6; i++ {
+		r.Wait()
+		calls = append(calls, time.Now())
+	}
+	// the burst passes at once, the other calls wait for a token each
+	if gap := calls[1].Sub(calls[0]); gap > interval/2 {
+		t.Errorf("the burst was delayed by %v", gap)
+	}
+	for i := 2; i < len(calls); i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < interval*8/10 {
+			t.Errorf("call %d followed the previous one after %v, expected about %v", i, gap, interval)
+		}
+	}
+	if total := calls[len(calls)-1].Sub(calls[0]); total < 4*interval*9/10 {
+		t.Errorf("6 calls with a burst of 2 took %v, expected at least %v", total, 4*interval)
+	}
+}
+
+func TestRateLimiterRefillsUpToTheBurst(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	r := newRateLimiter("fake", logrus.WithField("provider", "fake"), 50, 3)
+
+	r.Wait()
+	// a quiet period much longer than the bucket must not save up more
+	// than burst tokens
+	time.Sleep(10 * interval)
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		r.Wait()
+	}
+	if elapsed := time.Since(started); elapsed < 2*interval*8/10 {
+		t.Errorf("5 calls after a quiet period took %v, expected at least %v", elapsed, 2*interval)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := newRateLimiter("fake", logrus.WithField("provider", "fake"), 0, 5)
+	if r != nil {
+		t.Fatalf("expected no limiter without a rate")
+	}
+	started := time.Now()
+	for i := 0; i < 100; i++ {
+		r.Wait()
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Millisecond {
+		t.Errorf("a disabled limiter delayed the calls by %v", elapsed)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"os"
+	"time"
+)
+
+var (
+	// reloads carries the reload requests from the signal handler to
+	// the main loop, which applies them between two metadata polls
+	reloads = make(chan struct{}, 1)
+
+	configFileModTime time.Time
+)
+
+func requestReload() {
+	select {
+	case reloads <- struct{}{}:
+	default:
+	}
+}
+
+// configFileChanged reports whether the config file was modified since
+// the last call. The first call only records its modification time.
+func configFileChanged() bool {
+	if len(*configFile) == 0 {
+		return false
+	}
+	info, err := os.Stat(*configFile)
+	if err != nil || info.ModTime().Equal(configFileModTime) {
+		return false
+	}
+	changed := !configFileModTime.IsZero()
+	configFileModTime = info.ModTime()
+	return changed
+}
+
+// reload reads the config file again and applies the settings that can be
+// changed at runtime: the log level, the poll interval, the managed
+// services and the provider settings such as credentials. The providers are
+// initialized again with their new settings once their in-flight
+// reconcile finished. Other settings need a restart.
+func reload() {
+	logrus.Info("Reloading the configuration")
+	if len(*configFile) != 0 {
+		if err := loadConfigFile(*configFile); err != nil {
+			logrus.Errorf("Failed to reload the config file, keeping the current configuration: %v", err)
+			return
+		}
+	}
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	if err := setReloadableEnv(); err != nil {
+		logrus.Errorf("Failed to reload the configuration, keeping the current settings: %v", err)
+		return
+	}
+
+	for _, c := range controllers {
+		c.lock.Lock()
+		err := c.provider.Init()
+		c.lock.Unlock()
+		if err != nil {
+			c.log.Errorf("Failed to initialize the provider with the reloaded settings: %v", err)
+			continue
+		}
+		c.log.Info("Provider initialized with the reloaded settings")
+	}
+	logEffectiveConfig()
+}
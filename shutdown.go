@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// shutdownDrain leaves all provider resources in place so traffic
+	// keeps flowing while a replacement instance takes over
+	shutdownDrain = "drain"
+	// shutdownDeregister drains and deregisters the targets this instance
+	// registered but keeps the LB endpoints
+	shutdownDeregister = "deregister"
+	// shutdownCleanup removes all provider resources owned by this instance
+	shutdownCleanup = "cleanup"
+)
+
+// shutdownStatus is written to LB_STATUS_FILE on shutdown so that a
+// replacement instance can tell whether the previous one left the
+// provider in a consistent state.
+type shutdownStatus struct {
+	State     string    `json:"state"`
+	Mode      string    `json:"mode"`
+	Provider  string    `json:"provider"`
+	OwnerID   string    `json:"owner_id"`
+	Time      time.Time `json:"time"`
+	Endpoints []string  `json:"endpoints"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		requestReload()
+		sig = <-signals
+	}
+	logrus.Infof("Received %v, shutting down in %s mode", sig, shutdownMode)
+
+	var wg sync.WaitGroup
+	for _, c := range controllers {
+		wg.Add(1)
+		go func(c *providerController) {
+			defer wg.Done()
+			c.lock.Lock()
+			c.shutdown()
+		}(c)
+	}
+	wg.Wait()
+	os.Exit(0)
+}
+
+func (c *providerController) shutdown() {
+	status := shutdownStatus{
+		Mode:     shutdownMode,
+		Provider: c.provider.GetName(),
+		OwnerID:  ownerID,
+		Time:     time.Now(),
+	}
+
+	providerConfigs, _, err := c.getProviderLBConfigs()
+	if err != nil {
+		c.log.Errorf("Failed to read provider LB configs on shutdown: %v", err)
+		status.Errors = append(status.Errors, err.Error())
+	}
+	for endpoint := range providerConfigs {
+		status.Endpoints = append(status.Endpoints, endpoint)
+	}
+	sort.Strings(status.Endpoints)
+
+	switch {
+	case shutdownMode != shutdownDrain && !election.isLeader():
+		c.log.Infof("Not the leader, not touching %d LB endpoints on shutdown: %v", len(status.Endpoints), status.Endpoints)
+		status.State = "handed-off"
+	case shutdownMode != shutdownDrain && *dryRun:
+		c.log.Infof("Dry run, not touching %d LB endpoints on shutdown: %v", len(status.Endpoints), status.Endpoints)
+		status.State = "handed-off"
+	case shutdownMode == shutdownDeregister:
+		var configs []model.LBConfig
+		for _, config := range providerConfigs {
+			configs = append(configs, config)
+		}
+		c.log.Infof("Deregistering the targets of %d LB endpoints on shutdown: %v", len(status.Endpoints), status.Endpoints)
+		// one call per config, each paced by the rate limit like the
+		// changes of a reconcile
+		var mu sync.Mutex
+		forEachParallel(writeConcurrency, len(configs), func(i int) {
+			c.limiter.Wait()
+			err := c.provider.CleanupLBConfigs(configs[i : i+1])
+			deregistered := configs[i]
+			deregistered.LBTargets = nil
+			audit.record(c.provider.GetName(), "Cleanup", &deregistered, &configs[i], err)
+			if err != nil {
+				c.log.Errorf("Failed to deregister the targets of LB endpoint %s from provider: %v", configs[i].LBEndpoint, err)
+				providerUpdateErrors.Inc(c.provider.GetName(), "Cleanup")
+				mu.Lock()
+				status.Errors = append(status.Errors, configs[i].LBEndpoint+": "+err.Error())
+				mu.Unlock()
+			}
+		})
+		status.State = "deregistered"
+	case shutdownMode == shutdownCleanup:
+		var configs []model.LBConfig
+		for _, config := range providerConfigs {
+			configs = append(configs, config)
+		}
+		c.log.Infof("Removing %d LB configs on shutdown: %v", len(status.Endpoints), status.Endpoints)
+		errs := changeErrors{}
+		c.updateProvider(configs, nil, &Remove, errs)
+		for endpoint, err := range errs {
+			status.Errors = append(status.Errors, endpoint+": "+err.Error())
+		}
+		status.State = "cleaned-up"
+	default:
+		c.log.Infof("Handing off %d LB endpoints, provider resources are left in place: %v", len(status.Endpoints), status.Endpoints)
+		status.State = "handed-off"
+	}
+	if len(status.Errors) != 0 {
+		sort.Strings(status.Errors)
+		status.State = "inconsistent"
+	}
+
+	if err := c.state.save(); err != nil {
+		c.log.Errorf("Failed to save reconcile state: %v", err)
+	}
+	if err := writeShutdownStatus(c.statusFile, status); err != nil {
+		c.log.Errorf("Failed to write shutdown status: %v", err)
+	}
+	c.log.Infof("Shutdown complete, state: %s", status.State)
+}
+
+func writeShutdownStatus(path string, status shutdownStatus) error {
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
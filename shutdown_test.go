@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestShutdownIsRateLimited(t *testing.T) {
+	defer func(previous string) { shutdownMode = previous }(shutdownMode)
+	defer useTestSource()()
+	const interval = 50 * time.Millisecond
+
+	for _, mode := range []string{shutdownCleanup, shutdownDeregister} {
+		shutdownMode = mode
+		p := newFakeProvider(fakeConfigs(4)...)
+		c := newTestController(p)
+		c.limiter = newRateLimiter(p.GetName(), logrus.WithField("provider", p.GetName()), 20, 1)
+
+		started := time.Now()
+		c.shutdown()
+		if elapsed := time.Since(started); elapsed < 3*interval*9/10 {
+			t.Errorf("%s: 4 provider calls took %v, expected at least %v", mode, elapsed, 3*interval)
+		}
+		if mode == shutdownCleanup && len(p.configs) != 0 {
+			t.Errorf("%s: %d configs were not removed", mode, len(p.configs))
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package sources
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileWatchInterval is how often Watch checks the file for changes.
+const fileWatchInterval = time.Second
+
+// fileConfig is an LB config as written in the file. The fields that are
+// not passed on to providers, and so not part of the LBConfig encoding,
+// are given next to it.
+type fileConfig struct {
+	model.LBConfig
+	// Service names the config in logs and provider tags, by default
+	// "static/<target pool name>".
+	Service   string
+	Protected bool
+	Providers []string
+}
+
+type fileSource struct {
+	path            string
+	environmentUUID string
+	environmentName string
+
+	mu      sync.Mutex
+	configs []fileConfig
+	version string
+}
+
+// NewFileSource returns a Source reading the LB configs from the JSON
+// file at path, an array of LB configs in the encoding of the plugin
+// protocol. The target pool names in the file get the usual
+// "_<environmentUUID>_<suffix>" appended. The file is read again whenever
+// it changes; while it is invalid, the last valid configs are kept.
+func NewFileSource(path string, environmentUUID string, environmentName string) (Source, error) {
+	s := &fileSource{path: path, environmentUUID: environmentUUID, environmentName: environmentName}
+	if _, err := s.read(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// read reads the file if its content changed since the last read, and
+// returns the current version.
+func (s *fileSource) read() (string, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	version := fmt.Sprintf("%x", h.Sum64())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version == s.version {
+		return version, nil
+	}
+	var configs []fileConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return "", fmt.Errorf("%s: %v", s.path, err)
+	}
+	if err := validateFileConfigs(configs); err != nil {
+		return "", fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.configs = configs
+	s.version = version
+	return version, nil
+}
+
+func validateFileConfigs(configs []fileConfig) error {
+	endpoints := make(map[string]bool, len(configs))
+	for i, config := range configs {
+		switch {
+		case len(config.LBEndpoint) == 0:
+			return fmt.Errorf("config %d: LBEndpoint is empty", i)
+		case endpoints[config.LBEndpoint]:
+			return fmt.Errorf("config %d: LB endpoint %s is used more than once", i, config.LBEndpoint)
+		case len(config.LBTargetPoolName) == 0:
+			return fmt.Errorf("config %d: LBTargetPoolName is empty", i)
+		case strings.Contains(config.LBTargetPoolName, "_"):
+			return fmt.Errorf("config %d: LBTargetPoolName %q contains an underscore, which separates the environment UUID and suffix", i, config.LBTargetPoolName)
+		}
+		endpoints[config.LBEndpoint] = true
+		for _, target := range config.LBTargets {
+			if net.ParseIP(target.HostIP) == nil {
+				return fmt.Errorf("config %d: invalid target IP %q", i, target.HostIP)
+			}
+			if port, err := strconv.Atoi(target.Port); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("config %d: invalid target port %q", i, target.Port)
+			}
+		}
+		switch config.Protocol {
+		case "", model.ProtocolHTTP, model.ProtocolHTTPS, model.ProtocolTCP, model.ProtocolUDP, model.ProtocolTLS:
+		default:
+			return fmt.Errorf("config %d: invalid protocol %q", i, config.Protocol)
+		}
+		if config.Stickiness != nil && config.Stickiness.Type != model.StickinessCookie && config.Stickiness.Type != model.StickinessSourceIP {
+			return fmt.Errorf("config %d: invalid stickiness type %q", i, config.Stickiness.Type)
+		}
+	}
+	return nil
+}
+
+func (s *fileSource) GetVersion() (string, error) {
+	return s.read()
+}
+
+// Watch checks the file every second until its content differs from
+// version or maxWait has elapsed.
+func (s *fileSource) Watch(version string, maxWait time.Duration) (string, error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		current, err := s.read()
+		if err != nil || current != version || !time.Now().Add(fileWatchInterval).Before(deadline) {
+			return current, err
+		}
+		time.Sleep(fileWatchInterval)
+	}
+}
+
+// GetLBConfigs returns the configs of the file, the endpoint label is not
+// used. An invalid file is only logged, the last valid configs are
+// complete and can be reconciled.
+func (s *fileSource) GetLBConfigs(lbEndpointServiceLabel string, targetPoolSuffix string) (map[string]model.LBConfig, error) {
+	if _, err := s.read(); err != nil {
+		logrus.Errorf("Keeping the last valid LB configs: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configs := make(map[string]model.LBConfig, len(s.configs))
+	for _, fc := range s.configs {
+		config := fc.LBConfig
+		config.LBTargetPoolName = fc.LBTargetPoolName + "_" + s.environmentUUID + "_" + targetPoolSuffix
+		config.Service = fc.Service
+		if len(config.Service) == 0 {
+			config.Service = "static/" + fc.LBTargetPoolName
+		}
+		config.Environment = s.environmentName
+		config.Protected = fc.Protected
+		config.Providers = fc.Providers
+		configs[config.LBEndpoint] = config
+	}
+	return configs, nil
+}
+
+func (s *fileSource) GetEnvironmentUUID() string {
+	return s.environmentUUID
+}
+
+// GetLabelErrors returns no errors, an invalid file is reported by
+// GetLBConfigs.
+func (s *fileSource) GetLabelErrors() map[string][]metadata.LabelError {
+	return nil
+}
+
+func (s *fileSource) TestConnection() error {
+	_, err := os.Stat(s.path)
+	return err
+}
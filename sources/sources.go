@@ -0,0 +1,67 @@
+package sources
+
+import (
+	"github.com/rancher/external-lb/metadata"
+	"github.com/rancher/external-lb/model"
+	"time"
+)
+
+// Source provides the LB configs the providers are reconciled against.
+type Source interface {
+	// GetVersion returns a version that changes whenever the LB configs
+	// may have changed.
+	GetVersion() (string, error)
+	// Watch blocks until the version differs from version or maxWait has
+	// elapsed, and returns the current version.
+	Watch(version string, maxWait time.Duration) (string, error)
+	// GetLBConfigs returns the LB configs keyed by LB endpoint. Endpoints
+	// are read from lbEndpointServiceLabel where the source has labels,
+	// and target pool names end in "_<environment UUID>_<targetPoolSuffix>".
+	// An error means the configs could not be read completely, and are
+	// not reconciled, as the LBs of the missing ones would be removed.
+	GetLBConfigs(lbEndpointServiceLabel string, targetPoolSuffix string) (map[string]model.LBConfig, error)
+	// GetEnvironmentUUID identifies the environment in the target pool
+	// names and the default owner ID.
+	GetEnvironmentUUID() string
+	// GetLabelErrors returns the label validation errors of the last
+	// GetLBConfigs call, keyed by "stack/service".
+	GetLabelErrors() map[string][]metadata.LabelError
+	// TestConnection fails when the source cannot be reached.
+	TestConnection() error
+}
+
+type metadataSource struct {
+	client *metadata.MetadataClient
+}
+
+// NewMetadataSource returns a Source reading the LB configs from the
+// service labels of client, which may read Rancher metadata or one of the
+// sources presenting their services in its shape.
+func NewMetadataSource(client *metadata.MetadataClient) Source {
+	return metadataSource{client: client}
+}
+
+func (s metadataSource) GetVersion() (string, error) {
+	return s.client.GetVersion()
+}
+
+func (s metadataSource) Watch(version string, maxWait time.Duration) (string, error) {
+	return s.client.WaitForVersionChange(version, maxWait)
+}
+
+func (s metadataSource) GetLBConfigs(lbEndpointServiceLabel string, targetPoolSuffix string) (map[string]model.LBConfig, error) {
+	return s.client.GetMetadataLBConfigs(lbEndpointServiceLabel, targetPoolSuffix)
+}
+
+func (s metadataSource) GetEnvironmentUUID() string {
+	return s.client.EnvironmentUUID
+}
+
+func (s metadataSource) GetLabelErrors() map[string][]metadata.LabelError {
+	return s.client.LabelErrors
+}
+
+func (s metadataSource) TestConnection() error {
+	_, err := s.client.MetadataClient.GetSelfStack()
+	return err
+}
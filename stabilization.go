@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"sync"
+	"time"
+)
+
+// stabilizer holds back LB configs for endpoints that are not yet known
+// to the provider until they have been observed unchanged for the
+// configured period. This keeps us from creating provider resources for
+// services that are still being created in Rancher.
+// A nil *stabilizer lets every config through immediately.
+type stabilizer struct {
+	mu      sync.Mutex
+	period  time.Duration
+	pending map[string]pendingConfig
+	// now is the clock, time.Now outside of tests
+	now func() time.Time
+}
+
+type pendingConfig struct {
+	config model.LBConfig
+	since  time.Time
+	// released is set once the config was stable and handed out to be
+	// added. It stays pending until the add succeeded, so a failed add is
+	// retried without waiting for the period again.
+	released bool
+}
+
+func newStabilizer(period time.Duration) *stabilizer {
+	if period <= 0 {
+		return nil
+	}
+	return &stabilizer{
+		period:  period,
+		pending: make(map[string]pendingConfig),
+		now:     time.Now,
+	}
+}
+
+// filter returns the subset of newly seen configs that have been stable
+// for the full period. Configs that are no longer present in metadata
+// are dropped from the pending set, the others stay pending until added.
+func (s *stabilizer) filter(metadataConfigs map[string]model.LBConfig, toAdd []model.LBConfig) []model.LBConfig {
+	if s == nil {
+		return toAdd
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for endpoint := range s.pending {
+		if _, ok := metadataConfigs[endpoint]; !ok {
+			delete(s.pending, endpoint)
+		}
+	}
+
+	now := s.now()
+	var stable []model.LBConfig
+	for _, config := range toAdd {
+		seen, ok := s.pending[config.LBEndpoint]
+		if !ok || lbConfigChanged(config, seen.config) {
+			logrus.Infof("Waiting %v for LB config of endpoint %s to stabilize", s.period, config.LBEndpoint)
+			s.pending[config.LBEndpoint] = pendingConfig{config: config, since: now}
+			continue
+		}
+		if now.Sub(seen.since) < s.period {
+			logrus.Debugf("LB config of endpoint %s is not yet stable, unchanged since %v", config.LBEndpoint, seen.since)
+			continue
+		}
+		seen.released = true
+		s.pending[config.LBEndpoint] = seen
+		stable = append(stable, config)
+	}
+	return stable
+}
+
+// added drops the config of endpoint from the pending set once it was
+// added to the provider.
+func (s *stabilizer) added(endpoint string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, endpoint)
+}
+
+// due reports whether any pending config has reached the end of its
+// stabilization period and should be picked up by a reconcile. Released
+// configs are retried by the regular reconciles.
+func (s *stabilizer) due() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, seen := range s.pending {
+		if !seen.released && now.Sub(seen.since) >= s.period {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/rancher/external-lb/model"
+	"testing"
+	"time"
+)
+
+// fakeClock is advanced by the tests instead of sleeping.
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.current }
+func (c *fakeClock) advance(d time.Duration) { c.current = c.current.Add(d) }
+
+func newTestStabilizer(period time.Duration) (*stabilizer, *fakeClock) {
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	s := newStabilizer(period)
+	s.now = clock.now
+	return s, clock
+}
+
+func stabilizationConfigs(configs ...model.LBConfig) map[string]model.LBConfig {
+	m := make(map[string]model.LBConfig, len(configs))
+	for _, config := range configs {
+		m[config.LBEndpoint] = config
+	}
+	return m
+}
+
+func TestStabilizerHoldsNewConfigsForThePeriod(t *testing.T) {
+	s, clock := newTestStabilizer(time.Minute)
+	config := fakeConfigs(1)[0]
+	metadata := stabilizationConfigs(config)
+
+	if stable := s.filter(metadata, []model.LBConfig{config}); len(stable) != 0 {
+		t.Fatalf("a new config was released at once: %v", stable)
+	}
+	clock.advance(59 * time.Second)
+	if s.due() {
+		t.Errorf("due before the end of the period")
+	}
+	if stable := s.filter(metadata, []model.LBConfig{config}); len(stable) != 0 {
+		t.Fatalf("config released before the end of the period: %v", stable)
+	}
+	clock.advance(time.Second)
+	if !s.due() {
+		t.Errorf("not due at the end of the period")
+	}
+	if stable := s.filter(metadata, []model.LBConfig{config}); len(stable) != 1 {
+		t.Fatalf("config not released at the end of the period: %v", stable)
+	}
+	if s.due() {
+		t.Errorf("still due after the config was released")
+	}
+}
+
+func TestStabilizerRestartsTheWaitOnChange(t *testing.T) {
+	s, clock := newTestStabilizer(time.Minute)
+	config := fakeConfigs(1)[0]
+	s.filter(stabilizationConfigs(config), []model.LBConfig{config})
+
+	clock.advance(50 * time.Second)
+	config.LBTargets = []model.LBTarget{{HostIP: "10.0.0.1", Port: "80"}}
+	if stable := s.filter(stabilizationConfigs(config), []model.LBConfig{config}); len(stable) != 0 {
+		t.Fatalf("changed config was released: %v", stable)
+	}
+	clock.advance(50 * time.Second)
+	if stable := s.filter(stabilizationConfigs(config), []model.LBConfig{config}); len(stable) != 0 {
+		t.Fatalf("changed config released before a full period: %v", stable)
+	}
+	clock.advance(10 * time.Second)
+	if stable := s.filter(stabilizationConfigs(config), []model.LBConfig{config}); len(stable) != 1 {
+		t.Fatalf("changed config not released after a full period: %v", stable)
+	}
+}
+
+func TestStabilizerRetriesAFailedAddWithoutWaiting(t *testing.T) {
+	s, clock := newTestStabilizer(time.Minute)
+	config := fakeConfigs(1)[0]
+	metadata := stabilizationConfigs(config)
+	s.filter(metadata, []model.LBConfig{config})
+	clock.advance(time.Minute)
+	if stable := s.filter(metadata, []model.LBConfig{config}); len(stable) != 1 {
+		t.Fatalf("config not released: %v", stable)
+	}
+
+	// the add failed, so added was not called and the config is missing
+	// from the provider again on the next reconcile
+	clock.advance(time.Second)
+	if stable := s.filter(metadata, []model.LBConfig{config}); len(stable) != 1 {
+		t.Fatalf("config held back again after a failed add: %v", stable)
+	}
+
+	s.added(config.LBEndpoint)
+	if _, ok := s.pending[config.LBEndpoint]; ok {
+		t.Errorf("config still pending after it was added")
+	}
+}
+
+func TestStabilizerDropsConfigsRemovedFromMetadata(t *testing.T) {
+	s, clock := newTestStabilizer(time.Minute)
+	configs := fakeConfigs(2)
+	s.filter(stabilizationConfigs(configs...), configs)
+
+	clock.advance(30 * time.Second)
+	s.filter(stabilizationConfigs(configs[1]), configs[1:])
+	if _, ok := s.pending[configs[0].LBEndpoint]; ok {
+		t.Errorf("config removed from metadata is still pending")
+	}
+
+	// a config that comes back waits for a full period again
+	clock.advance(30 * time.Second)
+	if stable := s.filter(stabilizationConfigs(configs...), configs); len(stable) != 1 || stable[0].LBEndpoint != configs[1].LBEndpoint {
+		t.Fatalf("expected only %s to be released, got %v", configs[1].LBEndpoint, stable)
+	}
+}
+
+func TestStabilizerDisabled(t *testing.T) {
+	s := newStabilizer(0)
+	configs := fakeConfigs(2)
+	if stable := s.filter(stabilizationConfigs(configs...), configs); len(stable) != 2 {
+		t.Errorf("a disabled stabilizer held back configs: %v", stable)
+	}
+	if s.due() {
+		t.Errorf("a disabled stabilizer is due")
+	}
+	s.added(configs[0].LBEndpoint)
+}
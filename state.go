@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// serviceState is the reconcile bookkeeping kept for each LB endpoint.
+type serviceState struct {
+	TargetPoolName string    `json:"target_pool_name"`
+	Failures       int       `json:"failures"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastReconciled time.Time `json:"last_reconciled"`
+	// Protected is remembered from the service labels, it has to outlive
+	// the service to keep the config from being removed
+	Protected bool `json:"protected,omitempty"`
+	// Applied is the config last applied successfully, nil after a
+	// failed change. It lets drift be told apart from changes made by
+	// this instance across restarts.
+	Applied *model.LBConfig `json:"applied,omitempty"`
+}
+
+// stateStore tracks per-endpoint reconcile state. When a path is set the
+// state is persisted there as JSON so it survives restarts; otherwise it
+// only lives in memory.
+type stateStore struct {
+	mu       sync.Mutex
+	path     string
+	dirty    bool
+	Services map[string]*serviceState `json:"services"`
+}
+
+// loadStateStore reads the state file at path. A missing or unreadable
+// file is not fatal: the store starts out empty and gets rebuilt by the
+// next full reconcile.
+func loadStateStore(path string) *stateStore {
+	s := &stateStore{
+		path:     path,
+		Services: make(map[string]*serviceState),
+	}
+	if len(path) == 0 {
+		return s
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("Failed to read state file %s, starting with empty state: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		logrus.Warnf("Failed to parse state file %s, starting with empty state: %v", path, err)
+		s.Services = make(map[string]*serviceState)
+		return s
+	}
+	if s.Services == nil {
+		s.Services = make(map[string]*serviceState)
+	}
+	logrus.Infof("Loaded reconcile state for %d LB endpoints from %s", len(s.Services), path)
+	return s
+}
+
+func (s *stateStore) get(endpoint string) *serviceState {
+	state, ok := s.Services[endpoint]
+	if !ok {
+		state = &serviceState{}
+		s.Services[endpoint] = state
+	}
+	return state
+}
+
+func (s *stateStore) recordSuccess(config model.LBConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.get(config.LBEndpoint)
+	state.TargetPoolName = config.LBTargetPoolName
+	state.Failures = 0
+	state.LastError = ""
+	state.LastReconciled = time.Now()
+	state.Applied = &config
+	s.dirty = true
+}
+
+// recordFailure returns the number of consecutive failures of the endpoint.
+func (s *stateStore) recordFailure(config model.LBConfig, err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.get(config.LBEndpoint)
+	state.TargetPoolName = config.LBTargetPoolName
+	state.Failures++
+	state.LastError = err.Error()
+	// a failed change may have been applied partially
+	state.Applied = nil
+	s.dirty = true
+	return state.Failures
+}
+
+// setProtected records whether the config of endpoint is protected.
+func (s *stateStore) setProtected(endpoint string, protected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.Services[endpoint]
+	if !ok && !protected {
+		return
+	}
+	if !ok {
+		state = s.get(endpoint)
+	}
+	if state.Protected != protected {
+		state.Protected = protected
+		s.dirty = true
+	}
+}
+
+func (s *stateStore) isProtected(endpoint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.Services[endpoint]
+	return ok && state.Protected
+}
+
+func (s *stateStore) forget(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Services[endpoint]; ok {
+		delete(s.Services, endpoint)
+		s.dirty = true
+	}
+}
+
+// appliedConfigs returns the configs last applied by this instance.
+func (s *stateStore) appliedConfigs() map[string]model.LBConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configs := make(map[string]model.LBConfig)
+	for endpoint, state := range s.Services {
+		if state.Applied != nil {
+			configs[endpoint] = *state.Applied
+		}
+	}
+	return configs
+}
+
+// save writes the state file if anything changed since the last save.
+func (s *stateStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.path) == 0 || !s.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
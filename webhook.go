@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/external-lb/model"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const (
+	eventFrontendCreated = "frontend_created"
+	eventFrontendUpdated = "frontend_updated"
+	eventFrontendRemoved = "frontend_removed"
+	eventTargetsChanged  = "targets_changed"
+	eventUpdateFailed    = "update_failed"
+
+	// webhookQueueSize bounds the events waiting for delivery, further
+	// events are dropped while the receiver is slow or down
+	webhookQueueSize = 100
+	webhookTimeout   = 10 * time.Second
+)
+
+// webhookEvent is posted to the webhook for every LB change and for LB
+// endpoints whose changes keep failing.
+type webhookEvent struct {
+	Event    string   `json:"event"`
+	Time     string   `json:"time"`
+	Provider string   `json:"provider"`
+	OwnerID  string   `json:"owner_id"`
+	Endpoint string   `json:"endpoint"`
+	Service  string   `json:"service,omitempty"`
+	Targets  []string `json:"targets,omitempty"`
+	Failures int      `json:"failures,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// notifier posts the events to the webhook from its own goroutine, so a
+// slow receiver never holds back a reconcile. The payload is the JSON
+// encoded event unless a template is given. A nil *notifier sends nothing.
+type notifier struct {
+	url              string
+	template         *template.Template
+	failureThreshold int
+	events           chan webhookEvent
+	client           *http.Client
+}
+
+func newNotifier(url string, payloadTemplate string, failureThreshold int) (*notifier, error) {
+	if len(url) == 0 {
+		return nil, nil
+	}
+	n := &notifier{
+		url:              url,
+		failureThreshold: failureThreshold,
+		events:           make(chan webhookEvent, webhookQueueSize),
+		client:           &http.Client{Timeout: webhookTimeout},
+	}
+	if len(payloadTemplate) != 0 {
+		tmpl, err := template.New("payload").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(payloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload template: %v", err)
+		}
+		n.template = tmpl
+	}
+	go n.run()
+	return n, nil
+}
+
+// changeEvent describes the change op of value on the provider, previous
+// being the provider config it replaces.
+func changeEvent(provider string, op *Op, value model.LBConfig, previous *model.LBConfig) webhookEvent {
+	event := webhookEvent{
+		Provider: provider,
+		Endpoint: value.LBEndpoint,
+		Service:  value.Service,
+		Targets:  targetNames(value.LBTargets),
+	}
+	switch {
+	case *op == Add:
+		event.Event = eventFrontendCreated
+		event.Message = fmt.Sprintf("LB endpoint %s created with targets %v", value.LBEndpoint, event.Targets)
+	case *op == Remove:
+		event.Event = eventFrontendRemoved
+		event.Targets = nil
+		event.Message = fmt.Sprintf("LB endpoint %s removed", value.LBEndpoint)
+	case previous != nil && targetsOnlyChanged(value, *previous):
+		event.Event = eventTargetsChanged
+		event.Message = fmt.Sprintf("Targets of LB endpoint %s changed, added %v, removed %v", value.LBEndpoint,
+			targetNames(targetsMissing(value.LBTargets, previous.LBTargets)), targetNames(targetsMissing(previous.LBTargets, value.LBTargets)))
+	default:
+		event.Event = eventFrontendUpdated
+		event.Message = fmt.Sprintf("LB endpoint %s updated, targets %v", value.LBEndpoint, event.Targets)
+	}
+	return event
+}
+
+// notify queues event for delivery.
+func (n *notifier) notify(event webhookEvent) {
+	if n == nil {
+		return
+	}
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	event.OwnerID = ownerID
+	select {
+	case n.events <- event:
+	default:
+		logrus.Warnf("Webhook queue is full, dropping %s event of LB endpoint %s", event.Event, event.Endpoint)
+	}
+}
+
+// notifyFailure queues an update_failed event once the changes of an LB
+// endpoint failed failureThreshold times in a row.
+func (n *notifier) notifyFailure(event webhookEvent) {
+	if n == nil || event.Failures != n.failureThreshold {
+		return
+	}
+	event.Event = eventUpdateFailed
+	event.Message = fmt.Sprintf("Changes of LB endpoint %s failed %d times in a row: %s", event.Endpoint, event.Failures, event.Error)
+	n.notify(event)
+}
+
+func (n *notifier) run() {
+	for event := range n.events {
+		if err := n.send(event); err != nil {
+			logrus.Errorf("Failed to send %s event of LB endpoint %s to the webhook: %v", event.Event, event.Endpoint, err)
+		}
+	}
+}
+
+func (n *notifier) send(event webhookEvent) error {
+	var payload bytes.Buffer
+	if n.template != nil {
+		if err := n.template.Execute(&payload, event); err != nil {
+			return fmt.Errorf("rendering the payload: %v", err)
+		}
+	} else if err := json.NewEncoder(&payload).Encode(event); err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", &payload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
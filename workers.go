@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync"
+)
+
+// forEachParallel calls fn for every index in [0, count) using at most
+// workers goroutines and returns once all calls are done.
+func forEachParallel(workers int, count int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}